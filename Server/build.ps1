@@ -14,4 +14,10 @@ $env:GOARCH = "amd64"
 $env:CGO_ENABLED = "0"
 go build -o ./build/simplehost
 
+Write-Host "Building command-line client..."
+$env:GOOS = "windows"
+go build -o ./build/cli/simplehost.exe ./cmd/simplehost
+$env:GOOS = "linux"
+go build -o ./build/cli/simplehost ./cmd/simplehost
+
 Write-Host "Builds complete! Files are in the build/ directory."
\ No newline at end of file
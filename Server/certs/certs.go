@@ -0,0 +1,62 @@
+package certs
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// Reloader serves a certificate and key loaded from disk and can swap them for new ones
+// without restarting the server, e.g. after a renewal.
+type Reloader struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// Load reads the certificate and key, failing if either is missing or they don't match
+func Load(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files again. On error the previous certificate stays in use.
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+// GetCertificate is meant for tls.Config.GetCertificate, so every handshake picks up the
+// latest certificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// ReloadOn reloads the certificate whenever one of sigs is received
+func (r *Reloader) ReloadOn(sigs ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	go func() {
+		for sig := range ch {
+			if err := r.Reload(); err != nil {
+				slog.Error("Failed to reload TLS certificate, keeping the old one", "signal", sig, "error", err)
+				continue
+			}
+			slog.Info("Reloaded TLS certificate", "path", r.certFile)
+		}
+	}()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// client calls the server's API with an app token
+type client struct {
+	base  string // server URL without a trailing slash
+	token string
+	http  *http.Client
+}
+
+// apiError is an error response from the server
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string { return e.message }
+
+// isStatus reports whether err is an error response with the given status
+func isStatus(err error, status int) bool {
+	var e *apiError
+	return errors.As(err, &e) && e.status == status
+}
+
+// errNotExist is returned for remote paths that don't exist
+var errNotExist = errors.New("no such file or folder")
+
+// entry is a folder or file, as the server's /api/list describes it
+type entry struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Path      string     `json:"path"`
+	Type      string     `json:"type"`
+	Size      int64      `json:"size"`
+	OwnerID   string     `json:"owner_id"`
+	Uploaded  *time.Time `json:"uploaded,omitempty"`
+	CanDelete bool       `json:"can_delete"`
+}
+
+func (e *entry) isDir() bool { return e.Type == "folder" }
+
+// cleanPath turns a remote path as typed into the absolute form the server uses
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// do sends a request to an API path and returns the response, or the server's error
+func (c *client) do(ctx context.Context, method, apiPath string, query url.Values, contentType string, body io.Reader) (*http.Response, error) {
+	u := c.base + apiPath
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "simplehost-cli")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 400 {
+		return nil, &apiError{resp.StatusCode, fmt.Sprintf("the server redirected to %s; check the server URL and that it is up to date", resp.Header.Get("Location"))}
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	message := strings.TrimSpace(string(data))
+	var e struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(data, &e) == nil && e.Error != "" {
+		message = e.Error
+	}
+	if message == "" {
+		message = resp.Status
+	}
+	return nil, &apiError{resp.StatusCode, message}
+}
+
+// call sends a request and decodes the JSON response into v, if v isn't nil
+func (c *client) call(ctx context.Context, method, apiPath string, query url.Values, contentType string, body io.Reader, v any) error {
+	resp, err := c.do(ctx, method, apiPath, query, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if v == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *client) postForm(ctx context.Context, apiPath string, form url.Values, v any) error {
+	return c.call(ctx, http.MethodPost, apiPath, nil, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()), v)
+}
+
+func (c *client) postJSON(ctx context.Context, apiPath string, body any, v any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return c.call(ctx, http.MethodPost, apiPath, nil, "application/json", bytes.NewReader(data), v)
+}
+
+// list looks up a remote path, returning a folder's contents along with it
+func (c *client) list(ctx context.Context, p string) (*entry, []entry, error) {
+	var result struct {
+		Item     entry   `json:"item"`
+		Children []entry `json:"children"`
+	}
+	err := c.call(ctx, http.MethodGet, "/api/list", url.Values{"path": {cleanPath(p)}}, "", nil, &result)
+	if isStatus(err, http.StatusNotFound) {
+		return nil, nil, fmt.Errorf("%s: %w", cleanPath(p), errNotExist)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &result.Item, result.Children, nil
+}
+
+// mkdir creates a folder called name in parent
+func (c *client) mkdir(ctx context.Context, parent *entry, name string) (*entry, error) {
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := c.postForm(ctx, "/api/create-folder", url.Values{"parent_id": {parent.ID}, "name": {name}}, &created); err != nil {
+		return nil, err
+	}
+	return &entry{ID: created.ID, Name: name, Path: path.Join(parent.Path, name), Type: "folder", CanDelete: true}, nil
+}
+
+// mkdirAll returns the folder at p, creating it and any missing parents
+func (c *client) mkdirAll(ctx context.Context, p string) (*entry, error) {
+	p = cleanPath(p)
+	folder, _, err := c.list(ctx, "/")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		next, _, err := c.list(ctx, path.Join(folder.Path, name))
+		if errors.Is(err, errNotExist) {
+			next, err = c.mkdir(ctx, folder, name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !next.isDir() {
+			return nil, fmt.Errorf("%s: not a folder", next.Path)
+		}
+		folder = next
+	}
+	return folder, nil
+}
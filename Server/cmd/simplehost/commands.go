@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+)
+
+func cmdLs(c *cli, args []string) error {
+	fs := c.flagSet("ls", "[-r] [path]")
+	recursive := fs.Bool("r", false, "list subfolders too")
+	if err := c.parse(fs, args, 0); err != nil {
+		return err
+	}
+	item, children, err := c.client.list(c.ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	entries := []entry{*item}
+	if item.isDir() {
+		if entries, err = c.walk(c.ctx, children, *recursive); err != nil {
+			return err
+		}
+	}
+	c.output(entries, func() {
+		for _, e := range entries {
+			name, size, kind := e.Name, formatSize(e.Size), "-"
+			if *recursive {
+				name = e.Path
+			}
+			if e.isDir() {
+				name, size, kind = name+"/", "", "d"
+			}
+			fmt.Printf("%s %10s  %s  %s\n", kind, size, formatTime(e.Uploaded), name)
+		}
+	})
+	return nil
+}
+
+// walk returns children, followed by each subfolder's contents when recursive
+func (c *cli) walk(ctx context.Context, children []entry, recursive bool) ([]entry, error) {
+	entries := []entry{}
+	for _, e := range children {
+		entries = append(entries, e)
+		if !recursive || !e.isDir() {
+			continue
+		}
+		_, grandchildren, err := c.client.list(ctx, e.Path)
+		if err != nil {
+			return nil, err
+		}
+		found, err := c.walk(ctx, grandchildren, true)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, found...)
+	}
+	return entries, nil
+}
+
+// mkdirResult is the outcome of creating one folder
+type mkdirResult struct {
+	Path   string `json:"path"`
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status"` // created or failed
+	Error  string `json:"error,omitempty"`
+}
+
+func cmdMkdir(c *cli, args []string) error {
+	fs := c.flagSet("mkdir", "[-p] path...")
+	parents := fs.Bool("p", false, "create missing parent folders, and don't mind folders that exist")
+	if err := c.parse(fs, args, 1); err != nil {
+		return err
+	}
+	results := []mkdirResult{}
+	failed := false
+	for _, p := range fs.Args() {
+		res := mkdirResult{Path: cleanPath(p), Status: "created"}
+		folder, err := c.mkdir(p, *parents)
+		if err != nil {
+			res.Status, res.Error = "failed", err.Error()
+			c.warn("%v", err)
+			failed = true
+		} else {
+			res.ID = folder.ID
+		}
+		results = append(results, res)
+	}
+	c.output(results, func() {})
+	if failed {
+		return errFailed
+	}
+	return nil
+}
+
+func (c *cli) mkdir(p string, parents bool) (*entry, error) {
+	p = cleanPath(p)
+	if parents {
+		return c.client.mkdirAll(c.ctx, p)
+	}
+	if p == "/" {
+		return nil, errors.New("/: already exists")
+	}
+	parent, children, err := c.client.list(c.ctx, path.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+	if !parent.isDir() {
+		return nil, fmt.Errorf("%s: not a folder", parent.Path)
+	}
+	for _, e := range children {
+		if e.Name == path.Base(p) {
+			return nil, fmt.Errorf("%s: already exists", p)
+		}
+	}
+	return c.client.mkdir(c.ctx, parent, path.Base(p))
+}
+
+// rmResult is the outcome of deleting one path
+type rmResult struct {
+	Path   string `json:"path"`
+	Type   string `json:"type,omitempty"`
+	Status string `json:"status"` // deleted or failed
+	Error  string `json:"error,omitempty"`
+}
+
+func cmdRm(c *cli, args []string) error {
+	fs := c.flagSet("rm", "[-r] path...")
+	recursive := fs.Bool("r", false, "delete folders and everything in them")
+	if err := c.parse(fs, args, 1); err != nil {
+		return err
+	}
+	results := []rmResult{}
+	failed := false
+	for _, p := range fs.Args() {
+		res := rmResult{Path: cleanPath(p), Status: "deleted"}
+		item, err := c.rm(p, *recursive)
+		if item != nil {
+			res.Type = item.Type
+		}
+		if err != nil {
+			res.Status, res.Error = "failed", err.Error()
+			c.warn("%v", err)
+			failed = true
+		}
+		results = append(results, res)
+	}
+	c.output(results, func() {})
+	if failed {
+		return errFailed
+	}
+	return nil
+}
+
+func (c *cli) rm(p string, recursive bool) (*entry, error) {
+	item, _, err := c.client.list(c.ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case item.Path == "/":
+		return item, errors.New("/: the root folder can't be deleted")
+	case !item.CanDelete:
+		return item, fmt.Errorf("%s: only the owner can delete it", item.Path)
+	case !item.isDir():
+		err = c.client.call(c.ctx, http.MethodDelete, "/api/file/"+url.PathEscape(item.ID), nil, "", nil, nil)
+	case !recursive:
+		return item, fmt.Errorf("%s: is a folder; use -r to delete it with everything in it", item.Path)
+	default:
+		err = c.client.postJSON(c.ctx, "/api/folder/delete", map[string]string{"folder_id": item.ID, "mode": "all"}, nil)
+	}
+	if err != nil {
+		return item, fmt.Errorf("%s: %w", item.Path, err)
+	}
+	return item, nil
+}
+
+// shareLink is a link that lets anyone download a file. The server only sends its URL
+// when it is created.
+type shareLink struct {
+	ID        string     `json:"id"`
+	URL       string     `json:"url,omitempty"`
+	FileID    string     `json:"file_id"`
+	Name      string     `json:"name"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func cmdShare(c *cli, args []string) error {
+	fs := c.flagSet("share", "[-expires 72h] path | -list | -revoke id")
+	expires := fs.Duration("expires", 0, "stop the link working after this long, e.g. 72h (default never)")
+	list := fs.Bool("list", false, "list your share links")
+	revoke := fs.String("revoke", "", "revoke the link with this `id`")
+	if err := c.parse(fs, args, 0); err != nil {
+		return err
+	}
+	if !*list && *revoke == "" && fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+	switch {
+	case *list:
+		var links []shareLink
+		if err := c.client.call(c.ctx, http.MethodGet, "/api/share", nil, "", nil, &links); err != nil {
+			return err
+		}
+		c.output(links, func() {
+			for _, l := range links {
+				expiry := "never expires"
+				if l.ExpiresAt != nil {
+					expiry = "expires " + formatTime(l.ExpiresAt)
+				}
+				fmt.Printf("%s  %s  (%s)\n", l.ID, l.Name, expiry)
+			}
+		})
+		return nil
+	case *revoke != "":
+		if err := c.client.postForm(c.ctx, "/api/share/delete", url.Values{"id": {*revoke}}, nil); err != nil {
+			return err
+		}
+		c.output(map[string]string{"id": *revoke, "status": "revoked"}, func() {})
+		return nil
+	}
+	item, _, err := c.client.list(c.ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if item.isDir() {
+		return fmt.Errorf("%s: only files can be shared", item.Path)
+	}
+	form := url.Values{"file_id": {item.ID}}
+	if *expires > 0 {
+		form.Set("expires_in", expires.String())
+	}
+	var link shareLink
+	if err := c.client.postForm(c.ctx, "/api/share", form, &link); err != nil {
+		return err
+	}
+	c.output(link, func() { fmt.Println(link.URL) })
+	return nil
+}
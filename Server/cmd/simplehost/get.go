@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// getResult is the outcome of downloading one file
+type getResult struct {
+	Path   string `json:"path"`
+	Local  string `json:"local"`
+	Size   int64  `json:"size"`
+	Status string `json:"status"` // downloaded, skipped or failed
+	Error  string `json:"error,omitempty"`
+}
+
+// getTask is a remote file and where it goes
+type getTask struct {
+	file  entry
+	local string
+}
+
+func cmdGet(c *cli, args []string) error {
+	fs := c.flagSet("get", "[-j n] [-overwrite] remote [local]")
+	jobs := fs.Int("j", 4, "download up to `n` files at once")
+	overwrite := fs.Bool("overwrite", false, "replace local files that already exist instead of skipping them")
+	if err := c.parse(fs, args, 1); err != nil {
+		return err
+	}
+	if *jobs < 1 {
+		*jobs = 1
+	}
+	local := "."
+	if fs.NArg() > 1 {
+		local = fs.Arg(1)
+	}
+	item, children, err := c.client.list(c.ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	// Like cp, an existing local folder receives the item under its own name
+	if info, err := os.Stat(local); err == nil && info.IsDir() && item.Path != "/" {
+		if !safeName(item.Name) {
+			return fmt.Errorf("%s: the name can't be saved locally; give a local file name", item.Path)
+		}
+		local = filepath.Join(local, item.Name)
+	}
+	var tasks []getTask
+	if item.isDir() {
+		if tasks, err = c.planGet(c.ctx, children, local); err != nil {
+			return err
+		}
+	} else {
+		tasks = []getTask{{*item, local}}
+	}
+
+	results := make([]getResult, len(tasks))
+	files := make(chan struct{}, *jobs)
+	var wg sync.WaitGroup
+	for i, t := range tasks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			files <- struct{}{}
+			defer func() { <-files }()
+			res := getResult{Path: t.file.Path, Local: t.local, Size: t.file.Size, Status: "downloaded"}
+			if _, err := os.Lstat(t.local); err == nil && !*overwrite {
+				res.Status, res.Error = "skipped", "already exists"
+			} else if err := c.client.download(c.ctx, t.file, t.local); err != nil {
+				res.Status, res.Error = "failed", err.Error()
+			}
+			results[i] = res
+			switch res.Status {
+			case "downloaded":
+				c.progress("downloaded %s (%s)", res.Local, formatSize(res.Size))
+			case "skipped":
+				c.progress("skipped %s: %s", res.Local, res.Error)
+			default:
+				c.warn("%s: %s", res.Path, res.Error)
+			}
+		}()
+	}
+	wg.Wait()
+	c.output(results, func() {})
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	for _, res := range results {
+		if res.Status == "failed" {
+			return errFailed
+		}
+	}
+	return nil
+}
+
+// planGet makes the local folder for a remote one and returns the files to download into
+// it, going through subfolders too
+func (c *cli) planGet(ctx context.Context, children []entry, local string) ([]getTask, error) {
+	if err := os.MkdirAll(local, 0o755); err != nil {
+		return nil, err
+	}
+	var tasks []getTask
+	for _, child := range children {
+		if !safeName(child.Name) {
+			c.warn("%s: skipping a name that can't be saved locally", child.Path)
+			continue
+		}
+		target := filepath.Join(local, child.Name)
+		if !child.isDir() {
+			tasks = append(tasks, getTask{child, target})
+			continue
+		}
+		_, grandchildren, err := c.client.list(ctx, child.Path)
+		if err != nil {
+			return nil, err
+		}
+		found, err := c.planGet(ctx, grandchildren, target)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, found...)
+	}
+	return tasks, nil
+}
+
+// safeName reports whether a name from the server can be used as a local file name
+// without pointing outside the folder it's saved in
+func safeName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// download saves a remote file, writing to a temporary name so an interrupted download
+// doesn't leave a partial file behind
+func (c *client) download(ctx context.Context, file entry, local string) error {
+	resp, err := c.do(ctx, http.MethodGet, "/api/download", url.Values{"fileId": {file.ID}}, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	tmp := local + ".part"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, resp.Body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n != file.Size {
+		err = fmt.Errorf("got %d of %d bytes", n, file.Size)
+	}
+	if err == nil {
+		err = os.Rename(tmp, local)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if file.Uploaded != nil {
+		os.Chtimes(local, *file.Uploaded, *file.Uploaded)
+	}
+	return nil
+}
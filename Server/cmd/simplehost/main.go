@@ -0,0 +1,210 @@
+// Command simplehost is a command-line client for a SimpleHost server. It signs in with an
+// app token from the account page and works with paths as they appear in the web UI.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+)
+
+const usageText = `Usage: simplehost [flags] <command> [command flags] [arguments]
+
+Commands:
+  ls [-r] [path]                    list a folder, or show a file
+  put [-j n] [-overwrite] local... remote-folder
+                                    upload files and folders, resuming cut-off uploads
+  get [-j n] [-overwrite] remote [local]
+                                    download a file or a whole folder
+  mkdir [-p] path...                create folders
+  rm [-r] path...                   delete files, or folders with -r
+  share [-expires 72h] path         make a link anyone can download a file with
+  share -list | -revoke id          list or revoke share links
+
+Flags, also accepted after the command:
+  -server url    server URL, or $SIMPLEHOST_SERVER
+  -token token   app token from the account page, or $SIMPLEHOST_TOKEN
+  -json          print machine-readable JSON
+`
+
+var (
+	// errUsage reports bad arguments, after the usage has been printed
+	errUsage = errors.New("usage")
+	// errFailed reports that some items failed, after the results have been printed
+	errFailed = errors.New("some items failed")
+)
+
+var commands = map[string]func(c *cli, args []string) error{
+	"ls":    cmdLs,
+	"put":   cmdPut,
+	"get":   cmdGet,
+	"mkdir": cmdMkdir,
+	"rm":    cmdRm,
+	"share": cmdShare,
+}
+
+// options are the flags every command accepts
+type options struct {
+	server string
+	token  string
+	json   bool
+}
+
+func (o *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.server, "server", o.server, "server `URL` ($SIMPLEHOST_SERVER)")
+	fs.StringVar(&o.token, "token", o.token, "app `token` ($SIMPLEHOST_TOKEN)")
+	fs.BoolVar(&o.json, "json", o.json, "print machine-readable JSON")
+}
+
+// cli is the state shared by the commands
+type cli struct {
+	ctx    context.Context
+	opts   *options
+	client *client
+	outMu  sync.Mutex
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	code := run(ctx, os.Args[1:])
+	stop()
+	os.Exit(code)
+}
+
+func run(ctx context.Context, args []string) int {
+	opts := &options{server: os.Getenv("SIMPLEHOST_SERVER"), token: os.Getenv("SIMPLEHOST_TOKEN")}
+	global := flag.NewFlagSet("simplehost", flag.ContinueOnError)
+	global.Usage = func() { fmt.Fprint(os.Stderr, usageText) }
+	opts.register(global)
+	if err := global.Parse(args); err != nil {
+		return 2
+	}
+	if global.NArg() == 0 {
+		global.Usage()
+		return 2
+	}
+	name := global.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "simplehost: unknown command %q\n\n", name)
+		global.Usage()
+		return 2
+	}
+	c := &cli{ctx: ctx, opts: opts}
+	switch err := cmd(c, global.Args()[1:]); {
+	case err == nil:
+		return 0
+	case errors.Is(err, errUsage):
+		return 2
+	case errors.Is(err, errFailed):
+		return 1
+	default:
+		c.fail(err)
+		return 1
+	}
+}
+
+// flagSet returns a flag set for a command that also accepts the common flags
+func (c *cli) flagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet("simplehost "+name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: simplehost %s %s\n", name, usage)
+		fs.PrintDefaults()
+	}
+	c.opts.register(fs)
+	return fs
+}
+
+// parse parses a command's flags and connects to the server. want is how many arguments
+// the command needs at least.
+func (c *cli) parse(fs *flag.FlagSet, args []string, want int) error {
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() < want {
+		fs.Usage()
+		return errUsage
+	}
+	if c.opts.server == "" || c.opts.token == "" {
+		return errors.New("set the server URL and app token with -server and -token, or $SIMPLEHOST_SERVER and $SIMPLEHOST_TOKEN")
+	}
+	c.client = &client{
+		base:  strings.TrimSuffix(c.opts.server, "/"),
+		token: c.opts.token,
+		http: &http.Client{
+			// The server answers a bad token with a redirect to the login page
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+	return nil
+}
+
+// output prints v as JSON, or calls human to print it for people
+func (c *cli) output(v any, human func()) {
+	if c.opts.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+		return
+	}
+	human()
+}
+
+// progress prints a line as work finishes, unless the output is JSON
+func (c *cli) progress(format string, args ...any) {
+	if c.opts.json {
+		return
+	}
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	fmt.Printf(format+"\n", args...)
+}
+
+// warn reports a failed item without stopping the command
+func (c *cli) warn(format string, args ...any) {
+	if c.opts.json {
+		return
+	}
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	fmt.Fprintf(os.Stderr, "simplehost: "+format+"\n", args...)
+}
+
+// fail reports the error that stopped a command
+func (c *cli) fail(err error) {
+	if c.opts.json {
+		json.NewEncoder(os.Stderr).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	fmt.Fprintf(os.Stderr, "simplehost: %v\n", err)
+}
+
+// formatSize prints a byte count with a binary unit, e.g. 1.5 MB
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatTime prints a time in local time to the minute
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return strings.Repeat(" ", 16)
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
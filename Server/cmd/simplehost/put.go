@@ -0,0 +1,524 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errExists is the server's answer to uploading over a file without overwrite
+var errExists = errors.New("already exists")
+
+// putResult is the outcome of uploading one file
+type putResult struct {
+	Local   string `json:"local"`
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	Status  string `json:"status"` // uploaded, skipped or failed
+	ID      string `json:"id,omitempty"`
+	Resumed bool   `json:"resumed,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// putTask is a local file and the remote folder it goes in
+type putTask struct {
+	local   string
+	folder  *entry
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func cmdPut(c *cli, args []string) error {
+	fs := c.flagSet("put", "[-j n] [-overwrite] local... remote-folder")
+	jobs := fs.Int("j", 4, "send up to `n` chunks at once")
+	overwrite := fs.Bool("overwrite", false, "replace files that already exist instead of skipping them")
+	if err := c.parse(fs, args, 2); err != nil {
+		return err
+	}
+	if *jobs < 1 {
+		*jobs = 1
+	}
+	sources, remote := fs.Args()[:fs.NArg()-1], fs.Arg(fs.NArg()-1)
+	u := &uploader{
+		client:    c.client,
+		overwrite: *overwrite,
+		chunks:    make(chan struct{}, *jobs),
+		state:     loadResumeState(),
+		children:  map[string]map[string]entry{},
+	}
+	dest, err := c.client.mkdirAll(c.ctx, remote)
+	if err != nil {
+		return err
+	}
+
+	// Make the remote folders first, so files can go up in any order
+	var tasks []putTask
+	for _, src := range sources {
+		found, err := u.plan(c.ctx, src, dest)
+		if err != nil {
+			return err
+		}
+		tasks = append(tasks, found...)
+	}
+
+	results := make([]putResult, len(tasks))
+	files := make(chan struct{}, *jobs)
+	var wg sync.WaitGroup
+	for i, t := range tasks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			files <- struct{}{}
+			defer func() { <-files }()
+			res := u.upload(c.ctx, t)
+			results[i] = res
+			switch res.Status {
+			case "uploaded":
+				c.progress("uploaded %s (%s)", res.Path, formatSize(res.Size))
+			case "skipped":
+				c.progress("skipped %s: %s", res.Path, res.Error)
+			default:
+				c.warn("%s: %s", res.Local, res.Error)
+			}
+		}()
+	}
+	wg.Wait()
+	c.output(results, func() {})
+	if c.ctx.Err() != nil {
+		return errors.New("interrupted; run the same command again to resume")
+	}
+	for _, res := range results {
+		if res.Status == "failed" {
+			return errFailed
+		}
+	}
+	return nil
+}
+
+// uploader sends files with the chunked protocol the web UI uses
+type uploader struct {
+	client    *client
+	overwrite bool
+	// chunks limits how many chunks are sent at once, across all files
+	chunks chan struct{}
+	state  *resumeState
+
+	mu sync.Mutex
+	// children caches the contents of remote folders by ID, to check for existing files
+	children map[string]map[string]entry
+}
+
+// plan walks a local file or folder, makes the matching remote folders in dest and
+// returns the files to upload
+func (u *uploader) plan(ctx context.Context, src string, dest *entry) ([]putTask, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []putTask{{local: src, folder: dest, name: filepath.Base(src), size: info.Size(), modTime: info.ModTime()}}, nil
+	}
+	var tasks []putTask
+	folders := map[string]*entry{}
+	err = filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		parent, name := dest, d.Name()
+		if p != src {
+			parent = folders[filepath.Dir(p)]
+		} else if abs, err := filepath.Abs(src); err == nil {
+			name = filepath.Base(abs) // src may be "." or end in ".."
+		}
+		if d.IsDir() {
+			folder, err := u.folder(ctx, parent, name)
+			if err != nil {
+				return err
+			}
+			folders[p] = folder
+			return nil
+		}
+		// Follow links to files, and leave out sockets, devices and the like
+		info, err := os.Stat(p)
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		tasks = append(tasks, putTask{local: p, folder: parent, name: d.Name(), size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	return tasks, err
+}
+
+// folder returns the folder called name in parent, creating it if needed
+func (u *uploader) folder(ctx context.Context, parent *entry, name string) (*entry, error) {
+	existing, err := u.existing(ctx, parent, name)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if !existing.isDir() {
+			return nil, fmt.Errorf("%s: a file is in the way of the folder", existing.Path)
+		}
+		return existing, nil
+	}
+	folder, err := u.client.mkdir(ctx, parent, name)
+	if err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	u.children[parent.ID][name] = *folder
+	u.children[folder.ID] = map[string]entry{}
+	u.mu.Unlock()
+	return folder, nil
+}
+
+// existing returns the item called name in a remote folder, or nil
+func (u *uploader) existing(ctx context.Context, folder *entry, name string) (*entry, error) {
+	u.mu.Lock()
+	children, ok := u.children[folder.ID]
+	u.mu.Unlock()
+	if !ok {
+		_, list, err := u.client.list(ctx, folder.Path)
+		if err != nil {
+			return nil, err
+		}
+		// Names are only unique per owner. Pick the item the server would: folders over
+		// files, then the user's own.
+		rank := func(e entry) int {
+			r := 0
+			if e.isDir() {
+				r += 2
+			}
+			if e.CanDelete {
+				r++
+			}
+			return r
+		}
+		children = map[string]entry{}
+		for _, e := range list {
+			if prev, ok := children[e.Name]; !ok || rank(e) > rank(prev) {
+				children[e.Name] = e
+			}
+		}
+		u.mu.Lock()
+		u.children[folder.ID] = children
+		u.mu.Unlock()
+	}
+	if e, ok := children[name]; ok {
+		return &e, nil
+	}
+	return nil, nil
+}
+
+// upload sends one file. The first chunk goes alone, since that's when the server checks
+// for a file with the same name, and the last goes after all the others, since it makes
+// the server put the file together.
+func (u *uploader) upload(ctx context.Context, t putTask) putResult {
+	res := putResult{Local: t.local, Path: path.Join(t.folder.Path, t.name), Size: t.size}
+	fail := func(err error) putResult {
+		res.Status, res.Error = "failed", err.Error()
+		return res
+	}
+	existing, err := u.existing(ctx, t.folder, t.name)
+	if err != nil {
+		return fail(err)
+	}
+	key := u.state.key(u.client.base, t)
+	saved, resumed := u.state.get(key)
+	if resumed && (saved.Size != t.size || !saved.ModTime.Equal(t.modTime)) {
+		// The file changed since the upload started, so start again
+		resumed = false
+	}
+	if resumed && existing != nil && existing.ID == saved.UploadID {
+		// The server finished the upload last time, but we didn't hear back
+		u.state.remove(key)
+		res.Status, res.ID = "uploaded", saved.UploadID
+		return res
+	}
+	if existing != nil && (existing.isDir() || !u.overwrite) {
+		res.Status, res.Error = "skipped", "already exists"
+		return res
+	}
+
+	var status *uploadStatus
+	uploadID, chunkSize := "", int64(0)
+	if resumed {
+		uploadID, chunkSize = saved.UploadID, saved.ChunkSize
+		status, err = u.client.uploadStatus(ctx, uploadID)
+		if isStatus(err, http.StatusNotFound) {
+			// The server threw the upload away, or it was started by an older client
+			resumed = false
+		} else if err != nil {
+			return fail(err)
+		}
+	}
+	if !resumed {
+		// The server issues the upload ID, and only accepts chunks for it from us
+		status, err = u.client.startUpload(ctx)
+		if err != nil {
+			return fail(err)
+		}
+		uploadID, chunkSize = status.UploadID, status.ChunkSize
+		if err := u.state.put(key, savedUpload{UploadID: uploadID, Size: t.size, ModTime: t.modTime, ChunkSize: chunkSize}); err != nil {
+			return fail(err)
+		}
+	}
+	if chunkSize <= 0 {
+		chunkSize = status.ChunkSize
+	}
+	total := int((t.size + chunkSize - 1) / chunkSize)
+	if total == 0 {
+		total = 1 // Empty files are one empty chunk
+	}
+	chunkLen := func(i int) int64 { return min(chunkSize, t.size-int64(i)*chunkSize) }
+	have := map[int]bool{}
+	for _, ch := range status.Chunks {
+		if ch.Index < total && ch.Size == chunkLen(ch.Index) {
+			have[ch.Index] = true
+		}
+	}
+
+	f, err := os.Open(t.local)
+	if err != nil {
+		return fail(err)
+	}
+	defer f.Close()
+	send := func(i int) error {
+		return u.sendChunk(ctx, f, t, uploadID, i, total, int64(i)*chunkSize, chunkLen(i))
+	}
+	if total > 1 && !have[0] {
+		if err := send(0); err != nil {
+			return u.failed(res, key, err)
+		}
+	}
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	var firstErr error
+	for i := 1; i < total-1; i++ {
+		if have[i] {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := send(i); err != nil {
+				errMu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return u.failed(res, key, firstErr)
+	}
+	if err := send(total - 1); err != nil {
+		return u.failed(res, key, err)
+	}
+	u.state.remove(key)
+	res.Status, res.ID, res.Resumed = "uploaded", uploadID, len(have) > 0
+	return res
+}
+
+// failed reports a file that didn't upload. The server refusing to overwrite a file means
+// it was skipped, and there's nothing to resume.
+func (u *uploader) failed(res putResult, key string, err error) putResult {
+	if errors.Is(err, errExists) {
+		u.state.remove(key)
+		res.Status, res.Error = "skipped", err.Error()
+		return res
+	}
+	res.Status, res.Error = "failed", err.Error()
+	return res
+}
+
+// sendChunk uploads one chunk, trying again a few times if the connection or server fails
+func (u *uploader) sendChunk(ctx context.Context, f *os.File, t putTask, uploadID string, index, total int, offset, length int64) error {
+	u.chunks <- struct{}{}
+	defer func() { <-u.chunks }()
+	for attempt := 1; ; attempt++ {
+		err := u.client.uploadChunk(ctx, io.NewSectionReader(f, offset, length), url.Values{
+			"file_name":    {t.name},
+			"upload_id":    {uploadID},
+			"chunk_index":  {strconv.Itoa(index)},
+			"total_chunks": {strconv.Itoa(total)},
+			"folder_id":    {t.folder.ID},
+			"overwrite":    {strconv.FormatBool(u.overwrite)},
+		})
+		var apiErr *apiError
+		if err == nil || attempt == 3 || ctx.Err() != nil || (errors.As(err, &apiErr) && apiErr.status < 500) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+	}
+}
+
+// uploadStatus is what the server has of an upload
+type uploadStatus struct {
+	UploadID  string `json:"upload_id"`
+	ChunkSize int64  `json:"chunk_size"`
+	Chunks    []struct {
+		Index int   `json:"index"`
+		Size  int64 `json:"size"`
+	} `json:"chunks"`
+}
+
+func (c *client) uploadStatus(ctx context.Context, uploadID string) (*uploadStatus, error) {
+	var status uploadStatus
+	if err := c.call(ctx, http.MethodGet, "/api/upload", url.Values{"upload_id": {uploadID}}, "", nil, &status); err != nil {
+		return nil, err
+	}
+	if status.ChunkSize <= 0 {
+		return nil, errors.New("the server didn't say what chunk size to use")
+	}
+	return &status, nil
+}
+
+// startUpload asks the server for an upload ID to send chunks under
+func (c *client) startUpload(ctx context.Context) (*uploadStatus, error) {
+	var status uploadStatus
+	if err := c.postForm(ctx, "/api/upload/start", nil, &status); err != nil {
+		return nil, err
+	}
+	if status.UploadID == "" || status.ChunkSize <= 0 {
+		return nil, errors.New("the server didn't issue an upload ID; it may need updating")
+	}
+	return &status, nil
+}
+
+// uploadChunk posts one chunk as the multipart form UploadHandler expects
+func (c *client) uploadChunk(ctx context.Context, chunk io.Reader, fields url.Values) error {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		for name, values := range fields {
+			if err := mw.WriteField(name, values[0]); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		part, err := mw.CreateFormFile("chunk", fields.Get("file_name"))
+		if err == nil {
+			_, err = io.Copy(part, chunk)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	err := c.call(ctx, http.MethodPost, "/api/upload", nil, mw.FormDataContentType(), pr, nil)
+	pr.Close()
+	if isStatus(err, http.StatusConflict) {
+		return errExists
+	}
+	return err
+}
+
+// savedUpload remembers an upload in progress so it can be resumed
+type savedUpload struct {
+	UploadID  string    `json:"upload_id"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+	ChunkSize int64     `json:"chunk_size"`
+	Started   time.Time `json:"started"`
+}
+
+// resumeState is the uploads in progress, kept in the user's cache folder between runs
+type resumeState struct {
+	mu      sync.Mutex
+	path    string
+	uploads map[string]savedUpload
+}
+
+// resumeMaxAge is how long an unfinished upload is remembered
+const resumeMaxAge = 7 * 24 * time.Hour
+
+func loadResumeState() *resumeState {
+	s := &resumeState{uploads: map[string]savedUpload{}}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return s
+	}
+	s.path = filepath.Join(dir, "simplehost", "uploads.json")
+	if data, err := os.ReadFile(s.path); err == nil {
+		json.Unmarshal(data, &s.uploads)
+	}
+	for key, saved := range s.uploads {
+		if time.Since(saved.Started) > resumeMaxAge {
+			delete(s.uploads, key)
+		}
+	}
+	return s
+}
+
+// key identifies an upload by server, destination and local file
+func (s *resumeState) key(server string, t putTask) string {
+	local, err := filepath.Abs(t.local)
+	if err != nil {
+		local = t.local
+	}
+	return strings.Join([]string{server, t.folder.ID, t.name, local}, "\n")
+}
+
+func (s *resumeState) get(key string) (savedUpload, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved, ok := s.uploads[key]
+	return saved, ok
+}
+
+func (s *resumeState) put(key string, saved savedUpload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved.Started = time.Now()
+	s.uploads[key] = saved
+	return s.save()
+}
+
+func (s *resumeState) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.uploads[key]; ok {
+		delete(s.uploads, key)
+		s.save()
+	}
+}
+
+// save writes the state, replacing the file in one step so a crash can't corrupt it
+func (s *resumeState) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.uploads)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
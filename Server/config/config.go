@@ -0,0 +1,464 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting the server reads. Values are resolved in this order, later
+// sources winning: built-in defaults, the YAML config file, environment variables, then
+// command-line flags.
+//
+// Each setting's yaml tag doubles as its flag name, with sections joined by dots
+// (-server.addr, -ldap.url), and the env tag names its environment variable. Inside
+// rate_limits the env tags are prefixes, e.g. LOGIN_IP_FREE_ATTEMPTS. Fields tagged
+// secret:"true" are redacted when the config is printed.
+type Config struct {
+	// Env is "development" or "production"; production refuses unsafe settings
+	Env string `yaml:"env" env:"SIMPLEHOST_ENV"`
+
+	Log        Log        `yaml:"log"`
+	Server     Server     `yaml:"server"`
+	Database   Database   `yaml:"database"`
+	Storage    Storage    `yaml:"storage"`
+	Auth       Auth       `yaml:"auth"`
+	JWT        JWT        `yaml:"jwt"`
+	Passwords  Passwords  `yaml:"passwords"`
+	WebAuthn   WebAuthn   `yaml:"webauthn"`
+	OIDC       OIDC       `yaml:"oidc"`
+	LDAP       LDAP       `yaml:"ldap"`
+	Mail       Mail       `yaml:"mail"`
+	RateLimits RateLimits `yaml:"rate_limits"`
+	Metrics    Metrics    `yaml:"metrics"`
+	WebDAV     WebDAV     `yaml:"webdav"`
+	SFTP       SFTP       `yaml:"sftp"`
+	S3API      S3API      `yaml:"s3_api"`
+}
+
+type Log struct {
+	// Level is debug, info, warn or error
+	Level string `yaml:"level" env:"LOG_LEVEL"`
+	// Format is text or json
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+	// AccessLog writes a line for every HTTP request
+	AccessLog bool `yaml:"access_log" env:"ACCESS_LOG"`
+}
+
+type Server struct {
+	Addr string `yaml:"addr" env:"SIMPLEHOST_ADDR"`
+	// PublicURL is the scheme and host users reach the server at, used for links in emails.
+	// BasePath is appended to it.
+	PublicURL string `yaml:"public_url" env:"PUBLIC_URL"`
+	// BasePath serves the app under a prefix such as /files, for reverse proxies that pass
+	// the full path through
+	BasePath string `yaml:"base_path" env:"BASE_PATH"`
+	// TrustedProxies lists IPs and CIDR ranges allowed to set X-Forwarded-For and
+	// X-Forwarded-Proto
+	TrustedProxies []string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+	// TLSCert and TLSKey are PEM files; when both are set Addr serves HTTPS. Send the
+	// process SIGHUP to reload them after a renewal.
+	TLSCert string `yaml:"tls_cert" env:"TLS_CERT_FILE"`
+	TLSKey  string `yaml:"tls_key" env:"TLS_KEY_FILE"`
+	// RedirectAddr, when TLS is on, listens for plain HTTP and redirects it to HTTPS
+	RedirectAddr string `yaml:"redirect_addr" env:"HTTP_REDIRECT_ADDR"`
+	// ShutdownTimeout is how long SIGTERM or SIGINT waits for in-flight requests such as
+	// uploads and downloads before cutting them off
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+}
+
+type Database struct {
+	Path string `yaml:"path" env:"DATABASE_PATH"`
+}
+
+type Storage struct {
+	// Driver is where file contents are kept: disk (under upload_dir) or s3
+	Driver string `yaml:"driver" env:"STORAGE_DRIVER"`
+	// UploadDir holds file contents with the disk driver, and upload chunks with any driver
+	UploadDir string `yaml:"upload_dir" env:"UPLOAD_DIR"`
+	// ChunkSize is the size of each piece the browser uploader sends, in bytes
+	ChunkSize int64 `yaml:"chunk_size" env:"UPLOAD_CHUNK_SIZE"`
+	// MaxMultipartMemory is how much of an upload request is buffered in memory before
+	// spilling to temporary files, in bytes
+	MaxMultipartMemory int64 `yaml:"max_multipart_memory" env:"MAX_MULTIPART_MEMORY"`
+	// MinFreeBytes is how much free disk space upload_dir needs for /readyz to pass
+	MinFreeBytes int64      `yaml:"min_free_bytes" env:"MIN_FREE_DISK_BYTES"`
+	S3           S3         `yaml:"s3" env:"S3"`
+	Encryption   Encryption `yaml:"encryption" env:"ENCRYPTION"`
+}
+
+// Encryption encrypts file contents before they're stored, with a data key per file
+// wrapped by a master key. Files stored before it was enabled stay readable; files stored
+// while it was enabled can't be read once it's turned off.
+type Encryption struct {
+	Enabled bool `yaml:"enabled" env:"_ENABLED"`
+	// Keys is a comma separated list of id:key pairs with base64 encoded 32-byte keys. The
+	// first key wraps new data keys and the rest only unwrap.
+	Keys string `yaml:"keys" env:"_KEYS" secret:"true"`
+	// KeyFile stores generated keys when Keys isn't set. Keep it apart from the files
+	// and back it up: without it nothing can be decrypted.
+	KeyFile string `yaml:"key_file" env:"_KEY_FILE"`
+}
+
+// S3 configures the s3 storage driver, which works with AWS and S3-compatible servers
+// such as MinIO
+type S3 struct {
+	// Endpoint defaults to AWS for the region, e.g. https://s3.us-east-1.amazonaws.com
+	Endpoint  string `yaml:"endpoint" env:"_ENDPOINT"`
+	Region    string `yaml:"region" env:"_REGION"`
+	Bucket    string `yaml:"bucket" env:"_BUCKET"`
+	Prefix    string `yaml:"prefix" env:"_PREFIX"`
+	AccessKey string `yaml:"access_key" env:"_ACCESS_KEY_ID"`
+	SecretKey string `yaml:"secret_key" env:"_SECRET_ACCESS_KEY" secret:"true"`
+	// PathStyle puts the bucket in the path instead of the host name, which most
+	// self-hosted servers need
+	PathStyle bool `yaml:"path_style" env:"_PATH_STYLE"`
+	// PartSize is the size of each part when uploading large files, in bytes
+	PartSize int64 `yaml:"part_size" env:"_PART_SIZE"`
+}
+
+type Auth struct {
+	// Backends is the authenticator chain, e.g. [local, ldap]. Empty means local, plus LDAP
+	// when ldap.url is set.
+	Backends []string `yaml:"backends" env:"AUTH_BACKENDS"`
+	// AdminUsername promotes an existing account to admin at startup
+	AdminUsername string `yaml:"admin_username" env:"ADMIN_USERNAME"`
+	// RegistrationMode is the default policy until an admin picks one: open, closed, invite or approval
+	RegistrationMode string        `yaml:"registration_mode" env:"REGISTRATION_MODE"`
+	EmailVerifyTTL   time.Duration `yaml:"email_verify_ttl" env:"EMAIL_VERIFY_TTL"`
+	PasswordResetTTL time.Duration `yaml:"password_reset_ttl" env:"PASSWORD_RESET_TTL"`
+	MagicLinkTTL     time.Duration `yaml:"magic_link_ttl" env:"MAGIC_LINK_TTL"`
+}
+
+type JWT struct {
+	Secret string `yaml:"secret" env:"JWT_SECRET" secret:"true"`
+	// Keys is a comma separated list of kid:secret pairs; the first one signs
+	Keys string `yaml:"keys" env:"JWT_KEYS" secret:"true"`
+	// KeyFile stores generated keys when neither Secret nor Keys is set
+	KeyFile string `yaml:"key_file" env:"JWT_KEY_FILE"`
+	// KeyMaxAge rotates generated keys once they are this old; zero never rotates
+	KeyMaxAge time.Duration `yaml:"key_max_age" env:"JWT_KEY_MAX_AGE"`
+}
+
+type Passwords struct {
+	// Hash is the scheme for new hashes: argon2id or bcrypt
+	Hash          string `yaml:"hash" env:"PASSWORD_HASH"`
+	Argon2Memory  uint32 `yaml:"argon2_memory" env:"ARGON2_MEMORY"` // KiB
+	Argon2Time    uint32 `yaml:"argon2_time" env:"ARGON2_TIME"`
+	Argon2Threads uint8  `yaml:"argon2_threads" env:"ARGON2_THREADS"`
+	BcryptCost    int    `yaml:"bcrypt_cost" env:"BCRYPT_COST"`
+	// MaxConcurrent caps how many passwords are hashed at once, since each Argon2id hash
+	// uses argon2_memory while it runs
+	MaxConcurrent int `yaml:"max_concurrent" env:"PASSWORD_MAX_CONCURRENT"`
+}
+
+type WebAuthn struct {
+	// RPID and Origins default to the host and origin of server.public_url
+	RPID    string   `yaml:"rp_id" env:"WEBAUTHN_RP_ID"`
+	Origins []string `yaml:"origins" env:"WEBAUTHN_ORIGINS"`
+}
+
+type OIDC struct {
+	Issuer       string   `yaml:"issuer" env:"OIDC_ISSUER"`
+	ClientID     string   `yaml:"client_id" env:"OIDC_CLIENT_ID"`
+	ClientSecret string   `yaml:"client_secret" env:"OIDC_CLIENT_SECRET" secret:"true"`
+	RedirectURL  string   `yaml:"redirect_url" env:"OIDC_REDIRECT_URL"`
+	Scopes       []string `yaml:"scopes" env:"OIDC_SCOPES"`
+	GroupsClaim  string   `yaml:"groups_claim" env:"OIDC_GROUPS_CLAIM"`
+	// RoleMap maps group names to roles, e.g. "admins=admin;staff=user"
+	RoleMap string `yaml:"role_map" env:"OIDC_ROLE_MAP"`
+}
+
+type LDAP struct {
+	URL           string `yaml:"url" env:"LDAP_URL"`
+	StartTLS      bool   `yaml:"start_tls" env:"LDAP_START_TLS"`
+	SkipTLSVerify bool   `yaml:"skip_tls_verify" env:"LDAP_SKIP_TLS_VERIFY"`
+	BindDN        string `yaml:"bind_dn" env:"LDAP_BIND_DN"`
+	BindPassword  string `yaml:"bind_password" env:"LDAP_BIND_PASSWORD" secret:"true"`
+	BaseDN        string `yaml:"base_dn" env:"LDAP_BASE_DN"`
+	// UserFilter uses {username} as a placeholder
+	UserFilter   string `yaml:"user_filter" env:"LDAP_USER_FILTER"`
+	UsernameAttr string `yaml:"username_attr" env:"LDAP_USERNAME_ATTR"`
+	EmailAttr    string `yaml:"email_attr" env:"LDAP_EMAIL_ATTR"`
+	GroupAttr    string `yaml:"group_attr" env:"LDAP_GROUP_ATTR"`
+	RoleMap      string `yaml:"role_map" env:"LDAP_ROLE_MAP"`
+}
+
+type Mail struct {
+	From         string `yaml:"from" env:"MAIL_FROM"`
+	SMTPHost     string `yaml:"smtp_host" env:"SMTP_HOST"`
+	SMTPPort     int    `yaml:"smtp_port" env:"SMTP_PORT"`
+	SMTPUsername string `yaml:"smtp_username" env:"SMTP_USERNAME"`
+	SMTPPassword string `yaml:"smtp_password" env:"SMTP_PASSWORD" secret:"true"`
+	// OutboxDir receives messages as .eml files when no SMTP host is set
+	OutboxDir string `yaml:"outbox_dir" env:"MAIL_OUTBOX_DIR"`
+}
+
+type Metrics struct {
+	// Enabled serves Prometheus metrics at /metrics
+	Enabled bool `yaml:"enabled" env:"METRICS_ENABLED"`
+	// Token lets a scraper in with an Authorization: Bearer header
+	Token string `yaml:"token" env:"METRICS_TOKEN" secret:"true"`
+	// AllowedIPs lists IPs and CIDR ranges allowed to scrape without the token. When neither
+	// this nor Token is set, only loopback addresses may scrape.
+	AllowedIPs []string `yaml:"allowed_ips" env:"METRICS_ALLOWED_IPS"`
+}
+
+type WebDAV struct {
+	// Enabled serves the folder tree over WebDAV at /webdav, for mounting as a network drive
+	Enabled bool `yaml:"enabled" env:"WEBDAV_ENABLED"`
+}
+
+type SFTP struct {
+	// Enabled runs an SFTP server on Addr alongside the web server
+	Enabled bool   `yaml:"enabled" env:"SFTP_ENABLED"`
+	Addr    string `yaml:"addr" env:"SFTP_ADDR"`
+	// HostKeyFile holds the server's SSH host key, generated on first run. Keep it so
+	// clients don't warn that the host key changed.
+	HostKeyFile string `yaml:"host_key_file" env:"SFTP_HOST_KEY_FILE"`
+}
+
+type S3API struct {
+	// Enabled serves an S3-compatible API on Addr, for tools that only speak S3. Clients
+	// sign requests with access keys from the account page.
+	Enabled bool   `yaml:"enabled" env:"S3_API_ENABLED"`
+	Addr    string `yaml:"addr" env:"S3_API_ADDR"`
+}
+
+// RateLimit configures one limiter: the first FreeAttempts failures are free, then delays
+// double from BaseDelay up to MaxDelay, and LockoutThreshold failures lock the key out for
+// LockoutDuration. State is forgotten ResetAfter the last failure.
+type RateLimit struct {
+	FreeAttempts     int           `yaml:"free_attempts" env:"_FREE_ATTEMPTS"`
+	BaseDelay        time.Duration `yaml:"base_delay" env:"_BASE_DELAY"`
+	MaxDelay         time.Duration `yaml:"max_delay" env:"_MAX_DELAY"`
+	LockoutThreshold int           `yaml:"lockout_threshold" env:"_LOCKOUT_THRESHOLD"`
+	LockoutDuration  time.Duration `yaml:"lockout_duration" env:"_LOCKOUT_DURATION"`
+	ResetAfter       time.Duration `yaml:"reset_after" env:"_RESET_AFTER"`
+}
+
+type RateLimits struct {
+	LoginAccount    RateLimit `yaml:"login_account" env:"LOGIN_ACCOUNT"`
+	LoginIP         RateLimit `yaml:"login_ip" env:"LOGIN_IP"`
+	Login2FA        RateLimit `yaml:"login_2fa" env:"LOGIN_2FA"`
+	RegisterIP      RateLimit `yaml:"register_ip" env:"REGISTER_IP"`
+	PasswordResetIP RateLimit `yaml:"password_reset_ip" env:"PASSWORD_RESET_IP"`
+	MagicLinkIP     RateLimit `yaml:"magic_link_ip" env:"MAGIC_LINK_IP"`
+}
+
+// Default returns the settings used when nothing else is configured
+func Default() *Config {
+	return &Config{
+		Env: "development",
+		Log: Log{Level: "info", Format: "text", AccessLog: true},
+		Server: Server{
+			Addr:            ":8080",
+			PublicURL:       "http://localhost:8080",
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Database: Database{Path: "./Database/simplehost.db"},
+		Storage: Storage{
+			Driver:             "disk",
+			UploadDir:          "simplehostdata",
+			ChunkSize:          5 << 20,
+			MaxMultipartMemory: 32 << 20,
+			MinFreeBytes:       100 << 20,
+			S3:                 S3{Region: "us-east-1", PartSize: 64 << 20},
+			Encryption:         Encryption{KeyFile: "./Database/encryption_keys.json"},
+		},
+		Auth: Auth{
+			RegistrationMode: "open",
+			EmailVerifyTTL:   24 * time.Hour,
+			PasswordResetTTL: time.Hour,
+			MagicLinkTTL:     15 * time.Minute,
+		},
+		JWT: JWT{KeyFile: "./Database/jwt_keys.json"},
+		Passwords: Passwords{
+			// The second recommended option in RFC 9106
+			Hash:          "argon2id",
+			Argon2Memory:  64 * 1024,
+			Argon2Time:    3,
+			Argon2Threads: 4,
+			BcryptCost:    10,
+			MaxConcurrent: 4,
+		},
+		OIDC: OIDC{
+			Scopes:      []string{"openid", "profile", "email"},
+			GroupsClaim: "groups",
+		},
+		LDAP: LDAP{
+			// Matches both OpenLDAP (uid) and Active Directory (sAMAccountName) accounts
+			UserFilter:   "(&(objectClass=person)(|(uid={username})(sAMAccountName={username})))",
+			UsernameAttr: "uid",
+			EmailAttr:    "mail",
+			GroupAttr:    "memberOf",
+		},
+		Mail: Mail{
+			From:      "SimpleHost <noreply@localhost>",
+			SMTPPort:  587,
+			OutboxDir: "./Database/outbox",
+		},
+		// Accounts get a lockout after a handful of failures, while IPs get more headroom
+		// since many users can share one address
+		RateLimits: RateLimits{
+			LoginAccount:    RateLimit{3, time.Second, 5 * time.Minute, 10, 15 * time.Minute, time.Hour},
+			LoginIP:         RateLimit{10, time.Second, 5 * time.Minute, 50, time.Hour, time.Hour},
+			Login2FA:        RateLimit{3, time.Second, 5 * time.Minute, 10, 15 * time.Minute, time.Hour},
+			RegisterIP:      RateLimit{5, 5 * time.Second, 10 * time.Minute, 30, time.Hour, time.Hour},
+			PasswordResetIP: RateLimit{3, 10 * time.Second, 10 * time.Minute, 20, time.Hour, time.Hour},
+			MagicLinkIP:     RateLimit{3, 10 * time.Second, 10 * time.Minute, 20, time.Hour, time.Hour},
+		},
+		Metrics: Metrics{Enabled: true},
+		WebDAV:  WebDAV{},
+		SFTP:    SFTP{Addr: ":2022", HostKeyFile: "./Database/sftp_host_key"},
+		S3API:   S3API{Addr: ":9000"},
+	}
+}
+
+// Load builds the config from the file named by -config or SIMPLEHOST_CONFIG, the
+// environment and the command-line args (without the program name)
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("simplehost", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("SIMPLEHOST_CONFIG"), "path to a YAML config file")
+	flags := registerFlags(fs, cfg)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		data, err := os.ReadFile(*path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", *path, err)
+		}
+	}
+	if err := applyEnv(cfg); err != nil {
+		return nil, err
+	}
+	// Only flags given on the command line override, so their defaults don't mask the file or env
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if setting, ok := flags[f.Name]; ok && err == nil {
+			err = setting.apply()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	cfg.Server.BasePath = cleanBasePath(cfg.Server.BasePath)
+	return cfg, cfg.validate()
+}
+
+// cleanBasePath turns "files/", "/files/" and "/files" into "/files", and "/" into ""
+func cleanBasePath(p string) string {
+	p = strings.TrimSpace(p)
+	if p == "" {
+		return ""
+	}
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return ""
+	}
+	return p
+}
+
+func (c *Config) validate() error {
+	switch c.Env {
+	case "development", "production":
+	default:
+		return fmt.Errorf("env must be development or production, not %q", c.Env)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		return fmt.Errorf("log.level: %w", err)
+	}
+	switch c.Log.Format {
+	case "text", "json":
+	default:
+		return fmt.Errorf("log.format must be text or json, not %q", c.Log.Format)
+	}
+	if (c.Server.TLSCert == "") != (c.Server.TLSKey == "") {
+		return errors.New("server.tls_cert and server.tls_key must be set together")
+	}
+	if c.Server.RedirectAddr != "" && !c.TLSEnabled() {
+		return errors.New("server.redirect_addr needs server.tls_cert and server.tls_key")
+	}
+	if strings.ContainsAny(c.Server.BasePath, "?#%") {
+		return fmt.Errorf("server.base_path %q must be a plain path", c.Server.BasePath)
+	}
+	if c.Server.ShutdownTimeout < 0 {
+		return errors.New("server.shutdown_timeout must not be negative")
+	}
+	if c.Storage.ChunkSize <= 0 {
+		return errors.New("storage.chunk_size must be positive")
+	}
+	if c.Storage.MaxMultipartMemory <= 0 {
+		return errors.New("storage.max_multipart_memory must be positive")
+	}
+	if c.Storage.MinFreeBytes < 0 {
+		return errors.New("storage.min_free_bytes must not be negative")
+	}
+	switch c.Storage.Driver {
+	case "disk":
+	case "s3":
+		if c.Storage.S3.Bucket == "" || c.Storage.S3.AccessKey == "" || c.Storage.S3.SecretKey == "" {
+			return errors.New("storage.s3 needs bucket, access_key and secret_key")
+		}
+		// S3 parts other than the last must be at least 5 MiB
+		if c.Storage.S3.PartSize < 5<<20 {
+			return errors.New("storage.s3.part_size must be at least 5 MiB")
+		}
+	default:
+		return fmt.Errorf("storage.driver must be disk or s3, not %q", c.Storage.Driver)
+	}
+	if c.SFTP.Enabled && (c.SFTP.Addr == "" || c.SFTP.HostKeyFile == "") {
+		return errors.New("sftp needs addr and host_key_file when enabled")
+	}
+	if c.S3API.Enabled && c.S3API.Addr == "" {
+		return errors.New("s3_api needs addr when enabled")
+	}
+	return nil
+}
+
+// Production reports whether the server runs with env set to production
+func (c *Config) Production() bool {
+	return c.Env == "production"
+}
+
+// Logger builds the logger described by the log section
+func (c *Config) Logger() *slog.Logger {
+	var level slog.Level
+	level.UnmarshalText([]byte(c.Log.Level))
+	opts := &slog.HandlerOptions{Level: level}
+	if c.Log.Format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
+
+// TLSEnabled reports whether the server terminates TLS itself
+func (c *Config) TLSEnabled() bool {
+	return c.Server.TLSCert != "" && c.Server.TLSKey != ""
+}
+
+// Redacted renders the effective config as YAML with secrets masked, for logging at startup
+func (c *Config) Redacted() string {
+	masked := *c
+	redact(&masked)
+	data, err := yaml.Marshal(&masked)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "simplehost.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, `
+log:
+  level: warn
+  format: json
+server:
+  addr: ":1001"
+  public_url: https://file.example.com
+storage:
+  chunk_size: 1024
+rate_limits:
+  login_ip:
+    free_attempts: 7
+`)
+	t.Setenv("SIMPLEHOST_ADDR", ":2002")
+	t.Setenv("PUBLIC_URL", "https://env.example.com")
+	t.Setenv("LOGIN_IP_FREE_ATTEMPTS", "8")
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.0.2.1")
+
+	cfg, err := Load([]string{"-config", path, "-server.addr", ":3003", "-storage.s3.part_size", "6291456"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name      string
+		got, want any
+	}{
+		{"flag over env and file", cfg.Server.Addr, ":3003"},
+		{"env over file", cfg.Server.PublicURL, "https://env.example.com"},
+		{"prefixed env over file", cfg.RateLimits.LoginIP.FreeAttempts, 8},
+		{"env list", cfg.Server.TrustedProxies, []string{"10.0.0.0/8", "192.0.2.1"}},
+		{"file over default", cfg.Storage.ChunkSize, int64(1024)},
+		// A flag that wasn't given doesn't reset the file's value to the flag default
+		{"file not masked by flag default", cfg.Log.Format, "json"},
+		{"flag over default", cfg.Storage.S3.PartSize, int64(6 << 20)},
+		{"default", cfg.RateLimits.LoginIP.LockoutDuration, time.Hour},
+	} {
+		if !reflect.DeepEqual(c.got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, c.got, c.want)
+		}
+	}
+}
+
+func TestLoadConfigPathFromEnv(t *testing.T) {
+	t.Setenv("SIMPLEHOST_CONFIG", writeConfig(t, "server:\n  addr: \":4004\"\n"))
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Addr != ":4004" {
+		t.Fatalf("addr %q, want the one from SIMPLEHOST_CONFIG", cfg.Server.Addr)
+	}
+
+	cfg, err = Load([]string{"-config", writeConfig(t, "server:\n  addr: \":5005\"\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Addr != ":5005" {
+		t.Fatalf("addr %q, want the one from -config", cfg.Server.Addr)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	t.Setenv("UPLOAD_CHUNK_SIZE", "lots")
+	if _, err := Load(nil); err == nil || !strings.Contains(err.Error(), "UPLOAD_CHUNK_SIZE") {
+		t.Fatalf("a bad env value: %v, want an error naming the variable", err)
+	}
+	t.Setenv("UPLOAD_CHUNK_SIZE", "")
+
+	if _, err := Load([]string{"-server.shutdown_timeout", "soon"}); err == nil {
+		t.Fatal("a bad flag value was accepted")
+	}
+	if _, err := Load([]string{"-env", "staging"}); err == nil {
+		t.Fatal("an invalid env was accepted")
+	}
+}
+
+func TestBasePathIsCleaned(t *testing.T) {
+	for in, want := range map[string]string{"": "", "/": "", "files": "/files", "/files/": "/files", " files/ ": "/files"} {
+		cfg, err := Load([]string{"-server.base_path", in})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Server.BasePath != want {
+			t.Errorf("base_path %q became %q, want %q", in, cfg.Server.BasePath, want)
+		}
+	}
+}
+
+func TestRedactedMasksSecrets(t *testing.T) {
+	cfg := Default()
+	cfg.JWT.Secret = "jwt-secret-value"
+	cfg.Storage.S3.SecretKey = "s3-secret-value"
+	out := cfg.Redacted()
+	if strings.Contains(out, "jwt-secret-value") || strings.Contains(out, "s3-secret-value") {
+		t.Fatalf("secrets in the printed config:\n%s", out)
+	}
+	if cfg.JWT.Secret != "jwt-secret-value" {
+		t.Fatal("Redacted changed the config it printed")
+	}
+}
+
+func TestNetworkServicesAreOffByDefault(t *testing.T) {
+	cfg := Default()
+	if cfg.WebDAV.Enabled || cfg.SFTP.Enabled || cfg.S3API.Enabled {
+		t.Fatalf("WebDAV %v, SFTP %v, S3 API %v by default; want them all off", cfg.WebDAV.Enabled, cfg.SFTP.Enabled, cfg.S3API.Enabled)
+	}
+}
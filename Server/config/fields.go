@@ -0,0 +1,146 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// visit calls fn for every setting in the struct v points into, with its flag and env names
+func visit(v reflect.Value, flagPrefix, envPrefix string, fn func(field reflect.Value, sf reflect.StructField, flagName, envName string)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name, _, _ := strings.Cut(sf.Tag.Get("yaml"), ",")
+		env := sf.Tag.Get("env")
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			visit(field, flagPrefix+name+".", envPrefix+env, fn)
+			continue
+		}
+		envName := ""
+		if env != "" {
+			envName = envPrefix + env
+		}
+		fn(field, sf, flagPrefix+name, envName)
+	}
+}
+
+// setField parses s into a setting. Lists are comma separated.
+func setField(field reflect.Value, s string) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint8, reflect.Uint32:
+		n, err := strconv.ParseUint(s, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+func applyEnv(cfg *Config) error {
+	var err error
+	visit(reflect.ValueOf(cfg).Elem(), "", "", func(field reflect.Value, _ reflect.StructField, _, envName string) {
+		if err != nil || envName == "" {
+			return
+		}
+		if value := os.Getenv(envName); value != "" {
+			if setErr := setField(field, value); setErr != nil {
+				err = fmt.Errorf("%s: %w", envName, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// flagValue holds a command-line value until it is applied on top of the file and env
+type flagValue struct {
+	field  reflect.Value
+	name   string
+	raw    string
+	isBool bool
+}
+
+func (f *flagValue) String() string {
+	if !f.field.IsValid() {
+		return ""
+	}
+	return fmt.Sprint(f.field.Interface())
+}
+
+func (f *flagValue) Set(s string) error {
+	f.raw = s
+	// Parse into a scratch value so bad input is reported by the flag package
+	return setField(reflect.New(f.field.Type()).Elem(), s)
+}
+
+func (f *flagValue) IsBoolFlag() bool { return f.isBool }
+
+func (f *flagValue) apply() error {
+	if err := setField(f.field, f.raw); err != nil {
+		return fmt.Errorf("-%s: %w", f.name, err)
+	}
+	return nil
+}
+
+func registerFlags(fs *flag.FlagSet, cfg *Config) map[string]*flagValue {
+	flags := map[string]*flagValue{}
+	visit(reflect.ValueOf(cfg).Elem(), "", "", func(field reflect.Value, _ reflect.StructField, flagName, envName string) {
+		f := &flagValue{field: field, name: flagName, isBool: field.Kind() == reflect.Bool}
+		usage := "see the config file documentation"
+		if envName != "" {
+			usage = "also set by " + envName
+		}
+		fs.Var(f, flagName, usage)
+		flags[flagName] = f
+	})
+	return flags
+}
+
+// redact masks every non-empty secret in cfg
+func redact(cfg *Config) {
+	visit(reflect.ValueOf(cfg).Elem(), "", "", func(field reflect.Value, sf reflect.StructField, _, _ string) {
+		if sf.Tag.Get("secret") == "true" && field.String() != "" {
+			field.SetString("********")
+		}
+	})
+}
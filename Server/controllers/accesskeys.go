@@ -0,0 +1,51 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+
+	"simplehost-server/models"
+)
+
+// CreateAccessKeyHandler creates an access key pair for the S3 API and shows the secret
+// once: POST /account/s3-keys
+func CreateAccessKeyHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || len(name) > 100 {
+		accountResponse(w, r, render, http.StatusBadRequest, "Please give the key a name of up to 100 characters", true)
+		return
+	}
+	userID := GetUserIDFromRequest(r)
+	key, err := models.CreateAccessKey(userID, name)
+	if err != nil {
+		logFor(r).Error("Failed to create access key", "user_id", userID, "error", err)
+		accountResponse(w, r, render, http.StatusInternalServerError, "Failed to create access key", true)
+		return
+	}
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusCreated, map[string]string{"name": name, "access_key_id": key.ID, "secret_access_key": key.Secret})
+		return
+	}
+	data := accountPageData(r)
+	data["NewAccessKey"] = key
+	data["Message"] = "Access key created. Copy the secret now, it won't be shown again."
+	w.WriteHeader(http.StatusCreated)
+	render(w, r, "account.html", data)
+}
+
+// DeleteAccessKeyHandler revokes an access key: POST /account/s3-keys/delete
+func DeleteAccessKeyHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := models.DeleteAccessKey(r.FormValue("key_id"), GetUserIDFromRequest(r)); err != nil {
+		accountResponse(w, r, render, http.StatusNotFound, "Access key not found", true)
+		return
+	}
+	accountResponse(w, r, render, http.StatusOK, "Access key revoked.", false)
+}
@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// requestInfo is shared between AccessLogMiddleware and the handlers below it, so the
+// access log can include the user that AuthMiddleware identifies further down the chain
+type requestInfo struct {
+	id     string
+	userID string
+	route  string
+}
+
+const requestIDHeader = "X-Request-ID"
+
+// Incoming request IDs are kept when they look like one, so a proxy's ID can be followed
+// through the logs, but nothing that could break a log line is accepted
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func getRequestInfo(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value("requestInfo").(*requestInfo)
+	return info
+}
+
+// setRequestUser records the authenticated user for the access log
+func setRequestUser(r *http.Request, userID string) {
+	if info := getRequestInfo(r); info != nil {
+		info.userID = userID
+	}
+}
+
+// logFor returns a logger that tags entries with the request's ID and user
+func logFor(r *http.Request) *slog.Logger {
+	info := getRequestInfo(r)
+	if info == nil {
+		return slog.Default()
+	}
+	logger := slog.With("request_id", info.id)
+	if info.userID != "" {
+		logger = logger.With("user_id", info.userID)
+	}
+	return logger
+}
+
+// statusRecorder captures the status code and body size written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to flush
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// AccessLogMiddleware assigns every request an ID, returned in the X-Request-ID header,
+// and logs it once it completes. It should wrap everything else so the log sees the final
+// status and the path as the client sent it.
+func AccessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{id: r.Header.Get(requestIDHeader)}
+		if !validRequestID.MatchString(info.id) {
+			info.id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, info.id)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), "requestInfo", info)))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		elapsed := time.Since(start)
+		observeRequest(info.route, r.Method, rec.status, elapsed.Seconds())
+		if !appConfig.Log.AccessLog {
+			return
+		}
+		level := slog.LevelInfo
+		if info.route == "/healthz" || info.route == "/readyz" {
+			// Probes arrive every few seconds; /readyz logs its own failures
+			level = slog.LevelDebug
+		} else if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.LogAttrs(r.Context(), level, "HTTP request",
+			slog.String("request_id", info.id),
+			slog.String("method", r.Method),
+			slog.String("path", loggedPath(r, info)),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Duration("duration", elapsed),
+			slog.String("user_id", info.userID),
+			slog.String("ip", ClientIP(r)),
+		)
+	})
+}
+
+// loggedPath is the request path for the access log. The secret in a share link's URL
+// is left out, since anyone who can read the log could otherwise download the file.
+func loggedPath(r *http.Request, info *requestInfo) string {
+	if info.route == "/s/" {
+		return AppPath("/s/") + "REDACTED"
+	}
+	return r.URL.Path
+}
+
+// RecordRoute notes which of the mux's patterns matches each request, for the metrics
+func RecordRoute(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info := getRequestInfo(r); info != nil {
+			_, info.route = mux.Handler(r)
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
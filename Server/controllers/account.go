@@ -0,0 +1,260 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"simplehost-server/mailer"
+	"simplehost-server/models"
+	"simplehost-server/passwords"
+)
+
+// wantsJSON reports whether the caller is an API client rather than the settings page
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json") || hasBearerToken(r)
+}
+
+// accountResponse answers an account request either as JSON or by re-rendering the settings page
+func accountResponse(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any), status int, message string, isError bool) {
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		key := "status"
+		if isError {
+			key = "error"
+		}
+		json.NewEncoder(w).Encode(map[string]string{key: message})
+		return
+	}
+	data := accountPageData(r)
+	if isError {
+		data["Error"] = message
+	} else {
+		data["Message"] = message
+	}
+	w.WriteHeader(status)
+	render(w, r, "account.html", data)
+}
+
+func accountPageData(r *http.Request) map[string]any {
+	data := map[string]any{}
+	if user, err := models.GetUserByID(GetUserIDFromRequest(r)); err == nil {
+		data["Username"] = user.Username
+		data["Email"] = user.Email
+		data["EmailVerified"] = user.EmailVerified
+		data["TwoFactorEnabled"] = user.TOTPEnabled
+		data["RecoveryCodesLeft"] = models.RemainingRecoveryCodes(user.ID)
+		data["Require2FA"] = models.GetBoolSetting(models.SettingRequire2FA, false)
+		data["IsAdmin"] = user.IsAdmin()
+		if providers, err := models.ListIdentityProviders(user.ID); err == nil {
+			for _, p := range providers {
+				if strings.HasPrefix(p, "oidc:") {
+					data["OIDCLinked"] = true
+				}
+				if p == "ldap" {
+					data["LDAPLinked"] = true
+				}
+			}
+		}
+		if passkeys, err := models.ListPasskeys(user.ID); err == nil {
+			data["Passkeys"] = passkeys
+		}
+		if tokens, err := models.ListAPITokens(user.ID); err == nil {
+			data["APITokens"] = tokens
+		}
+		data["WebDAVEnabled"] = appConfig.WebDAV.Enabled
+		if keys, err := models.ListSSHKeys(user.ID); err == nil {
+			data["SSHKeys"] = keys
+		}
+		if appConfig.SFTP.Enabled {
+			if _, port, err := net.SplitHostPort(appConfig.SFTP.Addr); err == nil {
+				data["SFTPPort"] = port
+			}
+		}
+		if keys, err := models.ListAccessKeys(user.ID); err == nil {
+			data["AccessKeys"] = keys
+		}
+		if appConfig.S3API.Enabled {
+			if _, port, err := net.SplitHostPort(appConfig.S3API.Addr); err == nil {
+				data["S3APIPort"] = port
+			}
+		}
+	}
+	return data
+}
+
+// AccountPageHandler renders the account settings page: GET /account
+func AccountPageHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(accountPageData(r))
+		return
+	}
+	render(w, r, "account.html", accountPageData(r))
+}
+
+// currentUserWithPassword loads the logged in user and re-checks their password before a
+// sensitive change, answering the request itself when the check fails. The check counts
+// against the same account limiter as the login page, so a stolen session can't be used
+// to guess the password.
+func currentUserWithPassword(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) (*models.User, bool) {
+	user, err := models.GetUserByID(GetUserIDFromRequest(r))
+	if err != nil {
+		accountResponse(w, r, render, http.StatusForbidden, "Current password is incorrect", true)
+		return nil, false
+	}
+	account := accountKey(user.Username)
+	if ok, wait := loginAccountLimiter.Allow(account); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		accountResponse(w, r, render, http.StatusTooManyRequests, retryMessage(wait), true)
+		return nil, false
+	}
+	// Go through the authenticator chain so directory accounts re-check against LDAP
+	checked, err := authenticate(user.Username, r.FormValue("current_password"))
+	if errors.Is(err, passwords.ErrBusy) {
+		loginAccountLimiter.Release(account)
+		w.Header().Set("Retry-After", "1")
+		accountResponse(w, r, render, http.StatusServiceUnavailable, serverBusyMessage, true)
+		return nil, false
+	}
+	if err != nil || checked.ID != user.ID {
+		loginAccountLimiter.Fail(account)
+		logFor(r).Warn("Failed password check", "user_id", user.ID, "ip", ClientIP(r))
+		accountResponse(w, r, render, http.StatusForbidden, "Current password is incorrect", true)
+		return nil, false
+	}
+	loginAccountLimiter.Reset(account)
+	return user, true
+}
+
+// ChangePasswordHandler updates the password and logs out every other session: POST /account/password
+func ChangePasswordHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := currentUserWithPassword(w, r, render)
+	if !ok {
+		return
+	}
+	password := r.FormValue("password")
+	if password != r.FormValue("retype") {
+		accountResponse(w, r, render, http.StatusBadRequest, "Passwords do not match", true)
+		return
+	}
+	if !validatePassword(password) {
+		accountResponse(w, r, render, http.StatusBadRequest, "Password must be at least 8 characters and include uppercase, lowercase, number, and special character.", true)
+		return
+	}
+	if err := models.UpdatePassword(user.ID, password); err != nil {
+		if errors.Is(err, passwords.ErrBusy) {
+			w.Header().Set("Retry-After", "1")
+			accountResponse(w, r, render, http.StatusServiceUnavailable, serverBusyMessage, true)
+			return
+		}
+		accountResponse(w, r, render, http.StatusInternalServerError, "Failed to update password", true)
+		return
+	}
+	forgetDAVCredentials(user.ID)
+	if err := models.RevokeSessions(user.ID); err != nil {
+		accountResponse(w, r, render, http.StatusInternalServerError, "Failed to revoke sessions", true)
+		return
+	}
+	// Keep the current browser logged in with a token issued after the revocation
+	if !hasBearerToken(r) {
+		if token, err := GenerateJWT(user.ID, user.Username); err == nil {
+			setAuthCookie(w, r, token)
+		}
+	}
+	accountResponse(w, r, render, http.StatusOK, "Password changed. Other sessions have been logged out.", false)
+}
+
+// ChangeEmailHandler sets a new, unverified email address and sends a verification link: POST /account/email
+func ChangeEmailHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := currentUserWithPassword(w, r, render)
+	if !ok {
+		return
+	}
+	email := strings.TrimSpace(r.FormValue("email"))
+	if email == "" || !strings.Contains(email, "@") {
+		accountResponse(w, r, render, http.StatusBadRequest, "Please enter a valid email address", true)
+		return
+	}
+	oldEmail := user.Email
+	if err := models.UpdateEmail(user.ID, email); err != nil {
+		accountResponse(w, r, render, http.StatusConflict, "That email address is already in use", true)
+		return
+	}
+	user.Email = email
+	models.DeleteUserTokens(user.ID, models.TokenPurposeVerifyEmail)
+	if err := sendVerificationEmail(user); err != nil {
+		logFor(r).Error("Failed to send verification email", "user_id", user.ID, "error", err)
+	}
+	// Let the previous address know, in case the change wasn't made by its owner
+	if err := Mailer.Send(mailer.Message{
+		To:      oldEmail,
+		Subject: "Your SimpleHost email address was changed",
+		Body:    fmt.Sprintf("Hi %s,\n\nThe email address on your account was changed to %s. If you didn't do this, reset your password right away.\n", user.Username, email),
+	}); err != nil {
+		logFor(r).Error("Failed to send email change notice", "user_id", user.ID, "error", err)
+	}
+	accountResponse(w, r, render, http.StatusOK, "Email updated. Check your inbox to verify the new address.", false)
+}
+
+// DeleteAccountHandler deletes the account after either purging or handing over its files: POST /account/delete
+// Form fields: current_password, mode ("purge" or "transfer") and transfer_to (a username, for transfer)
+func DeleteAccountHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := currentUserWithPassword(w, r, render)
+	if !ok {
+		return
+	}
+	switch r.FormValue("mode") {
+	case "purge":
+		if err := models.DeleteUserContent(user.ID); err != nil {
+			accountResponse(w, r, render, http.StatusInternalServerError, "Failed to delete your files", true)
+			return
+		}
+	case "transfer":
+		recipient, err := models.GetUserByUsername(strings.TrimSpace(r.FormValue("transfer_to")))
+		if err != nil || recipient.ID == user.ID {
+			accountResponse(w, r, render, http.StatusBadRequest, "Choose another existing user to receive your files", true)
+			return
+		}
+		if err := models.TransferUserContent(user.ID, recipient.ID); err != nil {
+			accountResponse(w, r, render, http.StatusInternalServerError, "Failed to transfer your files", true)
+			return
+		}
+	default:
+		accountResponse(w, r, render, http.StatusBadRequest, "Invalid mode", true)
+		return
+	}
+	abortS3Uploads(user.ID)
+	abortChunkedUploads(user.ID)
+	// Removing the user row also invalidates every outstanding session token
+	if err := models.DeleteUser(user.ID); err != nil {
+		accountResponse(w, r, render, http.StatusInternalServerError, "Failed to delete account", true)
+		return
+	}
+	logFor(r).Info("Deleted account", "user_id", user.ID, "username", user.Username)
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+		return
+	}
+	clearAuthCookie(w, r)
+	render(w, r, "login.html", map[string]any{"Error": template.HTML(`<span class='success'>Your account has been deleted.</span>`)})
+}
@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestPasswordCheckIsRateLimited(t *testing.T) {
+	c := setupServer(t)
+	user := createUser(t, "carol", true)
+	cookie := sessionCookie(t, user)
+	change := AuthMiddleware(func(w http.ResponseWriter, r *http.Request) { ChangePasswordHandler(w, r, renderStub) })
+	wrong := url.Values{"current_password": {"Wrong-000"}, "password": {"Changed-456"}, "retype": {"Changed-456"}}
+
+	free := c.RateLimits.LoginAccount.FreeAttempts
+	for i := 0; i <= free; i++ {
+		if w := postForm(change, "/account/password", wrong, cookie); w.Code != http.StatusForbidden {
+			t.Fatalf("wrong password %d: got status %d, want 403", i+1, w.Code)
+		}
+	}
+	// Past the free attempts, even the right password has to wait
+	right := url.Values{"current_password": {testPassword}, "password": {"Changed-456"}, "retype": {"Changed-456"}}
+	w := postForm(change, "/account/password", right, cookie)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("got status %d after %d wrong passwords, want 429 with Retry-After", w.Code, free+1)
+	}
+
+	// The login page shares the limit
+	login := func(w http.ResponseWriter, r *http.Request) { LoginHandler(w, r, renderStub) }
+	if w := postForm(login, "/login", url.Values{"username": {"carol"}, "password": {testPassword}}); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("login after wrong password checks: got status %d, want 429", w.Code)
+	}
+
+	loginAccountLimiter.Reset(accountKey(user.Username))
+	if w := postForm(change, "/account/password", right, cookie); w.Code != http.StatusOK {
+		t.Fatalf("right password: got status %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"net/http"
+
+	"simplehost-server/models"
+)
+
+// AdminMiddleware only lets authenticated admins through
+func AdminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		user, err := models.GetUserByID(GetUserIDFromRequest(r))
+		if err != nil || !user.IsAdmin() {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+func adminPageData(r *http.Request) map[string]any {
+	users, err := models.ListUsers()
+	if err != nil {
+		logFor(r).Error("Failed to list users", "error", err)
+	}
+	var pending []models.User
+	for _, u := range users {
+		if !u.Approved {
+			pending = append(pending, u)
+		}
+	}
+	invites, err := models.ListInviteCodes()
+	if err != nil {
+		logFor(r).Error("Failed to list invite codes", "error", err)
+	}
+	return map[string]any{
+		"Users":         users,
+		"PendingUsers":  pending,
+		"Invites":       invites,
+		"Registration":  RegistrationMode(),
+		"CurrentUserID": GetUserIDFromRequest(r),
+		"Require2FA":    models.GetBoolSetting(models.SettingRequire2FA, false),
+		"MagicLink":     MagicLinkEnabled(),
+	}
+}
+
+func renderAdmin(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any), status int, message string, isError bool) {
+	data := adminPageData(r)
+	if isError {
+		data["Error"] = message
+	} else if message != "" {
+		data["Message"] = message
+	}
+	w.WriteHeader(status)
+	render(w, r, "admin.html", data)
+}
+
+// AdminPageHandler renders the instance settings and user list: GET /admin
+func AdminPageHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	renderAdmin(w, r, render, http.StatusOK, "", false)
+}
+
+// AdminSettingsHandler saves instance-wide settings: POST /admin/settings
+func AdminSettingsHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if mode := r.FormValue("registration_mode"); mode != "" {
+		if !validRegistrationMode(mode) {
+			renderAdmin(w, r, render, http.StatusBadRequest, "Invalid registration mode", true)
+			return
+		}
+		if err := models.SetSetting(models.SettingRegistrationMode, mode); err != nil {
+			renderAdmin(w, r, render, http.StatusInternalServerError, "Failed to save settings", true)
+			return
+		}
+		logFor(r).Info("Changed setting", "admin_id", GetUserIDFromRequest(r), "key", models.SettingRegistrationMode, "value", mode)
+	}
+	// Checkbox form fields map onto boolean settings
+	for field, key := range map[string]string{
+		"require_2fa": models.SettingRequire2FA,
+		"magic_link":  models.SettingMagicLinkEnabled,
+	} {
+		value := "false"
+		if r.FormValue(field) != "" {
+			value = "true"
+		}
+		if err := models.SetSetting(key, value); err != nil {
+			renderAdmin(w, r, render, http.StatusInternalServerError, "Failed to save settings", true)
+			return
+		}
+		logFor(r).Info("Changed setting", "admin_id", GetUserIDFromRequest(r), "key", key, "value", value)
+	}
+	renderAdmin(w, r, render, http.StatusOK, "Settings saved.", false)
+}
+
+// AdminUserRoleHandler changes a user's role: POST /admin/users/role
+func AdminUserRoleHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.FormValue("user_id")
+	role := r.FormValue("role")
+	if role != models.RoleAdmin && role != models.RoleUser {
+		renderAdmin(w, r, render, http.StatusBadRequest, "Invalid role", true)
+		return
+	}
+	if userID == GetUserIDFromRequest(r) {
+		renderAdmin(w, r, render, http.StatusBadRequest, "You can't change your own role", true)
+		return
+	}
+	if err := models.SetUserRole(userID, role); err != nil {
+		renderAdmin(w, r, render, http.StatusInternalServerError, "Failed to update role", true)
+		return
+	}
+	logFor(r).Info("Changed user role", "admin_id", GetUserIDFromRequest(r), "user_id", userID, "role", role)
+	renderAdmin(w, r, render, http.StatusOK, "Role updated.", false)
+}
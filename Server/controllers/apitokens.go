@@ -0,0 +1,51 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+
+	"simplehost-server/models"
+)
+
+// CreateAPITokenHandler creates an app token for WebDAV and other clients and shows it
+// once: POST /account/tokens
+func CreateAPITokenHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || len(name) > 100 {
+		accountResponse(w, r, render, http.StatusBadRequest, "Please give the token a name of up to 100 characters", true)
+		return
+	}
+	userID := GetUserIDFromRequest(r)
+	token, err := models.CreateAPIToken(userID, name)
+	if err != nil {
+		logFor(r).Error("Failed to create app token", "user_id", userID, "error", err)
+		accountResponse(w, r, render, http.StatusInternalServerError, "Failed to create token", true)
+		return
+	}
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusCreated, map[string]string{"name": name, "token": token})
+		return
+	}
+	data := accountPageData(r)
+	data["NewToken"] = token
+	data["Message"] = "Token created. Copy it now, it won't be shown again."
+	w.WriteHeader(http.StatusCreated)
+	render(w, r, "account.html", data)
+}
+
+// DeleteAPITokenHandler revokes an app token: POST /account/tokens/delete
+func DeleteAPITokenHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := models.DeleteAPIToken(r.FormValue("token_id"), GetUserIDFromRequest(r)); err != nil {
+		accountResponse(w, r, render, http.StatusNotFound, "Token not found", true)
+		return
+	}
+	accountResponse(w, r, render, http.StatusOK, "Token revoked.", false)
+}
@@ -2,40 +2,33 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"html/template"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"simplehost-server/models"
+	"simplehost-server/passwords"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var jwtKey = []byte(getJWTSecret())
-
-func getJWTSecret() string {
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		return "dev_secret_key_change_me" // fallback for dev
-	}
-	return secret
-}
+// sessionTTL is how long a login token issued by GenerateJWT stays valid
+const sessionTTL = 24 * time.Hour
 
 func GenerateJWT(userId, username string) (string, error) {
-	claims := jwt.MapClaims{
+	return signToken(jwt.MapClaims{
 		"userId":   userId,
 		"username": username,
-		"exp":      time.Now().Add(24 * time.Hour).Unix(),
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtKey)
+		"iat":      time.Now().Unix(),
+		"exp":      time.Now().Add(sessionTTL).Unix(),
+	})
 }
 
 func ValidateJWT(tokenString string) (jwt.MapClaims, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
+	token, err := jwt.Parse(tokenString, verificationKey, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 	if err != nil || !token.Valid {
 		return nil, err
 	}
@@ -53,27 +46,44 @@ func LoginHandler(w http.ResponseWriter, r *http.Request, render func(http.Respo
 	}
 	username := r.FormValue("username")
 	password := r.FormValue("password")
-	if models.VerifyUser(username, password) {
-		user, err := models.GetUserByUsername(username)
-		if err != nil {
-			render(w, r, "login.html", map[string]any{"Error": "Server error"})
-			return
-		}
-		token, err := GenerateJWT(user.ID, username)
-		if err != nil {
-			render(w, r, "login.html", map[string]any{"Error": "Server error"})
-			return
-		}
-		cookie := &http.Cookie{
-			Name:     "jwt",
-			Value:    token,
-			Path:     "/",
-			HttpOnly: true,
-			SameSite: http.SameSiteLaxMode,
-		}
-		http.SetCookie(w, cookie)
-		http.Redirect(w, r, "/simplehost", http.StatusSeeOther)
+	ip := ClientIP(r)
+	account := accountKey(username)
+	if ok, wait := checkLoginLimits(ip, account); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		w.WriteHeader(http.StatusTooManyRequests)
+		render(w, r, "login.html", map[string]any{"Error": retryMessage(wait)})
+		return
+	}
+	if user, err := authenticate(username, password); err == nil {
+		recordLogin("password", true)
+		// Only the account's history is cleared, so signing in to an account of their own
+		// doesn't let someone wipe out the failures from their IP
+		loginIPLimiter.Release(ip)
+		loginAccountLimiter.Reset(account)
+		completeLogin(w, r, render, user)
+	} else if errors.Is(err, passwords.ErrBusy) {
+		// The password was never checked, so the attempt doesn't count
+		loginIPLimiter.Release(ip)
+		loginAccountLimiter.Release(account)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		render(w, r, "login.html", map[string]any{"Error": serverBusyMessage})
+	} else if errors.Is(err, errIdentityNotLinked) {
+		// The directory accepted the password, so this isn't a failed attempt
+		loginIPLimiter.Release(ip)
+		loginAccountLimiter.Reset(account)
+		w.WriteHeader(http.StatusForbidden)
+		render(w, r, "login.html", map[string]any{"Error": "An account with your directory email address already exists. Log in to it and link your directory account from the account page."})
+	} else if errors.Is(err, errSignUpClosed) {
+		loginIPLimiter.Release(ip)
+		loginAccountLimiter.Reset(account)
+		w.WriteHeader(http.StatusForbidden)
+		render(w, r, "login.html", map[string]any{"Error": "No account is linked to your directory account, and new accounts can't be created with it. Log in and link your directory account from the account page, or ask an admin."})
 	} else {
+		recordLogin("password", false)
+		loginIPLimiter.Fail(ip)
+		loginAccountLimiter.Fail(account)
+		logFor(r).Warn("Failed login", "username", username, "ip", ip)
 		render(w, r, "login.html", map[string]any{"Error": "Invalid username or password"})
 	}
 }
@@ -83,10 +93,29 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request, render func(http.Re
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	ip := ClientIP(r)
+	if ok, wait := registerIPLimiter.Allow(ip); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		w.WriteHeader(http.StatusTooManyRequests)
+		render(w, r, "register.html", map[string]any{"Error": retryMessage(wait)})
+		return
+	}
+	// Every registration attempt counts, successful or not, since each one costs a password hash
+	registerIPLimiter.Fail(ip)
 	email := r.FormValue("email")
 	username := r.FormValue("username")
 	password := r.FormValue("password")
 	retype := r.FormValue("retype")
+	mode, err := newAccountMode()
+	if err != nil {
+		render(w, r, "register.html", map[string]any{"Error": "Server error"})
+		return
+	}
+	if mode == models.RegistrationClosed {
+		w.WriteHeader(http.StatusForbidden)
+		render(w, r, "register.html", map[string]any{"Error": "Registration is closed."})
+		return
+	}
 	if password != retype {
 		render(w, r, "register.html", map[string]any{"Error": "Passwords do not match"})
 		return
@@ -95,11 +124,44 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request, render func(http.Re
 		render(w, r, "register.html", map[string]any{"Error": "Password must be at least 8 characters and include uppercase, lowercase, number, and special character."})
 		return
 	}
-	if err := models.CreateUser(username, email, password); err != nil {
+	inviteID := ""
+	if mode == models.RegistrationInvite {
+		id, err := models.RedeemInviteCode(r.FormValue("invite_code"))
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			render(w, r, "register.html", map[string]any{"Error": "That invite code is invalid, expired or used up."})
+			return
+		}
+		inviteID = id
+	}
+	// CreateUser approves the first account itself, so one that loses a race to be first
+	// still waits for approval
+	user, err := models.CreateUser(username, email, password, RegistrationMode() != models.RegistrationApproval)
+	if err != nil {
+		if inviteID != "" {
+			models.ReleaseInviteCode(inviteID)
+		}
+		if errors.Is(err, passwords.ErrBusy) {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			render(w, r, "register.html", map[string]any{"Error": serverBusyMessage})
+			return
+		}
 		render(w, r, "register.html", map[string]any{"Error": "Username or email already exists."})
 		return
 	}
-	render(w, r, "login.html", map[string]any{"Error": template.HTML(`<span class='success'>Account created! Please log in.</span>`)})
+	if inviteID != "" {
+		logFor(r).Info("Registered with invite code", "user_id", user.ID, "invite_id", inviteID)
+	}
+	if err := sendVerificationEmail(user); err != nil {
+		logFor(r).Error("Failed to send verification email", "user_id", user.ID, "error", err)
+	}
+	if !user.Approved {
+		notifyAdminsOfPendingUser(user)
+		render(w, r, "login.html", map[string]any{"Error": template.HTML(`<span class='success'>Account created! Check your email to verify your address. You can log in once an admin approves your account.</span>`)})
+		return
+	}
+	render(w, r, "login.html", map[string]any{"Error": template.HTML(`<span class='success'>Account created! Check your email for a link to verify your address, then log in.</span>`)})
 }
 
 func validatePassword(pw string) bool {
@@ -128,7 +190,7 @@ func validatePassword(pw string) bool {
 func SuccessPageHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
 	claims, err := getUserClaims(r)
 	if err != nil {
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		http.Redirect(w, r, AppPath("/login"), http.StatusSeeOther)
 		return
 	}
 	data := map[string]any{"Username": claims["username"], "Message": ""}
@@ -136,15 +198,7 @@ func SuccessPageHandler(w http.ResponseWriter, r *http.Request, render func(http
 }
 
 func LogoutHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
-	cookie := &http.Cookie{
-		Name:     "jwt",
-		Value:    "",
-		Path:     "/",
-		HttpOnly: true,
-		MaxAge:   -1,
-		SameSite: http.SameSiteLaxMode,
-	}
-	http.SetCookie(w, cookie)
+	clearAuthCookie(w, r)
 	render(w, r, "login.html", map[string]any{"Error": template.HTML(`<span class='success'>Logged out.</span>`)})
 }
 
@@ -153,26 +207,91 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		uc, err := getUserClaims(r)
 		if err != nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			// API clients can't follow a redirect to the login page
+			if hasBearerToken(r) {
+				http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+				return
+			}
+			http.Redirect(w, r, AppPath("/login"), http.StatusSeeOther)
 			return
 		}
+		if userID, ok := uc["userId"].(string); ok {
+			setRequestUser(r, userID)
+		}
 		ctx := context.WithValue(r.Context(), "claims", uc)
 		next(w, r.WithContext(ctx))
 	}
 }
 
 func getUserClaims(r *http.Request) (map[string]any, error) {
+	// API clients authenticate with a bearer token instead of the cookie: either a
+	// session token or an app token. App tokens only reach the file API, so a leaked one
+	// can't be used to change account settings or mint more tokens.
+	if hasBearerToken(r) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if strings.HasPrefix(token, models.APITokenPrefix) {
+			if !strings.HasPrefix(r.URL.Path, "/api/") {
+				return nil, models.ErrInvalidToken
+			}
+			return appTokenClaims(token)
+		}
+		return validateSession(token)
+	}
 	cookie, err := r.Cookie("jwt")
 	if err != nil {
 		return nil, err
 	}
-	claims, err := ValidateJWT(cookie.Value)
+	return validateSession(cookie.Value)
+}
+
+var (
+	errSessionRevoked = errors.New("session has been revoked")
+	errNotApproved    = errors.New("account is waiting for approval")
+)
+
+// validateSession checks the token and that its user still exists and hasn't revoked it
+func validateSession(tokenString string) (map[string]any, error) {
+	claims, err := ValidateJWT(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	// Purpose-bound tokens, like the pending 2FA token, must never work as a session
+	if _, ok := claims["purpose"]; ok {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+	userID, _ := claims["userId"].(string)
+	user, err := models.GetUserByID(userID)
 	if err != nil {
 		return nil, err
 	}
+	if !user.Approved {
+		return nil, errNotApproved
+	}
+	iat, _ := claims["iat"].(float64)
+	if int64(iat) < user.SessionsRevokedAt {
+		return nil, errSessionRevoked
+	}
 	return claims, nil
 }
 
+// appTokenClaims returns session-like claims for the user an app token belongs to
+func appTokenClaims(token string) (map[string]any, error) {
+	userID, err := models.LookupAPIToken(token)
+	if err != nil {
+		recordLogin("app_token", false)
+		return nil, err
+	}
+	user, err := models.GetUserByID(userID)
+	if err == nil {
+		err = clientAccountError(user)
+	}
+	recordLogin("app_token", err == nil)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"userId": user.ID, "username": user.Username}, nil
+}
+
 func GetUserIDFromRequest(r *http.Request) string {
 	claims, _ := r.Context().Value("claims").(map[string]any)
 	userID := ""
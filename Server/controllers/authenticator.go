@@ -0,0 +1,193 @@
+package controllers
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+
+	"simplehost-server/models"
+	"simplehost-server/passwords"
+)
+
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// serverBusyMessage is shown when passwords.ErrBusy kept a password from being checked
+const serverBusyMessage = "The server is busy, please try again in a moment."
+
+// Authenticator checks a username and password against one credential store. It returns
+// ErrInvalidCredentials when the credentials are wrong and any other error when the store
+// itself couldn't be reached.
+type Authenticator interface {
+	Name() string
+	Authenticate(username, password string) (*models.User, error)
+}
+
+// localAuthenticator checks the password hash stored in the users table
+type localAuthenticator struct{}
+
+func (localAuthenticator) Name() string { return "local" }
+
+func (localAuthenticator) Authenticate(username, password string) (*models.User, error) {
+	ok, err := models.VerifyUser(username, password)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return models.GetUserByUsername(username)
+}
+
+var authenticators []Authenticator
+
+// loadAuthenticators builds the chain from auth.backends (e.g. [local, ldap]). By default the
+// local store is used, followed by LDAP when ldap.url is set.
+func loadAuthenticators(backends []string) []Authenticator {
+	if len(backends) == 0 {
+		backends = []string{"local"}
+		if ldapConfig.URL != "" {
+			backends = append(backends, "ldap")
+		}
+	}
+	var chain []Authenticator
+	for _, name := range backends {
+		switch strings.TrimSpace(name) {
+		case "local":
+			chain = append(chain, localAuthenticator{})
+		case "ldap":
+			chain = append(chain, &ldapAuthenticator{config: ldapConfig})
+		case "":
+		default:
+			slog.Warn("Ignoring unknown authentication backend", "backend", name)
+		}
+	}
+	return chain
+}
+
+// authenticate tries each configured backend in order and returns the first match. A
+// backend that checked the password but whose identity has to be linked first returns
+// errIdentityNotLinked, or errSignUpClosed when it may not create an account for it, and
+// one that is too busy to check it returns passwords.ErrBusy. Any of these ends the search.
+func authenticate(username, password string) (*models.User, error) {
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	for _, a := range authenticators {
+		user, err := a.Authenticate(username, password)
+		if err == nil {
+			return user, nil
+		}
+		if errors.Is(err, errIdentityNotLinked) || errors.Is(err, errSignUpClosed) || errors.Is(err, passwords.ErrBusy) {
+			return nil, err
+		}
+		if !errors.Is(err, ErrInvalidCredentials) {
+			slog.Error("Authentication backend failed", "backend", a.Name(), "error", err)
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// externalIdentity is a user as an identity provider describes them
+type externalIdentity struct {
+	Provider string
+	Subject  string
+	Username string
+	Email    string
+	// EmailVerified is set when the provider vouches that the user owns Email
+	EmailVerified bool
+	// Role is the role the user's groups map to, used when SyncRole is set
+	Role     string
+	SyncRole bool
+}
+
+var (
+	// errIdentityNotLinked is returned for a new identity whose email belongs to an existing
+	// account, which its owner has to link from the account page
+	errIdentityNotLinked = errors.New("an account with this email address already exists")
+	// errSignUpClosed is returned for a new identity when the registration mode doesn't let
+	// it create an account
+	errSignUpClosed = errors.New("registration is not open")
+)
+
+// provisionExternalUser finds the account linked to an identity at an external provider,
+// creating it on first sign-in as the registration mode allows, and syncs its role when
+// the provider manages roles. Identities are never attached to an existing account by email,
+// since whoever can edit their profile at the provider could then claim any account.
+func provisionExternalUser(id externalIdentity, mode string) (*models.User, error) {
+	user, provisioned, err := models.GetUserByIdentity(id.Provider, id.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		if id.Email != "" {
+			if _, err := models.GetUserByEmail(id.Email); err == nil {
+				return nil, errIdentityNotLinked
+			}
+		}
+		if mode != models.RegistrationOpen && mode != models.RegistrationApproval {
+			return nil, errSignUpClosed
+		}
+		username, email := id.Username, id.Email
+		if username == "" {
+			username, _, _ = strings.Cut(email, "@")
+		}
+		if username == "" {
+			username = id.Subject
+		}
+		if email == "" {
+			email = id.Subject + "@" + id.Provider
+		}
+		role := models.RoleUser
+		if id.SyncRole {
+			role = id.Role
+		}
+		user, err = models.CreateExternalUser(username, email, id.EmailVerified, mode != models.RegistrationApproval, role)
+		if err != nil {
+			return nil, err
+		}
+		if err := models.LinkIdentity(id.Provider, id.Subject, user.ID, true); err != nil {
+			return nil, err
+		}
+		slog.Info("Provisioned user", "user_id", user.ID, "username", user.Username, "provider", id.Provider, "approved", user.Approved)
+		if !user.Approved {
+			notifyAdminsOfPendingUser(user)
+		}
+		return user, nil
+	}
+	// Group roles only apply to accounts the provider created. An account its owner linked
+	// keeps the role it has in SimpleHost.
+	if id.SyncRole && provisioned && user.Role != id.Role {
+		if err := models.SetUserRole(user.ID, id.Role); err != nil {
+			return nil, err
+		}
+		slog.Info("Synced user role from groups", "user_id", user.ID, "role", id.Role, "provider", id.Provider)
+		user.Role = id.Role
+	}
+	if id.EmailVerified && !user.EmailVerified && strings.EqualFold(user.Email, id.Email) {
+		models.SetEmailVerified(user.ID, true)
+		user.EmailVerified = true
+	}
+	return user, nil
+}
+
+// linkExternalIdentity attaches an identity to the signed in user's account
+func linkExternalIdentity(userID, provider, subject string) error {
+	linked, _, err := models.GetUserByIdentity(provider, subject)
+	if err != nil {
+		return err
+	}
+	if linked != nil {
+		if linked.ID == userID {
+			return nil
+		}
+		return errIdentityLinkedElsewhere
+	}
+	if err := models.LinkIdentity(provider, subject, userID, false); err != nil {
+		return err
+	}
+	slog.Info("Linked identity", "user_id", userID, "provider", provider)
+	return nil
+}
+
+// errIdentityLinkedElsewhere is returned when linking an identity that already belongs to another account
+var errIdentityLinkedElsewhere = errors.New("this sign-in is already linked to another account")
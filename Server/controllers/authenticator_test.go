@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"simplehost-server/models"
+)
+
+func TestDirectoryIdentityNeverLinksByEmail(t *testing.T) {
+	setupServer(t)
+	admin := createUser(t, "admin", true)
+	id := externalIdentity{Provider: "ldap", Subject: "uid-1", Username: "mallory", Email: admin.Email, Role: models.RoleUser, SyncRole: true}
+
+	// Whoever can set their mail attribute to the admin's address mustn't get the admin account
+	if _, err := provisionExternalUser(id, models.RegistrationOpen); !errors.Is(err, errIdentityNotLinked) {
+		t.Fatalf("provisioning an identity with an existing account's email: %v, want errIdentityNotLinked", err)
+	}
+	if linked, _, _ := models.GetUserByIdentity("ldap", "uid-1"); linked != nil {
+		t.Fatal("the identity was linked to the existing account")
+	}
+
+	// Once the admin links it, signing in doesn't apply the directory's role to the account
+	if err := linkExternalIdentity(admin.ID, "ldap", "uid-1"); err != nil {
+		t.Fatal(err)
+	}
+	user, err := provisionExternalUser(id, models.RegistrationOpen)
+	if err != nil || user.ID != admin.ID {
+		t.Fatalf("signing in after linking: %+v, %v", user, err)
+	}
+	if stored, _ := models.GetUserByID(admin.ID); stored.Role != models.RoleAdmin {
+		t.Fatal("the linked account's role was changed by group sync")
+	}
+}
+
+func TestDirectoryAccountsAreProvisionedUnverified(t *testing.T) {
+	setupServer(t)
+	createUser(t, "admin", true)
+	user, err := provisionExternalUser(externalIdentity{Provider: "ldap", Subject: "uid-2", Username: "judy", Email: "judy@example.com"}, models.RegistrationOpen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.EmailVerified {
+		t.Fatal("the directory's email address was treated as verified")
+	}
+	// The directory vouches for the user, so they can still log in
+	if !models.IsProvisionedUser(user.ID) || clientAccountError(user) != nil {
+		t.Fatal("a directory account can't log in until it verifies its email")
+	}
+}
+
+// fakeDirectory stands in for the LDAP backend, accepting one password for each identity
+type fakeDirectory map[string]externalIdentity
+
+func (fakeDirectory) Name() string { return "ldap" }
+
+func (d fakeDirectory) Authenticate(username, password string) (*models.User, error) {
+	id, ok := d[username]
+	if !ok || password != testPassword {
+		return nil, ErrInvalidCredentials
+	}
+	return provisionDirectoryUser(id)
+}
+
+func TestDirectorySignUpFollowsRegistrationMode(t *testing.T) {
+	setupServer(t)
+	createUser(t, "admin", true)
+	directory := fakeDirectory{}
+	saved := authenticators
+	authenticators = []Authenticator{localAuthenticator{}, directory}
+	t.Cleanup(func() { authenticators = saved })
+	login := func(w http.ResponseWriter, r *http.Request) { LoginHandler(w, r, renderStub) }
+
+	for _, mode := range []string{models.RegistrationClosed, models.RegistrationInvite} {
+		models.SetSetting(models.SettingRegistrationMode, mode)
+		directory[mode] = externalIdentity{Provider: "ldap", Subject: "uid-" + mode, Username: mode, Email: mode + "@example.com"}
+		w := postForm(login, "/login", url.Values{"username": {mode}, "password": {testPassword}})
+		if sessionUser(t, w) != nil || w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "can't be created") {
+			t.Fatalf("%s registration: got status %d, %s", mode, w.Code, w.Body.String())
+		}
+		if count, _ := models.CountUsers(); count != 1 {
+			t.Fatalf("%s registration: %d accounts, want 1", mode, count)
+		}
+	}
+
+	models.SetSetting(models.SettingRegistrationMode, models.RegistrationApproval)
+	directory["grace"] = externalIdentity{Provider: "ldap", Subject: "uid-grace", Username: "grace", Email: "grace@example.com"}
+	w := postForm(login, "/login", url.Values{"username": {"grace"}, "password": {testPassword}})
+	if sessionUser(t, w) != nil || !strings.Contains(w.Body.String(), "waiting for an admin") {
+		t.Fatalf("approval registration: got status %d, %s", w.Code, w.Body.String())
+	}
+	pending, _, err := models.GetUserByIdentity("ldap", "uid-grace")
+	if err != nil || pending == nil || pending.Approved {
+		t.Fatalf("approval registration: account %+v, %v; want one waiting for approval", pending, err)
+	}
+}
@@ -0,0 +1,32 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+)
+
+// AppPath prefixes an absolute path within the app with server.base_path, for redirects
+// and links. Routes themselves are registered without the prefix.
+func AppPath(path string) string {
+	return appConfig.Server.BasePath + path
+}
+
+// BasePathMiddleware strips server.base_path from incoming requests so the router sees the
+// same paths with or without a prefix. Requests outside the prefix get a 404.
+func BasePathMiddleware(next http.Handler) http.Handler {
+	base := appConfig.Server.BasePath
+	if base == "" {
+		return next
+	}
+	stripped := http.StripPrefix(base, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == base:
+			http.Redirect(w, r, base+"/", http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, base+"/"):
+			stripped.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
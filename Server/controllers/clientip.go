@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a list of IPs and CIDR ranges
+func parseTrustedProxies(list []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, part := range list {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			if strings.Contains(part, ":") {
+				part += "/128"
+			} else {
+				part += "/32"
+			}
+		}
+		if _, ipNet, err := net.ParseCIDR(part); err == nil {
+			nets = append(nets, ipNet)
+		}
+	}
+	return nets
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that made the request. X-Forwarded-For is only
+// honored when the direct peer is a trusted proxy, and the rightmost untrusted hop wins so
+// clients can't spoof their address by sending the header themselves.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil || !isTrustedProxy(peer) {
+		return host
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			continue
+		}
+		if !isTrustedProxy(ip) {
+			return hop
+		}
+		host = hop
+	}
+	return host
+}
+
+// isHTTPS reports whether the browser reached the server over HTTPS, either directly or
+// through a trusted proxy that says so in X-Forwarded-Proto
+func isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil || !isTrustedProxy(peer) {
+		return false
+	}
+	// With several proxies the header may be a list; the first entry is the client's scheme
+	proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
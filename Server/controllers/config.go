@@ -0,0 +1,24 @@
+package controllers
+
+import "simplehost-server/config"
+
+// appConfig is the server configuration, set once at startup by Configure
+var appConfig = config.Default()
+
+// Configure applies the loaded configuration. It must run before any handler is served,
+// since the rate limiters and authenticator chain are built from it.
+func Configure(c *config.Config) {
+	appConfig = c
+	trustedProxies = parseTrustedProxies(c.Server.TrustedProxies)
+	oidcConfig = loadOIDCSettings(c.OIDC)
+	ldapConfig = loadLDAPSettings(c.LDAP)
+	authenticators = loadAuthenticators(c.Auth.Backends)
+
+	limits := c.RateLimits
+	loginAccountLimiter = NewRateLimiter("login-account", limits.LoginAccount)
+	loginIPLimiter = NewRateLimiter("login-ip", limits.LoginIP)
+	registerIPLimiter = NewRateLimiter("register-ip", limits.RegisterIP)
+	mfaLimiter = NewRateLimiter("login-2fa", limits.Login2FA)
+	passwordResetIPLimiter = NewRateLimiter("password-reset-ip", limits.PasswordResetIP)
+	magicLinkIPLimiter = NewRateLimiter("magic-link-ip", limits.MagicLinkIP)
+}
@@ -0,0 +1,32 @@
+package controllers
+
+import "net/http"
+
+// setCookie sets c, marking it Secure when the request came in over HTTPS and scoping its
+// path to the base path. Every cookie the server sets goes through here so none of them
+// leak over plain HTTP or to other apps on the same host.
+func setCookie(w http.ResponseWriter, r *http.Request, c *http.Cookie) {
+	c.Secure = isHTTPS(r)
+	c.Path = AppPath(c.Path)
+	http.SetCookie(w, c)
+}
+
+// clearCookie expires a cookie set by setCookie. Path must match the one it was set with.
+func clearCookie(w http.ResponseWriter, r *http.Request, name, path string, sameSite http.SameSite) {
+	setCookie(w, r, &http.Cookie{Name: name, Value: "", Path: path, HttpOnly: true, MaxAge: -1, SameSite: sameSite})
+}
+
+// setAuthCookie stores a session token issued by GenerateJWT in the browser
+func setAuthCookie(w http.ResponseWriter, r *http.Request, token string) {
+	setCookie(w, r, &http.Cookie{
+		Name:     "jwt",
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearAuthCookie(w http.ResponseWriter, r *http.Request) {
+	clearCookie(w, r, "jwt", "/", http.SameSiteLaxMode)
+}
@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	setupServer(t)
+	handler := CSRFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(GetCSRFToken(r)))
+	}))
+	send := func(method string, form url.Values, headers map[string]string, cookie string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/account/password", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: cookie})
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// A page load hands out the token in a cookie and to the page
+	w := send(http.MethodGet, nil, nil, "")
+	var token string
+	for _, c := range w.Result().Cookies() {
+		if c.Name == csrfCookieName {
+			token = c.Value
+		}
+	}
+	if w.Code != http.StatusOK || token == "" || w.Body.String() != token {
+		t.Fatalf("GET: %d, cookie %q, page token %q", w.Code, token, w.Body)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		method  string
+		form    url.Values
+		headers map[string]string
+		cookie  string
+		want    int
+	}{
+		{"no token", http.MethodPost, nil, nil, token, http.StatusForbidden},
+		{"no cookie", http.MethodPost, nil, map[string]string{csrfHeaderName: token}, "", http.StatusForbidden},
+		{"wrong header", http.MethodPost, nil, map[string]string{csrfHeaderName: "forged"}, token, http.StatusForbidden},
+		{"wrong form field", http.MethodPost, url.Values{csrfFormField: {"forged"}}, nil, token, http.StatusForbidden},
+		{"delete without token", http.MethodDelete, nil, nil, token, http.StatusForbidden},
+		{"matching header", http.MethodPost, nil, map[string]string{csrfHeaderName: token}, token, http.StatusOK},
+		{"matching form field", http.MethodPost, url.Values{csrfFormField: {token}}, nil, token, http.StatusOK},
+		{"bearer token", http.MethodPost, nil, map[string]string{"Authorization": "Bearer sht_abc"}, "", http.StatusOK},
+	} {
+		if w := send(tc.method, tc.form, tc.headers, tc.cookie); w.Code != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+}
@@ -22,6 +22,7 @@ func DeleteFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err := models.DeleteFileByID(fileID, userID); err != nil {
+		logFor(r).Error("Failed to delete file", "file_id", fileID, "error", err)
 		http.Error(w, "Failed to delete file", http.StatusInternalServerError)
 		return
 	}
@@ -61,16 +62,19 @@ func DeleteFolderHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if err := models.MoveFilesToParent(req.FolderID, parentID); err != nil {
+			logFor(r).Error("Failed to move files", "folder_id", req.FolderID, "error", err)
 			http.Error(w, "Failed to move files", http.StatusInternalServerError)
 			return
 		}
 
 		if err := models.MoveFoldersToParent(req.FolderID, parentID); err != nil {
+			logFor(r).Error("Failed to move subfolders", "folder_id", req.FolderID, "error", err)
 			http.Error(w, "Failed to move subfolders", http.StatusInternalServerError)
 			return
 		}
 
 		if err := models.DeleteFolderByID(req.FolderID, userID); err != nil {
+			logFor(r).Error("Failed to delete folder", "folder_id", req.FolderID, "error", err)
 			http.Error(w, "Failed to delete folder", http.StatusInternalServerError)
 			return
 		}
@@ -78,12 +82,14 @@ func DeleteFolderHandler(w http.ResponseWriter, r *http.Request) {
 		// Delete all files recursively, then delete folder
 		files, folders, err := models.GetAllFilesInFolderRecursive(req.FolderID)
 		if err != nil {
+			logFor(r).Error("Failed to get files", "folder_id", req.FolderID, "error", err)
 			http.Error(w, "Failed to get files", http.StatusInternalServerError)
 			return
 		}
 		for _, f := range files {
 			err = models.DeleteFileByID(f.ID, userID)
 			if err != nil {
+				logFor(r).Error("Failed to delete file", "file_id", f.ID, "error", err)
 				http.Error(w, "Failed to delete file", http.StatusInternalServerError)
 				return
 			}
@@ -91,12 +97,14 @@ func DeleteFolderHandler(w http.ResponseWriter, r *http.Request) {
 		for _, f := range folders {
 			err = models.DeleteFolderByID(f.ID, userID)
 			if err != nil {
+				logFor(r).Error("Failed to delete folder", "folder_id", f.ID, "error", err)
 				http.Error(w, "Failed to delete folder", http.StatusInternalServerError)
 				return
 			}
 		}
 
 		if err := models.DeleteFolderByID(req.FolderID, userID); err != nil {
+			logFor(r).Error("Failed to delete folder", "folder_id", req.FolderID, "error", err)
 			http.Error(w, "Failed to delete folder", http.StatusInternalServerError)
 			return
 		}
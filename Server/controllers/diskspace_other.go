@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package controllers
+
+import "errors"
+
+// freeDiskSpace isn't implemented here, so /readyz skips the disk check
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
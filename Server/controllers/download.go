@@ -3,9 +3,8 @@ package controllers
 import (
 	"io"
 	"net/http"
-	"os"
-	"path/filepath"
 	"simplehost-server/models"
+	"simplehost-server/storage"
 )
 
 // DownloadHandler serves a file by fileId as a download
@@ -31,17 +30,20 @@ func DownloadHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Unauthorized", http.StatusForbidden)
 		return
 	}
-	f, err := os.Open(filepath.Clean(file.StoragePath))
+	f, err := models.Blobs.Get(r.Context(), file.StorageKey, 0, -1)
 	if err != nil {
+		logFor(r).Error("Could not open file", "file_id", file.ID, "error", err)
 		http.Error(w, "Could not open file", http.StatusInternalServerError)
 		return
 	}
 	defer f.Close()
+	defer trackTransfer("download", file.Name, userID).done()
 	w.Header().Set("Content-Disposition", "attachment; filename=\""+file.Name+"\"")
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Content-Transfer-Encoding", "binary")
 	w.Header().Set("Expires", "0")
-	io.Copy(w, f)
+	n, _ := io.Copy(w, f)
+	transferBytes.Add(float64(n), "download")
 }
 
 func PreviewHandler(w http.ResponseWriter, r *http.Request) {
@@ -66,12 +68,16 @@ func PreviewHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Unauthorized", http.StatusForbidden)
 		return
 	}
-	f, err := os.Open(filepath.Clean(file.StoragePath))
+	info, err := models.Blobs.Stat(r.Context(), file.StorageKey)
 	if err != nil {
+		logFor(r).Error("Could not open file", "file_id", file.ID, "error", err)
 		http.Error(w, "Could not open file", http.StatusInternalServerError)
 		return
 	}
+	// Seeking lets ServeContent answer Range requests with ranged reads from storage
+	f := storage.NewReadSeeker(r.Context(), models.Blobs, file.StorageKey, info.Size)
 	defer f.Close()
+	defer trackTransfer("preview", file.Name, userID).done()
 	w.Header().Set("Content-Disposition", "attachment; filename=\""+file.Name+"\"")
 	w.Header().Set("Content-Type", "application/octet-stream")
 	http.ServeContent(w, r, file.Name, file.UploadedDate, f)
@@ -0,0 +1,190 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"simplehost-server/mailer"
+	"simplehost-server/models"
+	"simplehost-server/passwords"
+)
+
+var Mailer mailer.Mailer
+
+func SetMailer(m mailer.Mailer) {
+	Mailer = m
+}
+
+var passwordResetIPLimiter *RateLimiter
+
+// publicURL builds an absolute link for emails from the configured public URL
+func publicURL(path string, query url.Values) string {
+	link := strings.TrimSuffix(appConfig.Server.PublicURL, "/") + AppPath(path)
+	if len(query) > 0 {
+		link += "?" + query.Encode()
+	}
+	return link
+}
+
+func sendVerificationEmail(user *models.User) error {
+	emailVerifyTTL := appConfig.Auth.EmailVerifyTTL
+	token, err := models.CreateUserToken(user.ID, models.TokenPurposeVerifyEmail, emailVerifyTTL)
+	if err != nil {
+		return err
+	}
+	link := publicURL("/verify-email", url.Values{"token": {token}})
+	return Mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your SimpleHost email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening this link:\n\n%s\n\nThe link expires in %s.\n",
+			user.Username, link, emailVerifyTTL),
+	})
+}
+
+// emailResendInterval is how long an account waits before it is sent another link of the
+// same kind, so logging in or asking for links over and over, even from many IPs, can't
+// flood the inbox
+const emailResendInterval = 5 * time.Minute
+
+// sentRecently reports whether a link of the given purpose went out to the user within
+// emailResendInterval and is still unused
+func sentRecently(user *models.User, purpose string) (bool, error) {
+	return models.UserTokenSentSince(user.ID, purpose, time.Now().Add(-emailResendInterval))
+}
+
+// resendVerificationEmail sends a new verification link unless one went out recently
+func resendVerificationEmail(user *models.User) error {
+	if sent, err := sentRecently(user, models.TokenPurposeVerifyEmail); err != nil || sent {
+		return err
+	}
+	return sendVerificationEmail(user)
+}
+
+// sendPasswordResetEmail emails a reset link unless one went out recently, in which case
+// that one still works
+func sendPasswordResetEmail(user *models.User) error {
+	if sent, err := sentRecently(user, models.TokenPurposePasswordReset); err != nil || sent {
+		return err
+	}
+	// Only the most recent reset link should work
+	if err := models.DeleteUserTokens(user.ID, models.TokenPurposePasswordReset); err != nil {
+		return err
+	}
+	passwordResetTTL := appConfig.Auth.PasswordResetTTL
+	token, err := models.CreateUserToken(user.ID, models.TokenPurposePasswordReset, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+	link := publicURL("/reset-password", url.Values{"token": {token}})
+	return Mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your SimpleHost password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for your account. If it was you, open this link:\n\n%s\n\nThe link can be used once and expires in %s. If you didn't ask for this you can ignore this email.\n",
+			user.Username, link, passwordResetTTL),
+	})
+}
+
+// VerifyEmailHandler handles the link sent by sendVerificationEmail: GET /verify-email?token=...
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	userID, err := models.ConsumeUserToken(r.URL.Query().Get("token"), models.TokenPurposeVerifyEmail)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		render(w, r, "login.html", map[string]any{"Error": "This verification link is invalid or has expired. Log in to get a new one."})
+		return
+	}
+	if err := models.SetEmailVerified(userID, true); err != nil {
+		render(w, r, "login.html", map[string]any{"Error": "Server error"})
+		return
+	}
+	models.DeleteUserTokens(userID, models.TokenPurposeVerifyEmail)
+	render(w, r, "login.html", map[string]any{"Error": template.HTML(`<span class='success'>Email verified! Please log in.</span>`)})
+}
+
+// ForgotPasswordHandler shows the reset request form and emails a reset link.
+// The response is the same whether or not the address exists so accounts can't be enumerated.
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if r.Method == http.MethodGet {
+		render(w, r, "forgot_password.html", nil)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ip := ClientIP(r)
+	if ok, wait := passwordResetIPLimiter.Allow(ip); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		w.WriteHeader(http.StatusTooManyRequests)
+		render(w, r, "forgot_password.html", map[string]any{"Error": retryMessage(wait)})
+		return
+	}
+	passwordResetIPLimiter.Fail(ip)
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	if user, err := models.GetUserByEmail(email); err == nil {
+		if err := sendPasswordResetEmail(user); err != nil {
+			logFor(r).Error("Failed to send password reset email", "user_id", user.ID, "error", err)
+		}
+	}
+	render(w, r, "forgot_password.html", map[string]any{
+		"Message": "If an account uses that email address, a password reset link is on its way.",
+	})
+}
+
+// ResetPasswordHandler shows the new password form for a reset link and applies it
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	token := r.FormValue("token")
+	if r.Method == http.MethodGet {
+		if _, err := models.LookupUserToken(token, models.TokenPurposePasswordReset); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			render(w, r, "forgot_password.html", map[string]any{"Error": "This reset link is invalid or has expired."})
+			return
+		}
+		render(w, r, "reset_password.html", map[string]any{"Token": token})
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	password := r.FormValue("password")
+	if password != r.FormValue("retype") {
+		render(w, r, "reset_password.html", map[string]any{"Token": token, "Error": "Passwords do not match"})
+		return
+	}
+	if !validatePassword(password) {
+		render(w, r, "reset_password.html", map[string]any{"Token": token, "Error": "Password must be at least 8 characters and include uppercase, lowercase, number, and special character."})
+		return
+	}
+	userID, err := models.LookupUserToken(token, models.TokenPurposePasswordReset)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		render(w, r, "forgot_password.html", map[string]any{"Error": "This reset link is invalid or has expired."})
+		return
+	}
+	if err := models.UpdatePassword(userID, password); err != nil {
+		if errors.Is(err, passwords.ErrBusy) {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			render(w, r, "reset_password.html", map[string]any{"Token": token, "Error": serverBusyMessage})
+			return
+		}
+		render(w, r, "reset_password.html", map[string]any{"Token": token, "Error": "Server error"})
+		return
+	}
+	// The link is only used up once the new password is saved, so a busy server doesn't
+	// cost the user their link
+	models.DeleteUserTokens(userID, models.TokenPurposePasswordReset)
+	// Whoever knew the old password shouldn't stay logged in
+	models.RevokeSessions(userID)
+	forgetDAVCredentials(userID)
+	// Receiving the reset email proves the address belongs to the user
+	models.SetEmailVerified(userID, true)
+	render(w, r, "login.html", map[string]any{"Error": template.HTML(`<span class='success'>Password updated! Please log in.</span>`)})
+}
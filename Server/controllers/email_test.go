@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"simplehost-server/models"
+)
+
+func TestUnverifiedLoginThrottlesVerificationEmail(t *testing.T) {
+	setupServer(t)
+	user := createUser(t, "alice", false)
+	login := func(w http.ResponseWriter, r *http.Request) { LoginHandler(w, r, renderStub) }
+	form := url.Values{"username": {"alice"}, "password": {testPassword}}
+
+	for i := 0; i < 3; i++ {
+		w := postForm(login, "/login", form)
+		if !strings.Contains(w.Body.String(), "verify your email") {
+			t.Fatalf("login %d: got %q, want the verify email message", i+1, w.Body.String())
+		}
+		if cookie := w.Result().Cookies(); len(cookie) > 0 {
+			t.Fatalf("login %d: an unverified account got a session cookie", i+1)
+		}
+	}
+	messages := outbox(t)
+	if len(messages) != 1 {
+		t.Fatalf("sent %d verification emails for 3 logins, want 1", len(messages))
+	}
+	if !strings.Contains(messages[0], "To: alice@example.com") || !strings.Contains(messages[0], "https://files.example.com/verify-email?token=") {
+		t.Fatalf("unexpected verification email:\n%s", messages[0])
+	}
+
+	// Once the last link is old enough, logging in sends a fresh one
+	if _, err := models.DB.Exec(`UPDATE user_tokens SET created_at = ? WHERE user_id = ?`, time.Now().Add(-emailResendInterval-time.Minute).UTC(), user.ID); err != nil {
+		t.Fatal(err)
+	}
+	postForm(login, "/login", form)
+	if n := len(outbox(t)); n != 2 {
+		t.Fatalf("sent %d verification emails after the resend interval, want 2", n)
+	}
+}
+
+func TestPasswordResetByEmail(t *testing.T) {
+	setupServer(t)
+	user := createUser(t, "bob", false)
+	forgot := func(w http.ResponseWriter, r *http.Request) { ForgotPasswordHandler(w, r, renderStub) }
+	reset := func(w http.ResponseWriter, r *http.Request) { ResetPasswordHandler(w, r, renderStub) }
+
+	postForm(forgot, "/forgot-password", url.Values{"email": {"nobody@example.com"}})
+	if n := len(outbox(t)); n != 0 {
+		t.Fatalf("sent %d emails for an unknown address", n)
+	}
+	postForm(forgot, "/forgot-password", url.Values{"email": {"bob@example.com"}})
+	messages := outbox(t)
+	if len(messages) != 1 {
+		t.Fatalf("sent %d emails, want 1", len(messages))
+	}
+	token := emailedToken(t, messages[0], "/reset-password")
+
+	const newPassword = "Changed-456"
+	form := url.Values{"token": {token}, "password": {newPassword}, "retype": {newPassword}}
+	if w := postForm(reset, "/reset-password", form); !strings.Contains(w.Body.String(), "Password updated") {
+		t.Fatalf("reset: got %q", w.Body.String())
+	}
+	if w := postForm(reset, "/reset-password", form); w.Code != http.StatusBadRequest {
+		t.Fatalf("reusing the reset link: got status %d, want 400", w.Code)
+	}
+	if ok, _ := models.VerifyUser("bob", newPassword); !ok {
+		t.Fatal("the password wasn't changed")
+	}
+	if ok, _ := models.VerifyUser("bob", testPassword); ok {
+		t.Fatal("the password wasn't changed")
+	}
+	updated, err := models.GetUserByID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.EmailVerified {
+		t.Fatal("resetting by email didn't verify the address")
+	}
+}
+
+// postFormFrom sends a form like postForm does, from another client IP
+func postFormFrom(ip string, handler http.HandlerFunc, path string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestPasswordResetEmailsHaveAPerAccountCooldown(t *testing.T) {
+	setupServer(t)
+	user := createUser(t, "bob", true)
+	forgot := func(w http.ResponseWriter, r *http.Request) { ForgotPasswordHandler(w, r, renderStub) }
+
+	// Spreading the requests over many IPs gets past the IP limit, but not the cooldown
+	for i := 1; i <= 5; i++ {
+		w := postFormFrom("198.51.100."+strconv.Itoa(i), forgot, "/forgot-password", url.Values{"email": {"bob@example.com"}})
+		if !strings.Contains(w.Body.String(), "forgot_password.html: ") || w.Code != http.StatusOK {
+			t.Fatalf("request %d: %d %q", i, w.Code, w.Body)
+		}
+	}
+	messages := outbox(t)
+	if len(messages) != 1 {
+		t.Fatalf("sent %d reset emails, want 1", len(messages))
+	}
+	// The link that went out still works
+	if _, err := models.LookupUserToken(emailedToken(t, messages[0], "/reset-password"), models.TokenPurposePasswordReset); err != nil {
+		t.Fatalf("the emailed link stopped working: %v", err)
+	}
+
+	if _, err := models.DB.Exec(`UPDATE user_tokens SET created_at = ? WHERE user_id = ?`, time.Now().Add(-emailResendInterval-time.Minute).UTC(), user.ID); err != nil {
+		t.Fatal(err)
+	}
+	postFormFrom("198.51.100.9", forgot, "/forgot-password", url.Values{"email": {"bob@example.com"}})
+	if n := len(outbox(t)); n != 2 {
+		t.Fatalf("sent %d reset emails after the cooldown, want 2", n)
+	}
+}
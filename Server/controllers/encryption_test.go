@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"simplehost-server/config"
+	"simplehost-server/models"
+	"simplehost-server/storage"
+)
+
+// enableEncryption turns on encryption for files stored from now on, with keys in the
+// key file
+func enableEncryption(t *testing.T, c *config.Config) *storage.Encrypted {
+	t.Helper()
+	c.Storage.Encryption.Enabled = true
+	c.Storage.Encryption.KeyFile = filepath.Join(t.TempDir(), "encryption_keys.json")
+	blobs, err := storage.FromConfig(c.Storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	models.SetStorage(blobs)
+	return blobs.(*storage.Encrypted)
+}
+
+func readFile(t *testing.T, name string) (string, error) {
+	t.Helper()
+	file, err := models.GetFileByFolderAndName("root", name)
+	if err != nil || file == nil {
+		t.Fatalf("%s: %+v, %v", name, file, err)
+	}
+	r, err := models.Blobs.Get(context.Background(), file.StorageKey, 0, -1)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	return string(data), err
+}
+
+func TestOnlyFilesFromBeforeEncryptionAreReadUnencrypted(t *testing.T) {
+	c := setupServer(t)
+	cookie := sessionCookie(t, createUser(t, "alice", true))
+	if w := postChunk(t, cookie, startUpload(t, cookie), "0", 1, "from before"); w.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	if _, err := models.DB.Exec(`UPDATE files SET name = 'old.txt'`); err != nil {
+		t.Fatal(err)
+	}
+
+	enableEncryption(t, c)
+	if w := postChunk(t, cookie, startUpload(t, cookie), "0", 1, "encrypted"); w.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	if got, err := readFile(t, "old.txt"); err != nil || got != "from before" {
+		t.Errorf("file from before encryption: %q, %v", got, err)
+	}
+	if got, err := readFile(t, "notes.txt"); err != nil || got != "encrypted" {
+		t.Errorf("encrypted file: %q, %v", got, err)
+	}
+
+	// Without its envelope, an encrypted file can't be read rather than reading as ciphertext
+	file, _ := models.GetFileByFolderAndName("root", "notes.txt")
+	if err := os.Remove(filepath.Join(c.Storage.UploadDir, file.StorageKey+".dek")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readFile(t, "notes.txt"); err == nil {
+		t.Errorf("read %q from a file without its envelope", got)
+	}
+}
+
+func TestRotatingKeysKeepsPendingChunksReadable(t *testing.T) {
+	c := setupServer(t)
+	blobs := enableEncryption(t, c)
+	cookie := sessionCookie(t, createUser(t, "alice", true))
+	id := startUpload(t, cookie)
+	if w := postChunk(t, cookie, id, "0", 2, "hello, "); w.Code != http.StatusOK {
+		t.Fatalf("first chunk: %d %s", w.Code, w.Body)
+	}
+	stored, err := os.ReadFile(filepath.Join(chunkDir(), id, "0"))
+	if err != nil || strings.Contains(string(stored), "hello") {
+		t.Fatalf("chunk stored as %q, %v", stored, err)
+	}
+
+	// The way rotate-keys does: add a key, rewrap, then drop the old one
+	keys, err := storage.AddKeyFileKey(c.Storage.Encryption.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs.Keys = storage.NewKeyRing(keys)
+	if rewrapped, failed, err := RewrapChunks(context.Background()); rewrapped != 1 || failed != 0 || err != nil {
+		t.Fatalf("RewrapChunks: %d rewrapped, %d failed, %v", rewrapped, failed, err)
+	}
+	blobs.Keys = storage.NewKeyRing(keys[:1])
+
+	if w := postChunk(t, cookie, id, "1", 2, "world"); w.Code != http.StatusOK {
+		t.Fatalf("last chunk: %d %s", w.Code, w.Body)
+	}
+	if got, err := readFile(t, "notes.txt"); err != nil || got != "hello, world" {
+		t.Errorf("uploaded file: %q, %v", got, err)
+	}
+}
@@ -3,13 +3,10 @@ package controllers
 import (
 	"database/sql"
 	"encoding/json"
-	"html/template"
 	"net/http"
 	"simplehost-server/models"
 	"strings"
 
-	"simplehost-server/shared" // Import shared for TemplatesFS
-
 	"github.com/google/uuid"
 )
 
@@ -55,12 +52,14 @@ func FolderListPartialHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	folders, files, err := models.GetFolderChildren(folderID, userID)
 	if err != nil {
+		logFor(r).Error("Failed to list folder", "folder_id", folderID, "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("<div class='error'>Error loading files</div>"))
 		return
 	}
-	tmpl, err := template.ParseFS(shared.TemplatesFS, "templates/files_list_partial.html", "templates/folder_item_partial.html")
+	tmpl, err := ParseTemplates("files_list_partial.html", "folder_item_partial.html")
 	if err != nil {
+		logFor(r).Error("Failed to render folder list", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("<div class='error'>Template error</div>"))
 		return
@@ -70,8 +69,9 @@ func FolderListPartialHandler(w http.ResponseWriter, r *http.Request) {
 		"Files":           files,
 		"CurrentFolderID": folderID,
 	}
-	err = tmpl.Execute(w, data)
+	err = tmpl.ExecuteTemplate(w, "files_list_partial.html", data)
 	if err != nil {
+		logFor(r).Error("Failed to render folder list", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("<div class='error'>Template error</div>"))
 		return
@@ -110,17 +110,23 @@ func CreateFolderAPIHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	err := models.InsertFolder(folder)
 	if err != nil {
+		logFor(r).Error("Failed to create folder", "parent_id", parentID, "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 		return
 	}
 	folder.CanDelete = true // If you created it you are the owner so you can delete it
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusCreated, map[string]any{"id": folder.ID, "name": folder.Name, "parent_id": parentID})
+		return
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	tmpl, err := template.ParseFS(shared.TemplatesFS, "templates/folder_item_partial.html")
+	tmpl, err := ParseTemplates("folder_item_partial.html")
 	if err != nil {
+		logFor(r).Error("Failed to render folder list", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("<div class='error'>Template error</div>"))
 		return
 	}
-	tmpl.Execute(w, folder)
+	tmpl.ExecuteTemplate(w, "folder_item_partial.html", folder)
 }
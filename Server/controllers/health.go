@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"simplehost-server/models"
+	"simplehost-server/storage"
+)
+
+// readyTimeout bounds each /readyz check so a stuck disk or database fails the probe
+// instead of hanging it
+const readyTimeout = 2 * time.Second
+
+type healthCheck struct {
+	Status       string `json:"status"`
+	Error        string `json:"error,omitempty"`
+	DurationMS   int64  `json:"duration_ms"`
+	FreeBytes    uint64 `json:"free_bytes,omitempty"`
+	MinFreeBytes int64  `json:"min_free_bytes,omitempty"`
+}
+
+func writeHealth(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// HealthzHandler reports that the process is up: GET /healthz
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ReadyzHandler reports whether the server can take traffic: GET /readyz
+// It checks that the database answers, the upload directory is writable, there's enough
+// free disk space and object storage is reachable, and returns 503 with the failing
+// checks otherwise.
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]*healthCheck{
+		"database": runCheck(r.Context(), checkDatabase),
+		"storage":  runCheck(r.Context(), checkStorageWritable),
+	}
+	disk := runDetailedCheck(r.Context(), func(_ context.Context, result *healthCheck) error {
+		free, err := freeDiskSpace(uploadDir())
+		if errors.Is(err, errors.ErrUnsupported) {
+			result.Status = "skipped"
+			return nil
+		} else if err != nil {
+			return err
+		}
+		result.FreeBytes = free
+		if free < uint64(appConfig.Storage.MinFreeBytes) {
+			return fmt.Errorf("%d bytes free, need at least %d", free, appConfig.Storage.MinFreeBytes)
+		}
+		return nil
+	})
+	disk.MinFreeBytes = appConfig.Storage.MinFreeBytes
+	checks["disk"] = disk
+	if appConfig.Storage.Driver != "disk" {
+		checks["object_storage"] = runCheck(r.Context(), checkObjectStorage)
+	}
+
+	status, code := "ok", http.StatusOK
+	for name, check := range checks {
+		if check.Status == "fail" {
+			status, code = "unavailable", http.StatusServiceUnavailable
+			logFor(r).Warn("Readiness check failed", "check", name, "error", check.Error)
+		}
+	}
+	writeHealth(w, code, map[string]any{"status": status, "checks": checks})
+}
+
+func runCheck(parent context.Context, check func(context.Context) error) *healthCheck {
+	return runDetailedCheck(parent, func(ctx context.Context, _ *healthCheck) error { return check(ctx) })
+}
+
+// runDetailedCheck runs a check that can add details to its result. File system calls
+// can't be cancelled, so the check runs in its own goroutine and the probe gives up on it
+// after readyTimeout. One that is stuck stays behind until the disk answers.
+func runDetailedCheck(parent context.Context, check func(context.Context, *healthCheck) error) *healthCheck {
+	ctx, cancel := context.WithTimeout(parent, readyTimeout)
+	defer cancel()
+	start := time.Now()
+	done := make(chan *healthCheck, 1)
+	go func() {
+		result := &healthCheck{Status: "ok"}
+		if err := check(ctx, result); err != nil {
+			result.Status, result.Error = "fail", err.Error()
+		}
+		done <- result
+	}()
+	var result *healthCheck
+	select {
+	case result = <-done:
+	case <-ctx.Done():
+		result = &healthCheck{Status: "fail", Error: "timed out: " + ctx.Err().Error()}
+	}
+	result.DurationMS = time.Since(start).Milliseconds()
+	return result
+}
+
+func checkDatabase(ctx context.Context) error {
+	return models.PingDB(ctx)
+}
+
+// checkObjectStorage looks up a key that doesn't exist, which needs the bucket to be
+// reachable and the credentials to work
+func checkObjectStorage(ctx context.Context) error {
+	if _, err := models.Blobs.Stat(ctx, ".readyz"); err != nil && !errors.Is(err, storage.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// checkStorageWritable writes and removes a small file in the upload directory, creating
+// the directory first like the first upload would
+func checkStorageWritable(ctx context.Context) error {
+	if err := os.MkdirAll(uploadDir(), os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(uploadDir(), ".readyz-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("ok"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,44 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadyz(t *testing.T) {
+	setupServer(t)
+	w := httptest.NewRecorder()
+	ReadyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var body struct {
+		Status string                  `json:"status"`
+		Checks map[string]*healthCheck `json:"checks"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusOK || body.Status != "ok" {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	for _, name := range []string{"database", "storage", "disk"} {
+		if check := body.Checks[name]; check == nil || check.Status == "fail" {
+			t.Errorf("%s check: %+v", name, check)
+		}
+	}
+}
+
+func TestReadyCheckGivesUpOnAStuckCheck(t *testing.T) {
+	stuck := make(chan struct{})
+	defer close(stuck)
+	// Like a read from a hung disk, this ignores the context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	result := runCheck(ctx, func(context.Context) error {
+		<-stuck
+		return nil
+	})
+	if result.Status != "fail" || time.Since(start) > readyTimeout {
+		t.Fatalf("got %+v after %s", result, time.Since(start))
+	}
+}
@@ -0,0 +1,193 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The fallback secret older versions used when JWT_SECRET was unset. It is public, so it is
+// never accepted in production.
+const legacyDevSecret = "dev_secret_key_change_me"
+
+// HS256 keys shorter than the hash output weaken the signature
+const minJWTKeyLength = 32
+
+// jwtSigningKey is one HMAC key. Tokens carry its ID in the "kid" header so keys can be
+// rotated without invalidating tokens signed with the previous one.
+type jwtSigningKey struct {
+	ID        string    `json:"kid"`
+	Secret    []byte    `json:"secret"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// jwtKeyRing holds the key new tokens are signed with and every key that still verifies
+type jwtKeyRing struct {
+	current jwtSigningKey
+	byID    map[string][]byte
+}
+
+var jwtKeys *jwtKeyRing
+
+// InitJWTKeys loads the signing keys. They come from, in order of preference:
+//   - jwt.keys, a comma separated list of kid:secret pairs where the first key signs and the
+//     rest only verify
+//   - jwt.secret, a single key
+//   - jwt.key_file, which is created with a random key on first run. When jwt.key_max_age
+//     is set, a new key is added to the file once the newest one is older than that, and
+//     keys that can no longer have live tokens are dropped.
+func InitJWTKeys() error {
+	keys, err := configuredJWTKeys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		if keys, err = loadJWTKeyFile(); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		if len(key.Secret) < minJWTKeyLength || string(key.Secret) == legacyDevSecret {
+			if appConfig.Production() {
+				return fmt.Errorf("JWT key %q is too weak: use at least %d random bytes", key.ID, minJWTKeyLength)
+			}
+			slog.Warn("JWT key is weak; this would be refused in production", "kid", key.ID)
+		}
+	}
+	ring := &jwtKeyRing{current: keys[0], byID: map[string][]byte{}}
+	for _, key := range keys {
+		if _, dup := ring.byID[key.ID]; dup {
+			return fmt.Errorf("duplicate JWT key id %q", key.ID)
+		}
+		ring.byID[key.ID] = key.Secret
+	}
+	jwtKeys = ring
+	slog.Info("Loaded JWT keys", "signing_kid", ring.current.ID, "accepted", len(keys))
+	return nil
+}
+
+func configuredJWTKeys() ([]jwtSigningKey, error) {
+	if list := appConfig.JWT.Keys; list != "" {
+		var keys []jwtSigningKey
+		for _, pair := range strings.Split(list, ",") {
+			kid, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			if !ok || kid == "" || secret == "" {
+				return nil, errors.New("jwt.keys must be a comma separated list of kid:secret pairs")
+			}
+			keys = append(keys, jwtSigningKey{ID: kid, Secret: []byte(secret)})
+		}
+		return keys, nil
+	}
+	if secret := appConfig.JWT.Secret; secret != "" {
+		// Derive the kid from the secret so it stays the same across restarts
+		sum := sha256.Sum256([]byte(secret))
+		return []jwtSigningKey{{ID: hex.EncodeToString(sum[:4]), Secret: []byte(secret)}}, nil
+	}
+	return nil, nil
+}
+
+func newJWTSigningKey() (jwtSigningKey, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return jwtSigningKey{}, err
+	}
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return jwtSigningKey{}, err
+	}
+	return jwtSigningKey{ID: base64.RawURLEncoding.EncodeToString(id), Secret: secret, CreatedAt: time.Now().UTC()}, nil
+}
+
+// loadJWTKeyFile reads the persisted keys, newest first, creating or rotating them as needed
+func loadJWTKeyFile() ([]jwtSigningKey, error) {
+	path := appConfig.JWT.KeyFile
+	var keys []jwtSigningKey
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &keys); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+
+	changed := false
+	maxAge := appConfig.JWT.KeyMaxAge
+	if len(keys) == 0 || (maxAge > 0 && time.Since(keys[0].CreatedAt) > maxAge) {
+		key, err := newJWTSigningKey()
+		if err != nil {
+			return nil, err
+		}
+		keys = append([]jwtSigningKey{key}, keys...)
+		changed = true
+		slog.Info("Generated JWT signing key", "kid", key.ID, "path", path)
+	}
+	if maxAge > 0 {
+		// A retired key is still needed until the last token it signed has expired
+		kept := keys[:1]
+		for _, key := range keys[1:] {
+			if time.Since(key.CreatedAt) <= maxAge+sessionTTL {
+				kept = append(kept, key)
+			} else {
+				changed = true
+			}
+		}
+		keys = kept
+	}
+	if changed {
+		data, err := json.MarshalIndent(keys, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, data, 0o600); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// signToken signs claims with the current key. Every token the server issues goes through
+// here, including the pending 2FA and OIDC state tokens.
+func signToken(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = jwtKeys.current.ID
+	return token.SignedString(jwtKeys.current.Secret)
+}
+
+// verificationKey picks the key for a token by its kid. Tokens from before key IDs were
+// introduced have none and are checked against every key.
+func verificationKey(token *jwt.Token) (any, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		set := jwt.VerificationKeySet{}
+		for _, secret := range jwtKeys.byID {
+			set.Keys = append(set.Keys, secret)
+		}
+		return set, nil
+	}
+	secret, ok := jwtKeys.byID[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return secret, nil
+}
@@ -0,0 +1,241 @@
+package controllers
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"simplehost-server/config"
+	"simplehost-server/models"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapSettings come from the ldap config section. The user filter uses {username} as a placeholder,
+// which is escaped before it is substituted.
+type ldapSettings struct {
+	URL           string
+	StartTLS      bool
+	SkipTLSVerify bool
+	BindDN        string
+	BindPassword  string
+	BaseDN        string
+	UserFilter    string
+	UsernameAttr  string
+	EmailAttr     string
+	GroupAttr     string
+	RoleMap       map[string]string
+}
+
+var ldapConfig ldapSettings
+
+func loadLDAPSettings(c config.LDAP) ldapSettings {
+	cfg := ldapSettings{
+		URL:           c.URL,
+		StartTLS:      c.StartTLS,
+		SkipTLSVerify: c.SkipTLSVerify,
+		BindDN:        c.BindDN,
+		BindPassword:  c.BindPassword,
+		BaseDN:        c.BaseDN,
+		UserFilter:    c.UserFilter,
+		UsernameAttr:  c.UsernameAttr,
+		EmailAttr:     c.EmailAttr,
+		GroupAttr:     c.GroupAttr,
+		RoleMap:       parseRoleMap(c.RoleMap),
+	}
+	if cfg.UserFilter == "" {
+		// Matches both OpenLDAP (uid) and Active Directory (sAMAccountName) accounts
+		cfg.UserFilter = "(&(objectClass=person)(|(uid={username})(sAMAccountName={username})))"
+	}
+	if cfg.UsernameAttr == "" {
+		cfg.UsernameAttr = "uid"
+	}
+	if cfg.EmailAttr == "" {
+		cfg.EmailAttr = "mail"
+	}
+	if cfg.GroupAttr == "" {
+		cfg.GroupAttr = "memberOf"
+	}
+	return cfg
+}
+
+// LDAPEnabled reports whether a directory is configured
+func LDAPEnabled() bool {
+	return ldapConfig.URL != ""
+}
+
+// ldapAuthenticator binds with a service account, looks the user up, and then binds as the
+// user to check the password. Accounts are provisioned on the first successful bind.
+type ldapAuthenticator struct {
+	config ldapSettings
+}
+
+func (a *ldapAuthenticator) Name() string { return "ldap" }
+
+func (a *ldapAuthenticator) connect() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: a.config.SkipTLSVerify}
+	conn, err := ldap.DialURL(a.config.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	if a.config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (a *ldapAuthenticator) Authenticate(username, password string) (*models.User, error) {
+	id, err := a.lookup(username, password)
+	if err != nil {
+		return nil, err
+	}
+	return provisionDirectoryUser(id)
+}
+
+// provisionDirectoryUser finds the account linked to a directory identity, creating it on
+// the first bind when the registration mode allows new accounts
+func provisionDirectoryUser(id externalIdentity) (*models.User, error) {
+	mode, err := newAccountMode()
+	if err != nil {
+		return nil, err
+	}
+	return provisionExternalUser(id, mode)
+}
+
+// lookup checks the password by binding as the user and returns their directory identity
+func (a *ldapAuthenticator) lookup(username, password string) (externalIdentity, error) {
+	var id externalIdentity
+	// An empty password would be an unauthenticated bind, which many servers accept
+	if password == "" {
+		return id, ErrInvalidCredentials
+	}
+	conn, err := a.connect()
+	if err != nil {
+		return id, err
+	}
+	defer conn.Close()
+
+	if a.config.BindDN != "" {
+		if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+			return id, fmt.Errorf("service account bind: %w", err)
+		}
+	}
+	filter := strings.ReplaceAll(a.config.UserFilter, "{username}", ldap.EscapeFilter(username))
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		filter,
+		[]string{"dn", "entryUUID", "objectGUID", a.config.UsernameAttr, a.config.EmailAttr, a.config.GroupAttr},
+		nil,
+	))
+	if err != nil {
+		return id, fmt.Errorf("user search: %w", err)
+	}
+	if len(result.Entries) != 1 {
+		return id, ErrInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		var ldapErr *ldap.Error
+		if errors.As(err, &ldapErr) && ldapErr.ResultCode == ldap.LDAPResultInvalidCredentials {
+			return id, ErrInvalidCredentials
+		}
+		return id, fmt.Errorf("user bind: %w", err)
+	}
+
+	subject := entry.GetAttributeValue("entryUUID")
+	if subject == "" {
+		if guid := entry.GetRawAttributeValue("objectGUID"); len(guid) > 0 {
+			subject = hex.EncodeToString(guid)
+		}
+	}
+	if subject == "" {
+		subject = entry.DN
+	}
+	name := entry.GetAttributeValue(a.config.UsernameAttr)
+	if name == "" {
+		name = username
+	}
+	role, syncRole := roleForGroups(a.config.RoleMap, ldapGroupNames(entry.GetAttributeValues(a.config.GroupAttr)))
+	// Many directories let users edit their own mail attribute, so the address isn't
+	// treated as verified
+	return externalIdentity{
+		Provider: "ldap",
+		Subject:  subject,
+		Username: name,
+		Email:    entry.GetAttributeValue(a.config.EmailAttr),
+		Role:     role,
+		SyncRole: syncRole,
+	}, nil
+}
+
+// ldapGroupNames returns each group DN along with its CN, so the role map can use either
+func ldapGroupNames(dns []string) []string {
+	var names []string
+	for _, dn := range dns {
+		names = append(names, dn)
+		if parsed, err := ldap.ParseDN(dn); err == nil && len(parsed.RDNs) > 0 {
+			for _, attr := range parsed.RDNs[0].Attributes {
+				if strings.EqualFold(attr.Type, "cn") {
+					names = append(names, attr.Value)
+				}
+			}
+		}
+	}
+	return names
+}
+
+// LDAPLinkHandler links the signed in account to a directory account after checking its
+// password: POST /account/link/ldap
+// Form fields: ldap_username and ldap_password
+func LDAPLinkHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !LDAPEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	userID := GetUserIDFromRequest(r)
+	username := r.FormValue("ldap_username")
+	// Checks count against the directory account, like logging in as it does
+	account := accountKey(username)
+	if ok, wait := loginAccountLimiter.Allow(account); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		accountResponse(w, r, render, http.StatusTooManyRequests, retryMessage(wait), true)
+		return
+	}
+	a := &ldapAuthenticator{config: ldapConfig}
+	id, err := a.lookup(username, r.FormValue("ldap_password"))
+	if err != nil {
+		if !errors.Is(err, ErrInvalidCredentials) {
+			loginAccountLimiter.Release(account)
+			logFor(r).Error("LDAP lookup failed", "error", err)
+			accountResponse(w, r, render, http.StatusBadGateway, "The directory is currently unavailable", true)
+			return
+		}
+		loginAccountLimiter.Fail(account)
+		logFor(r).Warn("Failed directory password check", "user_id", userID, "ip", ClientIP(r))
+		accountResponse(w, r, render, http.StatusForbidden, "Invalid directory username or password", true)
+		return
+	}
+	loginAccountLimiter.Reset(account)
+	if err := linkExternalIdentity(userID, id.Provider, id.Subject); err != nil {
+		if errors.Is(err, errIdentityLinkedElsewhere) {
+			accountResponse(w, r, render, http.StatusConflict, "That directory account is already linked to another account.", true)
+			return
+		}
+		logFor(r).Error("Failed to link directory account", "user_id", userID, "error", err)
+		accountResponse(w, r, render, http.StatusInternalServerError, "Failed to link directory account", true)
+		return
+	}
+	accountResponse(w, r, render, http.StatusOK, "Directory account linked. You can now log in with it.", false)
+}
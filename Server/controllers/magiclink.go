@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"simplehost-server/mailer"
+	"simplehost-server/models"
+)
+
+var magicLinkIPLimiter *RateLimiter
+
+// MagicLinkEnabled reports whether admins have turned on email sign-in links
+func MagicLinkEnabled() bool {
+	return models.GetBoolSetting(models.SettingMagicLinkEnabled, false)
+}
+
+// sendMagicLinkEmail emails a sign-in link unless one went out recently, in which case
+// that one still works
+func sendMagicLinkEmail(user *models.User) error {
+	if sent, err := sentRecently(user, models.TokenPurposeMagicLink); err != nil || sent {
+		return err
+	}
+	// Only the most recent sign-in link should work
+	if err := models.DeleteUserTokens(user.ID, models.TokenPurposeMagicLink); err != nil {
+		return err
+	}
+	magicLinkTTL := appConfig.Auth.MagicLinkTTL
+	token, err := models.CreateUserToken(user.ID, models.TokenPurposeMagicLink, magicLinkTTL)
+	if err != nil {
+		return err
+	}
+	link := publicURL("/login/magic/verify", url.Values{"token": {token}})
+	return Mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Your SimpleHost sign-in link",
+		Body: fmt.Sprintf("Hi %s,\n\nOpen this link to sign in to SimpleHost:\n\n%s\n\nThe link can be used once and expires in %s. If you didn't ask for this you can ignore this email.\n",
+			user.Username, link, magicLinkTTL),
+	})
+}
+
+// MagicLinkHandler shows the request form and emails a sign-in link: GET/POST /login/magic
+// Like ForgotPasswordHandler, the response doesn't reveal whether the address has an account.
+func MagicLinkHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if !MagicLinkEnabled() {
+		http.Redirect(w, r, AppPath("/login"), http.StatusSeeOther)
+		return
+	}
+	if r.Method == http.MethodGet {
+		render(w, r, "magic_link.html", nil)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ip := ClientIP(r)
+	if ok, wait := magicLinkIPLimiter.Allow(ip); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		w.WriteHeader(http.StatusTooManyRequests)
+		render(w, r, "magic_link.html", map[string]any{"Error": retryMessage(wait)})
+		return
+	}
+	magicLinkIPLimiter.Fail(ip)
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	if user, err := models.GetUserByEmail(email); err == nil {
+		if err := sendMagicLinkEmail(user); err != nil {
+			logFor(r).Error("Failed to send sign-in link", "user_id", user.ID, "error", err)
+		}
+	}
+	render(w, r, "magic_link.html", map[string]any{
+		"Message": "If an account uses that email address, a sign-in link is on its way.",
+	})
+}
+
+// MagicLinkVerifyHandler signs the user in with an emailed link: GET/POST /login/magic/verify?token=...
+// GET only shows a confirmation button, so mail scanners that prefetch links can't use up the token.
+func MagicLinkVerifyHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if !MagicLinkEnabled() {
+		http.Redirect(w, r, AppPath("/login"), http.StatusSeeOther)
+		return
+	}
+	token := r.FormValue("token")
+	if r.Method == http.MethodGet {
+		if _, err := models.LookupUserToken(token, models.TokenPurposeMagicLink); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			render(w, r, "magic_link.html", map[string]any{"Error": "This sign-in link is invalid or has expired."})
+			return
+		}
+		render(w, r, "magic_link.html", map[string]any{"Token": token})
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	userID, err := models.ConsumeUserToken(token, models.TokenPurposeMagicLink)
+	if err != nil {
+		recordLogin("magic_link", false)
+		w.WriteHeader(http.StatusBadRequest)
+		render(w, r, "magic_link.html", map[string]any{"Error": "This sign-in link is invalid or has expired."})
+		return
+	}
+	user, err := models.GetUserByID(userID)
+	if err != nil {
+		render(w, r, "login.html", map[string]any{"Error": "Server error"})
+		return
+	}
+	// Receiving the link proves the address belongs to the user
+	if !user.EmailVerified {
+		models.SetEmailVerified(user.ID, true)
+		user.EmailVerified = true
+	}
+	recordLogin("magic_link", true)
+	logFor(r).Info("Signed in with an email link", "user_id", user.ID, "ip", ClientIP(r))
+	completeLogin(w, r, render, user)
+}
@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"simplehost-server/models"
+)
+
+func TestMagicLinkSignIn(t *testing.T) {
+	setupServer(t)
+	createUser(t, "admin", true)
+	user := createUser(t, "mia", false)
+	request := func(w http.ResponseWriter, r *http.Request) { MagicLinkHandler(w, r, renderStub) }
+	verify := func(w http.ResponseWriter, r *http.Request) { MagicLinkVerifyHandler(w, r, renderStub) }
+
+	postForm(request, "/login/magic", url.Values{"email": {user.Email}})
+	if n := len(outbox(t)); n != 0 {
+		t.Fatalf("sent %d emails while sign-in links are turned off", n)
+	}
+	models.SetSetting(models.SettingMagicLinkEnabled, "true")
+
+	postForm(request, "/login/magic", url.Values{"email": {"nobody@example.com"}})
+	postForm(request, "/login/magic", url.Values{"email": {user.Email}})
+	// Asking again, even from other IPs, doesn't send another until the cooldown is over
+	postFormFrom("198.51.100.1", request, "/login/magic", url.Values{"email": {user.Email}})
+	postFormFrom("198.51.100.2", request, "/login/magic", url.Values{"email": {user.Email}})
+	if n := len(outbox(t)); n != 1 {
+		t.Fatalf("sent %d emails during the cooldown, want 1", n)
+	}
+	if _, err := models.DB.Exec(`UPDATE user_tokens SET created_at = ? WHERE user_id = ?`, time.Now().Add(-emailResendInterval-time.Minute).UTC(), user.ID); err != nil {
+		t.Fatal(err)
+	}
+	postForm(request, "/login/magic", url.Values{"email": {user.Email}})
+	messages := outbox(t)
+	if len(messages) != 2 || !strings.Contains(messages[1], "To: mia@example.com") {
+		t.Fatalf("sent %d emails, want 2 to mia", len(messages))
+	}
+	stale := emailedToken(t, messages[0], "/login/magic/verify")
+	token := emailedToken(t, messages[1], "/login/magic/verify")
+
+	// Opening the link only shows a button, so a mail scanner can't use it up
+	w := httptest.NewRecorder()
+	verify(w, httptest.NewRequest(http.MethodGet, "/login/magic/verify?token="+token, nil))
+	if w.Code != http.StatusOK || len(w.Result().Cookies()) > 0 {
+		t.Fatalf("GET: got status %d and cookies %v", w.Code, w.Result().Cookies())
+	}
+
+	if w := postForm(verify, "/login/magic/verify", url.Values{"token": {stale}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("an earlier link still works: got status %d", w.Code)
+	}
+	w = postForm(verify, "/login/magic/verify", url.Values{"token": {token}})
+	if signedIn := sessionUser(t, w); signedIn == nil || signedIn.ID != user.ID {
+		t.Fatalf("the link didn't sign in: %d %s", w.Code, w.Body.String())
+	}
+	if stored, _ := models.GetUserByID(user.ID); !stored.EmailVerified {
+		t.Fatal("receiving the link didn't verify the email address")
+	}
+	if w := postForm(verify, "/login/magic/verify", url.Values{"token": {token}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("the link worked twice: got status %d", w.Code)
+	}
+}
@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"simplehost-server/metrics"
+	"simplehost-server/models"
+)
+
+var (
+	httpRequests = metrics.NewCounterVec("simplehost_http_requests_total",
+		"HTTP requests by route, method and status code.", "route", "method", "status")
+	httpDuration = metrics.NewHistogramVec("simplehost_http_request_duration_seconds",
+		"Time to serve HTTP requests.", metrics.DefaultBuckets, "route", "method")
+	transferBytes = metrics.NewCounterVec("simplehost_transfer_bytes_total",
+		"File bytes received by uploads and sent by downloads.", "direction")
+	assemblyDuration = metrics.NewHistogramVec("simplehost_chunk_assembly_duration_seconds",
+		"Time to join the chunks of an upload into the final file.", []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60})
+	logins = metrics.NewCounterVec("simplehost_logins_total",
+		"Login attempts by method and result.", "method", "result")
+)
+
+func init() {
+	metrics.NewGaugeFunc("simplehost_upload_sessions_active",
+		"Chunked uploads that have started but not been assembled.", countUploadSessions)
+	metrics.NewGaugeFunc("simplehost_storage_used_bytes",
+		"Total size of the files each user owns.", storageByUser, "user_id", "username")
+}
+
+func countUploadSessions() []metrics.Sample {
+	entries, err := os.ReadDir(chunkDir())
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error("Failed to count upload sessions", "error", err)
+	}
+	return []metrics.Sample{{Value: float64(len(entries))}}
+}
+
+func storageByUser() []metrics.Sample {
+	usage, err := models.StorageByUser()
+	if err != nil {
+		slog.Error("Failed to sum storage per user", "error", err)
+		return nil
+	}
+	samples := make([]metrics.Sample, len(usage))
+	for i, u := range usage {
+		samples[i] = metrics.Sample{Labels: []string{u.UserID, u.Username}, Value: float64(u.Bytes)}
+	}
+	return samples
+}
+
+// recordLogin counts a login attempt. method is password, 2fa, passkey, magic_link, oidc,
+// app_token, ssh_key or access_key.
+func recordLogin(method string, ok bool) {
+	result := "success"
+	if !ok {
+		result = "failure"
+	}
+	logins.Inc(method, result)
+}
+
+// observeRequest records a finished request. route is the pattern that matched, so paths
+// with IDs in them don't each get their own series.
+func observeRequest(route, method string, status int, seconds float64) {
+	if route == "" {
+		route = "unmatched"
+	}
+	httpRequests.Inc(route, method, strconv.Itoa(status))
+	httpDuration.Observe(seconds, route, method)
+}
+
+// MetricsHandler serves Prometheus metrics: GET /metrics
+// Scrapers must present metrics.token as a bearer token, or connect from an address in
+// metrics.allowed_ips. With neither configured only loopback addresses are let in.
+func MetricsHandler() http.Handler {
+	allowed := parseTrustedProxies(appConfig.Metrics.AllowedIPs)
+	handler := metrics.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !metricsAccessAllowed(r, allowed) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func metricsAccessAllowed(r *http.Request, allowed []*net.IPNet) bool {
+	token := appConfig.Metrics.Token
+	if token != "" {
+		sent, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(sent), []byte(token)) == 1 {
+			return true
+		}
+	}
+	ip := net.ParseIP(ClientIP(r))
+	if ip == nil {
+		return false
+	}
+	if token == "" && len(allowed) == 0 {
+		return ip.IsLoopback()
+	}
+	for _, n := range allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
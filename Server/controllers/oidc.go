@@ -0,0 +1,317 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"simplehost-server/config"
+	"simplehost-server/models"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcStateCookie = "oidc_state"
+	oidcStateTTL    = 10 * time.Minute
+	oidcPurpose     = "oidc"
+)
+
+// oidcSettings come from the oidc config section. The issuer can be any URL, including a plain
+// http:// mock issuer running locally for testing.
+type oidcSettings struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	GroupsClaim  string
+	RoleMap      map[string]string
+}
+
+var oidcConfig oidcSettings
+
+func loadOIDCSettings(c config.OIDC) oidcSettings {
+	scopes := c.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	}
+	groupsClaim := c.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+	return oidcSettings{
+		Issuer:       c.Issuer,
+		ClientID:     c.ClientID,
+		ClientSecret: c.ClientSecret,
+		RedirectURL:  c.RedirectURL,
+		Scopes:       scopes,
+		GroupsClaim:  groupsClaim,
+		RoleMap:      parseRoleMap(c.RoleMap),
+	}
+}
+
+// OIDCEnabled reports whether single sign-on is configured
+func OIDCEnabled() bool {
+	return oidcConfig.Issuer != "" && oidcConfig.ClientID != ""
+}
+
+type oidcClient struct {
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+var (
+	oidcMu     sync.Mutex
+	oidcCached *oidcClient
+)
+
+// getOIDCClient runs discovery on first use and caches the result, so an identity provider
+// that is down at startup doesn't stop the server from booting
+func getOIDCClient(ctx context.Context) (*oidcClient, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if oidcCached != nil {
+		return oidcCached, nil
+	}
+	provider, err := oidc.NewProvider(ctx, oidcConfig.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	redirect := oidcConfig.RedirectURL
+	if redirect == "" {
+		redirect = publicURL("/login/oidc/callback", nil)
+	}
+	oidcCached = &oidcClient{
+		oauth: oauth2.Config{
+			ClientID:     oidcConfig.ClientID,
+			ClientSecret: oidcConfig.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  redirect,
+			Scopes:       oidcConfig.Scopes,
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: oidcConfig.ClientID}),
+	}
+	return oidcCached, nil
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// OIDCLoginHandler starts the authorization code flow with PKCE: GET /login/oidc
+func OIDCLoginHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	startOIDCFlow(w, r, render, "")
+}
+
+// OIDCLinkHandler starts the same flow for a signed in user, to link the identity they sign
+// in with to their account: POST /account/link/oidc
+func OIDCLinkHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	startOIDCFlow(w, r, render, GetUserIDFromRequest(r))
+}
+
+// startOIDCFlow redirects to the identity provider. linkUserID is the account to link the
+// identity to, or "" to sign in with it.
+func startOIDCFlow(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any), linkUserID string) {
+	if !OIDCEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	client, err := getOIDCClient(r.Context())
+	if err != nil {
+		slog.Error("OIDC discovery failed", "issuer", oidcConfig.Issuer, "error", err)
+		w.WriteHeader(http.StatusBadGateway)
+		render(w, r, "login.html", map[string]any{"Error": "Single sign-on is currently unavailable"})
+		return
+	}
+	state, err1 := randomString()
+	nonce, err2 := randomString()
+	if err1 != nil || err2 != nil {
+		render(w, r, "login.html", map[string]any{"Error": "Server error"})
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+	// The state, nonce and PKCE verifier travel in a signed, short-lived cookie so the
+	// callback can check them without any server-side session storage
+	claims := jwt.MapClaims{
+		"purpose":  oidcPurpose,
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+		"exp":      time.Now().Add(oidcStateTTL).Unix(),
+	}
+	if linkUserID != "" {
+		claims["link"] = linkUserID
+	}
+	stateToken, err := signToken(claims)
+	if err != nil {
+		render(w, r, "login.html", map[string]any{"Error": "Server error"})
+		return
+	}
+	setCookie(w, r, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    stateToken,
+		Path:     "/login/oidc",
+		HttpOnly: true,
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, client.oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), http.StatusFound)
+}
+
+type oidcClaims struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Nonce             string `json:"nonce"`
+}
+
+var errOIDCState = errors.New("oidc state mismatch")
+
+// OIDCCallbackHandler finishes the flow, provisioning the account on first login or linking
+// the identity when the flow was started from the account page: GET /login/oidc/callback
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if !OIDCEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	fail := func(status int, msg string, err error) {
+		recordLogin("oidc", false)
+		logFor(r).Warn("OIDC login failed", "reason", msg, "error", err)
+		w.WriteHeader(status)
+		render(w, r, "login.html", map[string]any{"Error": "Single sign-on failed: " + msg})
+	}
+	clearCookie(w, r, oidcStateCookie, "/login/oidc", http.SameSiteLaxMode)
+
+	if e := r.URL.Query().Get("error"); e != "" {
+		fail(http.StatusUnauthorized, "the identity provider returned an error", errors.New(e+": "+r.URL.Query().Get("error_description")))
+		return
+	}
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		fail(http.StatusBadRequest, "the login session expired, please try again", err)
+		return
+	}
+	saved, err := ValidateJWT(cookie.Value)
+	if err != nil || saved["purpose"] != oidcPurpose || saved["state"] != r.URL.Query().Get("state") {
+		fail(http.StatusBadRequest, "the login session is invalid, please try again", errOIDCState)
+		return
+	}
+	client, err := getOIDCClient(r.Context())
+	if err != nil {
+		fail(http.StatusBadGateway, "the identity provider is unavailable", err)
+		return
+	}
+	verifier, _ := saved["verifier"].(string)
+	oauthToken, err := client.oauth.Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		fail(http.StatusUnauthorized, "could not exchange the authorization code", err)
+		return
+	}
+	rawIDToken, ok := oauthToken.Extra("id_token").(string)
+	if !ok {
+		fail(http.StatusUnauthorized, "no ID token was returned", nil)
+		return
+	}
+	idToken, err := client.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil {
+		fail(http.StatusUnauthorized, "the ID token is invalid", err)
+		return
+	}
+	var claims oidcClaims
+	var allClaims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		fail(http.StatusUnauthorized, "the ID token claims are invalid", err)
+		return
+	}
+	idToken.Claims(&allClaims)
+	if claims.Nonce != saved["nonce"] {
+		fail(http.StatusUnauthorized, "the ID token nonce doesn't match", errOIDCState)
+		return
+	}
+
+	if linkUserID, _ := saved["link"].(string); linkUserID != "" {
+		// The link must finish in the same browser session that started it
+		if current, err := getUserClaims(r); err != nil || current["userId"] != linkUserID {
+			fail(http.StatusForbidden, "sign in to SimpleHost again, then link single sign-on from your account page", err)
+			return
+		}
+		if err := linkExternalIdentity(linkUserID, "oidc:"+idToken.Issuer, claims.Subject); err != nil {
+			if errors.Is(err, errIdentityLinkedElsewhere) {
+				fail(http.StatusConflict, err.Error(), err)
+			} else {
+				fail(http.StatusInternalServerError, "the sign-in could not be linked", err)
+			}
+			return
+		}
+		http.Redirect(w, r, AppPath("/account"), http.StatusSeeOther)
+		return
+	}
+
+	mode, err := newAccountMode()
+	if err != nil {
+		fail(http.StatusInternalServerError, "your account could not be set up", err)
+		return
+	}
+	user, err := provisionOIDCUser(idToken.Issuer, claims, claimStrings(allClaims[oidcConfig.GroupsClaim]), mode)
+	switch {
+	case errors.Is(err, errIdentityNotLinked):
+		fail(http.StatusForbidden, "an account already uses your email address. Log in to it and link single sign-on from your account page.", err)
+		return
+	case errors.Is(err, errSignUpClosed):
+		fail(http.StatusForbidden, "no account is linked to this sign-in, and new accounts can't be created with it. Log in and link single sign-on from your account page, or ask an admin.", err)
+		return
+	case err != nil:
+		fail(http.StatusForbidden, "your account could not be set up", err)
+		return
+	}
+	recordLogin("oidc", true)
+	completeLogin(w, r, render, user)
+}
+
+// claimStrings accepts a claim that is either a list of strings or a single string
+func claimStrings(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var out []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// provisionOIDCUser maps the ID token claims onto a SimpleHost account
+func provisionOIDCUser(issuer string, claims oidcClaims, groups []string, mode string) (*models.User, error) {
+	role, syncRole := roleForGroups(oidcConfig.RoleMap, groups)
+	return provisionExternalUser(externalIdentity{
+		Provider:      "oidc:" + issuer,
+		Subject:       claims.Subject,
+		Username:      claims.PreferredUsername,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Role:          role,
+		SyncRole:      syncRole,
+	}, mode)
+}
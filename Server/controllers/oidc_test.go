@@ -0,0 +1,266 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"simplehost-server/config"
+	"simplehost-server/models"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockIssuer is a minimal OpenID provider: discovery, keys and a token endpoint that
+// returns the ID token claims a test queued for an authorization code
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+type mockGrant struct {
+	claims    jwt.MapClaims
+	challenge string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key, codes: map[string]mockGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                m.URL,
+			"authorization_endpoint":                m.URL + "/authorize",
+			"token_endpoint":                        m.URL + "/token",
+			"jwks_uri":                              m.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "test", "alg": "RS256", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, _ := r.BasicAuth(); id != "simplehost" || secret != "client-secret" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		m.mu.Lock()
+		grant, ok := m.codes[r.FormValue("code")]
+		delete(m.codes, r.FormValue("code"))
+		m.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, grant.claims)
+		token.Header["kid"] = "test"
+		idToken, err := token.SignedString(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "access", "token_type": "Bearer", "expires_in": 3600, "id_token": idToken})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+
+	oidcMu.Lock()
+	oidcCached = nil
+	oidcMu.Unlock()
+	oidcConfig = loadOIDCSettings(config.OIDC{Issuer: m.URL, ClientID: "simplehost", ClientSecret: "client-secret", RoleMap: "admins=admin"})
+	return m
+}
+
+// signIn runs the whole flow as the user the claims describe. start is the handler that
+// begins it; cookies are the browser's other cookies.
+func (m *mockIssuer) signIn(t *testing.T, start http.HandlerFunc, claims jwt.MapClaims, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/login/oidc", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	start(w, r)
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(location.String(), m.URL+"/authorize") {
+		t.Fatalf("the flow didn't start with a redirect to the issuer: %d %q", w.Code, w.Header().Get("Location"))
+	}
+	query := location.Query()
+
+	grant := jwt.MapClaims{
+		"iss":   m.URL,
+		"aud":   "simplehost",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for k, v := range claims {
+		grant[k] = v
+	}
+	m.mu.Lock()
+	m.codes["code-"+query.Get("state")] = mockGrant{grant, query.Get("code_challenge")}
+	m.mu.Unlock()
+
+	callback := httptest.NewRequest(http.MethodGet, "/login/oidc/callback?"+url.Values{"code": {"code-" + query.Get("state")}, "state": {query.Get("state")}}.Encode(), nil)
+	for _, c := range append(w.Result().Cookies(), cookies...) {
+		callback.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	OIDCCallbackHandler(w, callback, renderStub)
+	return w
+}
+
+func loginOIDC(w http.ResponseWriter, r *http.Request) { OIDCLoginHandler(w, r, renderStub) }
+
+// sessionUser returns the user a response logged in, or nil
+func sessionUser(t *testing.T, w *httptest.ResponseRecorder) *models.User {
+	t.Helper()
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "jwt" && c.Value != "" {
+			claims, err := validateSession(c.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			user, err := models.GetUserByID(claims["userId"].(string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return user
+		}
+	}
+	return nil
+}
+
+func TestOIDCSignUpAndSignIn(t *testing.T) {
+	setupServer(t)
+	createUser(t, "admin", true)
+	issuer := newMockIssuer(t)
+	claims := jwt.MapClaims{"sub": "u-1", "email": "frank@example.com", "email_verified": true, "preferred_username": "frank", "groups": []string{"admins"}}
+
+	w := issuer.signIn(t, loginOIDC, claims)
+	user := sessionUser(t, w)
+	if user == nil {
+		t.Fatalf("the first sign-in didn't log in: %d %s", w.Code, w.Body.String())
+	}
+	if user.Username != "frank" || !user.EmailVerified || user.Role != models.RoleAdmin {
+		t.Fatalf("provisioned %+v, want frank with a verified email and the admin role from groups", user)
+	}
+
+	claims["groups"] = []string{"staff"}
+	w = issuer.signIn(t, loginOIDC, claims)
+	again := sessionUser(t, w)
+	if again == nil || again.ID != user.ID {
+		t.Fatal("signing in again didn't log in to the same account")
+	}
+	if again.Role != models.RoleUser {
+		t.Fatalf("role %q after leaving the admins group, want user", again.Role)
+	}
+
+	claims["nonce"] = "something else"
+	if w := issuer.signIn(t, loginOIDC, claims); sessionUser(t, w) != nil || w.Code != http.StatusUnauthorized {
+		t.Fatalf("a token with the wrong nonce: got status %d", w.Code)
+	}
+}
+
+func TestOIDCNeverLinksByEmail(t *testing.T) {
+	setupServer(t)
+	admin := createUser(t, "admin", true)
+	issuer := newMockIssuer(t)
+
+	// The provider says the email is verified, but that doesn't make the account theirs
+	w := issuer.signIn(t, loginOIDC, jwt.MapClaims{"sub": "attacker", "email": admin.Email, "email_verified": true, "groups": []string{"staff"}})
+	if sessionUser(t, w) != nil || w.Code != http.StatusForbidden {
+		t.Fatalf("signing in with an existing account's email: got status %d, %s", w.Code, w.Body.String())
+	}
+	if linked, _, _ := models.GetUserByIdentity("oidc:"+issuer.URL, "attacker"); linked != nil {
+		t.Fatal("the identity was linked to the existing account")
+	}
+	if stored, _ := models.GetUserByID(admin.ID); stored.Role != models.RoleAdmin {
+		t.Fatal("the existing account's role was changed")
+	}
+}
+
+func TestOIDCSignUpFollowsRegistrationMode(t *testing.T) {
+	setupServer(t)
+	createUser(t, "admin", true)
+	issuer := newMockIssuer(t)
+
+	for i, mode := range []string{models.RegistrationClosed, models.RegistrationInvite} {
+		models.SetSetting(models.SettingRegistrationMode, mode)
+		w := issuer.signIn(t, loginOIDC, jwt.MapClaims{"sub": "closed-" + mode, "email": mode + "@example.com", "email_verified": true})
+		if sessionUser(t, w) != nil || w.Code != http.StatusForbidden {
+			t.Fatalf("%s registration: got status %d", mode, w.Code)
+		}
+		if count, _ := models.CountUsers(); count != 1 {
+			t.Fatalf("%s registration: %d accounts after sign-in %d, want 1", mode, count, i+1)
+		}
+	}
+
+	models.SetSetting(models.SettingRegistrationMode, models.RegistrationApproval)
+	w := issuer.signIn(t, loginOIDC, jwt.MapClaims{"sub": "pending", "email": "grace@example.com", "email_verified": true})
+	if sessionUser(t, w) != nil || !strings.Contains(w.Body.String(), "waiting for an admin") {
+		t.Fatalf("approval registration: got status %d, %s", w.Code, w.Body.String())
+	}
+	pending, _, err := models.GetUserByIdentity("oidc:"+issuer.URL, "pending")
+	if err != nil || pending == nil || pending.Approved {
+		t.Fatalf("approval registration: account %+v, %v; want one waiting for approval", pending, err)
+	}
+	notified := false
+	for _, msg := range outbox(t) {
+		notified = notified || strings.Contains(msg, "To: admin@example.com") && strings.Contains(msg, "waiting for approval")
+	}
+	if !notified {
+		t.Fatal("the admins weren't told about the account waiting for approval")
+	}
+}
+
+func TestOIDCLinkFromAccountPage(t *testing.T) {
+	setupServer(t)
+	createUser(t, "admin", true)
+	local := createUser(t, "heidi", true)
+	other := createUser(t, "ivan", true)
+	issuer := newMockIssuer(t)
+	link := AuthMiddleware(func(w http.ResponseWriter, r *http.Request) { OIDCLinkHandler(w, r, renderStub) })
+	claims := jwt.MapClaims{"sub": "heidi-sso", "email": local.Email, "email_verified": true, "groups": []string{"admins"}}
+
+	// The link has to finish in the session that started it
+	w := issuer.signIn(t, link, claims, sessionCookie(t, local))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/account" {
+		t.Fatalf("linking: got status %d, %s", w.Code, w.Body.String())
+	}
+	w = issuer.signIn(t, loginOIDC, claims)
+	user := sessionUser(t, w)
+	if user == nil || user.ID != local.ID {
+		t.Fatal("signing in after linking didn't log in to the linked account")
+	}
+	if user.Role != models.RoleUser {
+		t.Fatal("group roles were applied to an account that was linked rather than created")
+	}
+
+	if w := issuer.signIn(t, link, claims, sessionCookie(t, other)); w.Code != http.StatusConflict {
+		t.Fatalf("linking an identity that belongs to another account: got status %d", w.Code)
+	}
+}
@@ -0,0 +1,341 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"simplehost-server/models"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	passkeySessionCookie = "webauthn_session"
+	passkeySessionTTL    = 5 * time.Minute
+	// Login ceremonies can be started without an account, so the number kept in memory is
+	// capped, both overall and per client IP
+	maxPasskeySessions      = 10000
+	maxPasskeySessionsPerIP = 20
+)
+
+// webauthnUser adapts a models.User and its passkeys to the webauthn.User interface.
+// The user handle is the account ID, which lets discoverable logins find the account.
+type webauthnUser struct {
+	user     *models.User
+	passkeys []models.Passkey
+}
+
+func (u *webauthnUser) WebAuthnID() []byte          { return []byte(u.user.ID) }
+func (u *webauthnUser) WebAuthnName() string        { return u.user.Username }
+func (u *webauthnUser) WebAuthnDisplayName() string { return u.user.Username }
+
+func (u *webauthnUser) WebAuthnCredentials() []webauthn.Credential {
+	var creds []webauthn.Credential
+	for _, p := range u.passkeys {
+		var c webauthn.Credential
+		if err := json.Unmarshal(p.Credential, &c); err == nil {
+			creds = append(creds, c)
+		}
+	}
+	return creds
+}
+
+func loadWebauthnUser(userID string) (*webauthnUser, error) {
+	user, err := models.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	passkeys, err := models.ListPasskeys(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &webauthnUser{user: user, passkeys: passkeys}, nil
+}
+
+var (
+	webauthnOnce     sync.Once
+	webauthnInstance *webauthn.WebAuthn
+	webauthnErr      error
+)
+
+// getWebAuthn builds the relying party from the webauthn config section, whose RP ID and
+// origins default to the host and origin of the public URL
+func getWebAuthn() (*webauthn.WebAuthn, error) {
+	webauthnOnce.Do(func() {
+		public, err := url.Parse(publicURL("", nil))
+		if err != nil {
+			webauthnErr = err
+			return
+		}
+		rpID := appConfig.WebAuthn.RPID
+		if rpID == "" {
+			rpID = public.Hostname()
+		}
+		origins := appConfig.WebAuthn.Origins
+		if len(origins) == 0 {
+			origins = []string{public.Scheme + "://" + public.Host}
+		}
+		webauthnInstance, webauthnErr = webauthn.New(&webauthn.Config{
+			RPID:          rpID,
+			RPDisplayName: "SimpleHost",
+			RPOrigins:     origins,
+		})
+	})
+	return webauthnInstance, webauthnErr
+}
+
+// passkeySession is the server-side state of one registration or login ceremony
+type passkeySession struct {
+	data    webauthn.SessionData
+	userID  string
+	ip      string
+	expires time.Time
+}
+
+// Ceremony state is kept in memory and referenced by an opaque cookie, so every challenge
+// can only be answered once
+var (
+	passkeySessionsMu sync.Mutex
+	passkeySessions   = map[string]passkeySession{}
+)
+
+var errTooManyPasskeySessions = errors.New("too many passkey ceremonies in progress")
+
+func savePasskeySession(w http.ResponseWriter, r *http.Request, userID string, data *webauthn.SessionData) error {
+	id, err := randomString()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	ip := ClientIP(r)
+	passkeySessionsMu.Lock()
+	fromIP := 0
+	for key, s := range passkeySessions {
+		if now.After(s.expires) {
+			delete(passkeySessions, key)
+		} else if s.ip == ip {
+			fromIP++
+		}
+	}
+	if len(passkeySessions) >= maxPasskeySessions || fromIP >= maxPasskeySessionsPerIP {
+		passkeySessionsMu.Unlock()
+		return errTooManyPasskeySessions
+	}
+	passkeySessions[id] = passkeySession{data: *data, userID: userID, ip: ip, expires: now.Add(passkeySessionTTL)}
+	passkeySessionsMu.Unlock()
+	setCookie(w, r, &http.Cookie{
+		Name:     passkeySessionCookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		MaxAge:   int(passkeySessionTTL.Seconds()),
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+var errNoPasskeySession = errors.New("no passkey ceremony in progress")
+
+// takePasskeySession returns the ceremony state and removes it so it can't be reused
+func takePasskeySession(w http.ResponseWriter, r *http.Request) (passkeySession, error) {
+	clearCookie(w, r, passkeySessionCookie, "/", http.SameSiteStrictMode)
+	cookie, err := r.Cookie(passkeySessionCookie)
+	if err != nil {
+		return passkeySession{}, errNoPasskeySession
+	}
+	passkeySessionsMu.Lock()
+	defer passkeySessionsMu.Unlock()
+	s, ok := passkeySessions[cookie.Value]
+	delete(passkeySessions, cookie.Value)
+	if !ok || time.Now().After(s.expires) {
+		return passkeySession{}, errNoPasskeySession
+	}
+	return s, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// PasskeyRegisterBeginHandler returns creation options for a new passkey: POST /account/passkeys/register/begin
+func PasskeyRegisterBeginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	wa, err := getWebAuthn()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Passkeys are not configured"})
+		return
+	}
+	user, err := loadWebauthnUser(GetUserIDFromRequest(r))
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+		return
+	}
+	creation, session, err := wa.BeginRegistration(user,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithExclusions(webauthn.Credentials(user.WebAuthnCredentials()).CredentialDescriptors()),
+	)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := savePasskeySession(w, r, user.user.ID, session); err != nil {
+		if errors.Is(err, errTooManyPasskeySessions) {
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "Too many passkey requests, please try again in a few minutes"})
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Server error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, creation)
+}
+
+// PasskeyRegisterFinishHandler verifies the new credential and stores it: POST /account/passkeys/register/finish?name=...
+func PasskeyRegisterFinishHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	wa, err := getWebAuthn()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Passkeys are not configured"})
+		return
+	}
+	session, err := takePasskeySession(w, r)
+	if err != nil || session.userID != GetUserIDFromRequest(r) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Registration expired, please try again"})
+		return
+	}
+	user, err := loadWebauthnUser(session.userID)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+		return
+	}
+	credential, err := wa.FinishRegistration(user, session.data, r)
+	if err != nil {
+		logFor(r).Warn("Passkey registration failed", "user_id", user.user.ID, "error", err)
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Passkey registration failed"})
+		return
+	}
+	encoded, err := json.Marshal(credential)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Server error"})
+		return
+	}
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" {
+		name = "Passkey"
+	}
+	err = models.InsertPasskey(models.Passkey{
+		ID:         base64.RawURLEncoding.EncodeToString(credential.ID),
+		UserID:     user.user.ID,
+		Name:       name,
+		Credential: encoded,
+		CreatedAt:  time.Now(),
+	})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to save passkey"})
+		return
+	}
+	logFor(r).Info("Registered passkey", "user_id", user.user.ID, "name", name)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "registered"})
+}
+
+// DeletePasskeyHandler removes a passkey from the account page: POST /account/passkeys/delete
+func DeletePasskeyHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := models.DeletePasskey(r.FormValue("passkey_id"), GetUserIDFromRequest(r)); err != nil {
+		accountResponse(w, r, render, http.StatusNotFound, "Passkey not found", true)
+		return
+	}
+	accountResponse(w, r, render, http.StatusOK, "Passkey removed.", false)
+}
+
+// PasskeyLoginBeginHandler starts a usernameless login: POST /login/passkey/begin
+func PasskeyLoginBeginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	wa, err := getWebAuthn()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Passkeys are not configured"})
+		return
+	}
+	assertion, session, err := wa.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := savePasskeySession(w, r, "", session); err != nil {
+		if errors.Is(err, errTooManyPasskeySessions) {
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "Too many passkey requests, please try again in a few minutes"})
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Server error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, assertion)
+}
+
+// PasskeyLoginFinishHandler verifies the assertion and issues the same session cookie as
+// LoginHandler: POST /login/passkey/finish
+func PasskeyLoginFinishHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	wa, err := getWebAuthn()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Passkeys are not configured"})
+		return
+	}
+	session, err := takePasskeySession(w, r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Login expired, please try again"})
+		return
+	}
+	ip := ClientIP(r)
+	if ok, wait := loginIPLimiter.Allow(ip); !ok {
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": retryMessage(wait)})
+		return
+	}
+	var matched *webauthnUser
+	credential, err := wa.FinishDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		u, err := loadWebauthnUser(string(userHandle))
+		matched = u
+		return u, err
+	}, session.data, r)
+	if err != nil || matched == nil {
+		recordLogin("passkey", false)
+		loginIPLimiter.Fail(ip)
+		logFor(r).Warn("Failed passkey login", "ip", ip, "error", err)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "Passkey not recognized"})
+		return
+	}
+	if encoded, err := json.Marshal(credential); err == nil {
+		models.UpdatePasskeyCredential(base64.RawURLEncoding.EncodeToString(credential.ID), encoded)
+	}
+	recordLogin("passkey", true)
+	loginIPLimiter.Release(ip)
+	redirect, status, message := beginSession(w, r, matched.user)
+	if message != "" {
+		writeJSON(w, status, map[string]string{"error": message})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"redirect": redirect})
+}
@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"simplehost-server/models"
+)
+
+// Passkey logins go through beginSession, so they get the same checks as the login page
+func TestBeginSessionAppliesAccountPolicies(t *testing.T) {
+	setupServer(t)
+	createUser(t, "admin", true)
+	unverified := createUser(t, "kim", false)
+	verified := createUser(t, "lee", true)
+
+	start := func(user *models.User) (string, int, string, *httptest.ResponseRecorder) {
+		w := httptest.NewRecorder()
+		redirect, status, message := beginSession(w, httptest.NewRequest(http.MethodPost, "/login/passkey/finish", nil), user)
+		return redirect, status, message, w
+	}
+	hasSession := func(w *httptest.ResponseRecorder) bool {
+		for _, c := range w.Result().Cookies() {
+			if c.Name == "jwt" && c.Value != "" {
+				return true
+			}
+		}
+		return false
+	}
+
+	if _, status, message, w := start(unverified); status != http.StatusForbidden || !strings.Contains(message, "verify your email") || hasSession(w) {
+		t.Fatalf("unverified email: %d %q", status, message)
+	}
+	if len(outbox(t)) != 1 {
+		t.Fatal("no verification email was sent")
+	}
+
+	if redirect, _, _, w := start(verified); redirect != "/simplehost" || !hasSession(w) {
+		t.Fatalf("verified account: redirected to %q", redirect)
+	}
+
+	models.SetSetting(models.SettingRequire2FA, "true")
+	if redirect, _, _, w := start(verified); redirect != "/login/2fa/setup" || hasSession(w) {
+		t.Fatalf("with 2FA required: redirected to %q", redirect)
+	}
+	if err := models.EnableTOTP(verified.ID, "JBSWY3DPEHPK3PXP", 0); err != nil {
+		t.Fatal(err)
+	}
+	verified, _ = models.GetUserByID(verified.ID)
+	if redirect, _, _, w := start(verified); redirect != "/login/2fa" || hasSession(w) {
+		t.Fatalf("with 2FA enabled: redirected to %q", redirect)
+	}
+}
+
+func TestPasskeyLoginCeremoniesAreCapped(t *testing.T) {
+	setupServer(t)
+	passkeySessionsMu.Lock()
+	passkeySessions = map[string]passkeySession{}
+	passkeySessionsMu.Unlock()
+
+	begin := func(ip string) int {
+		r := httptest.NewRequest(http.MethodPost, "/login/passkey/begin", nil)
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		PasskeyLoginBeginHandler(w, r)
+		return w.Code
+	}
+	for i := 0; i < maxPasskeySessionsPerIP; i++ {
+		if code := begin("192.0.2.1"); code != http.StatusOK {
+			t.Fatalf("ceremony %d: got status %d", i+1, code)
+		}
+	}
+	if code := begin("192.0.2.1"); code != http.StatusTooManyRequests {
+		t.Fatalf("one ceremony too many from an IP: got status %d", code)
+	}
+	if code := begin("192.0.2.2"); code != http.StatusOK {
+		t.Fatalf("another IP was turned away: got status %d", code)
+	}
+}
@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"net/http"
+	"path"
+	"time"
+
+	"simplehost-server/vfs"
+)
+
+// apiEntry describes a folder or file to API clients
+type apiEntry struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Path      string     `json:"path"`
+	Type      string     `json:"type"` // "folder" or "file"
+	Size      int64      `json:"size"`
+	OwnerID   string     `json:"owner_id"`
+	Uploaded  *time.Time `json:"uploaded,omitempty"`
+	CanDelete bool       `json:"can_delete"`
+}
+
+func newAPIEntry(n *vfs.Node, p string) apiEntry {
+	e := apiEntry{ID: n.ID(), Name: n.Name(), Path: p, Size: n.Size()}
+	if n.File != nil {
+		uploaded := n.File.UploadedDate
+		e.Type, e.OwnerID, e.Uploaded, e.CanDelete = "file", n.File.OwnerID, &uploaded, n.File.CanDelete
+	} else {
+		e.Type, e.OwnerID, e.CanDelete = "folder", n.Folder.OwnerID, n.Folder.CanDelete
+	}
+	return e
+}
+
+// PathAPIHandler looks up a slash-separated path as the user sees it and returns the item,
+// along with a folder's contents: GET /api/list?path=/photos/2024
+func PathAPIHandler(w http.ResponseWriter, r *http.Request) {
+	p := path.Clean("/" + r.URL.Query().Get("path"))
+	fsys := vfs.New(GetUserIDFromRequest(r))
+	node, err := fsys.Stat(r.Context(), p)
+	if err == vfs.ErrNotExist {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "No such file or folder"})
+		return
+	}
+	if err != nil {
+		logFor(r).Error("Failed to look up path", "path", p, "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to look up path"})
+		return
+	}
+	result := map[string]any{"item": newAPIEntry(node, p)}
+	if node.IsDir() {
+		nodes, err := fsys.ReadDir(r.Context(), p)
+		if err != nil {
+			logFor(r).Error("Failed to list folder", "path", p, "error", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to list folder"})
+			return
+		}
+		children := make([]apiEntry, 0, len(nodes))
+		for _, n := range nodes {
+			children = append(children, newAPIEntry(n, path.Join(p, n.Name())))
+		}
+		result["children"] = children
+	}
+	writeJSON(w, http.StatusOK, result)
+}
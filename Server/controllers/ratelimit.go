@@ -0,0 +1,164 @@
+package controllers
+
+import (
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"simplehost-server/config"
+)
+
+type attemptState struct {
+	failures     int
+	pending      int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// RateLimiter tracks failed attempts per key (an IP or an account) and applies exponential
+// backoff followed by a temporary lockout. Allow reserves an attempt, which then counts
+// against the free attempts until the caller settles it with Fail, Release or Reset, so
+// parallel attempts can't all get in before the first one fails.
+type RateLimiter struct {
+	name   string
+	config config.RateLimit
+	mu     sync.Mutex
+	state  map[string]*attemptState
+}
+
+func NewRateLimiter(name string, limits config.RateLimit) *RateLimiter {
+	rl := &RateLimiter{name: name, config: limits, state: map[string]*attemptState{}}
+	go rl.cleanup()
+	return rl
+}
+
+// Allow reports whether another attempt for key may proceed, and if not, how long to wait.
+// An allowed attempt must be settled with Fail, Release or Reset.
+func (rl *RateLimiter) Allow(key string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	s, ok := rl.state[key]
+	if !ok {
+		s = &attemptState{}
+		rl.state[key] = s
+	} else if now.After(s.blockedUntil) && now.Sub(s.lastFailure) > rl.config.ResetAfter {
+		s.failures = 0
+	}
+	if wait := s.blockedUntil.Sub(now); wait > 0 {
+		return false, wait
+	}
+	// Attempts in flight count as failures: once the free attempts are used up, only one
+	// attempt at a time may wait for its result
+	if s.pending > 0 && s.failures+s.pending >= max(rl.config.FreeAttempts, 1) {
+		return false, rl.config.BaseDelay
+	}
+	s.pending++
+	return true, 0
+}
+
+// Fail records that an attempt Allow let through failed
+func (rl *RateLimiter) Fail(key string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	s, ok := rl.state[key]
+	if !ok {
+		s = &attemptState{}
+		rl.state[key] = s
+	}
+	if s.pending > 0 {
+		s.pending--
+	}
+	s.failures++
+	s.lastFailure = now
+
+	if rl.config.LockoutThreshold > 0 && s.failures >= rl.config.LockoutThreshold {
+		if s.failures == rl.config.LockoutThreshold {
+			slog.Warn("Locking out after repeated failures", "limiter", rl.name, "key", key, "duration", rl.config.LockoutDuration, "failures", s.failures)
+		}
+		s.blockedUntil = now.Add(rl.config.LockoutDuration)
+		return
+	}
+	if s.failures > rl.config.FreeAttempts {
+		exp := float64(s.failures - rl.config.FreeAttempts - 1)
+		delay := time.Duration(float64(rl.config.BaseDelay) * math.Pow(2, exp))
+		if delay > rl.config.MaxDelay || delay <= 0 {
+			delay = rl.config.MaxDelay
+		}
+		s.blockedUntil = now.Add(delay)
+	}
+}
+
+// Release settles an attempt Allow let through that didn't fail, keeping the failure
+// history. Use it where one success shouldn't wipe out other failures, e.g. for an IP.
+func (rl *RateLimiter) Release(key string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if s, ok := rl.state[key]; ok && s.pending > 0 {
+		s.pending--
+	}
+}
+
+// Reset settles an attempt Allow let through and clears the failure history for key,
+// e.g. after a successful login to the account
+func (rl *RateLimiter) Reset(key string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	s, ok := rl.state[key]
+	if !ok {
+		return
+	}
+	if s.pending > 1 {
+		*s = attemptState{pending: s.pending - 1}
+		return
+	}
+	delete(rl.state, key)
+}
+
+// cleanup periodically drops entries that are no longer blocked and have gone quiet
+func (rl *RateLimiter) cleanup() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		rl.mu.Lock()
+		for key, s := range rl.state {
+			if s.pending == 0 && now.After(s.blockedUntil) && now.Sub(s.lastFailure) > rl.config.ResetAfter {
+				delete(rl.state, key)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+// Limiters used by the login and registration handlers, built by Configure
+var (
+	loginAccountLimiter *RateLimiter
+	loginIPLimiter      *RateLimiter
+	registerIPLimiter   *RateLimiter
+)
+
+// checkLoginLimits reserves a login attempt with both the IP and the account limiter,
+// returning how long to wait when either refuses. Call it before authenticating, so
+// throttled attempts never reach the password hasher or LDAP.
+func checkLoginLimits(ip, account string) (bool, time.Duration) {
+	if ok, wait := loginIPLimiter.Allow(ip); !ok {
+		return false, wait
+	}
+	if ok, wait := loginAccountLimiter.Allow(account); !ok {
+		loginIPLimiter.Release(ip)
+		return false, wait
+	}
+	return true, 0
+}
+
+func accountKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+func retryMessage(wait time.Duration) string {
+	return "Too many attempts. Please try again in " + (wait + time.Second - 1).Truncate(time.Second).String() + "."
+}
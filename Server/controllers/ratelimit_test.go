@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"simplehost-server/config"
+)
+
+func TestRateLimiterCountsAttemptsInFlight(t *testing.T) {
+	rl := NewRateLimiter("test", config.RateLimit{FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Minute, ResetAfter: time.Hour})
+	// Only the free attempts get in at once, however many arrive before the first fails
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.Allow("ip"); !ok {
+			t.Fatalf("attempt %d refused", i+1)
+		}
+	}
+	if ok, _ := rl.Allow("ip"); ok {
+		t.Fatal("a fourth attempt in flight was allowed")
+	}
+	rl.Fail("ip")
+	rl.Fail("ip")
+	if ok, _ := rl.Allow("ip"); ok {
+		t.Fatal("allowed an attempt while two failures and one attempt in flight use up the free attempts")
+	}
+	rl.Fail("ip")
+	// The free attempts are used up, so another one can start, but only one at a time
+	if ok, _ := rl.Allow("ip"); !ok {
+		t.Fatal("refused the first attempt after the free ones")
+	}
+	if ok, _ := rl.Allow("ip"); ok {
+		t.Fatal("allowed a second attempt in flight after the free ones")
+	}
+	rl.Fail("ip")
+	if ok, wait := rl.Allow("ip"); ok || wait <= 0 {
+		t.Fatalf("Allow after a failure past the free attempts = %v, %v; want a delay", ok, wait)
+	}
+}
+
+func TestRateLimiterReleaseKeepsFailures(t *testing.T) {
+	rl := NewRateLimiter("test", config.RateLimit{FreeAttempts: 2, BaseDelay: time.Minute, MaxDelay: time.Hour, ResetAfter: time.Hour})
+	for i := 0; i < 2; i++ {
+		rl.Allow("ip")
+		rl.Fail("ip")
+	}
+	// A successful login from the same IP settles its own attempt but keeps the failures
+	if ok, _ := rl.Allow("ip"); !ok {
+		t.Fatal("refused an attempt within the free ones")
+	}
+	rl.Release("ip")
+	rl.Allow("ip")
+	rl.Fail("ip")
+	if ok, _ := rl.Allow("ip"); ok {
+		t.Fatal("Release cleared the failure history")
+	}
+
+	rl.Allow("account")
+	rl.Fail("account")
+	rl.Allow("account")
+	rl.Reset("account")
+	rl.Allow("account")
+	rl.Fail("account")
+	rl.Allow("account")
+	rl.Fail("account")
+	if ok, _ := rl.Allow("account"); !ok {
+		t.Fatal("Reset didn't clear the failure history")
+	}
+}
+
+func TestCheckLoginLimitsReleasesTheIPWhenTheAccountIsLimited(t *testing.T) {
+	setupServer(t)
+	loginIPLimiter = NewRateLimiter("test-ip", config.RateLimit{FreeAttempts: 1, BaseDelay: time.Second, MaxDelay: time.Minute, ResetAfter: time.Hour})
+	loginAccountLimiter = NewRateLimiter("test-account", config.RateLimit{FreeAttempts: 1, BaseDelay: time.Second, MaxDelay: time.Minute, ResetAfter: time.Hour})
+
+	if ok, _ := checkLoginLimits("192.0.2.1", "victim"); !ok {
+		t.Fatal("the first attempt was refused")
+	}
+	// Another IP guessing at the same account is refused, without using up its own attempt
+	if ok, _ := checkLoginLimits("192.0.2.2", "victim"); ok {
+		t.Fatal("a second attempt at the account was allowed while the first is in flight")
+	}
+	if ok, _ := checkLoginLimits("192.0.2.2", "someone-else"); !ok {
+		t.Fatal("the IP's reservation wasn't released when the account limiter refused")
+	}
+}
@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HTTPSRedirectHandler answers plain HTTP by redirecting to the same path over HTTPS. The
+// target is server.public_url when that is an https URL, otherwise the requested host on
+// the port server.addr listens on.
+func HTTPSRedirectHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := url.URL{Scheme: "https", Host: httpsHost(r), Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		// Clients may turn a POST into a GET on a 301, so other methods get a 308 which
+		// keeps the method and body
+		status := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, target.String(), status)
+	})
+}
+
+func httpsHost(r *http.Request) string {
+	if u, err := url.Parse(appConfig.Server.PublicURL); err == nil && u.Scheme == "https" && u.Host != "" {
+		return u.Host
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = strings.Trim(r.Host, "[]")
+	}
+	_, port, err := net.SplitHostPort(appConfig.Server.Addr)
+	if err != nil || port == "" || port == "443" {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"simplehost-server/mailer"
+	"simplehost-server/models"
+)
+
+// RegistrationMode returns the admin's registration policy. Until an admin picks one,
+// auth.registration_mode decides, and registration stays open if that isn't valid.
+func RegistrationMode() string {
+	fallback := appConfig.Auth.RegistrationMode
+	if !validRegistrationMode(fallback) {
+		fallback = models.RegistrationOpen
+	}
+	mode := models.GetSetting(models.SettingRegistrationMode, fallback)
+	if !validRegistrationMode(mode) {
+		return models.RegistrationClosed
+	}
+	return mode
+}
+
+// newAccountMode returns the registration mode that applies to a new account. The policy
+// doesn't apply to the first account, which sets up the instance.
+func newAccountMode() (string, error) {
+	count, err := models.CountUsers()
+	if err != nil {
+		return "", err
+	}
+	if count == 0 {
+		return models.RegistrationOpen, nil
+	}
+	return RegistrationMode(), nil
+}
+
+func validRegistrationMode(mode string) bool {
+	switch mode {
+	case models.RegistrationOpen, models.RegistrationClosed, models.RegistrationInvite, models.RegistrationApproval:
+		return true
+	}
+	return false
+}
+
+// notifyAdminsOfPendingUser lets admins know there is an account waiting for approval
+func notifyAdminsOfPendingUser(user *models.User) {
+	users, err := models.ListUsers()
+	if err != nil {
+		slog.Error("Failed to list admins", "error", err)
+		return
+	}
+	for _, admin := range users {
+		if !admin.IsAdmin() {
+			continue
+		}
+		err := Mailer.Send(mailer.Message{
+			To:      admin.Email,
+			Subject: "A SimpleHost account is waiting for approval",
+			Body: fmt.Sprintf("Hi %s,\n\n%s (%s) registered and is waiting for approval:\n\n%s\n",
+				admin.Username, user.Username, user.Email, publicURL("/admin", nil)),
+		})
+		if err != nil {
+			slog.Error("Failed to notify admin of pending user", "admin_id", admin.ID, "user_id", user.ID, "error", err)
+		}
+	}
+}
+
+// AdminApproveUserHandler approves or rejects an account in the approval queue: POST /admin/users/approve
+// Form fields: user_id and action ("approve" or "reject")
+func AdminApproveUserHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := models.GetUserByID(r.FormValue("user_id"))
+	if err != nil || user.Approved {
+		renderAdmin(w, r, render, http.StatusNotFound, "No pending account found", true)
+		return
+	}
+	switch r.FormValue("action") {
+	case "approve":
+		if err := models.ApproveUser(user.ID); err != nil {
+			renderAdmin(w, r, render, http.StatusInternalServerError, "Failed to approve account", true)
+			return
+		}
+		logFor(r).Info("Approved user", "admin_id", GetUserIDFromRequest(r), "user_id", user.ID)
+		err := Mailer.Send(mailer.Message{
+			To:      user.Email,
+			Subject: "Your SimpleHost account has been approved",
+			Body:    fmt.Sprintf("Hi %s,\n\nYour account has been approved. You can log in here:\n\n%s\n", user.Username, publicURL("/login", nil)),
+		})
+		if err != nil {
+			logFor(r).Error("Failed to send approval email", "user_id", user.ID, "error", err)
+		}
+		renderAdmin(w, r, render, http.StatusOK, "Account approved.", false)
+	case "reject":
+		// A pending account has never been able to log in, so it owns no files
+		if err := models.DeleteUser(user.ID); err != nil {
+			renderAdmin(w, r, render, http.StatusInternalServerError, "Failed to reject account", true)
+			return
+		}
+		logFor(r).Info("Rejected user", "admin_id", GetUserIDFromRequest(r), "user_id", user.ID, "username", user.Username)
+		renderAdmin(w, r, render, http.StatusOK, "Account rejected.", false)
+	default:
+		renderAdmin(w, r, render, http.StatusBadRequest, "Invalid action", true)
+	}
+}
+
+// AdminCreateInviteHandler creates an invite code: POST /admin/invites
+// Form fields: max_uses and expires_days
+func AdminCreateInviteHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	maxUses, err := strconv.Atoi(r.FormValue("max_uses"))
+	if err != nil || maxUses < 1 {
+		renderAdmin(w, r, render, http.StatusBadRequest, "Uses must be at least 1", true)
+		return
+	}
+	days, err := strconv.Atoi(r.FormValue("expires_days"))
+	if err != nil || days < 1 {
+		renderAdmin(w, r, render, http.StatusBadRequest, "Expiry must be at least 1 day", true)
+		return
+	}
+	invite, code, err := models.CreateInviteCode(GetUserIDFromRequest(r), maxUses, time.Duration(days)*24*time.Hour)
+	if err != nil {
+		renderAdmin(w, r, render, http.StatusInternalServerError, "Failed to create invite code", true)
+		return
+	}
+	logFor(r).Info("Created invite code", "admin_id", GetUserIDFromRequest(r), "invite_id", invite.ID, "max_uses", maxUses, "days", days)
+	renderAdmin(w, r, render, http.StatusOK, fmt.Sprintf("Invite code created: %s — copy it now, it won't be shown again.", code), false)
+}
+
+// AdminDeleteInviteHandler revokes an invite code: POST /admin/invites/delete
+func AdminDeleteInviteHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := models.DeleteInviteCode(r.FormValue("invite_id")); err != nil {
+		renderAdmin(w, r, render, http.StatusInternalServerError, "Failed to revoke invite code", true)
+		return
+	}
+	logFor(r).Info("Revoked invite code", "admin_id", GetUserIDFromRequest(r), "invite_id", r.FormValue("invite_id"))
+	renderAdmin(w, r, render, http.StatusOK, "Invite code revoked.", false)
+}
@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"simplehost-server/models"
+)
+
+func register(username, inviteCode string) *httptest.ResponseRecorder {
+	handler := func(w http.ResponseWriter, r *http.Request) { RegisterHandler(w, r, renderStub) }
+	return postFormFrom("198.51.100.7", handler, "/register", url.Values{
+		"username":    {username},
+		"email":       {username + "@example.com"},
+		"password":    {testPassword},
+		"retype":      {testPassword},
+		"invite_code": {inviteCode},
+	})
+}
+
+func TestRegisterWithInviteCode(t *testing.T) {
+	setupServer(t)
+	admin := createUser(t, "admin", true)
+	models.SetSetting(models.SettingRegistrationMode, models.RegistrationInvite)
+	_, code, err := models.CreateInviteCode(admin.ID, 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, expired, err := models.CreateInviteCode(admin.ID, 1, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ username, code string }{{"nocode", ""}, {"late", expired}} {
+		if w := register(tc.username, tc.code); !strings.Contains(w.Body.String(), "invite code is invalid") {
+			t.Errorf("%s: got %d %q", tc.username, w.Code, w.Body)
+		}
+	}
+	if w := register("olive", code); strings.Contains(w.Body.String(), "invite code") {
+		t.Fatalf("registering with a good code: %d %q", w.Code, w.Body)
+	}
+	if w := register("peggy", code); !strings.Contains(w.Body.String(), "invite code is invalid") {
+		t.Errorf("registering with a used up code: %d %q", w.Code, w.Body)
+	}
+	if count, _ := models.CountUsers(); count != 2 {
+		t.Fatalf("%d accounts, want the admin and olive", count)
+	}
+}
+
+func TestUnapprovedAccountCantLogIn(t *testing.T) {
+	setupServer(t)
+	createUser(t, "admin", true)
+	models.SetSetting(models.SettingRegistrationMode, models.RegistrationApproval)
+	register("quinn", "")
+	user, err := models.GetUserByUsername("quinn")
+	if err != nil || user.Approved {
+		t.Fatalf("registering in approval mode: %+v, %v", user, err)
+	}
+	// Even an account whose address is verified waits for approval
+	models.SetEmailVerified(user.ID, true)
+	user.EmailVerified = true
+	const waiting = "waiting for an admin"
+
+	login := func(w http.ResponseWriter, r *http.Request) { LoginHandler(w, r, renderStub) }
+	w := postForm(login, "/login", url.Values{"username": {"quinn"}, "password": {testPassword}})
+	if sessionUser(t, w) != nil || !strings.Contains(w.Body.String(), waiting) {
+		t.Errorf("password login: %d %q", w.Code, w.Body)
+	}
+
+	// Passkey logins finish through beginSession
+	w = httptest.NewRecorder()
+	_, status, message := beginSession(w, httptest.NewRequest(http.MethodPost, "/login/passkey/finish", nil), user)
+	if sessionUser(t, w) != nil || status != http.StatusForbidden || !strings.Contains(message, waiting) {
+		t.Errorf("passkey login: %d %q", status, message)
+	}
+
+	models.SetSetting(models.SettingMagicLinkEnabled, "true")
+	request := func(w http.ResponseWriter, r *http.Request) { MagicLinkHandler(w, r, renderStub) }
+	verify := func(w http.ResponseWriter, r *http.Request) { MagicLinkVerifyHandler(w, r, renderStub) }
+	postForm(request, "/login/magic", url.Values{"email": {user.Email}})
+	var token string
+	for _, msg := range outbox(t) {
+		if strings.Contains(msg, "To: quinn@example.com") && strings.Contains(msg, "/login/magic/verify") {
+			token = emailedToken(t, msg, "/login/magic/verify")
+		}
+	}
+	if token == "" {
+		t.Fatal("no sign-in link was sent")
+	}
+	w = postForm(verify, "/login/magic/verify", url.Values{"token": {token}})
+	if sessionUser(t, w) != nil || !strings.Contains(w.Body.String(), waiting) {
+		t.Errorf("magic link login: %d %q", w.Code, w.Body)
+	}
+
+	if err := models.ApproveUser(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	w = postForm(login, "/login", url.Values{"username": {"quinn"}, "password": {testPassword}})
+	if signedIn := sessionUser(t, w); signedIn == nil || signedIn.ID != user.ID {
+		t.Errorf("password login after approval: %d %q", w.Code, w.Body)
+	}
+}
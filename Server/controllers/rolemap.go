@@ -0,0 +1,42 @@
+package controllers
+
+import (
+	"strings"
+
+	"simplehost-server/models"
+)
+
+// parseRoleMap reads "group=role;other-group=role" pairs used to map identity provider
+// groups onto SimpleHost roles. Pairs are split on ';' and on the last '=' so LDAP group DNs
+// like "cn=admins,ou=groups,dc=example,dc=com=admin" work as keys.
+func parseRoleMap(value string) map[string]string {
+	roles := map[string]string{}
+	for _, pair := range strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == '\n' }) {
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			continue
+		}
+		group := strings.ToLower(strings.TrimSpace(pair[:i]))
+		role := strings.TrimSpace(pair[i+1:])
+		if role != models.RoleAdmin && role != models.RoleUser {
+			continue
+		}
+		roles[group] = role
+	}
+	return roles
+}
+
+// roleForGroups returns the most privileged role any of the groups maps to. Group names are
+// compared case-insensitively. ok is false when no role map is configured, in which case
+// roles are managed inside SimpleHost instead.
+func roleForGroups(roleMap map[string]string, groups []string) (role string, ok bool) {
+	if len(roleMap) == 0 {
+		return "", false
+	}
+	for _, g := range groups {
+		if roleMap[strings.ToLower(g)] == models.RoleAdmin {
+			return models.RoleAdmin, true
+		}
+	}
+	return models.RoleUser, true
+}
@@ -0,0 +1,1002 @@
+package controllers
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"simplehost-server/models"
+	"simplehost-server/sigv4"
+	"simplehost-server/vfs"
+)
+
+const (
+	s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+	// s3MaxSkew is how far the time a request was signed may be from ours
+	s3MaxSkew = 15 * time.Minute
+	// s3MaxKeys caps the keys in one listing and the objects in one DeleteObjects call
+	s3MaxKeys = 1000
+	// s3EmptyETag is the MD5 of nothing, given to folder marker objects
+	s3EmptyETag  = `"d41d8cd98f00b204e9800998ecf8427e"`
+	s3TimeFormat = "2006-01-02T15:04:05.000Z"
+)
+
+// s3Error is an error response in the form S3 clients expect
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Error) Error() string {
+	return e.code + ": " + e.message
+}
+
+var (
+	errS3AccessDenied      = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errS3InvalidAccessKey  = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key ID you provided does not exist in our records."}
+	errS3SignatureMismatch = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."}
+	errS3Malformed         = &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "Only AWS Signature Version 4 for the s3 service is supported."}
+	errS3Skewed            = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large."}
+	errS3Expired           = &s3Error{http.StatusForbidden, "AccessDenied", "Request has expired"}
+	errS3NoSuchBucket      = &s3Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	errS3NoSuchKey         = &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	errS3BucketNotEmpty    = &s3Error{http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty"}
+	errS3BucketOwned       = &s3Error{http.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it."}
+	errS3BucketExists      = &s3Error{http.StatusConflict, "BucketAlreadyExists", "The requested bucket name is not available."}
+	errS3InvalidKey        = &s3Error{http.StatusBadRequest, "InvalidArgument", "Keys can't have empty, . or .. path segments, as they map to folders."}
+	errS3InvalidArgument   = &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid argument."}
+	errS3NotImplemented    = &s3Error{http.StatusNotImplemented, "NotImplemented", "A header or query parameter you provided implies functionality that is not implemented."}
+	errS3MissingLength     = &s3Error{http.StatusLengthRequired, "MissingContentLength", "You must provide the Content-Length HTTP header."}
+	errS3IncompleteBody    = &s3Error{http.StatusBadRequest, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header."}
+	errS3InvalidDigest     = &s3Error{http.StatusBadRequest, "InvalidDigest", "The Content-MD5 you specified is not valid."}
+	errS3BadDigest         = &s3Error{http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received."}
+	errS3SHA256Mismatch    = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed."}
+	errS3MalformedXML      = &s3Error{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema."}
+	errS3Internal          = &s3Error{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."}
+)
+
+// s3Request is one S3 API call by an authenticated user
+type s3Request struct {
+	w      http.ResponseWriter
+	r      *http.Request
+	ctx    context.Context
+	bucket string
+	key    string
+
+	user    *models.User
+	fs      *vfs.FS
+	auth    *sigv4.Authorization
+	secret  string
+	time    time.Time
+	payload string
+}
+
+type s3Operation struct {
+	name   string
+	handle func(*s3Request) error
+	// params are the query parameters the operation understands; others make it fail
+	// rather than silently do something different from what was asked
+	params []string
+}
+
+// S3APIHandler serves each user's view of the folder tree through an S3-compatible API.
+// Top-level folders are buckets and the folders under them key prefixes, so the key
+// a/b.txt in bucket docs is the file /docs/a/b.txt. Requests must be path-style
+// (http://host/bucket/key) and signed with SigV4 using an access key from the account page.
+func S3APIHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := &s3Request{w: w, r: r, ctx: r.Context()}
+		s.bucket, s.key, _ = strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		op := s.operation()
+		if info := getRequestInfo(r); info != nil {
+			info.route = "s3 " + op.name
+		}
+		if err := s.authenticate(); err != nil {
+			s.fail(err)
+			return
+		}
+		setRequestUser(r, s.user.ID)
+		s.fs = vfs.New(s.user.ID)
+		if op.handle == nil || !s.understands(op.params) {
+			s.fail(errS3NotImplemented)
+			return
+		}
+		if err := op.handle(s); err != nil {
+			s.fail(err)
+		}
+	})
+}
+
+// operation works out which S3 call a request is
+func (s *s3Request) operation() s3Operation {
+	q := s.r.URL.Query()
+	method := s.r.Method
+	copySource := s.r.Header.Get("X-Amz-Copy-Source") != ""
+	listParams := []string{"prefix", "delimiter", "max-keys", "encoding-type"}
+	getParams := []string{"response-content-type", "response-content-disposition", "response-content-encoding",
+		"response-content-language", "response-cache-control", "response-expires"}
+	switch {
+	case s.bucket == "" && method == http.MethodGet:
+		return s3Operation{name: "ListBuckets", handle: (*s3Request).listBuckets}
+	case s.bucket == "":
+		return s3Operation{name: "Unknown"}
+
+	case s.key == "" && method == http.MethodGet && q.Has("location"):
+		return s3Operation{"GetBucketLocation", (*s3Request).getBucketLocation, []string{"location"}}
+	case s.key == "" && method == http.MethodGet && q.Has("uploads"):
+		return s3Operation{"ListMultipartUploads", (*s3Request).listMultipartUploads,
+			[]string{"uploads", "prefix", "delimiter", "max-uploads", "key-marker", "upload-id-marker", "encoding-type"}}
+	case s.key == "" && method == http.MethodGet && q.Get("list-type") == "2":
+		return s3Operation{"ListObjectsV2", func(s *s3Request) error { return s.listObjects(true) },
+			append(listParams, "list-type", "continuation-token", "start-after", "fetch-owner")}
+	case s.key == "" && method == http.MethodGet:
+		return s3Operation{"ListObjects", func(s *s3Request) error { return s.listObjects(false) }, append(listParams, "marker")}
+	case s.key == "" && method == http.MethodHead:
+		return s3Operation{name: "HeadBucket", handle: (*s3Request).headBucket}
+	case s.key == "" && method == http.MethodPut:
+		return s3Operation{name: "CreateBucket", handle: (*s3Request).createBucket}
+	case s.key == "" && method == http.MethodDelete:
+		return s3Operation{name: "DeleteBucket", handle: (*s3Request).deleteBucket}
+	case s.key == "" && method == http.MethodPost && q.Has("delete"):
+		return s3Operation{"DeleteObjects", (*s3Request).deleteObjects, []string{"delete"}}
+	case s.key == "":
+		return s3Operation{name: "Unknown"}
+
+	case method == http.MethodGet && q.Has("uploadId"):
+		return s3Operation{"ListParts", (*s3Request).listParts, []string{"uploadId", "max-parts", "part-number-marker"}}
+	case method == http.MethodGet:
+		return s3Operation{"GetObject", (*s3Request).getObject, getParams}
+	case method == http.MethodHead:
+		return s3Operation{"HeadObject", (*s3Request).getObject, getParams}
+	case method == http.MethodPut && q.Has("uploadId") && !copySource:
+		return s3Operation{"UploadPart", (*s3Request).uploadPart, []string{"uploadId", "partNumber"}}
+	case method == http.MethodPut && q.Has("uploadId"):
+		return s3Operation{name: "UploadPartCopy"}
+	case method == http.MethodPut && copySource:
+		return s3Operation{name: "CopyObject", handle: (*s3Request).copyObject}
+	case method == http.MethodPut:
+		return s3Operation{name: "PutObject", handle: (*s3Request).putObject}
+	case method == http.MethodPost && q.Has("uploads"):
+		return s3Operation{"CreateMultipartUpload", (*s3Request).createMultipartUpload, []string{"uploads"}}
+	case method == http.MethodPost && q.Has("uploadId"):
+		return s3Operation{"CompleteMultipartUpload", (*s3Request).completeMultipartUpload, []string{"uploadId"}}
+	case method == http.MethodDelete && q.Has("uploadId"):
+		return s3Operation{"AbortMultipartUpload", (*s3Request).abortMultipartUpload, []string{"uploadId"}}
+	case method == http.MethodDelete:
+		return s3Operation{name: "DeleteObject", handle: (*s3Request).deleteObject}
+	}
+	return s3Operation{name: "Unknown"}
+}
+
+// understands reports whether every query parameter is one the operation handles.
+// Presigned URL parameters and the x-id hint SDKs add are always fine.
+func (s *s3Request) understands(params []string) bool {
+	for name := range s.r.URL.Query() {
+		if name == "x-id" || strings.HasPrefix(name, "X-Amz-") {
+			continue
+		}
+		known := false
+		for _, p := range params {
+			known = known || p == name
+		}
+		if !known {
+			return false
+		}
+	}
+	return true
+}
+
+// authenticate checks the request's SigV4 signature, from the Authorization header or a
+// presigned URL. Failures count against the client's IP like failed logins.
+func (s *s3Request) authenticate() error {
+	r := s.r
+	var auth *sigv4.Authorization
+	var err error
+	switch {
+	case r.Header.Get("Authorization") != "":
+		auth, err = sigv4.ParseAuthorization(r.Header.Get("Authorization"))
+	case r.URL.Query().Has("X-Amz-Signature"):
+		auth, err = sigv4.ParseQuery(r.URL.Query())
+	default:
+		// Nothing is public
+		return errS3AccessDenied
+	}
+	if err != nil || auth.Service != "s3" {
+		return errS3Malformed
+	}
+	t, err := sigv4.RequestTime(r)
+	if err != nil {
+		return errS3AccessDenied
+	}
+	now := time.Now()
+	if auth.Presigned {
+		if auth.Expires > 7*24*time.Hour {
+			return &s3Error{http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires must be less than a week (in seconds) that is 604800"}
+		}
+		if now.Before(t.Add(-s3MaxSkew)) || now.After(t.Add(auth.Expires)) {
+			return errS3Expired
+		}
+	} else if d := now.Sub(t); d > s3MaxSkew || d < -s3MaxSkew {
+		return errS3Skewed
+	}
+	payload := sigv4.UnsignedPayload
+	if !auth.Presigned {
+		if payload = r.Header.Get("X-Amz-Content-Sha256"); payload == "" {
+			return &s3Error{http.StatusBadRequest, "InvalidRequest", "Missing required header for this request: x-amz-content-sha256"}
+		}
+	}
+
+	ip := ClientIP(r)
+	if ok, wait := loginIPLimiter.Allow(ip); !ok {
+		s.w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		return &s3Error{http.StatusServiceUnavailable, "SlowDown", retryMessage(wait)}
+	}
+	key, err := models.GetAccessKey(auth.AccessKey)
+	if err == nil && !auth.Verify(r, key.Secret, t, payload) {
+		err = errS3SignatureMismatch
+	}
+	if err != nil && err != sql.ErrNoRows && err != errS3SignatureMismatch {
+		loginIPLimiter.Release(ip)
+		logFor(r).Error("Failed to look up access key", "error", err)
+		return errS3Internal
+	}
+	recordLogin("access_key", err == nil)
+	if err != nil {
+		loginIPLimiter.Fail(ip)
+		logFor(r).Warn("Failed S3 API login", "access_key", auth.AccessKey, "ip", ip, "error", err)
+		if err == sql.ErrNoRows {
+			return errS3InvalidAccessKey
+		}
+		return errS3SignatureMismatch
+	}
+	loginIPLimiter.Release(ip)
+	models.UseAccessKey(key.ID)
+
+	user, err := models.GetUserByID(key.UserID)
+	if err != nil {
+		return errS3AccessDenied
+	}
+	if err := clientAccountError(user); err != nil {
+		return &s3Error{http.StatusForbidden, "AccessDenied", err.Error()}
+	}
+	s.user, s.auth, s.secret, s.time, s.payload = user, auth, key.Secret, t, payload
+	return nil
+}
+
+// fail writes an error response, turning file tree errors into their S3 equivalents
+func (s *s3Request) fail(err error) {
+	var e *s3Error
+	switch {
+	case errors.As(err, &e):
+	case errors.Is(err, sigv4.ErrChunkSignature):
+		e = errS3SignatureMismatch
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		e = errS3IncompleteBody
+	case errors.Is(err, vfs.ErrNotExist):
+		e = errS3NoSuchKey
+	case errors.Is(err, vfs.ErrPermission):
+		e = errS3AccessDenied
+	case errors.Is(err, vfs.ErrExist), errors.Is(err, vfs.ErrInvalid):
+		// A file where a folder has to be, or the other way round
+		e = &s3Error{http.StatusConflict, "InvalidRequest", "A file and a folder can't have the same name."}
+	default:
+		logFor(s.r).Error("S3 API request failed", "method", s.r.Method, "path", s.r.URL.Path, "error", err)
+		e = errS3Internal
+	}
+	if s.r.Method == http.MethodHead {
+		// HEAD responses have no body to explain the error in
+		s.w.WriteHeader(e.status)
+		return
+	}
+	resource := s.r.URL.Path
+	var requestID string
+	if info := getRequestInfo(s.r); info != nil {
+		requestID = info.id
+	}
+	writeXML(s.w, e.status, struct {
+		XMLName   xml.Name `xml:"Error"`
+		Code      string
+		Message   string
+		Resource  string
+		RequestId string
+	}{Code: e.code, Message: e.message, Resource: resource, RequestId: requestID})
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+// readXML decodes a small request body, such as a list of parts or keys
+func (s *s3Request) readXML(v any) error {
+	body, _, err := s.body()
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(body, 4<<20))
+	if err != nil {
+		return err
+	}
+	if xml.Unmarshal(data, v) != nil {
+		return errS3MalformedXML
+	}
+	return nil
+}
+
+// body returns the request body and its length. Reading it checks it against the
+// payload hash, chunk signatures or Content-MD5 the client sent; a mismatch is an error
+// in place of io.EOF, so storage drivers discard what they wrote.
+func (s *s3Request) body() (io.Reader, int64, error) {
+	r := s.r
+	var body io.Reader = r.Body
+	size := r.ContentLength
+	switch s.payload {
+	case sigv4.UnsignedPayload:
+	case sigv4.StreamingPayload, sigv4.StreamingUnsignedTrailer:
+		n, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil {
+			return nil, 0, errS3MissingLength
+		}
+		size = n
+		if s.payload == sigv4.StreamingPayload {
+			key := sigv4.SigningKey(s.secret, s.auth.Date, s.auth.Region, s.auth.Service)
+			body = sigv4.NewChunkReader(body, key, s.time, s.auth.Scope(), s.auth.Signature)
+		} else {
+			body = sigv4.NewUnsignedChunkReader(body)
+		}
+	default:
+		if len(s.payload) != sha256.Size*2 {
+			return nil, 0, errS3NotImplemented
+		}
+		body = &checkedReader{r: body, hash: sha256.New(), want: s.payload, err: errS3SHA256Mismatch}
+	}
+	if size < 0 {
+		return nil, 0, errS3MissingLength
+	}
+	if v := r.Header.Get("Content-MD5"); v != "" {
+		sum, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(sum) != md5.Size {
+			return nil, 0, errS3InvalidDigest
+		}
+		body = &checkedReader{r: body, hash: md5.New(), want: hex.EncodeToString(sum), err: errS3BadDigest}
+	}
+	return &sizedReader{r: body, left: size}, size, nil
+}
+
+// checkedReader hashes what it reads and fails at the end if the hash isn't want
+type checkedReader struct {
+	r    io.Reader
+	hash hash.Hash
+	want string
+	err  error
+}
+
+func (c *checkedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(c.hash.Sum(nil)) != c.want {
+		err = c.err
+	}
+	return n, err
+}
+
+// sizedReader reads a body of a known length. Once it has all of it, it reads on to the
+// end so the checks above run before the last bytes are handed over.
+type sizedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (s *sizedReader) Read(p []byte) (int, error) {
+	if s.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > s.left {
+		p = p[:s.left]
+	}
+	n, err := s.r.Read(p)
+	s.left -= int64(n)
+	if err == io.EOF && s.left > 0 {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	if s.left == 0 {
+		var extra [1]byte
+		m, err := io.ReadFull(s.r, extra[:])
+		switch {
+		case m > 0:
+			return n, errS3InvalidArgument
+		case err != io.EOF:
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// bucketPath checks the bucket exists and returns its folder's path
+func (s *s3Request) bucketPath() (string, error) {
+	if s.bucket == "." || s.bucket == ".." {
+		return "", errS3NoSuchBucket
+	}
+	node, err := s.fs.Stat(s.ctx, "/"+s.bucket)
+	if err == vfs.ErrNotExist || (err == nil && !node.IsDir()) {
+		return "", errS3NoSuchBucket
+	}
+	return "/" + s.bucket, err
+}
+
+// objectPath returns the path of the object's file, or of the folder for keys ending in
+// a slash, after checking the bucket exists
+func (s *s3Request) objectPath() (string, error) {
+	return s.keyPath(s.key)
+}
+
+func (s *s3Request) keyPath(key string) (string, error) {
+	bucket, err := s.bucketPath()
+	if err != nil {
+		return "", err
+	}
+	for _, part := range strings.Split(strings.TrimSuffix(key, "/"), "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", errS3InvalidKey
+		}
+	}
+	return bucket + "/" + strings.TrimSuffix(key, "/"), nil
+}
+
+func s3ETag(n *vfs.Node) string {
+	if n.IsDir() {
+		return s3EmptyETag
+	}
+	return strconv.Quote(n.ID())
+}
+
+func canDelete(n *vfs.Node) bool {
+	if n.File != nil {
+		return n.File.CanDelete
+	}
+	return n.Folder.CanDelete
+}
+
+type s3Owner struct {
+	ID          string
+	DisplayName string
+}
+
+func (s *s3Request) listBuckets() error {
+	nodes, err := s.fs.ReadDir(s.ctx, "/")
+	if err != nil {
+		return err
+	}
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+	var buckets []bucket
+	seen := map[string]bool{}
+	for _, n := range nodes {
+		if n.IsDir() && !seen[n.Name()] {
+			seen[n.Name()] = true
+			buckets = append(buckets, bucket{n.Name(), n.ModTime().UTC().Format(s3TimeFormat)})
+		}
+	}
+	writeXML(s.w, http.StatusOK, struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Owner   s3Owner
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: s3Namespace, Owner: s3Owner{s.user.ID, s.user.Username}, Buckets: buckets})
+	return nil
+}
+
+func (s *s3Request) headBucket() error {
+	_, err := s.bucketPath()
+	if err == nil {
+		s.w.WriteHeader(http.StatusOK)
+	}
+	return err
+}
+
+// getBucketLocation reports whatever region the client signed for, so it never tries
+// to redirect elsewhere
+func (s *s3Request) getBucketLocation() error {
+	if _, err := s.bucketPath(); err != nil {
+		return err
+	}
+	region := s.auth.Region
+	if region == "us-east-1" {
+		region = ""
+	}
+	writeXML(s.w, http.StatusOK, struct {
+		XMLName xml.Name `xml:"LocationConstraint"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Region  string   `xml:",chardata"`
+	}{Xmlns: s3Namespace, Region: region})
+	return nil
+}
+
+// createBucket makes a top-level folder. Any location constraint in the body is ignored.
+func (s *s3Request) createBucket() error {
+	if s.bucket == "." || s.bucket == ".." {
+		return &s3Error{http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid."}
+	}
+	err := s.fs.Mkdir(s.ctx, "/"+s.bucket)
+	if err == vfs.ErrExist {
+		node, statErr := s.fs.Stat(s.ctx, "/"+s.bucket)
+		if statErr == nil && node.IsDir() && canDelete(node) {
+			return errS3BucketOwned
+		}
+		return errS3BucketExists
+	}
+	if err != nil {
+		return err
+	}
+	s.w.Header().Set("Location", "/"+s.bucket)
+	s.w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// deleteBucket removes an empty top-level folder the user owns
+func (s *s3Request) deleteBucket() error {
+	bucket, err := s.bucketPath()
+	if err != nil {
+		return err
+	}
+	nodes, err := s.fs.ReadDir(s.ctx, bucket)
+	if err != nil {
+		return err
+	}
+	if len(nodes) > 0 {
+		return errS3BucketNotEmpty
+	}
+	if err := s.fs.Remove(s.ctx, bucket); err != nil {
+		return err
+	}
+	s.w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// s3Entry is a key in a listing. Node is nil for common prefixes.
+type s3Entry struct {
+	key  string
+	node *vfs.Node
+}
+
+// entries returns the bucket's keys under the folder prefix points into, sorted. Folders
+// are keys ending in a slash: all of them when shallow, as listings split on "/" only
+// need one level, and otherwise only empty ones, standing in for S3 folder markers.
+func (s *s3Request) entries(bucket, prefix string, shallow bool) ([]s3Entry, error) {
+	var entries []s3Entry
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		nodes, err := s.fs.ReadDir(s.ctx, bucket+"/"+dir)
+		if err != nil {
+			return err
+		}
+		if len(nodes) == 0 && dir != "" && !shallow {
+			entries = append(entries, s3Entry{key: dir, node: &vfs.Node{Folder: &models.Folder{}}})
+		}
+		// Names are only unique per owner. Pick the same item vfs would for the path.
+		picked := map[string]*vfs.Node{}
+		for _, n := range nodes {
+			prev, ok := picked[n.Name()]
+			if !ok || (prev.IsDir() == n.IsDir() && canDelete(n) && !canDelete(prev)) {
+				picked[n.Name()] = n
+			}
+		}
+		for name, n := range picked {
+			key := dir + name
+			switch {
+			case !n.IsDir():
+				entries = append(entries, s3Entry{key: key, node: n})
+			case shallow:
+				entries = append(entries, s3Entry{key: key + "/", node: n})
+			case strings.HasPrefix(key+"/", prefix):
+				if err := walk(key + "/"); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	err := walk(prefix[:strings.LastIndex(prefix, "/")+1])
+	if err == vfs.ErrNotExist || err == vfs.ErrInvalid {
+		// The prefix names a folder that doesn't exist
+		return nil, nil
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries, err
+}
+
+func (s *s3Request) listObjects(v2 bool) error {
+	bucket, err := s.bucketPath()
+	if err != nil {
+		return err
+	}
+	q := s.r.URL.Query()
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	maxKeys := s3MaxKeys
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errS3InvalidArgument
+		}
+		maxKeys = min(n, s3MaxKeys)
+	}
+	encodingType := q.Get("encoding-type")
+	if encodingType != "" && encodingType != "url" {
+		return errS3InvalidArgument
+	}
+	encode := func(s string) string {
+		if encodingType == "url" {
+			return sigv4.URIEncode(s, false)
+		}
+		return s
+	}
+	after := q.Get("marker")
+	if v2 {
+		after = q.Get("start-after")
+		if token := q.Get("continuation-token"); token != "" {
+			decoded, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				return &s3Error{http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect"}
+			}
+			after = string(decoded)
+		}
+	}
+
+	entries, err := s.entries(bucket, prefix, delimiter == "/")
+	if err != nil {
+		return err
+	}
+	// Group keys that share a prefix up to the delimiter. Sorted keys keep each group
+	// together, and its prefix sorts where its first key was.
+	var items []s3Entry
+	for _, e := range entries {
+		if !strings.HasPrefix(e.key, prefix) || e.key <= after {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(e.key[len(prefix):], delimiter); i >= 0 {
+				common := e.key[:len(prefix)+i+len(delimiter)]
+				if len(items) == 0 || items[len(items)-1].key != common {
+					if common > after {
+						items = append(items, s3Entry{key: common})
+					}
+				}
+				continue
+			}
+		}
+		items = append(items, e)
+	}
+	truncated := len(items) > maxKeys
+	if truncated {
+		items = items[:maxKeys]
+	}
+
+	type object struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int64
+		StorageClass string
+		Owner        *s3Owner `xml:",omitempty"`
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Xmlns                 string   `xml:"xmlns,attr"`
+		Name                  string
+		Prefix                string
+		Marker                *string `xml:",omitempty"`
+		NextMarker            string  `xml:",omitempty"`
+		ContinuationToken     string  `xml:",omitempty"`
+		NextContinuationToken string  `xml:",omitempty"`
+		StartAfter            string  `xml:",omitempty"`
+		KeyCount              *int    `xml:",omitempty"`
+		MaxKeys               int
+		Delimiter             string `xml:",omitempty"`
+		EncodingType          string `xml:",omitempty"`
+		IsTruncated           bool
+		Contents              []object
+		CommonPrefixes        []commonPrefix
+	}{
+		Xmlns:        s3Namespace,
+		Name:         s.bucket,
+		Prefix:       encode(prefix),
+		MaxKeys:      maxKeys,
+		Delimiter:    encode(delimiter),
+		EncodingType: encodingType,
+		IsTruncated:  truncated,
+	}
+	fetchOwner := !v2 || q.Get("fetch-owner") == "true"
+	for _, item := range items {
+		if item.node == nil {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{encode(item.key)})
+			continue
+		}
+		obj := object{
+			Key:          encode(item.key),
+			LastModified: item.node.ModTime().UTC().Format(s3TimeFormat),
+			ETag:         s3ETag(item.node),
+			Size:         item.node.Size(),
+			StorageClass: "STANDARD",
+		}
+		if fetchOwner && item.node.File != nil {
+			obj.Owner = &s3Owner{ID: item.node.File.OwnerID}
+		}
+		result.Contents = append(result.Contents, obj)
+	}
+	if v2 {
+		keyCount := len(items)
+		result.KeyCount = &keyCount
+		result.ContinuationToken = q.Get("continuation-token")
+		result.StartAfter = encode(q.Get("start-after"))
+		if truncated {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(items[len(items)-1].key))
+		}
+	} else {
+		marker := encode(q.Get("marker"))
+		result.Marker = &marker
+		if truncated {
+			result.NextMarker = encode(items[len(items)-1].key)
+		}
+	}
+	writeXML(s.w, http.StatusOK, result)
+	return nil
+}
+
+// s3Download counts the bytes of an object sent to the client
+type s3Download struct {
+	io.ReadSeeker
+}
+
+func (d s3Download) Read(p []byte) (int, error) {
+	n, err := d.ReadSeeker.Read(p)
+	transferBytes.Add(float64(n), "download")
+	return n, err
+}
+
+// getObject answers GetObject and HeadObject, including ranged and conditional requests
+func (s *s3Request) getObject() error {
+	p, err := s.objectPath()
+	if err != nil {
+		return err
+	}
+	node, reader, err := s.fs.Open(s.ctx, p)
+	if err != nil {
+		return err
+	}
+	if reader != nil {
+		defer reader.Close()
+	}
+	if node.IsDir() != strings.HasSuffix(s.key, "/") {
+		return errS3NoSuchKey
+	}
+	h := s.w.Header()
+	h.Set("ETag", s3ETag(node))
+	ctype := mime.TypeByExtension(path.Ext(node.Name()))
+	if ctype == "" || node.IsDir() {
+		ctype = "application/octet-stream"
+	}
+	h.Set("Content-Type", ctype)
+	q := s.r.URL.Query()
+	for param, header := range map[string]string{
+		"response-content-type":        "Content-Type",
+		"response-content-disposition": "Content-Disposition",
+		"response-content-encoding":    "Content-Encoding",
+		"response-content-language":    "Content-Language",
+		"response-cache-control":       "Cache-Control",
+		"response-expires":             "Expires",
+	} {
+		if v := q.Get(param); v != "" {
+			h.Set(header, v)
+		}
+	}
+	if node.IsDir() {
+		http.ServeContent(s.w, s.r, "", node.ModTime(), strings.NewReader(""))
+		return nil
+	}
+	if s.r.Method == http.MethodGet {
+		defer trackTransfer("download", node.Name(), s.user.ID).done()
+	}
+	http.ServeContent(s.w, s.r, node.Name(), node.ModTime(), s3Download{reader})
+	return nil
+}
+
+// putObject stores a file, creating the folders in its key as needed. A key ending in a
+// slash with an empty body creates just the folder.
+func (s *s3Request) putObject() error {
+	p, err := s.objectPath()
+	if err != nil {
+		return err
+	}
+	// Fail before reading the body if the file can't be written. Missing folders are
+	// created below.
+	if err := s.fs.CheckCreate(s.ctx, p); err != nil && err != vfs.ErrNotExist && !strings.HasSuffix(s.key, "/") {
+		return err
+	}
+	body, size, err := s.body()
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(s.key, "/") {
+		if size != 0 {
+			return &s3Error{http.StatusBadRequest, "InvalidArgument", "Keys ending in a slash are folders and can't have contents."}
+		}
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return err
+		}
+		if err := s.fs.MkdirAll(s.ctx, p); err != nil {
+			return err
+		}
+		s.w.Header().Set("ETag", s3EmptyETag)
+		s.w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	if err := s.fs.MkdirAll(s.ctx, path.Dir(p)); err != nil {
+		return err
+	}
+	defer trackTransfer("upload", path.Base(p), s.user.ID).done()
+	node, err := s.fs.Create(s.ctx, p, body, size)
+	if err != nil {
+		return err
+	}
+	transferBytes.Add(float64(size), "upload")
+	s.w.Header().Set("ETag", s3ETag(node))
+	s.w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// copyObject copies a file the user can read, which S3 clients use to rename objects
+func (s *s3Request) copyObject() error {
+	source, err := url.PathUnescape(s.r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return errS3InvalidArgument
+	}
+	if strings.Contains(source, "?versionId=") {
+		return errS3NotImplemented
+	}
+	srcBucket, srcKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	src := &s3Request{ctx: s.ctx, fs: s.fs, bucket: srcBucket}
+	srcPath, err := src.keyPath(srcKey)
+	if err != nil {
+		return err
+	}
+	dst, err := s.objectPath()
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(srcKey, "/") || strings.HasSuffix(s.key, "/") {
+		return errS3InvalidArgument
+	}
+	node, reader, err := s.fs.Open(s.ctx, srcPath)
+	if err != nil {
+		return err
+	}
+	if node.IsDir() {
+		return errS3NoSuchKey
+	}
+	defer reader.Close()
+	if err := s.fs.MkdirAll(s.ctx, path.Dir(dst)); err != nil {
+		return err
+	}
+	created, err := s.fs.Create(s.ctx, dst, reader, node.Size())
+	if err != nil {
+		return err
+	}
+	writeXML(s.w, http.StatusOK, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		Xmlns        string   `xml:"xmlns,attr"`
+		LastModified string
+		ETag         string
+	}{Xmlns: s3Namespace, LastModified: created.ModTime().UTC().Format(s3TimeFormat), ETag: s3ETag(created)})
+	return nil
+}
+
+// deleteKey removes a file, or an empty folder for a key ending in a slash. Like S3,
+// deleting something that isn't there succeeds.
+func (s *s3Request) deleteKey(key string) error {
+	p, err := s.keyPath(key)
+	if err != nil {
+		return err
+	}
+	node, err := s.fs.Stat(s.ctx, p)
+	if err == vfs.ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if node.IsDir() != strings.HasSuffix(key, "/") {
+		return nil
+	}
+	if node.IsDir() {
+		if nodes, err := s.fs.ReadDir(s.ctx, p); err != nil || len(nodes) > 0 {
+			return err
+		}
+	}
+	return s.fs.Remove(s.ctx, p)
+}
+
+func (s *s3Request) deleteObject() error {
+	if err := s.deleteKey(s.key); err != nil {
+		return err
+	}
+	s.w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *s3Request) deleteObjects() error {
+	if _, err := s.bucketPath(); err != nil {
+		return err
+	}
+	var req struct {
+		Quiet   bool
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	if err := s.readXML(&req); err != nil {
+		return err
+	}
+	if len(req.Objects) == 0 || len(req.Objects) > s3MaxKeys {
+		return errS3MalformedXML
+	}
+	type deleted struct {
+		Key string
+	}
+	type failed struct {
+		Key     string
+		Code    string
+		Message string
+	}
+	result := struct {
+		XMLName xml.Name `xml:"DeleteResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Deleted []deleted
+		Error   []failed
+	}{Xmlns: s3Namespace}
+	for _, obj := range req.Objects {
+		err := s.deleteKey(obj.Key)
+		var e *s3Error
+		switch {
+		case err == nil:
+			if !req.Quiet {
+				result.Deleted = append(result.Deleted, deleted{obj.Key})
+			}
+			continue
+		case errors.As(err, &e):
+		case errors.Is(err, vfs.ErrPermission):
+			e = errS3AccessDenied
+		default:
+			logFor(s.r).Error("Failed to delete object", "key", obj.Key, "error", err)
+			e = errS3Internal
+		}
+		result.Error = append(result.Error, failed{obj.Key, e.code, e.message})
+	}
+	writeXML(s.w, http.StatusOK, result)
+	return nil
+}
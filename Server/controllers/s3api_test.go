@@ -0,0 +1,181 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"simplehost-server/models"
+	"simplehost-server/sigv4"
+)
+
+// s3Client signs requests with one user's access key, as an SDK does
+type s3Client struct {
+	t     *testing.T
+	creds sigv4.Credentials
+}
+
+func newS3Client(t *testing.T, user *models.User) *s3Client {
+	t.Helper()
+	key, err := models.CreateAccessKey(user.ID, "sdk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &s3Client{t: t, creds: sigv4.Credentials{AccessKey: key.ID, SecretKey: key.Secret}}
+}
+
+// request signs a request whose payload hash is taken from body, or is payloadHash
+// when that isn't empty
+func (c *s3Client) request(method, target, body, payloadHash string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if payloadHash == "" {
+		payloadHash = sigv4.HashPayload([]byte(body))
+	}
+	sigv4.SignRequest(r, c.creds, "us-east-1", "s3", payloadHash, time.Now())
+	return r
+}
+
+func (c *s3Client) do(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	S3APIHandler().ServeHTTP(w, r)
+	return w
+}
+
+func (c *s3Client) send(method, target, body string) *httptest.ResponseRecorder {
+	return c.do(c.request(method, target, body, ""))
+}
+
+// s3ErrorCode returns the Code of an S3 error response
+func s3ErrorCode(w *httptest.ResponseRecorder) string {
+	var e struct{ Code string }
+	xml.Unmarshal(w.Body.Bytes(), &e)
+	return e.Code
+}
+
+func TestS3PutAndGetObject(t *testing.T) {
+	setupServer(t)
+	s3 := newS3Client(t, createUser(t, "alice", true))
+	if w := s3.send(http.MethodPut, "/docs", ""); w.Code != http.StatusOK {
+		t.Fatalf("CreateBucket: %d %s", w.Code, w.Body)
+	}
+	if w := s3.send(http.MethodPut, "/docs/notes/today.txt", "hello from s3"); w.Code != http.StatusOK || w.Header().Get("ETag") == "" {
+		t.Fatalf("PutObject: %d %s", w.Code, w.Body)
+	}
+	w := s3.send(http.MethodGet, "/docs/notes/today.txt", "")
+	if w.Code != http.StatusOK || w.Body.String() != "hello from s3" {
+		t.Fatalf("GetObject: %d %q", w.Code, w.Body)
+	}
+	if w := s3.send(http.MethodGet, "/docs/notes/missing.txt", ""); w.Code != http.StatusNotFound || s3ErrorCode(w) != "NoSuchKey" {
+		t.Errorf("GetObject of a missing key: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestS3RejectsBadRequests(t *testing.T) {
+	setupServer(t)
+	alice := createUser(t, "alice", true)
+	s3 := newS3Client(t, alice)
+	if w := s3.send(http.MethodPut, "/docs", ""); w.Code != http.StatusOK {
+		t.Fatalf("CreateBucket: %d %s", w.Code, w.Body)
+	}
+
+	// Signed with the wrong secret
+	forger := &s3Client{t: t, creds: sigv4.Credentials{AccessKey: s3.creds.AccessKey, SecretKey: "not-the-secret"}}
+	if w := forger.send(http.MethodPut, "/docs/forged.txt", "forged"); w.Code != http.StatusForbidden || s3ErrorCode(w) != "SignatureDoesNotMatch" {
+		t.Errorf("wrong signature: %d %s", w.Code, w.Body)
+	}
+	// Signed, then changed on the way
+	r := s3.request(http.MethodPut, "/docs/changed.txt", "original", "")
+	r.URL.Path = "/docs/other.txt"
+	if w := s3.do(r); w.Code != http.StatusForbidden || s3ErrorCode(w) != "SignatureDoesNotMatch" {
+		t.Errorf("changed path: %d %s", w.Code, w.Body)
+	}
+
+	for _, target := range []string{"/docs/../secret.txt", "/docs/a/../../secret.txt", "/docs/./a.txt", "/docs/a//b.txt"} {
+		if w := s3.send(http.MethodPut, target, "data"); w.Code != http.StatusBadRequest || s3ErrorCode(w) != "InvalidArgument" {
+			t.Errorf("PutObject %s: %d %s", target, w.Code, w.Body)
+		}
+	}
+
+	// A body that doesn't match the signed hash isn't stored
+	w := s3.do(s3.request(http.MethodPut, "/docs/tampered.txt", "tampered", sigv4.HashPayload([]byte("expected"))))
+	if w.Code != http.StatusBadRequest || s3ErrorCode(w) != "XAmzContentSHA256Mismatch" {
+		t.Errorf("mismatched x-amz-content-sha256: %d %s", w.Code, w.Body)
+	}
+	if w := s3.do(s3.request(http.MethodPut, "/docs/tampered.txt", "tampered", "not-a-hash")); w.Code != http.StatusNotImplemented {
+		t.Errorf("malformed x-amz-content-sha256: %d %s", w.Code, w.Body)
+	}
+	if w := s3.send(http.MethodGet, "/docs/tampered.txt", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GetObject after failed puts: %d %s", w.Code, w.Body)
+	}
+}
+
+// completeBody lists parts for CompleteMultipartUpload in the given order
+func completeBody(numbers []int, etags map[int]string) string {
+	var b strings.Builder
+	b.WriteString("<CompleteMultipartUpload>")
+	for _, n := range numbers {
+		fmt.Fprintf(&b, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", n, etags[n])
+	}
+	b.WriteString("</CompleteMultipartUpload>")
+	return b.String()
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	setupServer(t)
+	s3 := newS3Client(t, createUser(t, "alice", true))
+	bob := newS3Client(t, createUser(t, "bob", true))
+	if w := s3.send(http.MethodPut, "/docs", ""); w.Code != http.StatusOK {
+		t.Fatalf("CreateBucket: %d %s", w.Code, w.Body)
+	}
+	w := s3.send(http.MethodPost, "/docs/big.bin?uploads", "")
+	var started struct{ UploadId string }
+	if err := xml.Unmarshal(w.Body.Bytes(), &started); w.Code != http.StatusOK || err != nil || started.UploadId == "" {
+		t.Fatalf("CreateMultipartUpload: %d %s", w.Code, w.Body)
+	}
+	target := "/docs/big.bin?uploadId=" + started.UploadId
+
+	// Parts can arrive in any order
+	parts := map[int]string{1: "first part, ", 2: "second part, ", 3: "third part"}
+	etags := map[int]string{}
+	for _, n := range []int{3, 1, 2} {
+		w := s3.send(http.MethodPut, fmt.Sprintf("%s&partNumber=%d", target, n), parts[n])
+		if w.Code != http.StatusOK || w.Header().Get("ETag") == "" {
+			t.Fatalf("UploadPart %d: %d %s", n, w.Code, w.Body)
+		}
+		etags[n] = w.Header().Get("ETag")
+	}
+
+	// Another user can't see, add to or finish the upload
+	if w := bob.send(http.MethodPut, target+"&partNumber=1", "mallory"); s3ErrorCode(w) != "NoSuchUpload" {
+		t.Errorf("other user's UploadPart: %d %s", w.Code, w.Body)
+	}
+	if w := bob.send(http.MethodGet, target, ""); s3ErrorCode(w) != "NoSuchUpload" {
+		t.Errorf("other user's ListParts: %d %s", w.Code, w.Body)
+	}
+	if w := bob.send(http.MethodPost, target, completeBody([]int{1, 2, 3}, etags)); s3ErrorCode(w) != "NoSuchUpload" {
+		t.Errorf("other user's CompleteMultipartUpload: %d %s", w.Code, w.Body)
+	}
+	if w := bob.send(http.MethodDelete, target, ""); s3ErrorCode(w) != "NoSuchUpload" {
+		t.Errorf("other user's AbortMultipartUpload: %d %s", w.Code, w.Body)
+	}
+
+	// The list has to be in part order, as in S3
+	if w := s3.send(http.MethodPost, target, completeBody([]int{2, 1, 3}, etags)); w.Code != http.StatusBadRequest || s3ErrorCode(w) != "InvalidPartOrder" {
+		t.Errorf("CompleteMultipartUpload out of order: %d %s", w.Code, w.Body)
+	}
+	if w := s3.send(http.MethodPost, target, completeBody([]int{1, 2, 3}, etags)); w.Code != http.StatusOK {
+		t.Fatalf("CompleteMultipartUpload: %d %s", w.Code, w.Body)
+	}
+	w = s3.send(http.MethodGet, "/docs/big.bin", "")
+	if want := parts[1] + parts[2] + parts[3]; w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), []byte(want)) {
+		t.Errorf("GetObject: %d %q, want %q", w.Code, w.Body, want)
+	}
+	if w := s3.send(http.MethodPost, target, completeBody([]int{1, 2, 3}, etags)); s3ErrorCode(w) != "NoSuchUpload" {
+		t.Errorf("completing again: %d %s", w.Code, w.Body)
+	}
+}
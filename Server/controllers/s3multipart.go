@@ -0,0 +1,278 @@
+package controllers
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"simplehost-server/models"
+	"simplehost-server/vfs"
+)
+
+const (
+	// s3MaxParts is the most parts an S3 multipart upload can have
+	s3MaxParts = 10000
+	// s3UploadMaxAge is how long a multipart upload may go unfinished before its parts
+	// are thrown away
+	s3UploadMaxAge = 7 * 24 * time.Hour
+)
+
+var errS3NoSuchUpload = &s3Error{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist. The upload ID might be invalid, or the multipart upload might have been aborted or completed."}
+
+// removeS3Upload deletes an upload's parts and forgets it
+func removeS3Upload(u models.S3Upload) error {
+	if err := os.RemoveAll(filepath.Join(chunkDir(), u.ID)); err != nil {
+		return err
+	}
+	return models.DeleteS3Upload(u.ID)
+}
+
+// abortS3Uploads removes all of a user's unfinished uploads, e.g. before deleting them
+func abortS3Uploads(userID string) {
+	uploads, err := models.ListUserS3Uploads(userID)
+	if err != nil {
+		slog.Error("Failed to list S3 uploads", "user_id", userID, "error", err)
+		return
+	}
+	for _, u := range uploads {
+		if err := removeS3Upload(u); err != nil {
+			slog.Error("Failed to remove S3 upload", "upload_id", u.ID, "error", err)
+		}
+	}
+}
+
+// removeStaleS3Uploads throws away uploads abandoned for longer than s3UploadMaxAge
+func removeStaleS3Uploads() {
+	uploads, err := models.ListS3UploadsBefore(time.Now().Add(-s3UploadMaxAge))
+	if err != nil {
+		slog.Error("Failed to list stale S3 uploads", "error", err)
+		return
+	}
+	for _, u := range uploads {
+		if err := removeS3Upload(u); err != nil {
+			slog.Error("Failed to remove stale S3 upload", "upload_id", u.ID, "error", err)
+			continue
+		}
+		slog.Info("Removed stale S3 upload", "upload_id", u.ID, "user_id", u.UserID, "key", u.Bucket+"/"+u.Key)
+	}
+}
+
+// upload returns the user's upload named in the query, which must be for this object
+func (s *s3Request) upload() (*models.S3Upload, error) {
+	u, err := models.GetS3Upload(s.r.URL.Query().Get("uploadId"), s.user.ID)
+	if err == sql.ErrNoRows || (err == nil && (u.Bucket != s.bucket || u.Key != s.key)) {
+		return nil, errS3NoSuchUpload
+	}
+	return u, err
+}
+
+// createMultipartUpload starts an upload. Its parts are kept in the chunk store under the
+// upload ID, like uploads from the web UI, until it is completed.
+func (s *s3Request) createMultipartUpload() error {
+	p, err := s.objectPath()
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(s.key, "/") {
+		return errS3InvalidArgument
+	}
+	if err := s.fs.CheckCreate(s.ctx, p); err != nil && err != vfs.ErrNotExist {
+		return err
+	}
+	removeStaleS3Uploads()
+	u, err := models.CreateS3Upload(s.user.ID, s.bucket, s.key)
+	if err != nil {
+		return err
+	}
+	writeXML(s.w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Xmlns: s3Namespace, Bucket: u.Bucket, Key: u.Key, UploadId: u.ID})
+	return nil
+}
+
+// uploadPart stores one part as a chunk. Its ETag is the MD5 of its contents, as in S3.
+func (s *s3Request) uploadPart() error {
+	u, err := s.upload()
+	if err != nil {
+		return err
+	}
+	number, err := strconv.Atoi(s.r.URL.Query().Get("partNumber"))
+	if err != nil || number < 1 || number > s3MaxParts {
+		return &s3Error{http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive"}
+	}
+	body, size, err := s.body()
+	if err != nil {
+		return err
+	}
+	defer trackTransfer("upload", path.Base(u.Key), s.user.ID).done()
+	sum := md5.New()
+	if err := chunkStore().Put(s.ctx, u.ID+"/"+strconv.Itoa(number), io.TeeReader(body, sum), size); err != nil {
+		return err
+	}
+	transferBytes.Add(float64(size), "upload")
+	etag := hex.EncodeToString(sum.Sum(nil))
+	if err := models.PutS3UploadPart(u.ID, models.S3UploadPart{Number: number, ETag: etag, Size: size}); err != nil {
+		return err
+	}
+	s.w.Header().Set("ETag", strconv.Quote(etag))
+	s.w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// completeMultipartUpload joins the listed parts into the file
+func (s *s3Request) completeMultipartUpload() error {
+	u, err := s.upload()
+	if err != nil {
+		return err
+	}
+	p, err := s.objectPath()
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := s.readXML(&req); err != nil {
+		return err
+	}
+	if len(req.Parts) == 0 {
+		return errS3MalformedXML
+	}
+	stored, err := models.ListS3UploadParts(u.ID)
+	if err != nil {
+		return err
+	}
+	etags := map[int]string{}
+	for _, part := range stored {
+		etags[part.Number] = part.ETag
+	}
+	keys := make([]string, len(req.Parts))
+	for i, part := range req.Parts {
+		if i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber {
+			return &s3Error{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order. The parts list must be specified in order by part number."}
+		}
+		if etag, ok := etags[part.PartNumber]; !ok || etag != strings.Trim(part.ETag, `"`) {
+			return &s3Error{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found. The part might not have been uploaded, or the specified entity tag might not have matched the part's entity tag."}
+		}
+		keys[i] = u.ID + "/" + strconv.Itoa(part.PartNumber)
+	}
+
+	if err := s.fs.MkdirAll(s.ctx, path.Dir(p)); err != nil {
+		return err
+	}
+	chunks, size, closeChunks, err := openChunkKeys(s.ctx, keys)
+	if err != nil {
+		return err
+	}
+	assemblyStart := time.Now()
+	node, err := s.fs.Create(s.ctx, p, chunks, size)
+	closeChunks()
+	assemblyDuration.Observe(time.Since(assemblyStart).Seconds())
+	if err != nil {
+		return err
+	}
+	if err := removeS3Upload(*u); err != nil {
+		logFor(s.r).Error("Failed to remove completed S3 upload", "upload_id", u.ID, "error", err)
+	}
+	writeXML(s.w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{Xmlns: s3Namespace, Location: "/" + s.bucket + "/" + s.key, Bucket: s.bucket, Key: s.key, ETag: s3ETag(node)})
+	return nil
+}
+
+func (s *s3Request) abortMultipartUpload() error {
+	u, err := s.upload()
+	if err != nil {
+		return err
+	}
+	if err := removeS3Upload(*u); err != nil {
+		return err
+	}
+	s.w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *s3Request) listParts() error {
+	u, err := s.upload()
+	if err != nil {
+		return err
+	}
+	parts, err := models.ListS3UploadParts(u.ID)
+	if err != nil {
+		return err
+	}
+	type part struct {
+		PartNumber int
+		ETag       string
+		Size       int64
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListPartsResult"`
+		Xmlns       string   `xml:"xmlns,attr"`
+		Bucket      string
+		Key         string
+		UploadId    string
+		MaxParts    int
+		IsTruncated bool
+		Parts       []part `xml:"Part"`
+	}{Xmlns: s3Namespace, Bucket: u.Bucket, Key: u.Key, UploadId: u.ID, MaxParts: s3MaxParts}
+	for _, p := range parts {
+		result.Parts = append(result.Parts, part{p.Number, strconv.Quote(p.ETag), p.Size})
+	}
+	writeXML(s.w, http.StatusOK, result)
+	return nil
+}
+
+func (s *s3Request) listMultipartUploads() error {
+	if _, err := s.bucketPath(); err != nil {
+		return err
+	}
+	uploads, err := models.ListS3Uploads(s.user.ID, s.bucket)
+	if err != nil {
+		return err
+	}
+	type upload struct {
+		Key       string
+		UploadId  string
+		Initiated string
+	}
+	prefix := s.r.URL.Query().Get("prefix")
+	result := struct {
+		XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+		Xmlns       string   `xml:"xmlns,attr"`
+		Bucket      string
+		Prefix      string
+		MaxUploads  int
+		IsTruncated bool
+		Uploads     []upload `xml:"Upload"`
+	}{Xmlns: s3Namespace, Bucket: s.bucket, Prefix: prefix, MaxUploads: s3MaxKeys}
+	for _, u := range uploads {
+		if strings.HasPrefix(u.Key, prefix) {
+			result.Uploads = append(result.Uploads, upload{u.Key, u.ID, u.CreatedAt.UTC().Format(s3TimeFormat)})
+		}
+	}
+	writeXML(s.w, http.StatusOK, result)
+	return nil
+}
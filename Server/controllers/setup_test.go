@@ -0,0 +1,148 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"simplehost-server/config"
+	"simplehost-server/mailer"
+	"simplehost-server/models"
+	"simplehost-server/passwords"
+	"simplehost-server/storage"
+
+	_ "modernc.org/sqlite"
+)
+
+// testPassword satisfies validatePassword
+const testPassword = "Secret-123"
+
+// setupServer points the package at a fresh database, upload folder and outbox under a
+// temporary folder, and returns the config so tests can adjust it
+func setupServer(t *testing.T) *config.Config {
+	t.Helper()
+	dir := t.TempDir()
+	c := config.Default()
+	c.Server.PublicURL = "https://files.example.com"
+	c.Database.Path = filepath.Join(dir, "simplehost.db")
+	c.Storage.UploadDir = filepath.Join(dir, "uploads")
+	c.Mail.OutboxDir = filepath.Join(dir, "outbox")
+	c.JWT.Secret = strings.Repeat("test-secret-", 4)
+	Configure(c)
+	if err := InitJWTKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := models.OpenDB("sqlite", c.Database.Path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(`CREATE TABLE users (id TEXT PRIMARY KEY, username TEXT UNIQUE NOT NULL, email TEXT UNIQUE NOT NULL, password TEXT NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	models.SetUserDB(db)
+	models.SetFSDB(db)
+	// Hashing with the production parameters would make every test take seconds
+	models.SetPasswordHasher(passwords.Argon2id{Memory: 64, Time: 1, Threads: 1})
+	SetMailer(mailer.FromConfig(c.Mail))
+	blobs, err := storage.FromConfig(c.Storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	models.SetStorage(blobs)
+	for _, init := range []func() error{
+		models.InitUserTables, models.InitIdentityTable, models.InitPasskeyTable, models.InitAPITokenTable,
+		models.InitSSHKeyTable, models.InitAccessKeyTable, models.InitS3UploadTables, models.InitChunkedUploadTable, models.InitShareLinkTable,
+		models.InitInviteTable, models.InitSettingsTable,
+		func() error { return models.InitVirtualFileSystemTables(c.Storage.UploadDir) },
+		models.EnsureRootFolder,
+	} {
+		if err := init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+// createUser adds an approved account with testPassword
+func createUser(t *testing.T, username string, verified bool) *models.User {
+	t.Helper()
+	user, err := models.CreateUser(username, username+"@example.com", testPassword, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified {
+		if err := models.SetEmailVerified(user.ID, true); err != nil {
+			t.Fatal(err)
+		}
+		user.EmailVerified = true
+	}
+	return user
+}
+
+// sessionCookie logs the user in the way the login page does
+func sessionCookie(t *testing.T, user *models.User) *http.Cookie {
+	t.Helper()
+	token, err := GenerateJWT(user.ID, user.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Cookie{Name: "jwt", Value: token}
+}
+
+// outbox returns the messages the outbox mailer has written, oldest first
+func outbox(t *testing.T) []string {
+	t.Helper()
+	files, _ := filepath.Glob(filepath.Join(appConfig.Mail.OutboxDir, "*.eml"))
+	var messages []string
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, string(data))
+	}
+	return messages
+}
+
+// emailedToken returns the token query parameter of the link to path in an email
+func emailedToken(t *testing.T, message, path string) string {
+	t.Helper()
+	m := regexp.MustCompile(regexp.QuoteMeta(path) + `\?token=([A-Za-z0-9_-]+)`).FindStringSubmatch(message)
+	if m == nil {
+		t.Fatalf("no %s link in email:\n%s", path, message)
+	}
+	return m[1]
+}
+
+// renderStub stands in for main's template renderer, writing the template name and the
+// error message so tests can check which page a handler showed
+func renderStub(w http.ResponseWriter, r *http.Request, name string, data any) {
+	msg := ""
+	if m, ok := data.(map[string]any); ok {
+		if e, ok := m["Error"]; ok {
+			msg = fmt.Sprint(e)
+		}
+	}
+	w.Write([]byte(name + ": " + msg))
+}
+
+// postForm sends a form to a handler the way the browser does
+func postForm(handler http.HandlerFunc, path string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = "192.0.2.1:1234"
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
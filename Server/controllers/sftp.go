@@ -0,0 +1,536 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"simplehost-server/models"
+	"simplehost-server/passwords"
+	"simplehost-server/storage"
+	"simplehost-server/vfs"
+)
+
+// sftpReadWindow is how much recently read data each download keeps. SFTP clients ask
+// for several pieces at once and they can be served out of order, which would otherwise
+// restart the read from storage each time.
+const sftpReadWindow = 1 << 20
+
+// SFTPServer serves each user's view of the folder tree over SFTP. Users sign in with
+// their password, an app token or one of the SSH keys on their account page.
+type SFTPServer struct {
+	config *ssh.ServerConfig
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	// open counts files being read or written, so shutdown can wait for them
+	open sync.WaitGroup
+}
+
+// NewSFTPServer sets up the server with the host key in hostKeyFile, generating one
+// on first run
+func NewSFTPServer(hostKeyFile string) (*SFTPServer, error) {
+	hostKey, err := loadHostKey(hostKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	s := &SFTPServer{conns: map[net.Conn]struct{}{}}
+	s.config = &ssh.ServerConfig{
+		PasswordCallback:  sftpPasswordLogin,
+		PublicKeyCallback: sftpPublicKeyLogin,
+		ServerVersion:     "SSH-2.0-SimpleHost",
+	}
+	s.config.AddHostKey(hostKey)
+	return s, nil
+}
+
+// loadHostKey reads the SSH host key, generating an Ed25519 key if there isn't one so
+// clients see the same fingerprint across restarts
+func loadHostKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(key, "simplehost host key")
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(block)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			return nil, err
+		}
+		slog.Info("Generated SFTP host key", "path", path)
+	} else if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Loaded SFTP host key", "fingerprint", ssh.FingerprintSHA256(signer.PublicKey()))
+	return signer, nil
+}
+
+func remoteIP(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+func sftpPermissions(user *models.User) *ssh.Permissions {
+	return &ssh.Permissions{Extensions: map[string]string{"user-id": user.ID}}
+}
+
+// sftpPasswordLogin checks a password or app token with the same rules and limits as WebDAV
+func sftpPasswordLogin(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	ip := remoteIP(conn.RemoteAddr())
+	account := accountKey(conn.User())
+	if ok, wait := checkLoginLimits(ip, account); !ok {
+		return nil, errors.New(retryMessage(wait))
+	}
+	user, method, err := clientCredentials(conn.User(), string(password))
+	if errors.Is(err, passwords.ErrBusy) {
+		loginIPLimiter.Release(ip)
+		loginAccountLimiter.Release(account)
+		return nil, errors.New(serverBusyMessage)
+	}
+	recordLogin(method, err == nil)
+	if err != nil {
+		loginIPLimiter.Fail(ip)
+		loginAccountLimiter.Fail(account)
+		slog.Warn("Failed SFTP login", "username", conn.User(), "ip", ip, "error", err)
+		return nil, ErrInvalidCredentials
+	}
+	loginIPLimiter.Release(ip)
+	loginAccountLimiter.Reset(account)
+	if err := clientAccountError(user); err != nil {
+		return nil, err
+	}
+	return sftpPermissions(user), nil
+}
+
+// sftpPublicKeyLogin accepts the SSH keys on the user's account page. Clients offer every
+// key they have in turn, so keys that don't match don't count as failed logins.
+func sftpPublicKeyLogin(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	ip := remoteIP(conn.RemoteAddr())
+	if ok, wait := loginIPLimiter.Allow(ip); !ok {
+		return nil, errors.New(retryMessage(wait))
+	}
+	defer loginIPLimiter.Release(ip)
+	user, err := models.GetUserByUsername(conn.User())
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	if err := models.UseSSHKey(user.ID, ssh.FingerprintSHA256(key)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	if err := clientAccountError(user); err != nil {
+		return nil, err
+	}
+	recordLogin("ssh_key", true)
+	return sftpPermissions(user), nil
+}
+
+// ListenAndServe accepts connections on addr until Close is called
+func (s *SFTPServer) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return net.ErrClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		if !s.track(conn, true) {
+			conn.Close()
+			continue
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// track adds or removes a connection, reporting false once the server is closed
+func (s *SFTPServer) track(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, conn)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *SFTPServer) handleConn(conn net.Conn) {
+	defer s.track(conn, false)
+	defer conn.Close()
+	// Drop clients that connect but never finish signing in
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	sconn, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		slog.Debug("SFTP handshake failed", "ip", remoteIP(conn.RemoteAddr()), "error", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	defer sconn.Close()
+	userID := sconn.Permissions.Extensions["user-id"]
+	log := slog.With("user_id", userID, "ip", remoteIP(conn.RemoteAddr()))
+	log.Info("SFTP session started", "username", sconn.User())
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Warn("Failed to accept SFTP channel", "error", err)
+			continue
+		}
+		go s.serveSession(channel, requests, userID, log)
+	}
+	log.Info("SFTP session ended")
+}
+
+// serveSession runs the sftp subsystem. There's no shell, so scp only works with clients
+// that speak SFTP underneath, as OpenSSH 9 and later do by default.
+func (s *SFTPServer) serveSession(channel ssh.Channel, requests <-chan *ssh.Request, userID string, log *slog.Logger) {
+	defer channel.Close()
+	started := false
+	for req := range requests {
+		ok := !started && req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+		started = true
+		go func() {
+			handler := &sftpHandler{server: s, fs: vfs.New(userID), log: log}
+			server := sftp.NewRequestServer(channel, sftp.Handlers{
+				FileGet:  handler,
+				FilePut:  handler,
+				FileCmd:  handler,
+				FileList: handler,
+			})
+			if err := server.Serve(); err != nil && !errors.Is(err, io.EOF) {
+				log.Warn("SFTP session failed", "error", err)
+			}
+			server.Close()
+		}()
+	}
+}
+
+// Shutdown stops accepting connections and waits for files being transferred to finish,
+// then closes every connection
+func (s *SFTPServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.open.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	s.Close()
+	return err
+}
+
+// Close stops the server and drops every connection, abandoning any uploads in progress
+func (s *SFTPServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// sftpHandler maps SFTP requests onto the user's vfs tree
+type sftpHandler struct {
+	server *SFTPServer
+	fs     *vfs.FS
+	log    *slog.Logger
+}
+
+// sftpError maps vfs errors to SFTP status codes. Other errors are sent as failures
+// with their message.
+func sftpError(err error) error {
+	if errors.Is(err, fs.ErrPermission) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	return err
+}
+
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	node, rs, err := h.fs.Open(r.Context(), r.Filepath)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	if rs == nil {
+		return nil, errors.New("is a directory")
+	}
+	h.server.open.Add(1)
+	return &sftpReader{
+		server:   h.server,
+		rs:       rs,
+		size:     node.Size(),
+		transfer: trackTransfer("download", node.Name(), h.fs.UserID),
+	}, nil
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	flags := r.Pflags()
+	node, err := h.fs.Stat(r.Context(), r.Filepath)
+	switch {
+	case err == nil && flags.Excl:
+		return nil, os.ErrExist
+	case errors.Is(err, vfs.ErrNotExist) && !flags.Creat:
+		return nil, err
+	case err != nil && !errors.Is(err, vfs.ErrNotExist):
+		return nil, sftpError(err)
+	case err == nil && !node.IsDir() && (flags.Append || !flags.Trunc):
+		// Files are replaced as a whole, so writing into an existing one isn't supported
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+	if err := h.fs.CheckCreate(r.Context(), r.Filepath); err != nil {
+		return nil, sftpError(err)
+	}
+	spool, err := newSpoolFile()
+	if err != nil {
+		return nil, err
+	}
+	h.server.open.Add(1)
+	return &sftpWriter{
+		handler:  h,
+		ctx:      r.Context(),
+		name:     r.Filepath,
+		spool:    spool,
+		transfer: trackTransfer("upload", path.Base(r.Filepath), h.fs.UserID),
+	}, nil
+}
+
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	ctx := r.Context()
+	switch r.Method {
+	case "Setstat":
+		// Permissions and times aren't stored, so accept and ignore them
+		_, err := h.fs.Stat(ctx, r.Filepath)
+		return sftpError(err)
+	case "Rename":
+		return sftpError(h.fs.Rename(ctx, r.Filepath, r.Target))
+	case "Mkdir":
+		return sftpError(h.fs.Mkdir(ctx, r.Filepath))
+	case "Rmdir":
+		node, err := h.fs.Stat(ctx, r.Filepath)
+		if err != nil {
+			return sftpError(err)
+		}
+		if !node.IsDir() {
+			return errors.New("not a directory")
+		}
+		children, err := h.fs.ReadDir(ctx, r.Filepath)
+		if err != nil {
+			return sftpError(err)
+		}
+		if len(children) > 0 {
+			return errors.New("directory not empty")
+		}
+		return sftpError(h.fs.Remove(ctx, r.Filepath))
+	case "Remove":
+		node, err := h.fs.Stat(ctx, r.Filepath)
+		if err != nil {
+			return sftpError(err)
+		}
+		if node.IsDir() {
+			return errors.New("is a directory")
+		}
+		return sftpError(h.fs.Remove(ctx, r.Filepath))
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// PosixRename replaces the target if it's a file the user owns
+func (h *sftpHandler) PosixRename(r *sftp.Request) error {
+	ctx := r.Context()
+	if node, err := h.fs.Stat(ctx, r.Target); err == nil && !node.IsDir() {
+		if _, err := h.fs.Stat(ctx, r.Filepath); err != nil {
+			return sftpError(err)
+		}
+		if err := h.fs.Remove(ctx, r.Target); err != nil {
+			return sftpError(err)
+		}
+	}
+	return sftpError(h.fs.Rename(ctx, r.Filepath, r.Target))
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		nodes, err := h.fs.ReadDir(r.Context(), r.Filepath)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		infos := make(sftpListing, len(nodes))
+		for i, node := range nodes {
+			infos[i] = node
+		}
+		return infos, nil
+	case "Stat":
+		node, err := h.fs.Stat(r.Context(), r.Filepath)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		return sftpListing{node}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+type sftpListing []os.FileInfo
+
+func (l sftpListing) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(infos, l[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// sftpReader serves reads from a window of recently read data, reading on from storage
+// as needed and only starting over when a read falls outside it
+type sftpReader struct {
+	server   *SFTPServer
+	rs       *storage.ReadSeeker
+	size     int64
+	transfer *trackedTransfer
+
+	mu    sync.Mutex
+	start int64
+	buf   []byte
+}
+
+func (r *sftpReader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), r.size)
+	if off < r.start || off > r.start+int64(len(r.buf))+sftpReadWindow {
+		if _, err := r.rs.Seek(off, io.SeekStart); err != nil {
+			return 0, err
+		}
+		r.start, r.buf = off, r.buf[:0]
+	}
+	if need := end - r.start - int64(len(r.buf)); need > 0 {
+		chunk := make([]byte, need)
+		n, err := io.ReadFull(r.rs, chunk)
+		r.buf = append(r.buf, chunk[:n]...)
+		transferBytes.Add(float64(n), "download")
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf[off-r.start:end-r.start])
+	// Keep the last window of data, trimming occasionally so it isn't copied every read
+	if excess := int64(len(r.buf)) - sftpReadWindow; excess > sftpReadWindow {
+		r.buf = append(r.buf[:0], r.buf[excess:]...)
+		r.start += excess
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *sftpReader) Close() error {
+	defer r.server.open.Done()
+	r.transfer.done()
+	return r.rs.Close()
+}
+
+// sftpWriter spools an upload and stores it when the client closes the file
+type sftpWriter struct {
+	handler  *sftpHandler
+	ctx      context.Context
+	name     string
+	spool    *spoolFile
+	transfer *trackedTransfer
+	failed   bool
+}
+
+func (w *sftpWriter) WriteAt(p []byte, off int64) (int, error) {
+	n, err := w.spool.WriteAt(p, off)
+	transferBytes.Add(float64(n), "upload")
+	return n, err
+}
+
+// TransferError is called when the connection drops with the file still open, so the
+// partial upload isn't stored
+func (w *sftpWriter) TransferError(err error) {
+	w.failed = true
+	w.handler.log.Warn("SFTP upload interrupted", "path", w.name, "error", err)
+}
+
+func (w *sftpWriter) Close() error {
+	defer w.handler.server.open.Done()
+	defer w.transfer.done()
+	defer w.spool.Remove()
+	if w.failed {
+		return nil
+	}
+	if _, err := w.handler.fs.Create(w.ctx, w.name, w.spool.Reader(), w.spool.Size()); err != nil {
+		w.handler.log.Error("Failed to store SFTP upload", "path", w.name, "error", err)
+		return sftpError(err)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"simplehost-server/models"
+)
+
+// startSFTP runs an SFTP server on a loopback port and returns its address
+func startSFTP(t *testing.T) string {
+	t.Helper()
+	s, err := NewSFTPServer(filepath.Join(t.TempDir(), "ssh_host_key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ListenAndServe("127.0.0.1:0")
+	t.Cleanup(func() { s.Close() })
+	for range 100 {
+		s.mu.Lock()
+		listener := s.listener
+		s.mu.Unlock()
+		if listener != nil {
+			return listener.Addr().String()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the SFTP server didn't start listening")
+	return ""
+}
+
+// sftpLogin signs in as username and starts an SFTP session
+func sftpLogin(t *testing.T, addr, username string, auth ssh.AuthMethod) (*sftp.Client, error) {
+	t.Helper()
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	t.Cleanup(func() {
+		client.Close()
+		conn.Close()
+	})
+	return client, nil
+}
+
+func sftpPut(client *sftp.Client, name, contents string) error {
+	f, err := client.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(contents)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func sftpGet(client *sftp.Client, name string) (string, error) {
+	f, err := client.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	return string(data), err
+}
+
+// addSSHKey generates a key and adds it to the user's account page
+func addSSHKey(t *testing.T, user *models.User) ssh.Signer {
+	t.Helper()
+	signer := newSSHSigner(t)
+	err := models.InsertSSHKey(models.SSHKey{
+		ID:          uuid.NewString(),
+		UserID:      user.ID,
+		Name:        "laptop",
+		Fingerprint: ssh.FingerprintSHA256(signer.PublicKey()),
+		PublicKey:   string(ssh.MarshalAuthorizedKey(signer.PublicKey())),
+		CreatedAt:   time.Now().UTC(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func newSSHSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestSFTPLogins(t *testing.T) {
+	setupServer(t)
+	addr := startSFTP(t)
+	alice := createUser(t, "alice", true)
+	createUser(t, "bob", true)
+	token, err := models.CreateAPIToken(alice.ID, "sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := addSSHKey(t, alice)
+
+	for _, tc := range []struct {
+		name string
+		auth ssh.AuthMethod
+	}{
+		{"password", ssh.Password(testPassword)},
+		{"app token", ssh.Password(token)},
+		{"SSH key", ssh.PublicKeys(key)},
+	} {
+		client, err := sftpLogin(t, addr, "alice", tc.auth)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if err := sftpPut(client, "/"+tc.name+".txt", tc.name); err != nil {
+			t.Errorf("%s: uploading: %v", tc.name, err)
+		}
+		if got, err := sftpGet(client, "/"+tc.name+".txt"); err != nil || got != tc.name {
+			t.Errorf("%s: downloading: %q, %v", tc.name, got, err)
+		}
+	}
+	if file, err := models.GetFileByFolderAndName("root", "SSH key.txt"); err != nil || file == nil || file.OwnerID != alice.ID {
+		t.Errorf("uploaded file: %+v, %v", file, err)
+	}
+
+	for _, tc := range []struct {
+		name, username string
+		auth           ssh.AuthMethod
+	}{
+		{"wrong password", "alice", ssh.Password("Wrong-000")},
+		{"unknown app token", "alice", ssh.Password(models.APITokenPrefix + "unknown")},
+		{"key not on the account", "alice", ssh.PublicKeys(newSSHSigner(t))},
+		{"another user's key", "bob", ssh.PublicKeys(key)},
+	} {
+		if _, err := sftpLogin(t, addr, tc.username, tc.auth); err == nil {
+			t.Errorf("%s: signed in", tc.name)
+		}
+	}
+}
+
+func TestSFTPCantChangeAnotherUsersFile(t *testing.T) {
+	setupServer(t)
+	addr := startSFTP(t)
+	createUser(t, "alice", true)
+	createUser(t, "bob", true)
+	alice, err := sftpLogin(t, addr, "alice", ssh.Password(testPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := sftpLogin(t, addr, "bob", ssh.Password(testPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sftpPut(alice, "/report.txt", "alice's report"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob can read the shared file but not replace, rename or delete it
+	if got, err := sftpGet(bob, "/report.txt"); err != nil || got != "alice's report" {
+		t.Errorf("reading: %q, %v", got, err)
+	}
+	if err := sftpPut(bob, "/report.txt", "bob's report"); !os.IsPermission(err) {
+		t.Errorf("replacing: %v, want permission denied", err)
+	}
+	if err := bob.Rename("/report.txt", "/mine.txt"); !os.IsPermission(err) {
+		t.Errorf("renaming: %v, want permission denied", err)
+	}
+	if err := bob.Remove("/report.txt"); !os.IsPermission(err) {
+		t.Errorf("deleting: %v, want permission denied", err)
+	}
+	if got, err := sftpGet(alice, "/report.txt"); err != nil || got != "alice's report" {
+		t.Errorf("alice's file afterwards: %q, %v", got, err)
+	}
+}
@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"database/sql"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"simplehost-server/models"
+	"simplehost-server/storage"
+)
+
+// shareLinkJSON describes a share link to API clients. The URL is only known when the
+// link has just been created, since only a hash of its secret is kept.
+func shareLinkJSON(l *models.ShareLink, file *models.File) map[string]any {
+	v := map[string]any{
+		"id":         l.ID,
+		"file_id":    l.FileID,
+		"name":       file.Name,
+		"created_at": l.CreatedAt,
+	}
+	if l.Token != "" {
+		v["url"] = publicURL("/s/"+l.Token, nil)
+	}
+	if l.ExpiresAt.Valid {
+		v["expires_at"] = l.ExpiresAt.Time
+	}
+	return v
+}
+
+// ShareAPIHandler lists the user's share links on GET, and on POST shares one of the
+// user's files with anyone who has the link: /api/share. expires_in is a duration such
+// as 72h; without it the link works until revoked.
+func ShareAPIHandler(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserIDFromRequest(r)
+	switch r.Method {
+	case http.MethodGet:
+		links, err := models.ListShareLinks(userID)
+		if err != nil {
+			logFor(r).Error("Failed to list share links", "user_id", userID, "error", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to list share links"})
+			return
+		}
+		result := []map[string]any{}
+		for i := range links {
+			file, err := models.GetFileByID(links[i].FileID)
+			if err != nil || file == nil {
+				continue
+			}
+			result = append(result, shareLinkJSON(&links[i], file))
+		}
+		writeJSON(w, http.StatusOK, result)
+	case http.MethodPost:
+		var ttl time.Duration
+		if s := r.FormValue("expires_in"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "expires_in must be a positive duration such as 72h"})
+				return
+			}
+			ttl = d
+		}
+		file, err := models.GetFileByID(r.FormValue("file_id"))
+		if err != nil || file == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "File not found"})
+			return
+		}
+		if file.OwnerID != userID {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "Only the owner can share a file"})
+			return
+		}
+		link, err := models.CreateShareLink(userID, file.ID, ttl)
+		if err != nil {
+			logFor(r).Error("Failed to create share link", "file_id", file.ID, "error", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to create share link"})
+			return
+		}
+		logFor(r).Info("Shared file", "file_id", file.ID, "link_id", link.ID)
+		writeJSON(w, http.StatusCreated, shareLinkJSON(link, file))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// DeleteShareHandler revokes a share link: POST /api/share/delete
+func DeleteShareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := models.DeleteShareLink(r.FormValue("id"), GetUserIDFromRequest(r)); err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Share link not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "revoked"})
+}
+
+// SharedFileHandler serves a shared file to anyone with the link: GET /s/{id}
+func SharedFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	link, err := models.LookupShareLink(strings.TrimPrefix(r.URL.Path, "/s/"))
+	if err != nil && err != sql.ErrNoRows {
+		logFor(r).Error("Failed to look up share link", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if err != nil || link.Expired() {
+		http.Error(w, "This link doesn't exist or has expired", http.StatusNotFound)
+		return
+	}
+	file, err := models.GetFileByID(link.FileID)
+	if err != nil || file == nil {
+		http.Error(w, "This link doesn't exist or has expired", http.StatusNotFound)
+		return
+	}
+	info, err := models.Blobs.Stat(r.Context(), file.StorageKey)
+	if err != nil {
+		logFor(r).Error("Could not open file", "file_id", file.ID, "error", err)
+		http.Error(w, "Could not open file", http.StatusInternalServerError)
+		return
+	}
+	f := storage.NewReadSeeker(r.Context(), models.Blobs, file.StorageKey, info.Size)
+	defer f.Close()
+	defer trackTransfer("download", file.Name, "").done()
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.Name}))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, file.Name, file.UploadedDate, f)
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"simplehost-server/models"
+)
+
+// shareFile uploads a file for the user and shares it, returning the link's ID and URL
+func shareFile(t *testing.T, cookie *http.Cookie) (string, string) {
+	t.Helper()
+	fileID := startUpload(t, cookie)
+	if w := postChunk(t, cookie, fileID, "0", 1, "shared contents"); w.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	w := postForm(AuthMiddleware(ShareAPIHandler), "/api/share", url.Values{"file_id": {fileID}}, cookie)
+	var link struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &link); w.Code != http.StatusCreated || err != nil || link.URL == "" {
+		t.Fatalf("share: %d %s", w.Code, w.Body)
+	}
+	return link.ID, link.URL
+}
+
+func TestShareLinkSecretIsOnlyStoredHashed(t *testing.T) {
+	setupServer(t)
+	alice := sessionCookie(t, createUser(t, "alice", true))
+	id, link := shareFile(t, alice)
+	token := strings.TrimPrefix(link, "https://files.example.com/s/")
+	if token == link || token == id || strings.Contains(token, "/") {
+		t.Fatalf("link %q, id %q", link, id)
+	}
+
+	var stored int
+	if err := models.DB.QueryRow(`SELECT COUNT(*) FROM share_links WHERE id = ? OR token_hash = ?`, token, token).Scan(&stored); err != nil || stored != 0 {
+		t.Errorf("the secret is stored as is (%d rows, %v)", stored, err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/s/"+token, nil)
+	w := httptest.NewRecorder()
+	SharedFileHandler(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "shared contents" {
+		t.Errorf("download: %d %s", w.Code, w.Body)
+	}
+
+	// Listing can't show the URL any more, but the ID still revokes the link
+	r = httptest.NewRequest(http.MethodGet, "/api/share", nil)
+	r.AddCookie(alice)
+	w = httptest.NewRecorder()
+	AuthMiddleware(ShareAPIHandler)(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), id) || strings.Contains(w.Body.String(), token) {
+		t.Errorf("list: %d %s", w.Code, w.Body)
+	}
+	if w := postForm(AuthMiddleware(DeleteShareHandler), "/api/share/delete", url.Values{"id": {id}}, alice); w.Code != http.StatusOK {
+		t.Fatalf("revoke: %d %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	SharedFileHandler(w, httptest.NewRequest(http.MethodGet, "/s/"+token, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("download after revoking: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestShareLinksStoredUnhashedAreMigrated(t *testing.T) {
+	setupServer(t)
+	alice := createUser(t, "alice", true)
+	cookie := sessionCookie(t, alice)
+	fileID := startUpload(t, cookie)
+	if w := postChunk(t, cookie, fileID, "0", 1, "old link"); w.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	// Links used to be stored with the secret as the ID and no hash
+	const token = "old-secret-from-before-hashing"
+	if _, err := models.DB.Exec(`INSERT INTO share_links (id, user_id, file_id, created_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)`, token, alice.ID, fileID); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.InitShareLinkTable(); err != nil {
+		t.Fatal(err)
+	}
+	link, err := models.LookupShareLink(token)
+	if err != nil {
+		t.Fatalf("old link no longer works: %v", err)
+	}
+	if link.ID == token {
+		t.Errorf("the old link's ID is still its secret")
+	}
+}
+
+func TestAccessLogLeavesOutShareLinkSecrets(t *testing.T) {
+	setupServer(t)
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/s/", func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) })
+	mux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {})
+	handler := AccessLogMiddleware(RecordRoute(mux))
+	for _, path := range []string{"/s/very-secret-token", "/files/s/kept"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	if strings.Contains(logs.String(), "very-secret-token") || !strings.Contains(logs.String(), "path=/s/REDACTED") {
+		t.Errorf("share link secret logged:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "path=/files/s/kept") {
+		t.Errorf("other paths should be logged as is:\n%s", logs.String())
+	}
+}
@@ -8,7 +8,7 @@ import (
 func SuccessMessageHandler(w http.ResponseWriter, r *http.Request, _ func(http.ResponseWriter, *http.Request, string, any)) {
 	if _, err := getUserClaims(r); err != nil {
 		w.WriteHeader(http.StatusForbidden)
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		http.Redirect(w, r, AppPath("/login"), http.StatusSeeOther)
 		return
 	}
 	if r.Method != http.MethodGet {
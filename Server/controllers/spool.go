@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+
+	"simplehost-server/models"
+	"simplehost-server/storage"
+)
+
+// spoolFile buffers an upload in a temporary file under upload_dir until it is complete
+// and its size is known. When files are encrypted at rest the spool is too, with a
+// throwaway key, so uploads in progress aren't left readable.
+type spoolFile struct {
+	file  *os.File
+	block cipher.Block
+	nonce []byte
+	mu    sync.Mutex
+	size  int64
+}
+
+func newSpoolFile() (*spoolFile, error) {
+	if err := os.MkdirAll(uploadDir(), 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(uploadDir(), ".spool-*"+storage.PartialSuffix)
+	if err != nil {
+		return nil, err
+	}
+	s := &spoolFile{file: file}
+	if _, ok := models.Blobs.(*storage.Encrypted); ok {
+		key := make([]byte, 32)
+		s.nonce = make([]byte, 8)
+		rand.Read(key)
+		rand.Read(s.nonce)
+		if s.block, err = aes.NewCipher(key); err != nil {
+			s.Remove()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// stream returns the AES-CTR key stream from offset, so writes can land anywhere
+func (s *spoolFile) stream(offset int64) cipher.Stream {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, s.nonce)
+	binary.BigEndian.PutUint64(iv[8:], uint64(offset/aes.BlockSize))
+	stream := cipher.NewCTR(s.block, iv)
+	skip := make([]byte, offset%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
+	return stream
+}
+
+// WriteAt may be called concurrently, as SFTP clients send several writes at once
+func (s *spoolFile) WriteAt(p []byte, off int64) (int, error) {
+	data := p
+	if s.block != nil {
+		data = make([]byte, len(p))
+		s.stream(off).XORKeyStream(data, p)
+	}
+	n, err := s.file.WriteAt(data, off)
+	s.mu.Lock()
+	s.size = max(s.size, off+int64(n))
+	s.mu.Unlock()
+	return n, err
+}
+
+// Write appends to what has been written so far
+func (s *spoolFile) Write(p []byte) (int, error) {
+	return s.WriteAt(p, s.Size())
+}
+
+func (s *spoolFile) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Reader reads back everything written
+func (s *spoolFile) Reader() io.Reader {
+	r := io.NewSectionReader(s.file, 0, s.Size())
+	if s.block == nil {
+		return r
+	}
+	return cipher.StreamReader{S: s.stream(0), R: r}
+}
+
+func (s *spoolFile) Remove() {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+
+	"simplehost-server/models"
+)
+
+// AddSSHKeyHandler adds a public key for signing in to SFTP: POST /account/ssh-keys
+func AddSSHKeyHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(r.FormValue("public_key")))
+	if err != nil {
+		accountResponse(w, r, render, http.StatusBadRequest, "Please paste a public key in OpenSSH format, such as the contents of ~/.ssh/id_ed25519.pub", true)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		name = comment
+	}
+	if name == "" || len(name) > 100 {
+		accountResponse(w, r, render, http.StatusBadRequest, "Please give the key a name of up to 100 characters", true)
+		return
+	}
+	userID := GetUserIDFromRequest(r)
+	fingerprint := ssh.FingerprintSHA256(key)
+	if keys, err := models.ListSSHKeys(userID); err == nil {
+		for _, k := range keys {
+			if k.Fingerprint == fingerprint {
+				accountResponse(w, r, render, http.StatusConflict, "That key is already on your account", true)
+				return
+			}
+		}
+	}
+	err = models.InsertSSHKey(models.SSHKey{
+		ID:          uuid.NewString(),
+		UserID:      userID,
+		Name:        name,
+		Fingerprint: fingerprint,
+		PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+		CreatedAt:   time.Now(),
+	})
+	if err != nil {
+		logFor(r).Error("Failed to save SSH key", "user_id", userID, "error", err)
+		accountResponse(w, r, render, http.StatusInternalServerError, "Failed to save key", true)
+		return
+	}
+	accountResponse(w, r, render, http.StatusCreated, "SSH key added.", false)
+}
+
+// DeleteSSHKeyHandler removes an SSH key: POST /account/ssh-keys/delete
+func DeleteSSHKeyHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := models.DeleteSSHKey(r.FormValue("key_id"), GetUserIDFromRequest(r)); err != nil {
+		accountResponse(w, r, render, http.StatusNotFound, "SSH key not found", true)
+		return
+	}
+	accountResponse(w, r, render, http.StatusOK, "SSH key removed.", false)
+}
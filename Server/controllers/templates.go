@@ -0,0 +1,25 @@
+package controllers
+
+import (
+	"html/template"
+
+	"simplehost-server/shared"
+)
+
+// templateFuncs are available to every template:
+//   - path prefixes an app path with the base path, e.g. {{path "/login"}}
+//   - basePath is the prefix itself, for scripts that build URLs
+var templateFuncs = template.FuncMap{
+	"path":     AppPath,
+	"basePath": func() string { return appConfig.Server.BasePath },
+}
+
+// ParseTemplates parses the named files from the embedded templates folder with
+// templateFuncs available
+func ParseTemplates(names ...string) (*template.Template, error) {
+	patterns := make([]string, len(names))
+	for i, name := range names {
+		patterns[i] = "templates/" + name
+	}
+	return template.New("").Funcs(templateFuncs).ParseFS(shared.TemplatesFS, patterns...)
+}
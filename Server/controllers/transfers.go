@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// transfer is an upload or download in progress, tracked so shutdown can wait for it and
+// report it if it gets cut off
+type transfer struct {
+	kind    string
+	name    string
+	userID  string
+	started time.Time
+}
+
+var (
+	transfersMu   sync.Mutex
+	transfers     = map[uint64]transfer{}
+	nextTransfer  uint64
+	transfersDone sync.WaitGroup
+)
+
+// trackedTransfer is the handle for a registered transfer
+type trackedTransfer struct {
+	id   uint64
+	once sync.Once
+}
+
+// trackTransfer registers a transfer. Callers must call done when it ends.
+func trackTransfer(kind, name, userID string) *trackedTransfer {
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+	nextTransfer++
+	transfers[nextTransfer] = transfer{kind: kind, name: name, userID: userID, started: time.Now()}
+	transfersDone.Add(1)
+	return &trackedTransfer{id: nextTransfer}
+}
+
+// rename updates the file name once it is known, e.g. after the upload form is parsed
+func (t *trackedTransfer) rename(name string) {
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+	if tr, ok := transfers[t.id]; ok {
+		tr.name = name
+		transfers[t.id] = tr
+	}
+}
+
+func (t *trackedTransfer) done() {
+	t.once.Do(func() {
+		transfersMu.Lock()
+		delete(transfers, t.id)
+		transfersMu.Unlock()
+		transfersDone.Done()
+	})
+}
+
+// ActiveTransfers describes the uploads and downloads in progress, oldest first
+func ActiveTransfers() []string {
+	transfersMu.Lock()
+	list := make([]transfer, 0, len(transfers))
+	for _, t := range transfers {
+		list = append(list, t)
+	}
+	transfersMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].started.Before(list[j].started) })
+
+	descriptions := make([]string, len(list))
+	for i, t := range list {
+		what := t.kind
+		if t.name != "" {
+			what += fmt.Sprintf(" of %q", t.name)
+		}
+		descriptions[i] = fmt.Sprintf("%s by user %s, running for %s", what, t.userID, time.Since(t.started).Round(time.Second))
+	}
+	return descriptions
+}
+
+// WaitForTransfers blocks until every tracked transfer has returned or timeout passes,
+// and reports whether they all finished
+func WaitForTransfers(timeout time.Duration) bool {
+	finished := make(chan struct{})
+	go func() {
+		transfersDone.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
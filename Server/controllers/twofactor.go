@@ -0,0 +1,380 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"simplehost-server/models"
+	"simplehost-server/totp"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	mfaCookieName  = "mfa_pending"
+	mfaPendingTTL  = 5 * time.Minute
+	mfaPurpose     = "mfa"
+	totpIssuerName = "SimpleHost"
+
+	totpSetupCookieName = "totp_setup"
+	totpSetupTTL        = 15 * time.Minute
+	totpSetupPurpose    = "totp_setup"
+)
+
+var mfaLimiter *RateLimiter
+
+// loginStep is what stands between a user who passed primary authentication and a session
+type loginStep int
+
+const (
+	loginReady loginStep = iota
+	loginAwaitingApproval
+	loginVerifyEmail
+	loginEnterTOTP
+	loginSetUpTOTP
+)
+
+// nextLoginStep applies the account policies every login method shares. Accounts an identity
+// provider created don't have to verify their email, since the provider vouches for them.
+func nextLoginStep(user *models.User) loginStep {
+	switch {
+	case !user.Approved:
+		return loginAwaitingApproval
+	case !user.EmailVerified && !models.IsProvisionedUser(user.ID):
+		return loginVerifyEmail
+	case user.TOTPEnabled:
+		return loginEnterTOTP
+	case models.GetBoolSetting(models.SettingRequire2FA, false):
+		return loginSetUpTOTP
+	}
+	return loginReady
+}
+
+// beginSession takes a user who passed primary authentication through nextLoginStep. It
+// returns where to send the browser, or the status and message to show when the login
+// can't go on. Users with 2FA enabled, or who must enroll because the instance requires
+// it, get a short-lived pending token and are sent to the second step instead of
+// receiving a session.
+func beginSession(w http.ResponseWriter, r *http.Request, user *models.User) (redirect string, status int, message string) {
+	setRequestUser(r, user.ID)
+	switch step := nextLoginStep(user); step {
+	case loginAwaitingApproval:
+		return "", http.StatusForbidden, "Your account is waiting for an admin to approve it."
+	case loginVerifyEmail:
+		if err := resendVerificationEmail(user); err != nil {
+			logFor(r).Error("Failed to send verification email", "user_id", user.ID, "error", err)
+		}
+		return "", http.StatusForbidden, "Please verify your email address first. Check your inbox for the verification link."
+	case loginEnterTOTP, loginSetUpTOTP:
+		token, err := generateMFAPendingToken(user.ID)
+		if err != nil {
+			return "", http.StatusInternalServerError, "Server error"
+		}
+		setCookie(w, r, &http.Cookie{
+			Name:     mfaCookieName,
+			Value:    token,
+			Path:     "/login/2fa",
+			HttpOnly: true,
+			MaxAge:   int(mfaPendingTTL.Seconds()),
+			SameSite: http.SameSiteLaxMode,
+		})
+		if step == loginEnterTOTP {
+			return AppPath("/login/2fa"), 0, ""
+		}
+		return AppPath("/login/2fa/setup"), 0, ""
+	}
+	token, err := GenerateJWT(user.ID, user.Username)
+	if err != nil {
+		return "", http.StatusInternalServerError, "Server error"
+	}
+	setAuthCookie(w, r, token)
+	return AppPath("/simplehost"), 0, ""
+}
+
+// completeLogin finishes a login from one of the HTML login pages
+func completeLogin(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any), user *models.User) {
+	redirect, status, message := beginSession(w, r, user)
+	if message != "" {
+		w.WriteHeader(status)
+		render(w, r, "login.html", map[string]any{"Error": message})
+		return
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+func generateMFAPendingToken(userID string) (string, error) {
+	claims := jwt.MapClaims{
+		"userId":  userID,
+		"purpose": mfaPurpose,
+		"iat":     time.Now().Unix(),
+		"exp":     time.Now().Add(mfaPendingTTL).Unix(),
+	}
+	return signToken(claims)
+}
+
+var errNoPendingLogin = errors.New("no pending two-factor login")
+
+// pendingMFAUser returns the user who passed the password step of the current login
+func pendingMFAUser(r *http.Request) (*models.User, error) {
+	cookie, err := r.Cookie(mfaCookieName)
+	if err != nil {
+		return nil, errNoPendingLogin
+	}
+	claims, err := ValidateJWT(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+	if purpose, _ := claims["purpose"].(string); purpose != mfaPurpose {
+		return nil, errNoPendingLogin
+	}
+	userID, _ := claims["userId"].(string)
+	return models.GetUserByID(userID)
+}
+
+func clearMFAPending(w http.ResponseWriter, r *http.Request) {
+	clearCookie(w, r, mfaCookieName, "/login/2fa", http.SameSiteLaxMode)
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused recovery code
+func verifySecondFactor(user *models.User, code string) bool {
+	if step, ok := totp.Validate(user.TOTPSecret, code, time.Now()); ok {
+		return models.UseTOTPStep(user.ID, step)
+	}
+	if models.UseRecoveryCode(user.ID, code) {
+		slog.Info("Used a recovery code", "user_id", user.ID, "remaining", models.RemainingRecoveryCodes(user.ID))
+		return true
+	}
+	return false
+}
+
+// LoginTwoFactorHandler asks for the authenticator or recovery code: GET/POST /login/2fa
+func LoginTwoFactorHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	user, err := pendingMFAUser(r)
+	if err != nil || !user.TOTPEnabled {
+		http.Redirect(w, r, AppPath("/login"), http.StatusSeeOther)
+		return
+	}
+	if r.Method == http.MethodGet {
+		render(w, r, "login_2fa.html", nil)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if ok, wait := mfaLimiter.Allow(user.ID); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		w.WriteHeader(http.StatusTooManyRequests)
+		render(w, r, "login_2fa.html", map[string]any{"Error": retryMessage(wait)})
+		return
+	}
+	if !verifySecondFactor(user, r.FormValue("code")) {
+		recordLogin("2fa", false)
+		mfaLimiter.Fail(user.ID)
+		logFor(r).Warn("Failed two-factor code", "user_id", user.ID, "ip", ClientIP(r))
+		render(w, r, "login_2fa.html", map[string]any{"Error": "Invalid code"})
+		return
+	}
+	recordLogin("2fa", true)
+	mfaLimiter.Reset(user.ID)
+	token, err := GenerateJWT(user.ID, user.Username)
+	if err != nil {
+		render(w, r, "login_2fa.html", map[string]any{"Error": "Server error"})
+		return
+	}
+	clearMFAPending(w, r)
+	setAuthCookie(w, r, token)
+	http.Redirect(w, r, AppPath("/simplehost"), http.StatusSeeOther)
+}
+
+// LoginTwoFactorSetupHandler enrolls users who have to set up 2FA before they can log in: GET/POST /login/2fa/setup
+func LoginTwoFactorSetupHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	user, err := pendingMFAUser(r)
+	if err != nil || user.TOTPEnabled {
+		http.Redirect(w, r, AppPath("/login"), http.StatusSeeOther)
+		return
+	}
+	twoFactorSetup(w, r, render, user, "/login/2fa/setup", func() string {
+		token, err := GenerateJWT(user.ID, user.Username)
+		if err != nil {
+			return ""
+		}
+		clearMFAPending(w, r)
+		setAuthCookie(w, r, token)
+		return "/simplehost"
+	})
+}
+
+// AccountTwoFactorSetupHandler lets a logged in user turn on 2FA: GET/POST /account/2fa/setup
+func AccountTwoFactorSetupHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	user, err := models.GetUserByID(GetUserIDFromRequest(r))
+	if err != nil {
+		http.Redirect(w, r, AppPath("/login"), http.StatusSeeOther)
+		return
+	}
+	if user.TOTPEnabled {
+		http.Redirect(w, r, AppPath("/account"), http.StatusSeeOther)
+		return
+	}
+	twoFactorSetup(w, r, render, user, "/account/2fa/setup", func() string { return "/account" })
+}
+
+// twoFactorSetup shows a fresh secret as a QR code on GET and enables it once the user
+// confirms a code on POST. onEnabled runs after enrollment and returns where to continue.
+// Until then the secret only lives in a signed cookie, so viewing the page changes nothing.
+func twoFactorSetup(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any), user *models.User, action string, onEnabled func() string) {
+	switch r.Method {
+	case http.MethodGet:
+		secret, err := totp.GenerateSecret()
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		token, err := signToken(jwt.MapClaims{
+			"userId":  user.ID,
+			"purpose": totpSetupPurpose,
+			"secret":  secret,
+			"iat":     time.Now().Unix(),
+			"exp":     time.Now().Add(totpSetupTTL).Unix(),
+		})
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		setCookie(w, r, &http.Cookie{
+			Name:     totpSetupCookieName,
+			Value:    token,
+			Path:     action,
+			HttpOnly: true,
+			MaxAge:   int(totpSetupTTL.Seconds()),
+			SameSite: http.SameSiteLaxMode,
+		})
+		user.TOTPSecret = secret
+		renderTwoFactorSetup(w, r, render, user, action, "")
+	case http.MethodPost:
+		secret := pendingTOTPSecret(r, user)
+		if secret == "" {
+			http.Redirect(w, r, AppPath(action), http.StatusSeeOther)
+			return
+		}
+		user.TOTPSecret = secret
+		step, ok := totp.Validate(secret, r.FormValue("code"), time.Now())
+		if !ok {
+			renderTwoFactorSetup(w, r, render, user, action, "That code didn't match. Check your device's clock and try again.")
+			return
+		}
+		if err := models.EnableTOTP(user.ID, secret, step); err != nil {
+			renderTwoFactorSetup(w, r, render, user, action, "Server error")
+			return
+		}
+		clearCookie(w, r, totpSetupCookieName, action, http.SameSiteLaxMode)
+		codes, err := models.GenerateRecoveryCodes(user.ID)
+		if err != nil {
+			renderTwoFactorSetup(w, r, render, user, action, "Server error")
+			return
+		}
+		logFor(r).Info("Enabled two-factor authentication", "user_id", user.ID)
+		render(w, r, "twofactor_recovery.html", map[string]any{"Codes": codes, "Continue": onEnabled()})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// pendingTOTPSecret returns the secret the setup page showed the user, or "" if the setup
+// cookie is missing, expired or was issued to someone else
+func pendingTOTPSecret(r *http.Request, user *models.User) string {
+	cookie, err := r.Cookie(totpSetupCookieName)
+	if err != nil {
+		return ""
+	}
+	claims, err := ValidateJWT(cookie.Value)
+	if err != nil {
+		return ""
+	}
+	if purpose, _ := claims["purpose"].(string); purpose != totpSetupPurpose {
+		return ""
+	}
+	if userID, _ := claims["userId"].(string); userID != user.ID {
+		return ""
+	}
+	secret, _ := claims["secret"].(string)
+	return secret
+}
+
+func renderTwoFactorSetup(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any), user *models.User, action, errMsg string) {
+	uri := totp.KeyURI(totpIssuerName, user.Username, user.TOTPSecret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	render(w, r, "twofactor_setup.html", map[string]any{
+		"Secret": user.TOTPSecret,
+		"QRCode": template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)),
+		"Action": action,
+		"Error":  errMsg,
+	})
+}
+
+// DisableTwoFactorHandler turns 2FA off after re-checking the password and a code: POST /account/2fa/disable
+func DisableTwoFactorHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if models.GetBoolSetting(models.SettingRequire2FA, false) {
+		accountResponse(w, r, render, http.StatusForbidden, "Two-factor authentication is required on this instance", true)
+		return
+	}
+	user, ok := currentUserWithPassword(w, r, render)
+	if !ok {
+		return
+	}
+	// Share the login's code limit, since the correct password resets the account limiter
+	if ok, wait := mfaLimiter.Allow(user.ID); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		accountResponse(w, r, render, http.StatusTooManyRequests, retryMessage(wait), true)
+		return
+	}
+	if !verifySecondFactor(user, r.FormValue("code")) {
+		mfaLimiter.Fail(user.ID)
+		logFor(r).Warn("Failed two-factor code", "user_id", user.ID, "ip", ClientIP(r))
+		accountResponse(w, r, render, http.StatusForbidden, "Invalid code", true)
+		return
+	}
+	mfaLimiter.Reset(user.ID)
+	if err := models.DisableTOTP(user.ID); err != nil {
+		accountResponse(w, r, render, http.StatusInternalServerError, "Failed to disable two-factor authentication", true)
+		return
+	}
+	logFor(r).Info("Disabled two-factor authentication", "user_id", user.ID)
+	accountResponse(w, r, render, http.StatusOK, "Two-factor authentication disabled.", false)
+}
+
+// RegenerateRecoveryCodesHandler replaces the recovery codes: POST /account/2fa/recovery-codes
+func RegenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, string, any)) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := currentUserWithPassword(w, r, render)
+	if !ok {
+		return
+	}
+	if !user.TOTPEnabled {
+		accountResponse(w, r, render, http.StatusBadRequest, "Two-factor authentication is not enabled", true)
+		return
+	}
+	codes, err := models.GenerateRecoveryCodes(user.ID)
+	if err != nil {
+		accountResponse(w, r, render, http.StatusInternalServerError, "Failed to generate recovery codes", true)
+		return
+	}
+	render(w, r, "twofactor_recovery.html", map[string]any{"Codes": codes, "Continue": "/account"})
+}
@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"simplehost-server/models"
+	"simplehost-server/totp"
+)
+
+func TestTwoFactorSetupOnlyChangesAccountOnConfirm(t *testing.T) {
+	setupServer(t)
+	user := createUser(t, "dave", true)
+	session := sessionCookie(t, user)
+	setup := AuthMiddleware(func(w http.ResponseWriter, r *http.Request) { AccountTwoFactorSetupHandler(w, r, renderStub) })
+
+	r := httptest.NewRequest(http.MethodGet, "/account/2fa/setup", nil)
+	r.AddCookie(session)
+	w := httptest.NewRecorder()
+	setup(w, r)
+	var setupCookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == totpSetupCookieName {
+			setupCookie = c
+		}
+	}
+	if setupCookie == nil {
+		t.Fatal("the setup page didn't set the setup cookie")
+	}
+	if stored, _ := models.GetUserByID(user.ID); stored.TOTPSecret != "" || stored.TOTPEnabled {
+		t.Fatal("viewing the setup page changed the account")
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/account/2fa/setup", nil)
+	r.AddCookie(setupCookie)
+	secret := pendingTOTPSecret(r, user)
+	if secret == "" {
+		t.Fatal("the setup cookie has no secret")
+	}
+	if other := createUser(t, "eve", true); pendingTOTPSecret(r, other) != "" {
+		t.Fatal("the setup cookie was accepted for another user")
+	}
+
+	if w := postForm(setup, "/account/2fa/setup", url.Values{"code": {"000000"}}, session, setupCookie); w.Code != http.StatusOK {
+		t.Fatalf("wrong code: got status %d", w.Code)
+	}
+	if stored, _ := models.GetUserByID(user.ID); stored.TOTPEnabled {
+		t.Fatal("a wrong code enabled two-factor authentication")
+	}
+	code, err := totp.CodeAt(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	postForm(setup, "/account/2fa/setup", url.Values{"code": {code}}, session, setupCookie)
+	stored, _ := models.GetUserByID(user.ID)
+	if !stored.TOTPEnabled || stored.TOTPSecret != secret {
+		t.Fatal("confirming the code didn't enable two-factor authentication with the shown secret")
+	}
+	if models.RemainingRecoveryCodes(user.ID) == 0 {
+		t.Fatal("no recovery codes were generated")
+	}
+}
+
+func TestDisableTwoFactorLimitsCodeGuesses(t *testing.T) {
+	setupServer(t)
+	user := createUser(t, "dave", true)
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := models.EnableTOTP(user.ID, secret, 0); err != nil {
+		t.Fatal(err)
+	}
+	session := sessionCookie(t, user)
+	disable := AuthMiddleware(func(w http.ResponseWriter, r *http.Request) { DisableTwoFactorHandler(w, r, renderStub) })
+	guess := func(code string) int {
+		return postForm(disable, "/account/2fa/disable", url.Values{"current_password": {testPassword}, "code": {code}}, session).Code
+	}
+
+	// The right password doesn't buy unlimited guesses at the code
+	for i := 0; i <= appConfig.RateLimits.Login2FA.FreeAttempts; i++ {
+		if code := guess("000000"); code != http.StatusForbidden {
+			t.Fatalf("guess %d: got status %d, want 403", i+1, code)
+		}
+	}
+	code, err := totp.CodeAt(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := guess(code); status != http.StatusTooManyRequests {
+		t.Fatalf("after the free attempts: got status %d, want 429", status)
+	}
+	if stored, _ := models.GetUserByID(user.ID); !stored.TOTPEnabled {
+		t.Fatal("two-factor authentication was disabled while throttled")
+	}
+}
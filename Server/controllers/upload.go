@@ -1,12 +1,15 @@
 package controllers
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -14,15 +17,226 @@ import (
 	"github.com/google/uuid"
 
 	"simplehost-server/models"
+	"simplehost-server/storage"
 )
 
-const uploadDir = "simplehostdata"
+// uploadDir is where in-progress chunks are stored, along with uploaded files when the
+// disk storage driver is used
+func uploadDir() string {
+	return appConfig.Storage.UploadDir
+}
+
+// chunkDir holds the chunks of uploads until the last one arrives and they're assembled
+// into the final file
+func chunkDir() string {
+	return filepath.Join(uploadDir(), ".chunks")
+}
+
+// chunkStore stores chunks on local disk, encrypted like files are so uploads in
+// progress aren't left readable
+func chunkStore() storage.Driver {
+	var d storage.Driver = &storage.Disk{Root: chunkDir()}
+	if enc, ok := models.Blobs.(*storage.Encrypted); ok {
+		d = &storage.Encrypted{Inner: d, Keys: enc.Keys}
+	}
+	return d
+}
+
+// CleanupPartialUploads removes files left by uploads that were cut off, e.g. by a crash
+func CleanupPartialUploads() {
+	(&storage.Disk{Root: uploadDir()}).RemovePartial()
+}
+
+// RewrapChunks rewraps the data keys of the chunks of unfinished uploads, S3 multipart
+// parts included, with the current master key, so the old keys can be dropped without
+// losing uploads in progress. It returns how many were rewrapped and how many failed.
+func RewrapChunks(ctx context.Context) (int, int, error) {
+	store, ok := chunkStore().(*storage.Encrypted)
+	if !ok {
+		return 0, 0, nil
+	}
+	uploads, err := os.ReadDir(chunkDir())
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	rewrapped, failed := 0, 0
+	for _, upload := range uploads {
+		if !upload.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(chunkDir(), upload.Name()))
+		if err != nil {
+			return rewrapped, failed, err
+		}
+		for _, entry := range entries {
+			// Envelopes and partly written chunks aren't chunks themselves
+			if _, err := strconv.Atoi(entry.Name()); err != nil {
+				continue
+			}
+			key := upload.Name() + "/" + entry.Name()
+			changed, err := store.Rewrap(ctx, key)
+			if err != nil {
+				slog.Error("Failed to rewrap data key of chunk", "key", key, "error", err)
+				failed++
+			} else if changed {
+				rewrapped++
+			}
+		}
+	}
+	return rewrapped, failed, nil
+}
+
+// openChunks reads the chunks of an upload in order as one stream, and returns its size
+func openChunks(ctx context.Context, uploadID string, total int) (io.Reader, int64, func(), error) {
+	keys := make([]string, total)
+	for i := range keys {
+		keys[i] = uploadID + "/" + strconv.Itoa(i)
+	}
+	return openChunkKeys(ctx, keys)
+}
+
+// openChunkKeys reads the given chunks in order as one stream, and returns its size
+func openChunkKeys(ctx context.Context, keys []string) (io.Reader, int64, func(), error) {
+	chunks := chunkStore()
+	readers := make([]io.Reader, 0, len(keys))
+	closers := make([]io.Closer, 0, len(keys))
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+	var size int64
+	for _, key := range keys {
+		info, err := chunks.Stat(ctx, key)
+		if err != nil {
+			closeAll()
+			return nil, 0, nil, err
+		}
+		r, err := chunks.Get(ctx, key, 0, -1)
+		if err != nil {
+			closeAll()
+			return nil, 0, nil, err
+		}
+		size += info.Size
+		closers = append(closers, r)
+		readers = append(readers, r)
+	}
+	return io.MultiReader(readers...), size, closeAll, nil
+}
 
 func atoi(s string) int {
 	n, _ := strconv.Atoi(s)
 	return n
 }
 
+// chunkedUploadMaxAge is how long an upload through /api/upload may go unfinished before
+// its chunks are thrown away
+const chunkedUploadMaxAge = 7 * 24 * time.Hour
+
+// removeChunkedUpload deletes an upload's chunks and forgets it
+func removeChunkedUpload(u models.ChunkedUpload) error {
+	if err := os.RemoveAll(filepath.Join(chunkDir(), u.ID)); err != nil {
+		return err
+	}
+	return models.DeleteChunkedUpload(u.ID)
+}
+
+// abortChunkedUploads removes all of a user's unfinished uploads, e.g. before deleting them
+func abortChunkedUploads(userID string) {
+	uploads, err := models.ListUserChunkedUploads(userID)
+	if err != nil {
+		slog.Error("Failed to list uploads", "user_id", userID, "error", err)
+		return
+	}
+	for _, u := range uploads {
+		if err := removeChunkedUpload(u); err != nil {
+			slog.Error("Failed to remove upload", "upload_id", u.ID, "error", err)
+		}
+	}
+}
+
+// removeStaleChunkedUploads throws away uploads abandoned for longer than chunkedUploadMaxAge
+func removeStaleChunkedUploads() {
+	uploads, err := models.ListChunkedUploadsBefore(time.Now().Add(-chunkedUploadMaxAge))
+	if err != nil {
+		slog.Error("Failed to list stale uploads", "error", err)
+		return
+	}
+	for _, u := range uploads {
+		if err := removeChunkedUpload(u); err != nil {
+			slog.Error("Failed to remove stale upload", "upload_id", u.ID, "error", err)
+			continue
+		}
+		slog.Info("Removed stale upload", "upload_id", u.ID, "user_id", u.UserID)
+	}
+}
+
+// UploadStartHandler issues the ID a chunked upload sends its chunks under. Only the user
+// it was issued to can send chunks for it or see its status: POST /api/upload/start
+func UploadStartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed"})
+		return
+	}
+	removeStaleChunkedUploads()
+	u, err := models.CreateChunkedUpload(GetUserIDFromRequest(r))
+	if err != nil {
+		logFor(r).Error("Failed to start upload", "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Could not start upload"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"upload_id":  u.ID,
+		"chunk_size": appConfig.Storage.ChunkSize,
+	})
+}
+
+// UploadStatusHandler reports which chunks of an upload the server already has, so a
+// client can resume an upload that was cut off: GET /api/upload?upload_id=...
+func UploadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	uploadID := r.URL.Query().Get("upload_id")
+	if _, err := models.GetChunkedUpload(uploadID, GetUserIDFromRequest(r)); err == sql.ErrNoRows {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Unknown upload"})
+		return
+	} else if err != nil {
+		logFor(r).Error("Failed to look up upload", "upload_id", uploadID, "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Could not look up upload"})
+		return
+	}
+	type chunk struct {
+		Index int   `json:"index"`
+		Size  int64 `json:"size"`
+	}
+	chunks := []chunk{}
+	entries, err := os.ReadDir(filepath.Join(chunkDir(), uploadID))
+	if err != nil && !os.IsNotExist(err) {
+		logFor(r).Error("Failed to list chunks", "upload_id", uploadID, "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Could not list chunks"})
+		return
+	}
+	store := chunkStore()
+	for _, entry := range entries {
+		// Skip partly written chunks and anything else that isn't a whole chunk
+		index, err := strconv.Atoi(entry.Name())
+		if err != nil || index < 0 {
+			continue
+		}
+		info, err := store.Stat(r.Context(), uploadID+"/"+entry.Name())
+		if err != nil {
+			continue
+		}
+		chunks = append(chunks, chunk{index, info.Size})
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Index < chunks[j].Index })
+	writeJSON(w, http.StatusOK, map[string]any{
+		"upload_id":  uploadID,
+		"chunk_size": appConfig.Storage.ChunkSize,
+		"chunks":     chunks,
+	})
+}
+
 // UploadHandler handles file uploads (chunked and non-chunked)
 func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -30,29 +244,49 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	transfer := trackTransfer("upload", "", GetUserIDFromRequest(r))
+	defer transfer.done()
+
 	// Ensure upload directory exists
-	if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
+	if err := os.MkdirAll(uploadDir(), os.ModePerm); err != nil {
+		logFor(r).Error("Could not create upload directory", "dir", uploadDir(), "error", err)
 		http.Error(w, "Could not create upload directory", http.StatusInternalServerError)
 		return
 	}
 
-	err := r.ParseMultipartForm(32 << 20) // 32 MB
+	err := r.ParseMultipartForm(appConfig.Storage.MaxMultipartMemory)
 	if err != nil {
 		http.Error(w, "Error parsing form", http.StatusBadRequest)
 		return
 	}
 
 	// Chunked upload: check for chunk fields
-	chunkFile, _, chunkErr := r.FormFile("chunk")
+	chunkFile, chunkHeader, chunkErr := r.FormFile("chunk")
 	fileName := r.FormValue("file_name")
 	uploadId := r.FormValue("upload_id")
 	chunkIdx := r.FormValue("chunk_index")
 	totalChunks := r.FormValue("total_chunks")
 	folderId := r.FormValue("folder_id")
 	overwrite := r.FormValue("overwrite") == "true"
+	if fileName != "" {
+		transfer.rename(fileName)
+	}
 
 	if chunkErr == nil && fileName != "" && uploadId != "" && chunkIdx != "" && totalChunks != "" {
-		// Generate file ID for this upload (use uploadId for all chunks, but only save on last chunk)
+		// The upload ID was issued to this user by UploadStartHandler. It names the chunks
+		// and becomes the file's ID once the last chunk arrives.
+		if _, err := models.GetChunkedUpload(uploadId, GetUserIDFromRequest(r)); err == sql.ErrNoRows {
+			http.Error(w, "Unknown upload", http.StatusNotFound)
+			return
+		} else if err != nil {
+			logFor(r).Error("Failed to look up upload", "upload_id", uploadId, "error", err)
+			http.Error(w, "Could not look up upload", http.StatusInternalServerError)
+			return
+		}
+		if index, err := strconv.Atoi(chunkIdx); err != nil || index < 0 || index >= atoi(totalChunks) || strconv.Itoa(index) != chunkIdx {
+			http.Error(w, "Invalid chunk_index", http.StatusBadRequest)
+			return
+		}
 		fileID := uploadId
 		file, err := models.GetFileByFolderAndName(folderId, fileName)
 
@@ -60,7 +294,7 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 		if err == nil && file != nil {
 			if chunkIdx == "0" {
 				// File already exists, return conflict if not overwriting
-				if _, err := os.Stat(file.StoragePath); err == nil && !overwrite {
+				if _, err := models.Blobs.Stat(r.Context(), file.StorageKey); err == nil && !overwrite {
 					w.WriteHeader(http.StatusConflict)
 					w.Write([]byte("EXISTS"))
 					return
@@ -68,55 +302,41 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			// If not the first chunk, we don't care about existing files
 		} else if err != nil {
+			logFor(r).Error("Failed to check for an existing file", "name", fileName, "error", err)
 			http.Error(w, "Error checking existing file", http.StatusInternalServerError)
 			return
 		}
 
 		// Handle chunked upload
 		defer chunkFile.Close()
-		tmpDir := filepath.Join(uploadDir, ".chunks", uploadId)
-		if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
-			http.Error(w, "Could not create chunk dir", http.StatusInternalServerError)
-			return
-		}
-		chunkPath := filepath.Join(tmpDir, chunkIdx)
-		out, err := os.Create(chunkPath)
+		chunkKey := uploadId + "/" + chunkIdx
+		err = chunkStore().Put(r.Context(), chunkKey, chunkFile, chunkHeader.Size)
 		if err != nil {
-			http.Error(w, "Could not create chunk file", http.StatusInternalServerError)
-			return
-		}
-		if _, err := io.Copy(out, chunkFile); err != nil {
-			out.Close()
+			logFor(r).Error("Could not write chunk", "upload_id", uploadId, "chunk", chunkIdx, "error", err)
 			http.Error(w, "Could not write chunk", http.StatusInternalServerError)
 			return
 		}
-		out.Close()
+		transferBytes.Add(float64(chunkHeader.Size), "upload")
 		// If last chunk, assemble
 		if chunkIdx == fmt.Sprintf("%d", atoi(totalChunks)-1) {
-			finalPath := filepath.Join(uploadDir, fileID)
-			finalOut, err := os.Create(finalPath)
+			chunks, size, closeChunks, err := openChunks(r.Context(), uploadId, atoi(totalChunks))
 			if err != nil {
-				http.Error(w, "Could not create final file", http.StatusInternalServerError)
+				logFor(r).Error("Missing chunk", "upload_id", uploadId, "error", err)
+				http.Error(w, "Missing chunk", http.StatusInternalServerError)
 				return
 			}
-			for i := 0; i < atoi(totalChunks); i++ {
-				chunkPath := filepath.Join(tmpDir, fmt.Sprintf("%d", i))
-				in, err := os.Open(chunkPath)
-				if err != nil {
-					finalOut.Close()
-					http.Error(w, "Missing chunk", http.StatusInternalServerError)
-					return
-				}
-				if _, err := io.Copy(finalOut, in); err != nil {
-					in.Close()
-					finalOut.Close()
-					http.Error(w, "Error assembling file", http.StatusInternalServerError)
-					return
-				}
-				in.Close()
+			assemblyStart := time.Now()
+			err = models.Blobs.Put(r.Context(), fileID, chunks, size)
+			closeChunks()
+			assemblyDuration.Observe(time.Since(assemblyStart).Seconds())
+			if err != nil {
+				logFor(r).Error("Failed to assemble upload", "file_id", fileID, "name", fileName, "error", err)
+				http.Error(w, "Error assembling file", http.StatusInternalServerError)
+				return
+			}
+			if err := removeChunkedUpload(models.ChunkedUpload{ID: uploadId}); err != nil {
+				logFor(r).Warn("Failed to remove assembled chunks", "upload_id", uploadId, "error", err)
 			}
-			finalOut.Close()
-			os.RemoveAll(tmpDir)
 			// Insert file record
 			claims, _ := r.Context().Value("claims").(map[string]any)
 			ownerID := ""
@@ -133,13 +353,15 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 				ID:           fileID,
 				Name:         fileName,
 				FolderID:     folderId,
-				StoragePath:  finalPath,
+				StorageKey:   fileID,
+				Size:         size,
 				OwnerID:      ownerID,
 				UploadedDate: time.Now(),
 				IsPrivate:    false,
 			}
 			err = models.InsertFile(fileRecord)
 			if err != nil {
+				logFor(r).Error("Failed to save file record", "file_id", fileID, "error", err)
 				http.Error(w, "Error saving file record", http.StatusInternalServerError)
 				return
 			}
@@ -148,6 +370,7 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 			if file != nil && file.OwnerID == ownerID {
 				err = models.DeleteFileByID(file.ID, ownerID)
 				if err != nil {
+					logFor(r).Error("Failed to delete replaced file record", "file_id", file.ID, "error", err)
 					http.Error(w, "Error deleting old file record", http.StatusInternalServerError)
 					return
 				}
@@ -174,6 +397,7 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	for i, fileHeader := range files {
 		src, err := fileHeader.Open()
 		if err != nil {
+			logFor(r).Error("Failed to open uploaded file", "name", fileHeader.Filename, "error", err)
 			http.Error(w, "Error opening file", http.StatusInternalServerError)
 			return
 		}
@@ -227,29 +451,26 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		fileID := uuid.NewString()
-		dstPath := filepath.Join(uploadDir, fileID)
-		if _, err := os.Stat(dstPath); err == nil && !overwrite {
+		if _, err := models.Blobs.Stat(r.Context(), fileID); err == nil && !overwrite {
 			w.WriteHeader(http.StatusConflict)
 			w.Write([]byte("EXISTS"))
 			return
 		}
-		dst, err := os.Create(dstPath)
-		if err != nil {
-			http.Error(w, "Error saving file", http.StatusInternalServerError)
-			return
-		}
-		defer dst.Close()
-
-		if _, err := io.Copy(dst, src); err != nil {
+		size := fileHeader.Size
+		if err := models.Blobs.Put(r.Context(), fileID, src, size); err != nil {
+			logFor(r).Error("Failed to write file", "name", fileHeader.Filename, "error", err)
 			http.Error(w, "Error writing file", http.StatusInternalServerError)
 			return
 		}
 
+		transferBytes.Add(float64(size), "upload")
+
 		fileRecord := models.File{
 			ID:           fileID,
 			Name:         fileHeader.Filename,
 			FolderID:     parentID,
-			StoragePath:  dstPath,
+			StorageKey:   fileID,
+			Size:         size,
 			OwnerID:      ownerID,
 			UploadedDate: time.Now(),
 			IsPrivate:    false,
@@ -0,0 +1,119 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"simplehost-server/models"
+)
+
+// startUpload asks for an upload ID the way the uploader does
+func startUpload(t *testing.T, cookie *http.Cookie) string {
+	t.Helper()
+	w := postForm(AuthMiddleware(UploadStartHandler), "/api/upload/start", nil, cookie)
+	var started struct {
+		UploadID  string `json:"upload_id"`
+		ChunkSize int64  `json:"chunk_size"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &started); w.Code != http.StatusOK || err != nil || started.UploadID == "" || started.ChunkSize <= 0 {
+		t.Fatalf("start upload: %d %s", w.Code, w.Body)
+	}
+	return started.UploadID
+}
+
+// postChunk sends one chunk as the multipart form the uploader sends
+func postChunk(t *testing.T, cookie *http.Cookie, uploadID, index string, total int, data string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, value := range map[string]string{
+		"file_name":    "notes.txt",
+		"upload_id":    uploadID,
+		"chunk_index":  index,
+		"total_chunks": strconv.Itoa(total),
+		"folder_id":    "root",
+	} {
+		mw.WriteField(name, value)
+	}
+	part, _ := mw.CreateFormFile("chunk", "notes.txt")
+	part.Write([]byte(data))
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/api/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	AuthMiddleware(UploadHandler)(w, r)
+	return w
+}
+
+func uploadStatus(cookie *http.Cookie, uploadID string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/api/upload?upload_id="+uploadID, nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	AuthMiddleware(UploadStatusHandler)(w, r)
+	return w
+}
+
+func TestChunkedUploadBelongsToItsUser(t *testing.T) {
+	setupServer(t)
+	alice := sessionCookie(t, createUser(t, "alice", true))
+	bob := sessionCookie(t, createUser(t, "bob", true))
+	id := startUpload(t, alice)
+
+	if w := postChunk(t, alice, id, "0", 2, "hello, "); w.Code != http.StatusOK {
+		t.Fatalf("first chunk: %d %s", w.Code, w.Body)
+	}
+	if w := uploadStatus(alice, id); w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(`"index":0`)) {
+		t.Fatalf("status: %d %s", w.Code, w.Body)
+	}
+
+	// Another user can neither see the upload nor add to it
+	if w := uploadStatus(bob, id); w.Code != http.StatusNotFound {
+		t.Errorf("other user's status: %d %s", w.Code, w.Body)
+	}
+	if w := postChunk(t, bob, id, "1", 2, "mallory"); w.Code != http.StatusNotFound {
+		t.Errorf("other user's chunk: %d %s", w.Code, w.Body)
+	}
+
+	// Upload IDs the server didn't issue, like an S3 multipart upload's, are refused
+	for _, chosen := range []string{"my-own-id", "../" + id} {
+		if w := postChunk(t, alice, chosen, "0", 1, "data"); w.Code != http.StatusNotFound {
+			t.Errorf("chunk for %q: %d %s", chosen, w.Code, w.Body)
+		}
+		if w := uploadStatus(alice, chosen); w.Code != http.StatusNotFound {
+			t.Errorf("status of %q: %d %s", chosen, w.Code, w.Body)
+		}
+	}
+	for _, index := range []string{"2", "-1", "01", "x"} {
+		if w := postChunk(t, alice, id, index, 2, "data"); w.Code != http.StatusBadRequest {
+			t.Errorf("chunk %q: %d %s", index, w.Code, w.Body)
+		}
+	}
+
+	if w := postChunk(t, alice, id, "1", 2, "world"); w.Code != http.StatusOK {
+		t.Fatalf("last chunk: %d %s", w.Code, w.Body)
+	}
+	file, err := models.GetFileByFolderAndName("root", "notes.txt")
+	if err != nil || file == nil || file.ID != id {
+		t.Fatalf("uploaded file: %+v, %v", file, err)
+	}
+	r, err := models.Blobs.Get(context.Background(), file.StorageKey, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if data, _ := io.ReadAll(r); string(data) != "hello, world" {
+		t.Errorf("contents = %q", data)
+	}
+	// A finished upload can't be added to
+	if w := uploadStatus(alice, id); w.Code != http.StatusNotFound {
+		t.Errorf("status after finishing: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,426 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"simplehost-server/models"
+	"simplehost-server/passwords"
+	"simplehost-server/storage"
+	"simplehost-server/vfs"
+)
+
+// davCredentialTTL is how long a checked password is remembered. WebDAV clients send
+// basic auth with every request, and hashing the password each time would be far too slow.
+// App tokens are cheap to check, so they aren't cached and revoking one takes effect at once.
+const davCredentialTTL = 5 * time.Minute
+
+type davCredential struct {
+	userID  string
+	checked time.Time
+}
+
+var (
+	davCredentialsMu sync.Mutex
+	davCredentials   = map[[sha256.Size]byte]davCredential{}
+	// Locks are per user since each user sees a different tree
+	davLocksMu sync.Mutex
+	davLocks   = map[string]webdav.LockSystem{}
+)
+
+func isWebDAVPath(p string) bool {
+	return p == "/webdav" || strings.HasPrefix(p, "/webdav/")
+}
+
+// WebDAVHandler serves each user's view of the folder tree over WebDAV: /webdav/
+func WebDAVHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := webDAVUser(w, r)
+		if !ok {
+			return
+		}
+		setRequestUser(r, user.ID)
+		// Responses link to full URLs and clients send them back in Destination headers,
+		// so put back the base path BasePathMiddleware took off
+		r.URL.Path = AppPath(r.URL.Path)
+		h := &webdav.Handler{
+			Prefix:     AppPath("/webdav"),
+			FileSystem: &davFS{fs: vfs.New(user.ID)},
+			LockSystem: davLockSystem(user.ID),
+			Logger: func(r *http.Request, err error) {
+				if err != nil && !errors.Is(err, fs.ErrNotExist) {
+					logFor(r).Warn("WebDAV request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+				}
+			},
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func davLockSystem(userID string) webdav.LockSystem {
+	davLocksMu.Lock()
+	defer davLocksMu.Unlock()
+	ls, ok := davLocks[userID]
+	if !ok {
+		ls = webdav.NewMemLS()
+		davLocks[userID] = ls
+	}
+	return ls
+}
+
+// webDAVUser checks basic auth credentials, answering the request itself when they're
+// missing or wrong. The password may be the account password or an app token; accounts
+// with two-factor authentication must use an app token. Session cookies are never
+// accepted, so a web page can't make WebDAV requests as the user.
+func webDAVUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	username, password, ok := r.BasicAuth()
+	if !ok || username == "" || password == "" {
+		davUnauthorized(w, "Authentication required")
+		return nil, false
+	}
+	sum := sha256.Sum256([]byte(accountKey(username) + "\x00" + password))
+	if user := cachedDAVUser(sum); user != nil {
+		return user, checkWebDAVUser(w, user)
+	}
+
+	ip := ClientIP(r)
+	account := accountKey(username)
+	if ok, wait := checkLoginLimits(ip, account); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, retryMessage(wait), http.StatusTooManyRequests)
+		return nil, false
+	}
+	// Taken before the check, so a password change made while it runs still counts as
+	// coming after it
+	checked := time.Now()
+	user, method, err := clientCredentials(username, password)
+	if errors.Is(err, passwords.ErrBusy) {
+		loginIPLimiter.Release(ip)
+		loginAccountLimiter.Release(account)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, serverBusyMessage, http.StatusServiceUnavailable)
+		return nil, false
+	}
+	recordLogin(method, err == nil)
+	if err != nil {
+		loginIPLimiter.Fail(ip)
+		loginAccountLimiter.Fail(account)
+		logFor(r).Warn("Failed WebDAV login", "username", username, "ip", ip, "error", err)
+		davUnauthorized(w, "Invalid username or password")
+		return nil, false
+	}
+	loginIPLimiter.Release(ip)
+	loginAccountLimiter.Reset(account)
+	if !checkWebDAVUser(w, user) {
+		return nil, false
+	}
+	if method == "app_token" {
+		return user, true
+	}
+
+	davCredentialsMu.Lock()
+	for key, c := range davCredentials {
+		if time.Since(c.checked) > davCredentialTTL {
+			delete(davCredentials, key)
+		}
+	}
+	davCredentials[sum] = davCredential{userID: user.ID, checked: checked}
+	davCredentialsMu.Unlock()
+	return user, true
+}
+
+// forgetDAVCredentials drops the user's remembered passwords, e.g. once the password
+// changes or their sessions are revoked
+func forgetDAVCredentials(userID string) {
+	davCredentialsMu.Lock()
+	defer davCredentialsMu.Unlock()
+	for key, c := range davCredentials {
+		if c.userID == userID {
+			delete(davCredentials, key)
+		}
+	}
+}
+
+// cachedDAVUser returns the user for a recently checked password, unless the user has
+// since changed it, logged out everywhere or turned on two-factor authentication
+func cachedDAVUser(sum [sha256.Size]byte) *models.User {
+	davCredentialsMu.Lock()
+	cached, ok := davCredentials[sum]
+	davCredentialsMu.Unlock()
+	if !ok || time.Since(cached.checked) > davCredentialTTL {
+		return nil
+	}
+	user, err := models.GetUserByID(cached.userID)
+	if err != nil || user.SessionsRevokedAt >= cached.checked.Unix() || passwordNeeds2FA(user) {
+		davCredentialsMu.Lock()
+		delete(davCredentials, sum)
+		davCredentialsMu.Unlock()
+		return nil
+	}
+	return user
+}
+
+// clientCredentials checks a username with a password or app token for clients that sign
+// in without the login page, and returns the login method for metrics
+func clientCredentials(username, password string) (*models.User, string, error) {
+	if strings.HasPrefix(password, models.APITokenPrefix) {
+		userID, err := models.LookupAPIToken(password)
+		if err != nil {
+			return nil, "app_token", err
+		}
+		user, err := models.GetUserByID(userID)
+		if err != nil {
+			return nil, "app_token", err
+		}
+		if accountKey(user.Username) != accountKey(username) {
+			return nil, "app_token", ErrInvalidCredentials
+		}
+		return user, "app_token", nil
+	}
+	user, err := authenticate(username, password)
+	if err != nil {
+		return nil, "password", err
+	}
+	if passwordNeeds2FA(user) {
+		return nil, "password", errors.New("two-factor authentication is on, so an app token is required")
+	}
+	return user, "password", nil
+}
+
+// passwordNeeds2FA reports whether the user's password alone isn't enough to sign in
+func passwordNeeds2FA(user *models.User) bool {
+	return user.TOTPEnabled || models.GetBoolSetting(models.SettingRequire2FA, false)
+}
+
+// clientAccountError reports why a user with valid credentials still can't use a client
+func clientAccountError(user *models.User) error {
+	switch nextLoginStep(user) {
+	case loginAwaitingApproval:
+		return errors.New("your account is waiting for approval")
+	case loginVerifyEmail:
+		return errors.New("please verify your email address first")
+	}
+	return nil
+}
+
+func checkWebDAVUser(w http.ResponseWriter, user *models.User) bool {
+	if err := clientAccountError(user); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func davUnauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="SimpleHost", charset="UTF-8"`)
+	http.Error(w, message, http.StatusUnauthorized)
+}
+
+// davFS adapts a user's vfs tree to webdav.FileSystem
+type davFS struct {
+	fs *vfs.FS
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return d.fs.Mkdir(ctx, name)
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return d.create(ctx, name, flag)
+	}
+	node, rs, err := d.fs.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if rs == nil {
+		return &davFile{fs: d.fs, ctx: ctx, name: name, node: node}, nil
+	}
+	return &davFile{
+		fs:       d.fs,
+		ctx:      ctx,
+		name:     name,
+		node:     node,
+		reader:   rs,
+		transfer: trackTransfer("download", node.Name(), d.fs.UserID),
+	}, nil
+}
+
+// create opens a file for writing. Writes are spooled to a temporary file and stored
+// when the file is closed, since storage needs the size up front.
+func (d *davFS) create(ctx context.Context, name string, flag int) (webdav.File, error) {
+	node, err := d.fs.Stat(ctx, name)
+	switch {
+	case err == nil && flag&os.O_EXCL != 0:
+		return nil, os.ErrExist
+	case errors.Is(err, vfs.ErrNotExist) && flag&os.O_CREATE == 0:
+		return nil, err
+	case err != nil && !errors.Is(err, vfs.ErrNotExist):
+		return nil, err
+	case err == nil && flag&os.O_TRUNC == 0:
+		// Files are replaced as a whole, so writing into an existing one isn't supported
+		return nil, vfs.ErrPermission
+	}
+	if err := d.fs.CheckCreate(ctx, name); err != nil {
+		return nil, err
+	}
+	spool, err := newSpoolFile()
+	if err != nil {
+		return nil, err
+	}
+	_, base := path.Split(path.Clean("/" + name))
+	return &davFile{
+		fs:       d.fs,
+		ctx:      ctx,
+		name:     name,
+		node:     node,
+		spool:    spool,
+		transfer: trackTransfer("upload", base, d.fs.UserID),
+	}, nil
+}
+
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	if err := d.fs.Remove(ctx, name); err != nil && !errors.Is(err, vfs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	return d.fs.Rename(ctx, oldName, newName)
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	node, err := d.fs.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return davInfo{node}, nil
+}
+
+// davInfo saves the webdav package from opening files to guess their type and gives
+// each stored version of a file its own ETag
+type davInfo struct {
+	*vfs.Node
+}
+
+func (i davInfo) ContentType(ctx context.Context) (string, error) {
+	if ctype := mime.TypeByExtension(path.Ext(i.Name())); ctype != "" {
+		return ctype, nil
+	}
+	return "application/octet-stream", nil
+}
+
+func (i davInfo) ETag(ctx context.Context) (string, error) {
+	if i.ID() == "" {
+		// A file still being written, which has no ID yet
+		return "", webdav.ErrNotImplemented
+	}
+	return strconv.Quote(i.ID()), nil
+}
+
+// davFile is an open folder, a file being read, or a file being written
+type davFile struct {
+	fs       *vfs.FS
+	ctx      context.Context
+	name     string
+	node     *vfs.Node
+	reader   *storage.ReadSeeker
+	spool    *spoolFile
+	listing  []*vfs.Node
+	listed   bool
+	transfer *trackedTransfer
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if f.reader == nil {
+		return 0, vfs.ErrInvalid
+	}
+	n, err := f.reader.Read(p)
+	transferBytes.Add(float64(n), "download")
+	return n, err
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	if f.reader == nil {
+		return 0, vfs.ErrInvalid
+	}
+	return f.reader.Seek(offset, whence)
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	if f.spool == nil {
+		return 0, vfs.ErrPermission
+	}
+	n, err := f.spool.Write(p)
+	transferBytes.Add(float64(n), "upload")
+	return n, err
+}
+
+// Readdir follows os.File: count > 0 returns at most count entries and io.EOF at the end
+func (f *davFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if f.node == nil || !f.node.IsDir() {
+		return nil, vfs.ErrInvalid
+	}
+	if !f.listed {
+		nodes, err := f.fs.ReadDir(f.ctx, f.name)
+		if err != nil {
+			return nil, err
+		}
+		f.listing, f.listed = nodes, true
+	}
+	n := len(f.listing)
+	if count > 0 {
+		if n == 0 {
+			return nil, io.EOF
+		}
+		n = min(n, count)
+	}
+	infos := make([]fs.FileInfo, n)
+	for i, node := range f.listing[:n] {
+		infos[i] = davInfo{node}
+	}
+	f.listing = f.listing[n:]
+	return infos, nil
+}
+
+func (f *davFile) Stat() (fs.FileInfo, error) {
+	if f.spool != nil {
+		// Not stored yet, so describe what has been written so far
+		_, base := path.Split(path.Clean("/" + f.name))
+		return davInfo{&vfs.Node{File: &models.File{Name: base, Size: f.spool.Size(), UploadedDate: time.Now(), CanDelete: true}}}, nil
+	}
+	return davInfo{f.node}, nil
+}
+
+func (f *davFile) Close() error {
+	if f.transfer != nil {
+		defer f.transfer.done()
+	}
+	if f.reader != nil {
+		return f.reader.Close()
+	}
+	if f.spool == nil {
+		return nil
+	}
+	defer f.spool.Remove()
+	node, err := f.fs.Create(f.ctx, f.name, f.spool.Reader(), f.spool.Size())
+	if err != nil {
+		return err
+	}
+	f.node = node
+	return nil
+}
@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// davPropfind lists the top of the user's tree with basic auth, as a WebDAV client does
+func davPropfind(username, password string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("PROPFIND", "/webdav/", nil)
+	r.Header.Set("Depth", "0")
+	r.SetBasicAuth(username, password)
+	w := httptest.NewRecorder()
+	WebDAVHandler().ServeHTTP(w, r)
+	return w
+}
+
+func TestWebDAVForgetsPasswordsOnceChanged(t *testing.T) {
+	setupServer(t)
+	user := createUser(t, "dave", true)
+	const newPassword = "Changed-456"
+	if w := davPropfind("dave", testPassword); w.Code != http.StatusMultiStatus {
+		t.Fatalf("first login: %d %s", w.Code, w.Body)
+	}
+
+	change := AuthMiddleware(func(w http.ResponseWriter, r *http.Request) { ChangePasswordHandler(w, r, renderStub) })
+	form := url.Values{"current_password": {testPassword}, "password": {newPassword}, "retype": {newPassword}}
+	if w := postForm(change, "/account/password", form, sessionCookie(t, user)); w.Code != http.StatusOK {
+		t.Fatalf("changing the password: %d %s", w.Code, w.Body)
+	}
+	if w := davPropfind("dave", testPassword); w.Code != http.StatusUnauthorized {
+		t.Errorf("old password after changing it: %d", w.Code)
+	}
+	if w := davPropfind("dave", newPassword); w.Code != http.StatusMultiStatus {
+		t.Fatalf("new password: %d %s", w.Code, w.Body)
+	}
+
+	// Resetting it by email forgets it too
+	forgot := func(w http.ResponseWriter, r *http.Request) { ForgotPasswordHandler(w, r, renderStub) }
+	reset := func(w http.ResponseWriter, r *http.Request) { ResetPasswordHandler(w, r, renderStub) }
+	postForm(forgot, "/forgot-password", url.Values{"email": {user.Email}})
+	messages := outbox(t)
+	if len(messages) != 1 {
+		t.Fatalf("sent %d emails, want 1", len(messages))
+	}
+	form = url.Values{"token": {emailedToken(t, messages[0], "/reset-password")}, "password": {testPassword}, "retype": {testPassword}}
+	postForm(reset, "/reset-password", form)
+	if w := davPropfind("dave", newPassword); w.Code != http.StatusUnauthorized {
+		t.Errorf("password replaced by a reset: %d", w.Code)
+	}
+}
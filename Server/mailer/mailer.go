@@ -0,0 +1,161 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"simplehost-server/config"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email. SMTPMailer delivers for real, OutboxMailer just writes messages to disk
+// so development setups don't need a mail server.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// FromConfig returns an SMTP mailer when an SMTP host is configured and an outbox mailer otherwise
+func FromConfig(c config.Mail) Mailer {
+	if c.SMTPHost != "" {
+		return &SMTPMailer{
+			Host:     c.SMTPHost,
+			Port:     c.SMTPPort,
+			Username: c.SMTPUsername,
+			Password: c.SMTPPassword,
+			From:     c.From,
+		}
+	}
+	return &OutboxMailer{Dir: c.OutboxDir, From: c.From}
+}
+
+var errBadRecipient = errors.New("mailer: invalid recipient address")
+
+// format renders the message with the headers every mailer needs
+func format(from string, msg Message) ([]byte, error) {
+	if msg.To == "" || strings.ContainsAny(msg.To, "\r\n") {
+		return nil, errBadRecipient
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(msg.Body)
+	return b.Bytes(), nil
+}
+
+// SMTPMailer delivers mail through an SMTP server. Port 465 uses implicit TLS, any other
+// port upgrades with STARTTLS when the server offers it.
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	sender := envelopeAddress(m.From)
+	body, err := format(m.From, msg)
+	if err != nil {
+		return err
+	}
+	if m.Port != 465 {
+		return smtp.SendMail(addr, auth, sender, []string{msg.To}, body)
+	}
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: m.Host})
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(sender); err != nil {
+		return err
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return err
+	}
+	wc, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(body); err != nil {
+		wc.Close()
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+var angleAddress = regexp.MustCompile(`<([^>]+)>`)
+
+// envelopeAddress extracts the bare address from a "Name <addr>" From header
+func envelopeAddress(from string) string {
+	if m := angleAddress.FindStringSubmatch(from); m != nil {
+		return m[1]
+	}
+	return from
+}
+
+// OutboxMailer writes each message to an .eml file in Dir and logs it, for development and tests
+type OutboxMailer struct {
+	Dir  string
+	From string
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9@._-]`)
+
+func (m *OutboxMailer) Send(msg Message) error {
+	if err := os.MkdirAll(m.Dir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), unsafeFileChars.ReplaceAllString(msg.To, "_"))
+	path := filepath.Join(m.Dir, name)
+	body, err := format(m.From, msg)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, body, 0600); err != nil {
+		return err
+	}
+	slog.Info("Wrote mail to outbox", "to", msg.To, "subject", msg.Subject, "path", path)
+	return nil
+}
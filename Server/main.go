@@ -1,31 +1,41 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"database/sql"
-	"html/template"
+	"errors"
 	"io/fs"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
+	"simplehost-server/certs"
+	"simplehost-server/config"
 	"simplehost-server/controllers"
+	"simplehost-server/mailer"
 	"simplehost-server/models"
+	"simplehost-server/passwords"
 	"simplehost-server/shared"
+	"simplehost-server/storage"
 
 	_ "modernc.org/sqlite"
 )
 
-const templateFolderPath = "templates"
-
-func initDB() *sql.DB {
-	dbDir := "./Database"
-	if err := os.MkdirAll(dbDir, 0755); err != nil {
-		log.Fatalf("Failed to create database directory: %v", err)
+func initDB(path string) *sql.DB {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		fatal("Failed to create database directory", "error", err)
 	}
-	db, err := sql.Open("sqlite", dbDir+"/simplehost.db")
+	// Concurrent uploads write at the same time; wait for the lock rather than fail
+	db, err := models.OpenDB("sqlite", path+"?_pragma=busy_timeout(5000)")
 	if err != nil {
-		log.Fatal(err)
+		fatal("Failed to open database", "path", path, "error", err)
 	}
 	createTable := `CREATE TABLE IF NOT EXISTS users (
 		id TEXT PRIMARY KEY,
@@ -35,7 +45,7 @@ func initDB() *sql.DB {
 	);`
 	_, err = db.Exec(createTable)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Failed to create users table", "error", err)
 	}
 	return db
 }
@@ -60,35 +70,129 @@ func mergeData(data any, extra map[string]any) map[string]any {
 	return m
 }
 
-func render(w http.ResponseWriter, _ *http.Request, name string, data any) {
-	tmpl, err := template.New("").ParseFS(shared.TemplatesFS, templateFolderPath+"/"+name, templateFolderPath+"/base.html")
+func render(w http.ResponseWriter, r *http.Request, name string, data any) {
+	tmpl, err := controllers.ParseTemplates(name, "base.html")
 	if err != nil {
+		slog.Error("Failed to parse template", "template", name, "error", err)
 		http.Error(w, "Error parsing template", http.StatusInternalServerError)
 		return
 	}
 	version := getUploaderJSVersion()
-	merged := mergeData(data, map[string]any{"UploaderJSVersion": version})
+	merged := mergeData(data, map[string]any{
+		"UploaderJSVersion": version,
+		"CSRFToken":         controllers.GetCSRFToken(r),
+		"OIDCEnabled":       controllers.OIDCEnabled(),
+		"LDAPEnabled":       controllers.LDAPEnabled(),
+		"MagicLinkEnabled":  controllers.MagicLinkEnabled(),
+		"RegistrationMode":  controllers.RegistrationMode(),
+		"ChunkSize":         cfg.Storage.ChunkSize,
+	})
 	err = tmpl.ExecuteTemplate(w, "base", merged)
 	if err != nil {
+		slog.Error("Failed to execute template", "template", name, "error", err)
 		http.Error(w, "Error executing template", http.StatusInternalServerError)
 		return
 	}
 }
 
+var cfg = config.Default()
+
+// fatal logs an error and exits, for failures the server can't start without
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
 func main() {
-	db := initDB()
-	defer db.Close()
+	// The first argument names a command when it isn't a flag; the default is to serve
+	args, command := os.Args[1:], "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	if command != "serve" && command != "rotate-keys" {
+		fatal("Unknown command; use serve or rotate-keys", "command", command)
+	}
+	loaded, err := config.Load(args)
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	cfg = loaded
+	slog.SetDefault(cfg.Logger())
+	slog.Info("Effective configuration", "config", cfg.Redacted())
+	controllers.Configure(cfg)
+
+	if err := controllers.InitJWTKeys(); err != nil {
+		fatal("Failed to load JWT signing keys", "error", err)
+	}
+	db := initDB(cfg.Database.Path)
 	models.SetUserDB(db)
 	models.SetFSDB(db)
+	models.SetPasswordHasher(passwords.FromConfig(cfg.Passwords))
+	passwords.SetConcurrency(cfg.Passwords.MaxConcurrent)
+	controllers.SetMailer(mailer.FromConfig(cfg.Mail))
+	blobs, err := storage.FromConfig(cfg.Storage)
+	if err != nil {
+		fatal("Failed to set up storage", "error", err)
+	}
+	models.SetStorage(blobs)
+
+	if err := models.InitUserTables(); err != nil {
+		fatal("Failed to initialize user tables", "error", err)
+	}
+	if err := models.InitIdentityTable(); err != nil {
+		fatal("Failed to initialize identity table", "error", err)
+	}
+	if err := models.InitPasskeyTable(); err != nil {
+		fatal("Failed to initialize passkey table", "error", err)
+	}
+	if err := models.InitAPITokenTable(); err != nil {
+		fatal("Failed to initialize app token table", "error", err)
+	}
+	if err := models.InitSSHKeyTable(); err != nil {
+		fatal("Failed to initialize SSH key table", "error", err)
+	}
+	if err := models.InitAccessKeyTable(); err != nil {
+		fatal("Failed to initialize access key table", "error", err)
+	}
+	if err := models.InitS3UploadTables(); err != nil {
+		fatal("Failed to initialize S3 upload tables", "error", err)
+	}
+	if err := models.InitChunkedUploadTable(); err != nil {
+		fatal("Failed to initialize chunked upload table", "error", err)
+	}
+	if err := models.InitShareLinkTable(); err != nil {
+		fatal("Failed to initialize share link table", "error", err)
+	}
+	if err := models.InitInviteTable(); err != nil {
+		fatal("Failed to initialize invite table", "error", err)
+	}
+	if err := models.InitSettingsTable(); err != nil {
+		fatal("Failed to initialize settings table", "error", err)
+	}
+	// The first account registered becomes admin; ADMIN_USERNAME promotes an existing one
+	if admin := cfg.Auth.AdminUsername; admin != "" {
+		if err := models.PromoteAdmin(admin); err != nil {
+			slog.Warn("Could not promote admin", "username", admin, "error", err)
+		}
+	}
 
 	// Initialize virtual filesystem tables
-	if err := models.InitVirtualFileSystemTables(); err != nil {
-		log.Fatalf("Failed to initialize virtual filesystem tables: %v", err)
+	if err := models.InitVirtualFileSystemTables(cfg.Storage.UploadDir); err != nil {
+		fatal("Failed to initialize virtual filesystem tables", "error", err)
 	}
 	// Ensure root folder exists
 	if err := models.EnsureRootFolder(); err != nil {
-		log.Fatalf("Failed to create root folder: %v", err)
+		fatal("Failed to create root folder", "error", err)
+	}
+	if command == "rotate-keys" {
+		err := rotateKeys(blobs)
+		db.Close()
+		if err != nil {
+			fatal("Key rotation failed", "error", err)
+		}
+		return
 	}
+	controllers.CleanupPartialUploads()
 
 	router := http.NewServeMux()
 
@@ -97,16 +201,37 @@ func main() {
 			render(w, r, "login.html", nil)
 			return
 		}
-		// After successful login, redirect to /simplehost
-		controllers.LoginHandler(w, r, func(w http.ResponseWriter, r *http.Request, name string, data any) {
-			// If login is successful, LoginHandler should set the cookie and redirect
-			// If not, render login.html with error
-			if err, ok := data.(error); ok && err != nil {
-				render(w, r, "login.html", map[string]any{"Error": err.Error()})
-			} else {
-				http.Redirect(w, r, "/simplehost", http.StatusSeeOther)
-			}
-		})
+		// On success LoginHandler sets the cookie and redirects to /simplehost,
+		// otherwise it renders login.html with the error
+		controllers.LoginHandler(w, r, render)
+	})
+
+	router.HandleFunc("/login/2fa", func(w http.ResponseWriter, r *http.Request) {
+		controllers.LoginTwoFactorHandler(w, r, render)
+	})
+
+	router.HandleFunc("/login/2fa/setup", func(w http.ResponseWriter, r *http.Request) {
+		controllers.LoginTwoFactorSetupHandler(w, r, render)
+	})
+
+	router.HandleFunc("/login/magic", func(w http.ResponseWriter, r *http.Request) {
+		controllers.MagicLinkHandler(w, r, render)
+	})
+
+	router.HandleFunc("/login/magic/verify", func(w http.ResponseWriter, r *http.Request) {
+		controllers.MagicLinkVerifyHandler(w, r, render)
+	})
+
+	router.HandleFunc("/login/passkey/begin", controllers.PasskeyLoginBeginHandler)
+
+	router.HandleFunc("/login/passkey/finish", controllers.PasskeyLoginFinishHandler)
+
+	router.HandleFunc("/login/oidc", func(w http.ResponseWriter, r *http.Request) {
+		controllers.OIDCLoginHandler(w, r, render)
+	})
+
+	router.HandleFunc("/login/oidc/callback", func(w http.ResponseWriter, r *http.Request) {
+		controllers.OIDCCallbackHandler(w, r, render)
 	})
 
 	router.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
@@ -117,6 +242,110 @@ func main() {
 		controllers.RegisterHandler(w, r, render)
 	})
 
+	router.HandleFunc("/verify-email", func(w http.ResponseWriter, r *http.Request) {
+		controllers.VerifyEmailHandler(w, r, render)
+	})
+
+	router.HandleFunc("/forgot-password", func(w http.ResponseWriter, r *http.Request) {
+		controllers.ForgotPasswordHandler(w, r, render)
+	})
+
+	router.HandleFunc("/reset-password", func(w http.ResponseWriter, r *http.Request) {
+		controllers.ResetPasswordHandler(w, r, render)
+	})
+
+	router.HandleFunc("/account", controllers.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.AccountPageHandler(w, r, render)
+	}))
+
+	router.HandleFunc("/account/password", controllers.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.ChangePasswordHandler(w, r, render)
+	}))
+
+	router.HandleFunc("/account/email", controllers.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.ChangeEmailHandler(w, r, render)
+	}))
+
+	router.HandleFunc("/account/delete", controllers.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.DeleteAccountHandler(w, r, render)
+	}))
+
+	router.HandleFunc("/account/2fa/setup", controllers.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.AccountTwoFactorSetupHandler(w, r, render)
+	}))
+
+	router.HandleFunc("/account/2fa/disable", controllers.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.DisableTwoFactorHandler(w, r, render)
+	}))
+
+	router.HandleFunc("/account/2fa/recovery-codes", controllers.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.RegenerateRecoveryCodesHandler(w, r, render)
+	}))
+
+	router.HandleFunc("/account/link/oidc", controllers.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.OIDCLinkHandler(w, r, render)
+	}))
+
+	router.HandleFunc("/account/link/ldap", controllers.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.LDAPLinkHandler(w, r, render)
+	}))
+
+	router.HandleFunc("/account/passkeys/register/begin", controllers.AuthMiddleware(controllers.PasskeyRegisterBeginHandler))
+
+	router.HandleFunc("/account/passkeys/register/finish", controllers.AuthMiddleware(controllers.PasskeyRegisterFinishHandler))
+
+	router.HandleFunc("/account/passkeys/delete", controllers.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.DeletePasskeyHandler(w, r, render)
+	}))
+
+	router.HandleFunc("/account/tokens", controllers.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.CreateAPITokenHandler(w, r, render)
+	}))
+
+	router.HandleFunc("/account/tokens/delete", controllers.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.DeleteAPITokenHandler(w, r, render)
+	}))
+
+	router.HandleFunc("/account/ssh-keys", controllers.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.AddSSHKeyHandler(w, r, render)
+	}))
+
+	router.HandleFunc("/account/ssh-keys/delete", controllers.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.DeleteSSHKeyHandler(w, r, render)
+	}))
+
+	router.HandleFunc("/account/s3-keys", controllers.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.CreateAccessKeyHandler(w, r, render)
+	}))
+
+	router.HandleFunc("/account/s3-keys/delete", controllers.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.DeleteAccessKeyHandler(w, r, render)
+	}))
+
+	router.HandleFunc("/admin", controllers.AdminMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.AdminPageHandler(w, r, render)
+	}))
+
+	router.HandleFunc("/admin/settings", controllers.AdminMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.AdminSettingsHandler(w, r, render)
+	}))
+
+	router.HandleFunc("/admin/users/role", controllers.AdminMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.AdminUserRoleHandler(w, r, render)
+	}))
+
+	router.HandleFunc("/admin/users/approve", controllers.AdminMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.AdminApproveUserHandler(w, r, render)
+	}))
+
+	router.HandleFunc("/admin/invites", controllers.AdminMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.AdminCreateInviteHandler(w, r, render)
+	}))
+
+	router.HandleFunc("/admin/invites/delete", controllers.AdminMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		controllers.AdminDeleteInviteHandler(w, r, render)
+	}))
+
 	router.HandleFunc("/success", controllers.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		controllers.SuccessPageHandler(w, r, render)
 	}))
@@ -135,6 +364,20 @@ func main() {
 
 	router.HandleFunc("/favicon.ico", http.NotFound)
 
+	// Unauthenticated probes for Docker and load balancers
+	router.HandleFunc("/healthz", controllers.HealthzHandler)
+	router.HandleFunc("/readyz", controllers.ReadyzHandler)
+
+	if cfg.Metrics.Enabled {
+		router.Handle("/metrics", controllers.MetricsHandler())
+	}
+
+	// WebDAV authenticates every request itself with basic auth
+	if cfg.WebDAV.Enabled {
+		router.Handle("/webdav/", controllers.WebDAVHandler())
+		router.Handle("/webdav", controllers.WebDAVHandler())
+	}
+
 	router.HandleFunc("/404", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		render(w, r, "404.html", nil)
@@ -145,8 +388,13 @@ func main() {
 	router.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(staticFiles))))
 
 	router.HandleFunc("/api/upload", controllers.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			controllers.UploadStatusHandler(w, r)
+			return
+		}
 		controllers.UploadHandler(w, r)
 	}))
+	router.HandleFunc("/api/upload/start", controllers.AuthMiddleware(controllers.UploadStartHandler))
 
 	// router.HandleFunc("/api/folder", controllers.AuthMiddleware(controllers.FolderChildrenAPIHandler))
 
@@ -160,6 +408,14 @@ func main() {
 	// Breadcrumbs endpoint
 	router.HandleFunc("/api/breadcrumbs", controllers.AuthMiddleware(controllers.BreadcrumbsHandler))
 
+	// Path-based listing for API clients
+	router.HandleFunc("/api/list", controllers.AuthMiddleware(controllers.PathAPIHandler))
+
+	// Share links, and the public page they point to
+	router.HandleFunc("/api/share", controllers.AuthMiddleware(controllers.ShareAPIHandler))
+	router.HandleFunc("/api/share/delete", controllers.AuthMiddleware(controllers.DeleteShareHandler))
+	router.HandleFunc("/s/", controllers.SharedFileHandler)
+
 	// Catch-all handler for root and unknown routes
 	// Keep this at the end to catch all unmatched routes
 	router.HandleFunc("/", controllers.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
@@ -170,6 +426,109 @@ func main() {
 	router.HandleFunc("/api/file/", controllers.AuthMiddleware(controllers.DeleteFileHandler))
 	router.HandleFunc("/api/folder/delete", controllers.AuthMiddleware(controllers.DeleteFolderHandler))
 
-	log.Println("Server running on :8080")
-	http.ListenAndServe(":8080", router)
+	handler := controllers.AccessLogMiddleware(controllers.BasePathMiddleware(controllers.CSRFMiddleware(controllers.RecordRoute(router))))
+	server := &http.Server{Addr: cfg.Server.Addr, Handler: handler, ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn)}
+	servers := []*http.Server{server}
+	if cfg.TLSEnabled() {
+		certificate, err := certs.Load(cfg.Server.TLSCert, cfg.Server.TLSKey)
+		if err != nil {
+			fatal("Failed to load TLS certificate", "error", err)
+		}
+		certificate.ReloadOn(syscall.SIGHUP)
+		server.TLSConfig = &tls.Config{GetCertificate: certificate.GetCertificate, MinVersion: tls.VersionTLS12}
+		if addr := cfg.Server.RedirectAddr; addr != "" {
+			redirect := &http.Server{Addr: addr, Handler: controllers.HTTPSRedirectHandler()}
+			servers = append(servers, redirect)
+			go func() {
+				slog.Info("Redirecting HTTP to HTTPS", "addr", addr)
+				if err := redirect.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+					fatal("Redirect listener failed", "error", err)
+				}
+			}()
+		}
+	}
+	go func() {
+		var err error
+		if cfg.TLSEnabled() {
+			slog.Info("Server running", "addr", cfg.Server.Addr, "base_path", cfg.Server.BasePath, "tls", true)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			slog.Info("Server running", "addr", cfg.Server.Addr, "base_path", cfg.Server.BasePath, "tls", false)
+			err = server.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			fatal("Server failed", "error", err)
+		}
+	}()
+
+	// The S3 API has a listener of its own, as buckets are at the root of its URLs
+	if cfg.S3API.Enabled {
+		s3Server := &http.Server{Addr: cfg.S3API.Addr, Handler: controllers.AccessLogMiddleware(controllers.S3APIHandler()), ErrorLog: server.ErrorLog}
+		servers = append(servers, s3Server)
+		go func() {
+			slog.Info("S3 API running", "addr", cfg.S3API.Addr)
+			if err := s3Server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				fatal("S3 API server failed", "error", err)
+			}
+		}()
+	}
+
+	var sftpServer *controllers.SFTPServer
+	if cfg.SFTP.Enabled {
+		sftpServer, err = controllers.NewSFTPServer(cfg.SFTP.HostKeyFile)
+		if err != nil {
+			fatal("Failed to set up SFTP", "error", err)
+		}
+		go func() {
+			slog.Info("SFTP server running", "addr", cfg.SFTP.Addr)
+			if err := sftpServer.ListenAndServe(cfg.SFTP.Addr); !errors.Is(err, net.ErrClosed) {
+				fatal("SFTP server failed", "error", err)
+			}
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+	// A second signal kills the process straight away
+	signal.Stop(stop)
+	slog.Info("Shutting down", "signal", sig)
+	shutdown(servers, sftpServer, cfg.Server.ShutdownTimeout)
+	if err := db.Close(); err != nil {
+		slog.Error("Failed to close database", "error", err)
+	}
+	slog.Info("Shutdown complete")
+}
+
+// shutdown stops accepting connections and waits up to timeout for in-flight requests to
+// finish. Transfers still running after that are logged and cut off.
+func shutdown(servers []*http.Server, sftpServer *controllers.SFTPServer, timeout time.Duration) {
+	if active := controllers.ActiveTransfers(); len(active) > 0 {
+		slog.Info("Waiting for active transfers", "count", len(active), "timeout", timeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	timedOut := false
+	for _, s := range servers {
+		if err := s.Shutdown(ctx); err != nil {
+			timedOut = true
+		}
+	}
+	if sftpServer != nil && sftpServer.Shutdown(ctx) != nil {
+		timedOut = true
+	}
+	if !timedOut {
+		return
+	}
+	for _, t := range controllers.ActiveTransfers() {
+		slog.Warn("Interrupted transfer", "transfer", t)
+	}
+	for _, s := range servers {
+		s.Close()
+	}
+	// Closing the connections cancels the handlers' contexts, so they stop and remove their
+	// partial files before the database goes away
+	if !controllers.WaitForTransfers(5 * time.Second) {
+		slog.Warn("Some transfers did not stop in time; their partial files are removed on the next start")
+	}
 }
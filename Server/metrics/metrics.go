@@ -0,0 +1,266 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A small implementation of the Prometheus text exposition format, enough for counters,
+// gauges and histograms with labels. Metrics register themselves when created and are
+// written by Handler in registration order.
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	registry = append(registry, m)
+	registryMu.Unlock()
+}
+
+// Handler serves every registered metric
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		registryMu.Lock()
+		metrics := append([]metric(nil), registry...)
+		registryMu.Unlock()
+		for _, m := range metrics {
+			m.write(w)
+		}
+	})
+}
+
+// desc is what every metric type shares: its name, help text and label names
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d desc) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, kind)
+}
+
+// key joins label values into a map key
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// series formats name{label="value",...}, with extra appended after the metric's own labels
+func (d desc) series(name string, values []string, extra ...string) string {
+	var pairs []string
+	for i, label := range d.labels {
+		pairs = append(pairs, label+`="`+escapeLabel(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return name
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of a series map in a stable order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func splitKey(key string, n int) []string {
+	if n == 0 {
+		return nil
+	}
+	return strings.Split(key, "\xff")
+}
+
+// valueVec is a set of float series keyed by label values, used by counters and gauges
+type valueVec struct {
+	desc
+	kind   string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (v *valueVec) add(delta float64, labels []string) {
+	key := v.key(labels)
+	v.mu.Lock()
+	v.values[key] += delta
+	v.mu.Unlock()
+}
+
+func (v *valueVec) write(w io.Writer) {
+	v.header(w, v.kind)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, key := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s %s\n", v.series(v.name, splitKey(key, len(v.labels))), formatValue(v.values[key]))
+	}
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct{ v *valueVec }
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{&valueVec{desc: desc{name, help, labels}, kind: "counter", values: map[string]float64{}}}
+	register(c.v)
+	return c
+}
+
+// Inc adds one to the series with the given label values
+func (c *CounterVec) Inc(labels ...string) {
+	c.v.add(1, labels)
+}
+
+// Add adds delta, which must not be negative, to the series with the given label values
+func (c *CounterVec) Add(delta float64, labels ...string) {
+	if delta < 0 {
+		panic("metrics: counters can't decrease")
+	}
+	c.v.add(delta, labels)
+}
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct{ v *valueVec }
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{&valueVec{desc: desc{name, help, labels}, kind: "gauge", values: map[string]float64{}}}
+	register(g.v)
+	return g
+}
+
+func (g *GaugeVec) Add(delta float64, labels ...string) {
+	g.v.add(delta, labels)
+}
+
+func (g *GaugeVec) Set(value float64, labels ...string) {
+	key := g.v.key(labels)
+	g.v.mu.Lock()
+	g.v.values[key] = value
+	g.v.mu.Unlock()
+}
+
+// DefaultBuckets suit request latencies in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec tracks the distribution of observations, partitioned by labels
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	byKey   map[string]*histogram
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{desc: desc{name, help, labels}, buckets: buckets, byKey: map[string]*histogram{}}
+	register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labels ...string) {
+	key := h.key(labels)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.byKey[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.byKey[key] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.header(w, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.byKey) {
+		s := h.byKey[key]
+		values := splitKey(key, len(h.labels))
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s %d\n", h.series(h.name+"_bucket", values, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s %d\n", h.series(h.name+"_bucket", values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s %s\n", h.series(h.name+"_sum", values), formatValue(s.sum))
+		fmt.Fprintf(w, "%s %d\n", h.series(h.name+"_count", values), s.count)
+	}
+}
+
+// Sample is one series reported by a GaugeFunc
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// GaugeFunc reports gauges computed when scraped, for values that live elsewhere such as
+// in the database
+type GaugeFunc struct {
+	desc
+	collect func() []Sample
+}
+
+func NewGaugeFunc(name, help string, collect func() []Sample, labels ...string) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{name, help, labels}, collect: collect}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.header(w, "gauge")
+	for _, s := range g.collect() {
+		g.key(s.Labels) // checks the label count
+		fmt.Fprintf(w, "%s %s\n", g.series(g.name, s.Labels), formatValue(s.Value))
+	}
+}
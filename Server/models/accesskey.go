@@ -0,0 +1,109 @@
+package models
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"time"
+)
+
+// AccessKey signs S3 API requests. SigV4 signatures are HMACs keyed with the secret, so
+// unlike app tokens the secret itself has to be stored.
+type AccessKey struct {
+	ID         string
+	UserID     string
+	Name       string
+	Secret     string
+	CreatedAt  time.Time
+	LastUsedAt sql.NullTime
+}
+
+func InitAccessKeyTable() error {
+	_, err := DB.Exec(`
+	CREATE TABLE IF NOT EXISTS s3_access_keys (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_s3_access_keys_user ON s3_access_keys(user_id);
+	`)
+	return err
+}
+
+// CreateAccessKey makes a new key pair for the user. IDs look like AWS ones: 20
+// upper-case letters and digits.
+func CreateAccessKey(userID, name string) (*AccessKey, error) {
+	id := make([]byte, 12)
+	secret := make([]byte, 30)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	key := &AccessKey{
+		ID:        "SH" + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(id)[:18],
+		UserID:    userID,
+		Name:      name,
+		Secret:    base64.RawURLEncoding.EncodeToString(secret),
+		CreatedAt: time.Now().UTC(),
+	}
+	_, err := DB.Exec(`INSERT INTO s3_access_keys (id, user_id, name, secret, created_at) VALUES (?, ?, ?, ?, ?)`,
+		key.ID, key.UserID, key.Name, key.Secret, key.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// GetAccessKey returns the key with the given ID, or sql.ErrNoRows
+func GetAccessKey(id string) (*AccessKey, error) {
+	var k AccessKey
+	err := DB.QueryRow(`SELECT id, user_id, name, secret, created_at, last_used_at FROM s3_access_keys WHERE id = ?`, id).
+		Scan(&k.ID, &k.UserID, &k.Name, &k.Secret, &k.CreatedAt, &k.LastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// UseAccessKey records that a request was signed with the key
+func UseAccessKey(id string) error {
+	_, err := DB.Exec(`UPDATE s3_access_keys SET last_used_at = ? WHERE id = ?`, time.Now().UTC(), id)
+	return err
+}
+
+// ListAccessKeys returns the user's access keys, oldest first, without their secrets
+func ListAccessKeys(userID string) ([]AccessKey, error) {
+	rows, err := DB.Query(`SELECT id, user_id, name, created_at, last_used_at FROM s3_access_keys WHERE user_id = ? ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []AccessKey
+	for rows.Next() {
+		var k AccessKey
+		if err := rows.Scan(&k.ID, &k.UserID, &k.Name, &k.CreatedAt, &k.LastUsedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// DeleteAccessKey revokes one of the user's access keys
+func DeleteAccessKey(id, userID string) error {
+	res, err := DB.Exec(`DELETE FROM s3_access_keys WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// APITokenPrefix starts every app token, so they're easy to tell apart from passwords
+const APITokenPrefix = "sht_"
+
+// APIToken lets apps such as WebDAV clients sign in without the account password. Only a
+// hash of the token is stored.
+type APIToken struct {
+	ID         string
+	UserID     string
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt sql.NullTime
+}
+
+func InitAPITokenTable() error {
+	_, err := DB.Exec(`
+	CREATE TABLE IF NOT EXISTS api_tokens (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_api_tokens_user ON api_tokens(user_id);
+	`)
+	return err
+}
+
+// CreateAPIToken stores a new app token for the user and returns the raw value, which
+// can't be recovered later
+func CreateAPIToken(userID, name string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := APITokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	_, err := DB.Exec(`INSERT INTO api_tokens (id, user_id, name, token_hash, created_at) VALUES (?, ?, ?, ?, ?)`,
+		uuid.NewString(), userID, name, hashToken(token), time.Now().UTC())
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// LookupAPIToken returns the user an app token belongs to and records that it was used
+func LookupAPIToken(token string) (string, error) {
+	if !strings.HasPrefix(token, APITokenPrefix) {
+		return "", ErrInvalidToken
+	}
+	hash := hashToken(token)
+	var userID string
+	if err := DB.QueryRow(`SELECT user_id FROM api_tokens WHERE token_hash = ?`, hash).Scan(&userID); err != nil {
+		return "", ErrInvalidToken
+	}
+	DB.Exec(`UPDATE api_tokens SET last_used_at = ? WHERE token_hash = ?`, time.Now().UTC(), hash)
+	return userID, nil
+}
+
+// ListAPITokens returns the user's app tokens, oldest first
+func ListAPITokens(userID string) ([]APIToken, error) {
+	rows, err := DB.Query(`SELECT id, user_id, name, created_at, last_used_at FROM api_tokens WHERE user_id = ? ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tokens []APIToken
+	for rows.Next() {
+		var t APIToken
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Name, &t.CreatedAt, &t.LastUsedAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteAPIToken revokes one of the user's app tokens
+func DeleteAPIToken(id, userID string) error {
+	res, err := DB.Exec(`DELETE FROM api_tokens WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
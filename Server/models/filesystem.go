@@ -1,9 +1,14 @@
 package models
 
 import (
+	"context"
 	"database/sql"
-	"os"
+	"log/slog"
+	"path/filepath"
+	"strings"
 	"time"
+
+	"simplehost-server/storage"
 )
 
 var db *sql.DB
@@ -12,6 +17,30 @@ func SetFSDB(database *sql.DB) {
 	db = database
 }
 
+// Blobs holds the contents of files, which the files table refers to by storage key
+var Blobs storage.Driver
+
+func SetStorage(d storage.Driver) {
+	Blobs = d
+	if enc, ok := d.(*storage.Encrypted); ok {
+		enc.Plaintext = storedInPlaintext
+	}
+}
+
+// storedInPlaintext reports whether the file stored under key was uploaded while
+// encryption was off, so it can be read without an envelope
+func storedInPlaintext(ctx context.Context, key string) (bool, error) {
+	var plaintext bool
+	err := db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM files WHERE storage_key = ? AND plaintext)", key).Scan(&plaintext)
+	return plaintext, err
+}
+
+// PingDB checks that the database answers a query
+func PingDB(ctx context.Context) error {
+	var one int
+	return db.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
+
 type Folder struct {
 	ID        string
 	Name      string
@@ -25,14 +54,17 @@ type File struct {
 	ID           string
 	Name         string
 	FolderID     string
-	StoragePath  string
+	StorageKey   string
+	Size         int64 // bytes
 	OwnerID      string
 	UploadedDate time.Time
 	IsPrivate    bool
 	CanDelete    bool // Indicates if the user can delete this file
 }
 
-func InitVirtualFileSystemTables() error {
+// InitVirtualFileSystemTables creates the folder and file tables. uploadDir is where older
+// versions stored files, for turning their stored paths into storage keys.
+func InitVirtualFileSystemTables(uploadDir string) error {
 	_, err := db.Exec(`
 	CREATE TABLE IF NOT EXISTS folders (
 		id TEXT PRIMARY KEY,
@@ -46,29 +78,183 @@ func InitVirtualFileSystemTables() error {
 		id TEXT PRIMARY KEY,
 		name TEXT NOT NULL,
 		folder_id TEXT NOT NULL,
-		storage_path TEXT NOT NULL,
+		storage_key TEXT NOT NULL,
 		owner_id TEXT NOT NULL,
 		uploaded_date DATETIME NOT NULL,
 		is_private BOOLEAN NOT NULL DEFAULT 0,
 		FOREIGN KEY(folder_id) REFERENCES folders(id)
 	);
 	`)
-	return err
+	if err != nil {
+		return err
+	}
+	if err := migrateStoragePaths(uploadDir); err != nil {
+		return err
+	}
+	// NULL marks files uploaded before sizes were recorded
+	if err := addColumnIfMissing(db, "files", "size", "INTEGER"); err != nil {
+		return err
+	}
+	// Files from before the column existed may predate encryption. The flag only matters
+	// for files without an envelope.
+	if err := addColumnIfMissing(db, "files", "plaintext", "BOOLEAN NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+	return backfillFileSizes()
+}
+
+// migrateStoragePaths turns the OS paths older versions stored into storage keys, which
+// are relative to the upload directory
+func migrateStoragePaths(uploadDir string) error {
+	legacy, err := hasColumn(db, "files", "storage_path")
+	if err != nil || !legacy {
+		return err
+	}
+	rows, err := db.Query("SELECT id, storage_path FROM files")
+	if err != nil {
+		return err
+	}
+	keys := map[string]string{}
+	for rows.Next() {
+		var id, path string
+		if err := rows.Scan(&id, &path); err != nil {
+			rows.Close()
+			return err
+		}
+		keys[id] = storageKeyFromPath(uploadDir, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for id, key := range keys {
+		if _, err := tx.Exec("UPDATE files SET storage_path = ? WHERE id = ?", key, id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("ALTER TABLE files RENAME COLUMN storage_path TO storage_key"); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	slog.Info("Converted stored file paths to storage keys", "files", len(keys))
+	return nil
+}
+
+func storageKeyFromPath(uploadDir, path string) string {
+	root, rootErr := filepath.Abs(uploadDir)
+	abs, pathErr := filepath.Abs(path)
+	rel, err := filepath.Rel(root, abs)
+	if rootErr != nil || pathErr != nil || err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		// The file isn't under the upload directory, so the best guess is that it was moved there
+		slog.Warn("Stored file path is outside the upload directory", "path", path, "upload_dir", uploadDir)
+		return filepath.Base(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// backfillFileSizes records the size of files stored before the size column existed,
+// reading it from storage. Files that are missing count as empty.
+func backfillFileSizes() error {
+	rows, err := db.Query("SELECT id, storage_key FROM files WHERE size IS NULL")
+	if err != nil {
+		return err
+	}
+	sizes := map[string]int64{}
+	for rows.Next() {
+		var id, key string
+		if err := rows.Scan(&id, &key); err != nil {
+			rows.Close()
+			return err
+		}
+		if info, err := Blobs.Stat(context.Background(), key); err == nil {
+			sizes[id] = info.Size
+		} else {
+			sizes[id] = 0
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, size := range sizes {
+		if _, err := db.Exec("UPDATE files SET size = ? WHERE id = ?", size, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AllStorageKeys lists the storage key of every file
+func AllStorageKeys() ([]string, error) {
+	rows, err := db.Query("SELECT storage_key FROM files")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// UserStorage is the total size of the files a user owns
+type UserStorage struct {
+	UserID   string
+	Username string
+	Bytes    int64
+}
+
+// StorageByUser sums file sizes per owner
+func StorageByUser() ([]UserStorage, error) {
+	rows, err := db.Query(`
+		SELECT f.owner_id, COALESCE(u.username, ''), SUM(COALESCE(f.size, 0))
+		FROM files f LEFT JOIN users u ON u.id = f.owner_id
+		GROUP BY f.owner_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var usage []UserStorage
+	for rows.Next() {
+		var u UserStorage
+		if err := rows.Scan(&u.UserID, &u.Username, &u.Bytes); err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
 }
 
-// InsertFile inserts a new file record into the files table
+// InsertFile inserts a new file record into the files table. Files stored while
+// encryption is off are marked as plaintext.
 func InsertFile(file File) error {
+	_, encrypted := Blobs.(*storage.Encrypted)
 	_, err := db.Exec(`
-		INSERT INTO files (id, name, folder_id, storage_path, owner_id, uploaded_date, is_private)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO files (id, name, folder_id, storage_key, size, owner_id, uploaded_date, is_private, plaintext)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`,
 		file.ID,
 		file.Name,
 		file.FolderID,
-		file.StoragePath,
+		file.StorageKey,
+		file.Size,
 		file.OwnerID,
 		file.UploadedDate,
 		file.IsPrivate,
+		!encrypted,
 	)
 	return err
 }
@@ -154,7 +340,7 @@ func GetFolderChildren(folderID, userID string) ([]Folder, []File, error) {
 	}
 
 	// Get files in folder
-	fileRows, err := db.Query("SELECT id, name, folder_id, storage_path, owner_id, uploaded_date, is_private FROM files WHERE folder_id = ?", folderID)
+	fileRows, err := db.Query("SELECT id, name, folder_id, storage_key, COALESCE(size, 0), owner_id, uploaded_date, is_private FROM files WHERE folder_id = ?", folderID)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -162,7 +348,7 @@ func GetFolderChildren(folderID, userID string) ([]Folder, []File, error) {
 	for fileRows.Next() {
 		var file File
 		var uploaded time.Time
-		if err := fileRows.Scan(&file.ID, &file.Name, &file.FolderID, &file.StoragePath, &file.OwnerID, &uploaded, &file.IsPrivate); err != nil {
+		if err := fileRows.Scan(&file.ID, &file.Name, &file.FolderID, &file.StorageKey, &file.Size, &file.OwnerID, &uploaded, &file.IsPrivate); err != nil {
 			return nil, nil, err
 		}
 		file.UploadedDate = uploaded
@@ -179,8 +365,8 @@ func GetFolderChildren(folderID, userID string) ([]Folder, []File, error) {
 func GetFileByID(fileID string) (*File, error) {
 	var file File
 	var uploaded time.Time
-	err := db.QueryRow(`SELECT id, name, folder_id, storage_path, owner_id, uploaded_date, is_private FROM files WHERE id = ?`, fileID).
-		Scan(&file.ID, &file.Name, &file.FolderID, &file.StoragePath, &file.OwnerID, &uploaded, &file.IsPrivate)
+	err := db.QueryRow(`SELECT id, name, folder_id, storage_key, COALESCE(size, 0), owner_id, uploaded_date, is_private FROM files WHERE id = ?`, fileID).
+		Scan(&file.ID, &file.Name, &file.FolderID, &file.StorageKey, &file.Size, &file.OwnerID, &uploaded, &file.IsPrivate)
 	if err != nil {
 		return nil, err
 	}
@@ -192,8 +378,8 @@ func GetFileByID(fileID string) (*File, error) {
 func GetFileByFolderAndName(folderID, fileName string) (*File, error) {
 	var file File
 	var uploaded time.Time
-	err := db.QueryRow(`SELECT id, name, folder_id, storage_path, owner_id, uploaded_date, is_private FROM files WHERE folder_id = ? AND name = ?`, folderID, fileName).
-		Scan(&file.ID, &file.Name, &file.FolderID, &file.StoragePath, &file.OwnerID, &uploaded, &file.IsPrivate)
+	err := db.QueryRow(`SELECT id, name, folder_id, storage_key, COALESCE(size, 0), owner_id, uploaded_date, is_private FROM files WHERE folder_id = ? AND name = ?`, folderID, fileName).
+		Scan(&file.ID, &file.Name, &file.FolderID, &file.StorageKey, &file.Size, &file.OwnerID, &uploaded, &file.IsPrivate)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -204,7 +390,7 @@ func GetFileByFolderAndName(folderID, fileName string) (*File, error) {
 	return &file, nil
 }
 
-// DeleteFileByID deletes a file by its ID: removes the file from disk and deletes the DB record
+// DeleteFileByID deletes a file by its ID: removes its contents from storage and deletes the DB record
 func DeleteFileByID(fileID string, userID string) error {
 	file, err := GetFileByID(fileID)
 	if err != nil {
@@ -217,13 +403,16 @@ func DeleteFileByID(fileID string, userID string) error {
 		return sql.ErrNoRows // Unauthorized access
 	}
 
-	// Remove file from disk
-	if file.StoragePath != "" {
-		if removeErr := os.Remove(file.StoragePath); removeErr != nil && !os.IsNotExist(removeErr) {
-			return removeErr
+	// Remove the contents from storage
+	if file.StorageKey != "" {
+		if err := Blobs.Delete(context.Background(), file.StorageKey); err != nil {
+			return err
 		}
 	}
-	// Remove from DB
+	// Remove from DB, along with links sharing the file
+	if _, err := db.Exec(`DELETE FROM share_links WHERE file_id = ?`, fileID); err != nil {
+		return err
+	}
 	_, err = db.Exec(`DELETE FROM files WHERE id = ?`, fileID)
 	return err
 }
@@ -244,6 +433,18 @@ func DeleteFolderByID(folderID string, userID string) error {
 	return err
 }
 
+// MoveFile renames a file and/or moves it to another folder
+func MoveFile(fileID, folderID, name string) error {
+	_, err := db.Exec(`UPDATE files SET folder_id = ?, name = ? WHERE id = ?`, folderID, name, fileID)
+	return err
+}
+
+// MoveFolder renames a folder and/or moves it under another parent
+func MoveFolder(folderID, parentID, name string) error {
+	_, err := db.Exec(`UPDATE folders SET parent_id = ?, name = ? WHERE id = ?`, parentID, name, folderID)
+	return err
+}
+
 // MoveFilesToParent moves all files in a folder to its parent folder
 func MoveFilesToParent(folderID, parentID string) error {
 	_, err := db.Exec(`UPDATE files SET folder_id = ? WHERE folder_id = ?`, parentID, folderID)
@@ -297,6 +498,86 @@ func GetFolderByID(folderID string) (*Folder, error) {
 	return &folder, nil
 }
 
+// DeleteUserContent removes every file and folder owned by the user. Items other users put
+// inside the user's folders are kept and moved up to the deleted folder's parent.
+func DeleteUserContent(userID string) error {
+	rows, err := db.Query(`SELECT id FROM files WHERE owner_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	var fileIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		fileIDs = append(fileIDs, id)
+	}
+	rows.Close()
+	for _, id := range fileIDs {
+		if err := DeleteFileByID(id, userID); err != nil {
+			return err
+		}
+	}
+
+	folderRows, err := db.Query(`SELECT id FROM folders WHERE owner_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	var folderIDs []string
+	for folderRows.Next() {
+		var id string
+		if err := folderRows.Scan(&id); err != nil {
+			folderRows.Close()
+			return err
+		}
+		folderIDs = append(folderIDs, id)
+	}
+	folderRows.Close()
+	// Folders are removed one at a time, so a child moved into a folder that is deleted later
+	// simply moves up again
+	for _, id := range folderIDs {
+		folder, err := GetFolderByID(id)
+		if err != nil {
+			return err
+		}
+		if folder == nil {
+			continue
+		}
+		parentID := ConvertNullStringToString(folder.ParentID)
+		if parentID == "" {
+			parentID = "root"
+		}
+		if err := MoveFilesToParent(id, parentID); err != nil {
+			return err
+		}
+		if err := MoveFoldersToParent(id, parentID); err != nil {
+			return err
+		}
+		if err := DeleteFolderByID(id, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TransferUserContent hands every file and folder owned by one user over to another
+func TransferUserContent(fromUserID, toUserID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE files SET owner_id = ? WHERE owner_id = ?`, toUserID, fromUserID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE folders SET owner_id = ? WHERE owner_id = ?`, toUserID, fromUserID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func ConvertNullStringToString(ns sql.NullString) string {
 	if ns.Valid {
 		return ns.String
@@ -0,0 +1,106 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// External identities link accounts to users at an identity provider (OIDC, LDAP, ...).
+// provisioned is set when the provider created the account on first sign-in, rather than
+// the account's owner linking it to an account they already had.
+func InitIdentityTable() error {
+	_, err := DB.Exec(`
+	CREATE TABLE IF NOT EXISTS user_identities (
+		provider TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		provisioned BOOLEAN NOT NULL DEFAULT 0,
+		PRIMARY KEY(provider, subject),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`)
+	if err != nil {
+		return err
+	}
+	exists, err := hasColumn(DB, "user_identities", "provisioned")
+	if err != nil || exists {
+		return err
+	}
+	if _, err := DB.Exec("ALTER TABLE user_identities ADD COLUMN provisioned BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	// Accounts a provider created have no password of their own
+	_, err = DB.Exec("UPDATE user_identities SET provisioned = 1 WHERE user_id IN (SELECT id FROM users WHERE password = '')")
+	return err
+}
+
+// GetUserByIdentity returns the user linked to an external identity, or nil if there is none.
+// provisioned reports whether the provider created the account.
+func GetUserByIdentity(provider, subject string) (user *User, provisioned bool, err error) {
+	var userID string
+	err = DB.QueryRow("SELECT user_id, provisioned FROM user_identities WHERE provider = ? AND subject = ?", provider, subject).Scan(&userID, &provisioned)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	user, err = GetUserByID(userID)
+	return user, provisioned, err
+}
+
+func LinkIdentity(provider, subject, userID string, provisioned bool) error {
+	_, err := DB.Exec("INSERT INTO user_identities (provider, subject, user_id, provisioned) VALUES (?, ?, ?, ?)", provider, subject, userID, provisioned)
+	return err
+}
+
+// ListIdentityProviders returns the providers the user has linked identities at
+func ListIdentityProviders(userID string) ([]string, error) {
+	rows, err := DB.Query("SELECT DISTINCT provider FROM user_identities WHERE user_id = ? ORDER BY provider", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var providers []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+	return providers, rows.Err()
+}
+
+// CreateExternalUser provisions an account for someone who authenticated at an identity
+// provider. It has no local password, and the username gets a numeric suffix if it is taken.
+// Accounts created with approved false wait in the approval queue.
+func CreateExternalUser(username, email string, emailVerified, approved bool, role string) (*User, error) {
+	base := username
+	for i := 2; ; i++ {
+		if _, err := GetUserByUsername(username); err == sql.ErrNoRows {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		username = fmt.Sprintf("%s%d", base, i)
+	}
+	user := &User{ID: uuid.New().String(), Username: username, Email: email, EmailVerified: emailVerified, Role: role, Approved: approved}
+	// An empty hash never matches in VerifyUser, so the account can't log in with a password
+	_, err := DB.Exec("INSERT INTO users (id, username, email, password, email_verified, role, approved) VALUES (?, ?, ?, '', ?, ?, ?)",
+		user.ID, user.Username, user.Email, user.EmailVerified, user.Role, user.Approved)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// IsProvisionedUser reports whether an identity provider created the account, in which case
+// the provider rather than an emailed link vouches for who the user is
+func IsProvisionedUser(userID string) bool {
+	var exists bool
+	err := DB.QueryRow("SELECT EXISTS (SELECT 1 FROM user_identities WHERE user_id = ? AND provisioned = 1)", userID).Scan(&exists)
+	return err == nil && exists
+}
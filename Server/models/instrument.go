@@ -0,0 +1,106 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"time"
+
+	"simplehost-server/metrics"
+)
+
+var queryDuration = metrics.NewHistogramVec("simplehost_db_query_duration_seconds",
+	"Time spent running database statements, by statement type.",
+	[]float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}, "statement")
+
+// OpenDB opens a database whose statements are timed for the metrics endpoint. Queries are
+// timed until their first row is ready, not until the rows are consumed.
+func OpenDB(driverName, dsn string) (*sql.DB, error) {
+	// sql.Open doesn't connect, it's only used to look up the registered driver
+	probe, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	drv := probe.Driver()
+	probe.Close()
+	return sql.OpenDB(timedConnector{drv, dsn}), nil
+}
+
+func observeQuery(query string, start time.Time) {
+	statement, _, _ := strings.Cut(strings.TrimSpace(query), " ")
+	switch statement = strings.ToLower(statement); statement {
+	case "select", "insert", "update", "delete", "create", "alter", "with", "pragma":
+	default:
+		statement = "other"
+	}
+	queryDuration.Observe(time.Since(start).Seconds(), statement)
+}
+
+type timedConnector struct {
+	driver driver.Driver
+	dsn    string
+}
+
+func (c timedConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return timedConn{conn}, nil
+}
+
+func (c timedConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// timedConn passes everything through to the driver's connection, timing statements on the way
+type timedConn struct {
+	driver.Conn
+}
+
+func (c timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer observeQuery(query, time.Now())
+	return execer.ExecContext(ctx, query, args)
+}
+
+func (c timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer observeQuery(query, time.Now())
+	return queryer.QueryContext(ctx, query, args)
+}
+
+func (c timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c timedConn) CheckNamedValue(v *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(v)
+	}
+	return driver.ErrSkip
+}
+
+func (c timedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Registration modes stored in the SettingRegistrationMode setting
+const (
+	RegistrationOpen     = "open"
+	RegistrationClosed   = "closed"
+	RegistrationInvite   = "invite"
+	RegistrationApproval = "approval"
+)
+
+var ErrInvalidInvite = errors.New("invalid, expired or used up invite code")
+
+// InviteCode lets someone register while registration is invite-only. Only a hash of the
+// code is stored, so the code itself is shown to the admin once when it is created.
+type InviteCode struct {
+	ID        string
+	CreatedBy string
+	MaxUses   int
+	Uses      int
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+func (i InviteCode) Expired() bool {
+	return time.Now().After(i.ExpiresAt)
+}
+
+func InitInviteTable() error {
+	_, err := DB.Exec(`
+	CREATE TABLE IF NOT EXISTS invite_codes (
+		id TEXT PRIMARY KEY,
+		code_hash TEXT UNIQUE NOT NULL,
+		created_by TEXT NOT NULL,
+		max_uses INTEGER NOT NULL,
+		uses INTEGER NOT NULL DEFAULT 0,
+		expires_at DATETIME NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	`)
+	return err
+}
+
+// CreateInviteCode stores a new invite and returns it along with the raw code
+func CreateInviteCode(createdBy string, maxUses int, ttl time.Duration) (*InviteCode, string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	code := base32.StdEncoding.EncodeToString(b)
+	now := time.Now().UTC()
+	invite := &InviteCode{ID: uuid.New().String(), CreatedBy: createdBy, MaxUses: maxUses, ExpiresAt: now.Add(ttl), CreatedAt: now}
+	_, err := DB.Exec(`INSERT INTO invite_codes (id, code_hash, created_by, max_uses, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		invite.ID, hashToken(code), createdBy, maxUses, invite.ExpiresAt, invite.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+	return invite, code, nil
+}
+
+// ListInviteCodes returns every invite, newest first
+func ListInviteCodes() ([]InviteCode, error) {
+	rows, err := DB.Query(`SELECT id, created_by, max_uses, uses, expires_at, created_at FROM invite_codes ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var invites []InviteCode
+	for rows.Next() {
+		var i InviteCode
+		if err := rows.Scan(&i.ID, &i.CreatedBy, &i.MaxUses, &i.Uses, &i.ExpiresAt, &i.CreatedAt); err != nil {
+			return nil, err
+		}
+		invites = append(invites, i)
+	}
+	return invites, rows.Err()
+}
+
+// RedeemInviteCode uses up one registration from the invite. The check and the increment are
+// a single UPDATE so concurrent registrations can't exceed the usage count.
+func RedeemInviteCode(code string) (string, error) {
+	hash := hashToken(strings.ToUpper(strings.TrimSpace(code)))
+	res, err := DB.Exec(`UPDATE invite_codes SET uses = uses + 1 WHERE code_hash = ? AND uses < max_uses AND expires_at > ?`,
+		hash, time.Now().UTC())
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", ErrInvalidInvite
+	}
+	var id string
+	err = DB.QueryRow(`SELECT id FROM invite_codes WHERE code_hash = ?`, hash).Scan(&id)
+	return id, err
+}
+
+// ReleaseInviteCode gives back a use taken by RedeemInviteCode when registration fails afterwards
+func ReleaseInviteCode(id string) error {
+	_, err := DB.Exec(`UPDATE invite_codes SET uses = uses - 1 WHERE id = ? AND uses > 0`, id)
+	return err
+}
+
+func DeleteInviteCode(id string) error {
+	_, err := DB.Exec(`DELETE FROM invite_codes WHERE id = ?`, id)
+	return err
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setupInviteDB(t *testing.T) {
+	t.Helper()
+	setupUserDB(t)
+	if err := InitInviteTable(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedeemInviteCode(t *testing.T) {
+	setupInviteDB(t)
+	invite, code, err := CreateInviteCode("admin", 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Codes are typed by hand, so case and surrounding spaces don't matter
+	for _, typed := range []string{code, " " + strings.ToLower(code) + " "} {
+		id, err := RedeemInviteCode(typed)
+		if err != nil || id != invite.ID {
+			t.Fatalf("redeeming %q: %q, %v", typed, id, err)
+		}
+	}
+	if _, err := RedeemInviteCode(code); err != ErrInvalidInvite {
+		t.Fatalf("redeeming a used up code: %v, want ErrInvalidInvite", err)
+	}
+	// A registration that fails after redeeming gives its use back
+	if err := ReleaseInviteCode(invite.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RedeemInviteCode(code); err != nil {
+		t.Fatalf("redeeming a released use: %v", err)
+	}
+	if _, err := RedeemInviteCode("NOT-A-CODE"); err != ErrInvalidInvite {
+		t.Fatalf("redeeming an unknown code: %v, want ErrInvalidInvite", err)
+	}
+}
+
+func TestExpiredInviteCodeIsRejected(t *testing.T) {
+	setupInviteDB(t)
+	_, code, err := CreateInviteCode("admin", 5, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RedeemInviteCode(code); err != ErrInvalidInvite {
+		t.Fatalf("redeeming an expired code: %v, want ErrInvalidInvite", err)
+	}
+	invites, err := ListInviteCodes()
+	if err != nil || len(invites) != 1 || !invites[0].Expired() || invites[0].Uses != 0 {
+		t.Fatalf("invites after redeeming an expired code: %+v, %v", invites, err)
+	}
+}
+
+func TestConcurrentInviteRedemptionsStayWithinMaxUses(t *testing.T) {
+	setupInviteDB(t)
+	const maxUses, attempts = 3, 12
+	_, code, err := CreateInviteCode("admin", maxUses, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	redeemed := 0
+	for range attempts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := RedeemInviteCode(code); err == nil {
+				mu.Lock()
+				redeemed++
+				mu.Unlock()
+			} else if err != ErrInvalidInvite {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	invites, _ := ListInviteCodes()
+	if redeemed != maxUses || len(invites) != 1 || invites[0].Uses != maxUses {
+		t.Fatalf("%d of %d redemptions succeeded and %+v recorded, want %d", redeemed, attempts, invites, maxUses)
+	}
+}
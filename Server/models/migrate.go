@@ -0,0 +1,33 @@
+package models
+
+import "database/sql"
+
+// addColumnIfMissing adds a column to an existing table. SQLite has no ADD COLUMN IF NOT EXISTS,
+// so the table schema is checked first.
+func addColumnIfMissing(conn *sql.DB, table, column, definition string) error {
+	exists, err := hasColumn(conn, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = conn.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+// hasColumn reports whether the table has the column
+func hasColumn(conn *sql.DB, table, column string) (bool, error) {
+	rows, err := conn.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Passkey is a WebAuthn credential registered to a user. Credential holds the library's
+// JSON encoding of the public key, sign counter and flags.
+type Passkey struct {
+	ID         string
+	UserID     string
+	Name       string
+	Credential []byte
+	CreatedAt  time.Time
+	LastUsedAt sql.NullTime
+}
+
+func InitPasskeyTable() error {
+	_, err := DB.Exec(`
+	CREATE TABLE IF NOT EXISTS webauthn_credentials (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		credential TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_user ON webauthn_credentials(user_id);
+	`)
+	return err
+}
+
+func InsertPasskey(p Passkey) error {
+	_, err := DB.Exec(`INSERT INTO webauthn_credentials (id, user_id, name, credential, created_at) VALUES (?, ?, ?, ?, ?)`,
+		p.ID, p.UserID, p.Name, string(p.Credential), p.CreatedAt)
+	return err
+}
+
+// ListPasskeys returns the user's passkeys, oldest first
+func ListPasskeys(userID string) ([]Passkey, error) {
+	rows, err := DB.Query(`SELECT id, user_id, name, credential, created_at, last_used_at FROM webauthn_credentials WHERE user_id = ? ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []Passkey
+	for rows.Next() {
+		var p Passkey
+		var credential string
+		if err := rows.Scan(&p.ID, &p.UserID, &p.Name, &credential, &p.CreatedAt, &p.LastUsedAt); err != nil {
+			return nil, err
+		}
+		p.Credential = []byte(credential)
+		keys = append(keys, p)
+	}
+	return keys, rows.Err()
+}
+
+// UpdatePasskeyCredential stores the credential after a login, which bumps its sign counter
+func UpdatePasskeyCredential(id string, credential []byte) error {
+	_, err := DB.Exec(`UPDATE webauthn_credentials SET credential = ?, last_used_at = ? WHERE id = ?`, string(credential), time.Now(), id)
+	return err
+}
+
+// DeletePasskey removes one of the user's passkeys
+func DeletePasskey(id, userID string) error {
+	res, err := DB.Exec(`DELETE FROM webauthn_credentials WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
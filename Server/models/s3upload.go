@@ -0,0 +1,146 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// S3Upload is a multipart upload started through the S3 API. Its parts are stored as
+// upload chunks until it is completed or aborted.
+type S3Upload struct {
+	ID        string
+	UserID    string
+	Bucket    string
+	Key       string
+	CreatedAt time.Time
+}
+
+// S3UploadPart is one uploaded part. ETag is the hex MD5 of its contents.
+type S3UploadPart struct {
+	Number int
+	ETag   string
+	Size   int64
+}
+
+func InitS3UploadTables() error {
+	_, err := DB.Exec(`
+	CREATE TABLE IF NOT EXISTS s3_uploads (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		bucket TEXT NOT NULL,
+		object_key TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE TABLE IF NOT EXISTS s3_upload_parts (
+		upload_id TEXT NOT NULL,
+		part_number INTEGER NOT NULL,
+		etag TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		PRIMARY KEY(upload_id, part_number),
+		FOREIGN KEY(upload_id) REFERENCES s3_uploads(id)
+	);
+	`)
+	return err
+}
+
+func CreateS3Upload(userID, bucket, key string) (*S3Upload, error) {
+	u := &S3Upload{ID: uuid.NewString(), UserID: userID, Bucket: bucket, Key: key, CreatedAt: time.Now().UTC()}
+	_, err := DB.Exec(`INSERT INTO s3_uploads (id, user_id, bucket, object_key, created_at) VALUES (?, ?, ?, ?, ?)`,
+		u.ID, u.UserID, u.Bucket, u.Key, u.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// GetS3Upload returns one of the user's uploads, or sql.ErrNoRows
+func GetS3Upload(id, userID string) (*S3Upload, error) {
+	var u S3Upload
+	err := DB.QueryRow(`SELECT id, user_id, bucket, object_key, created_at FROM s3_uploads WHERE id = ? AND user_id = ?`, id, userID).
+		Scan(&u.ID, &u.UserID, &u.Bucket, &u.Key, &u.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// ListS3Uploads returns the user's uploads into a bucket, oldest first
+func ListS3Uploads(userID, bucket string) ([]S3Upload, error) {
+	return queryS3Uploads(`SELECT id, user_id, bucket, object_key, created_at FROM s3_uploads WHERE user_id = ? AND bucket = ? ORDER BY object_key, created_at`, userID, bucket)
+}
+
+// ListS3UploadsBefore returns everyone's uploads started before t
+func ListS3UploadsBefore(t time.Time) ([]S3Upload, error) {
+	return queryS3Uploads(`SELECT id, user_id, bucket, object_key, created_at FROM s3_uploads WHERE created_at < ?`, t.UTC())
+}
+
+// ListUserS3Uploads returns all of the user's uploads
+func ListUserS3Uploads(userID string) ([]S3Upload, error) {
+	return queryS3Uploads(`SELECT id, user_id, bucket, object_key, created_at FROM s3_uploads WHERE user_id = ?`, userID)
+}
+
+func queryS3Uploads(query string, args ...any) ([]S3Upload, error) {
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var uploads []S3Upload
+	for rows.Next() {
+		var u S3Upload
+		if err := rows.Scan(&u.ID, &u.UserID, &u.Bucket, &u.Key, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, rows.Err()
+}
+
+// PutS3UploadPart records a part, replacing an earlier upload of the same part number
+func PutS3UploadPart(uploadID string, p S3UploadPart) error {
+	_, err := DB.Exec(`INSERT INTO s3_upload_parts (upload_id, part_number, etag, size) VALUES (?, ?, ?, ?)
+		ON CONFLICT(upload_id, part_number) DO UPDATE SET etag = excluded.etag, size = excluded.size`,
+		uploadID, p.Number, p.ETag, p.Size)
+	return err
+}
+
+// ListS3UploadParts returns an upload's parts in order
+func ListS3UploadParts(uploadID string) ([]S3UploadPart, error) {
+	rows, err := DB.Query(`SELECT part_number, etag, size FROM s3_upload_parts WHERE upload_id = ? ORDER BY part_number`, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var parts []S3UploadPart
+	for rows.Next() {
+		var p S3UploadPart
+		if err := rows.Scan(&p.Number, &p.ETag, &p.Size); err != nil {
+			return nil, err
+		}
+		parts = append(parts, p)
+	}
+	return parts, rows.Err()
+}
+
+// DeleteS3Upload forgets an upload and its parts
+func DeleteS3Upload(id string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM s3_upload_parts WHERE upload_id = ?`, id); err != nil {
+		return err
+	}
+	res, err := tx.Exec(`DELETE FROM s3_uploads WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
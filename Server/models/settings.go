@@ -0,0 +1,43 @@
+package models
+
+import "database/sql"
+
+// Instance-wide settings that admins can change at runtime
+const (
+	SettingRequire2FA       = "require_2fa"
+	SettingMagicLinkEnabled = "magic_link_enabled"
+	SettingRegistrationMode = "registration_mode"
+)
+
+func InitSettingsTable() error {
+	_, err := DB.Exec(`
+	CREATE TABLE IF NOT EXISTS settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+	`)
+	return err
+}
+
+// GetSetting returns the stored value for key, or fallback if it has never been set
+func GetSetting(key, fallback string) string {
+	var value string
+	err := DB.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows || err != nil {
+		return fallback
+	}
+	return value
+}
+
+func GetBoolSetting(key string, fallback bool) bool {
+	def := "false"
+	if fallback {
+		def = "true"
+	}
+	return GetSetting(key, def) == "true"
+}
+
+func SetSetting(key, value string) error {
+	_, err := DB.Exec("INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value", key, value)
+	return err
+}
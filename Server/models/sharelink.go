@@ -0,0 +1,152 @@
+package models
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ShareLink lets anyone with its URL download one file without signing in. Token is the
+// secret part of the URL. Only a hash of it is stored, so it is only set on a link that
+// was just created; the ID names the link when listing and revoking it.
+type ShareLink struct {
+	ID        string
+	Token     string
+	UserID    string
+	FileID    string
+	CreatedAt time.Time
+	ExpiresAt sql.NullTime
+}
+
+// Expired reports whether the link can no longer be used
+func (l *ShareLink) Expired() bool {
+	return l.ExpiresAt.Valid && time.Now().After(l.ExpiresAt.Time)
+}
+
+func InitShareLinkTable() error {
+	_, err := DB.Exec(`
+	CREATE TABLE IF NOT EXISTS share_links (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		file_id TEXT NOT NULL,
+		token_hash TEXT,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_share_links_user ON share_links(user_id);
+	CREATE INDEX IF NOT EXISTS idx_share_links_file ON share_links(file_id);
+	`)
+	if err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(DB, "share_links", "token_hash", "TEXT"); err != nil {
+		return err
+	}
+	if err := hashShareLinkTokens(); err != nil {
+		return err
+	}
+	_, err = DB.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_share_links_token ON share_links(token_hash)`)
+	return err
+}
+
+// hashShareLinkTokens moves links made when the secret was stored as the ID over to a
+// hash of it and a new ID, so their URLs keep working
+func hashShareLinkTokens() error {
+	rows, err := DB.Query(`SELECT id FROM share_links WHERE token_hash IS NULL`)
+	if err != nil {
+		return err
+	}
+	var tokens []string
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			rows.Close()
+			return err
+		}
+		tokens = append(tokens, token)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(tokens) == 0 {
+		return err
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, token := range tokens {
+		if _, err := tx.Exec(`UPDATE share_links SET id = ?, token_hash = ? WHERE id = ?`, uuid.NewString(), hashToken(token), token); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// CreateShareLink shares a file. A zero ttl makes a link that never expires.
+func CreateShareLink(userID, fileID string, ttl time.Duration) (*ShareLink, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	link := &ShareLink{
+		ID:        uuid.NewString(),
+		Token:     base64.RawURLEncoding.EncodeToString(b),
+		UserID:    userID,
+		FileID:    fileID,
+		CreatedAt: time.Now().UTC(),
+	}
+	if ttl > 0 {
+		link.ExpiresAt = sql.NullTime{Time: link.CreatedAt.Add(ttl), Valid: true}
+	}
+	_, err := DB.Exec(`INSERT INTO share_links (id, user_id, file_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		link.ID, link.UserID, link.FileID, hashToken(link.Token), link.CreatedAt, link.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// LookupShareLink returns the link with the given secret token, or sql.ErrNoRows
+func LookupShareLink(token string) (*ShareLink, error) {
+	var l ShareLink
+	err := DB.QueryRow(`SELECT id, user_id, file_id, created_at, expires_at FROM share_links WHERE token_hash = ?`, hashToken(token)).
+		Scan(&l.ID, &l.UserID, &l.FileID, &l.CreatedAt, &l.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// ListShareLinks returns the user's links, oldest first
+func ListShareLinks(userID string) ([]ShareLink, error) {
+	rows, err := DB.Query(`SELECT id, user_id, file_id, created_at, expires_at FROM share_links WHERE user_id = ? ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var links []ShareLink
+	for rows.Next() {
+		var l ShareLink
+		if err := rows.Scan(&l.ID, &l.UserID, &l.FileID, &l.CreatedAt, &l.ExpiresAt); err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+// DeleteShareLink revokes one of the user's links
+func DeleteShareLink(id, userID string) error {
+	res, err := DB.Exec(`DELETE FROM share_links WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
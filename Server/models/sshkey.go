@@ -0,0 +1,84 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SSHKey is a public key the user can sign in to SFTP with. PublicKey is in
+// authorized_keys format and Fingerprint is its SHA256 fingerprint.
+type SSHKey struct {
+	ID          string
+	UserID      string
+	Name        string
+	Fingerprint string
+	PublicKey   string
+	CreatedAt   time.Time
+	LastUsedAt  sql.NullTime
+}
+
+func InitSSHKeyTable() error {
+	_, err := DB.Exec(`
+	CREATE TABLE IF NOT EXISTS ssh_keys (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		fingerprint TEXT NOT NULL,
+		public_key TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME,
+		UNIQUE(user_id, fingerprint),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`)
+	return err
+}
+
+func InsertSSHKey(k SSHKey) error {
+	_, err := DB.Exec(`INSERT INTO ssh_keys (id, user_id, name, fingerprint, public_key, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		k.ID, k.UserID, k.Name, k.Fingerprint, k.PublicKey, k.CreatedAt)
+	return err
+}
+
+// ListSSHKeys returns the user's SSH keys, oldest first
+func ListSSHKeys(userID string) ([]SSHKey, error) {
+	rows, err := DB.Query(`SELECT id, user_id, name, fingerprint, public_key, created_at, last_used_at FROM ssh_keys WHERE user_id = ? ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []SSHKey
+	for rows.Next() {
+		var k SSHKey
+		if err := rows.Scan(&k.ID, &k.UserID, &k.Name, &k.Fingerprint, &k.PublicKey, &k.CreatedAt, &k.LastUsedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// UseSSHKey records a login with one of the user's keys, returning sql.ErrNoRows if the
+// key isn't theirs
+func UseSSHKey(userID, fingerprint string) error {
+	res, err := DB.Exec(`UPDATE ssh_keys SET last_used_at = ? WHERE user_id = ? AND fingerprint = ?`, time.Now(), userID, fingerprint)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteSSHKey removes one of the user's SSH keys
+func DeleteSSHKey(id, userID string) error {
+	res, err := DB.Exec(`DELETE FROM ssh_keys WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Purposes for single-use tokens emailed to users
+const (
+	TokenPurposeVerifyEmail   = "verify_email"
+	TokenPurposePasswordReset = "password_reset"
+	TokenPurposeMagicLink     = "magic_link"
+)
+
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// hashToken is used so the raw token only ever exists in the email, never in the database
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateUserToken stores a new single-use token for the user and returns the raw value
+func CreateUserToken(userID, purpose string, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now().UTC()
+	_, err := DB.Exec(`INSERT INTO user_tokens (token_hash, user_id, purpose, expires_at, created_at) VALUES (?, ?, ?, ?, ?)`,
+		hashToken(token), userID, purpose, now.Add(ttl), now)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// UserTokenSentSince reports whether the user was issued a token of a purpose that is still
+// unused and unexpired after the given time
+func UserTokenSentSince(userID, purpose string, since time.Time) (bool, error) {
+	var exists bool
+	err := DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM user_tokens WHERE user_id = ? AND purpose = ? AND used_at IS NULL AND expires_at > ? AND created_at > ?)`,
+		userID, purpose, time.Now().UTC(), since.UTC()).Scan(&exists)
+	return exists, err
+}
+
+// LookupUserToken returns the user a token belongs to without using it up
+func LookupUserToken(token, purpose string) (string, error) {
+	var userID string
+	err := DB.QueryRow(`SELECT user_id FROM user_tokens WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?`,
+		hashToken(token), purpose, time.Now().UTC()).Scan(&userID)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	return userID, nil
+}
+
+// ConsumeUserToken marks a token as used and returns its user. The update only matches unused,
+// unexpired tokens, so concurrent requests can't both redeem the same token.
+func ConsumeUserToken(token, purpose string) (string, error) {
+	hash := hashToken(token)
+	now := time.Now().UTC()
+	res, err := DB.Exec(`UPDATE user_tokens SET used_at = ? WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?`,
+		now, hash, purpose, now)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return "", ErrInvalidToken
+	}
+	var userID string
+	if err := DB.QueryRow(`SELECT user_id FROM user_tokens WHERE token_hash = ?`, hash).Scan(&userID); err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+// DeleteUserTokens removes all outstanding tokens of a purpose for a user
+func DeleteUserTokens(userID, purpose string) error {
+	_, err := DB.Exec(`DELETE FROM user_tokens WHERE user_id = ? AND purpose = ?`, userID, purpose)
+	return err
+}
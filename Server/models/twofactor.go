@@ -0,0 +1,106 @@
+package models
+
+import (
+	"crypto/rand"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const recoveryCodeCount = 10
+
+// EnableTOTP stores the secret once the user has proved their authenticator produces
+// matching codes, recording the step of the code they confirmed with
+func EnableTOTP(userID, secret string, step int64) error {
+	_, err := DB.Exec("UPDATE users SET totp_secret = ?, totp_enabled = 1, totp_last_step = ? WHERE id = ?", secret, step, userID)
+	return err
+}
+
+// DisableTOTP turns two-factor off and forgets the secret and recovery codes
+func DisableTOTP(userID string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE users SET totp_secret = '', totp_enabled = 0, totp_last_step = 0 WHERE id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep records the time step of an accepted code. It fails if that step (or a later one)
+// was already used, so an intercepted code can't be replayed within its validity window.
+func UseTOTPStep(userID string, step int64) bool {
+	res, err := DB.Exec("UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?", step, userID, step)
+	if err != nil {
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n == 1
+}
+
+// recoveryAlphabet avoids characters that are easy to misread
+const recoveryAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(recoveryAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = recoveryAlphabet[n.Int64()]
+	}
+	return string(b[:5]) + "-" + string(b[5:]), nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(code)), " ", "")
+}
+
+// GenerateRecoveryCodes replaces the user's recovery codes and returns the new plain codes.
+// Only hashes are stored, so this is the one time the codes can be shown.
+func GenerateRecoveryCodes(userID string) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hashToken(normalizeRecoveryCode(code))); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, tx.Commit()
+}
+
+// UseRecoveryCode redeems a recovery code, which then can't be used again
+func UseRecoveryCode(userID, code string) bool {
+	res, err := DB.Exec("UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		time.Now().UTC(), userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n == 1
+}
+
+// RemainingRecoveryCodes counts unused recovery codes
+func RemainingRecoveryCodes(userID string) int {
+	var n int
+	DB.QueryRow("SELECT COUNT(1) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", userID).Scan(&n)
+	return n
+}
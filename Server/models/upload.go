@@ -0,0 +1,88 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ChunkedUpload is an upload through /api/upload whose chunks are still arriving. The
+// server issues its ID, which also becomes the uploaded file's ID.
+type ChunkedUpload struct {
+	ID        string
+	UserID    string
+	CreatedAt time.Time
+}
+
+func InitChunkedUploadTable() error {
+	_, err := DB.Exec(`
+	CREATE TABLE IF NOT EXISTS chunked_uploads (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`)
+	return err
+}
+
+func CreateChunkedUpload(userID string) (*ChunkedUpload, error) {
+	u := &ChunkedUpload{ID: uuid.NewString(), UserID: userID, CreatedAt: time.Now().UTC()}
+	_, err := DB.Exec(`INSERT INTO chunked_uploads (id, user_id, created_at) VALUES (?, ?, ?)`,
+		u.ID, u.UserID, u.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// GetChunkedUpload returns one of the user's uploads, or sql.ErrNoRows
+func GetChunkedUpload(id, userID string) (*ChunkedUpload, error) {
+	var u ChunkedUpload
+	err := DB.QueryRow(`SELECT id, user_id, created_at FROM chunked_uploads WHERE id = ? AND user_id = ?`, id, userID).
+		Scan(&u.ID, &u.UserID, &u.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// ListChunkedUploadsBefore returns everyone's uploads started before t
+func ListChunkedUploadsBefore(t time.Time) ([]ChunkedUpload, error) {
+	return queryChunkedUploads(`SELECT id, user_id, created_at FROM chunked_uploads WHERE created_at < ?`, t.UTC())
+}
+
+// ListUserChunkedUploads returns all of the user's uploads
+func ListUserChunkedUploads(userID string) ([]ChunkedUpload, error) {
+	return queryChunkedUploads(`SELECT id, user_id, created_at FROM chunked_uploads WHERE user_id = ?`, userID)
+}
+
+func queryChunkedUploads(query string, args ...any) ([]ChunkedUpload, error) {
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var uploads []ChunkedUpload
+	for rows.Next() {
+		var u ChunkedUpload
+		if err := rows.Scan(&u.ID, &u.UserID, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, rows.Err()
+}
+
+// DeleteChunkedUpload forgets an upload
+func DeleteChunkedUpload(id string) error {
+	res, err := DB.Exec(`DELETE FROM chunked_uploads WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
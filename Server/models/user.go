@@ -2,9 +2,12 @@ package models
 
 import (
 	"database/sql"
+	"log/slog"
+	"time"
+
+	"simplehost-server/passwords"
 
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var DB *sql.DB
@@ -13,40 +16,277 @@ func SetUserDB(db *sql.DB) {
 	DB = db
 }
 
+var passwordHasher passwords.Hasher = passwords.DefaultArgon2id
+
+// SetPasswordHasher picks the scheme new password hashes are created with
+func SetPasswordHasher(h passwords.Hasher) {
+	passwordHasher = h
+}
+
 type User struct {
-	ID       string
-	Username string
-	Email    string
-	Password string
+	ID            string
+	Username      string
+	Email         string
+	Password      string
+	EmailVerified bool
+	// Tokens issued before this unix time are rejected
+	SessionsRevokedAt int64
+	Role              string
+	TOTPSecret        string
+	TOTPEnabled       bool
+	// False while the account waits in the admin approval queue
+	Approved bool
 }
 
-func CreateUser(username, email, password string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// InitUserTables migrates the users table and creates the tables that hang off it
+func InitUserTables() error {
+	// Accounts that existed before verification was introduced count as verified
+	if err := addColumnIfMissing(DB, "users", "email_verified", "BOOLEAN NOT NULL DEFAULT 1"); err != nil {
 		return err
 	}
-	id := uuid.New().String()
-	_, err = DB.Exec("INSERT INTO users (id, username, email, password) VALUES (?, ?, ?, ?)", id, username, email, string(hash))
+	for _, col := range []struct{ name, definition string }{
+		{"sessions_revoked_at", "INTEGER NOT NULL DEFAULT 0"},
+		{"role", "TEXT NOT NULL DEFAULT 'user'"},
+		{"totp_secret", "TEXT NOT NULL DEFAULT ''"},
+		{"totp_enabled", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+		{"approved", "BOOLEAN NOT NULL DEFAULT 1"},
+	} {
+		if err := addColumnIfMissing(DB, "users", col.name, col.definition); err != nil {
+			return err
+		}
+	}
+	_, err := DB.Exec(`
+	CREATE TABLE IF NOT EXISTS user_tokens (
+		token_hash TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		purpose TEXT NOT NULL,
+		expires_at DATETIME NOT NULL,
+		used_at DATETIME,
+		created_at DATETIME,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		user_id TEXT NOT NULL,
+		code_hash TEXT NOT NULL,
+		used_at DATETIME,
+		PRIMARY KEY(user_id, code_hash),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`)
 	if err != nil {
 		return err
 	}
-	return nil
+	return addColumnIfMissing(DB, "user_tokens", "created_at", "DATETIME")
+}
+
+const userColumns = "id, username, email, password, email_verified, sessions_revoked_at, role, totp_secret, totp_enabled, approved"
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row rowScanner) (*User, error) {
+	var user User
+	if err := row.Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.EmailVerified, &user.SessionsRevokedAt, &user.Role, &user.TOTPSecret, &user.TOTPEnabled, &user.Approved); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// CreateUser inserts a new account with an unverified email and returns it. Accounts created
+// with approved false can't log in until an admin approves them.
+// The very first account on an instance becomes its admin and is always approved.
+func CreateUser(username, email, password string, approved bool) (*User, error) {
+	hash, err := passwords.Hash(passwordHasher, password)
+	if err != nil {
+		return nil, err
+	}
+	user := &User{ID: uuid.New().String(), Username: username, Email: email, Password: hash}
+	// Checking for other accounts in the same statement means two registrations racing on a
+	// new instance can't both become admin
+	err = DB.QueryRow(`INSERT INTO users (id, username, email, password, email_verified, role, approved)
+		SELECT ?, ?, ?, ?, 0,
+			CASE WHEN EXISTS (SELECT 1 FROM users) THEN ? ELSE ? END,
+			CASE WHEN EXISTS (SELECT 1 FROM users) THEN ? ELSE 1 END
+		RETURNING role, approved`,
+		user.ID, username, email, user.Password, RoleUser, RoleAdmin, approved).Scan(&user.Role, &user.Approved)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
 }
 
-func VerifyUser(username, password string) bool {
-	var hash string
-	err := DB.QueryRow("SELECT password FROM users WHERE username = ?", username).Scan(&hash)
+// VerifyUser checks the password, and upgrades the stored hash when it was made with an
+// older scheme or weaker parameters than the configured hasher. The error is
+// passwords.ErrBusy when the check couldn't run.
+func VerifyUser(username, password string) (bool, error) {
+	var id, hash string
+	err := DB.QueryRow("SELECT id, password FROM users WHERE username = ?", username).Scan(&id, &hash)
 	if err != nil {
-		return false
+		return false, nil
 	}
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	ok, rehash, err := passwords.Verify(passwordHasher, password, hash)
+	if err != nil {
+		return false, err
+	}
+	if rehash {
+		if err := UpdatePassword(id, password); err != nil {
+			slog.Error("Failed to upgrade password hash", "user_id", id, "error", err)
+		}
+	}
+	return ok, nil
 }
 
 func GetUserByUsername(username string) (*User, error) {
-	var user User
-	err := DB.QueryRow("SELECT id, username, email, password FROM users WHERE username = ?", username).Scan(&user.ID, &user.Username, &user.Email, &user.Password)
+	return scanUser(DB.QueryRow("SELECT "+userColumns+" FROM users WHERE username = ?", username))
+}
+
+func GetUserByID(id string) (*User, error) {
+	return scanUser(DB.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+}
+
+func GetUserByEmail(email string) (*User, error) {
+	return scanUser(DB.QueryRow("SELECT "+userColumns+" FROM users WHERE email = ? COLLATE NOCASE", email))
+}
+
+func SetEmailVerified(userID string, verified bool) error {
+	_, err := DB.Exec("UPDATE users SET email_verified = ? WHERE id = ?", verified, userID)
+	return err
+}
+
+// UpdatePassword replaces the user's password hash
+func UpdatePassword(userID, password string) error {
+	hash, err := passwords.Hash(passwordHasher, password)
+	if err != nil {
+		return err
+	}
+	_, err = DB.Exec("UPDATE users SET password = ? WHERE id = ?", hash, userID)
+	return err
+}
+
+// UpdateEmail changes the user's email address and marks it as unverified
+func UpdateEmail(userID, email string) error {
+	_, err := DB.Exec("UPDATE users SET email = ?, email_verified = 0 WHERE id = ?", email, userID)
+	return err
+}
+
+// RevokeSessions invalidates every token issued to the user up to now
+func RevokeSessions(userID string) error {
+	_, err := DB.Exec("UPDATE users SET sessions_revoked_at = ? WHERE id = ?", time.Now().Unix(), userID)
+	return err
+}
+
+// DeleteUser removes the account row and anything keyed to it. Files and folders must be
+// purged or transferred first with DeleteUserContent or TransferUserContent.
+func DeleteUser(userID string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM user_tokens WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM user_identities WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM webauthn_credentials WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM api_tokens WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM ssh_keys WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM s3_access_keys WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM share_links WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM s3_upload_parts WHERE upload_id IN (SELECT id FROM s3_uploads WHERE user_id = ?)", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM s3_uploads WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM chunked_uploads WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE invite_codes SET created_by = '' WHERE created_by = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM users WHERE id = ?", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListUsers returns every account ordered by username
+func ListUsers() ([]User, error) {
+	rows, err := DB.Query("SELECT " + userColumns + " FROM users ORDER BY username")
 	if err != nil {
 		return nil, err
 	}
-	return &user, nil
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *user)
+	}
+	return users, rows.Err()
+}
+
+func SetUserRole(userID, role string) error {
+	_, err := DB.Exec("UPDATE users SET role = ? WHERE id = ?", role, userID)
+	return err
+}
+
+// CountUsers returns the number of accounts on the instance
+func CountUsers() (int, error) {
+	var count int
+	err := DB.QueryRow("SELECT COUNT(1) FROM users").Scan(&count)
+	return count, err
+}
+
+// ApproveUser lets an account from the approval queue log in
+func ApproveUser(userID string) error {
+	res, err := DB.Exec("UPDATE users SET approved = 1 WHERE id = ?", userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// PromoteAdmin makes an existing account an admin, for bootstrapping instances created before roles existed
+func PromoteAdmin(username string) error {
+	res, err := DB.Exec("UPDATE users SET role = ? WHERE username = ?", RoleAdmin, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
 }
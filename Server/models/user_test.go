@@ -0,0 +1,77 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"simplehost-server/passwords"
+
+	_ "modernc.org/sqlite"
+)
+
+// setupUserDB points the package at a fresh database with the user tables
+func setupUserDB(t *testing.T) {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "simplehost.db")+"?_pragma=busy_timeout(10000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(`CREATE TABLE users (id TEXT PRIMARY KEY, username TEXT UNIQUE NOT NULL, email TEXT UNIQUE NOT NULL, password TEXT NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	SetUserDB(db)
+	SetPasswordHasher(passwords.Argon2id{Memory: 64, Time: 1, Threads: 1})
+	if err := InitUserTables(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOnlyFirstUserBecomesAdmin(t *testing.T) {
+	setupUserDB(t)
+	const n = 8
+	users := make([]*User, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, err := CreateUser(fmt.Sprintf("user%d", i), fmt.Sprintf("user%d@example.com", i), "Secret-123", false)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			users[i] = user
+		}()
+	}
+	wg.Wait()
+
+	admins := 0
+	for _, u := range users {
+		if u == nil {
+			t.FailNow()
+		}
+		stored, err := GetUserByID(u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Role != u.Role || stored.Approved != u.Approved {
+			t.Errorf("%s: CreateUser returned role %q approved %v, stored %q %v", u.Username, u.Role, u.Approved, stored.Role, stored.Approved)
+		}
+		switch {
+		case stored.IsAdmin():
+			admins++
+			if !stored.Approved {
+				t.Errorf("the admin %s isn't approved", u.Username)
+			}
+		case stored.Approved:
+			t.Errorf("%s was approved without an admin", u.Username)
+		}
+	}
+	if admins != 1 {
+		t.Fatalf("%d of %d racing registrations became admin, want 1", admins, n)
+	}
+}
@@ -0,0 +1,198 @@
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"simplehost-server/config"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hasher produces encoded password hashes. Hashes are self-describing, so Verify can check
+// a password against any supported scheme regardless of which Hasher is configured.
+type Hasher interface {
+	Hash(password string) (string, error)
+	// NeedsRehash reports whether encoded was made with another scheme or weaker parameters
+	NeedsRehash(encoded string) bool
+}
+
+var ErrUnknownScheme = errors.New("unrecognized password hash")
+
+// ErrBusy is returned when every hashing slot stayed taken for busyWait. An Argon2id hash
+// holds its whole memory cost while it runs, so a burst of logins could otherwise run the
+// server out of memory.
+var ErrBusy = errors.New("too many password checks in progress")
+
+const busyWait = time.Second
+
+var slots = make(chan struct{}, 4)
+
+// SetConcurrency sets how many passwords can be hashed or checked at once
+func SetConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	slots = make(chan struct{}, n)
+}
+
+// acquire takes a hashing slot, waiting up to busyWait for one to free up, and returns the
+// function that gives it back
+func acquire() (func(), error) {
+	s := slots
+	release := func() { <-s }
+	select {
+	case s <- struct{}{}:
+		return release, nil
+	default:
+	}
+	timer := time.NewTimer(busyWait)
+	defer timer.Stop()
+	select {
+	case s <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, ErrBusy
+	}
+}
+
+// Hash hashes password with h once a hashing slot is free
+func Hash(h Hasher, password string) (string, error) {
+	release, err := acquire()
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return h.Hash(password)
+}
+
+// FromConfig returns the hasher selected by the passwords config section: argon2id, the
+// default, or bcrypt
+func FromConfig(c config.Passwords) Hasher {
+	switch c.Hash {
+	case "bcrypt":
+		cost := c.BcryptCost
+		if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			slog.Warn("bcrypt_cost is out of range, using the default", "bcrypt_cost", cost, "default", bcrypt.DefaultCost)
+			cost = bcrypt.DefaultCost
+		}
+		return Bcrypt{Cost: cost}
+	case "", "argon2id":
+	default:
+		slog.Warn("Unknown password hash, using argon2id", "hash", c.Hash)
+	}
+	params := DefaultArgon2id
+	if c.Argon2Memory > 0 {
+		params.Memory = c.Argon2Memory
+	}
+	if c.Argon2Time > 0 {
+		params.Time = c.Argon2Time
+	}
+	if c.Argon2Threads > 0 {
+		params.Threads = c.Argon2Threads
+	}
+	return params
+}
+
+// Verify checks password against encoded once a hashing slot is free. rehash is true when
+// the password matched but the hash should be replaced with one from h.
+func Verify(h Hasher, password, encoded string) (ok, rehash bool, err error) {
+	release, err := acquire()
+	if err != nil {
+		return false, false, err
+	}
+	defer release()
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		ok = verifyArgon2id(password, encoded)
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		ok = bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) == nil
+	}
+	return ok, ok && h.NeedsRehash(encoded), nil
+}
+
+// Argon2id hashes into the PHC string format, e.g. $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+type Argon2id struct {
+	Memory  uint32 // KiB
+	Time    uint32
+	Threads uint8
+}
+
+// DefaultArgon2id follows the second recommended option in RFC 9106
+var DefaultArgon2id = Argon2id{Memory: 64 * 1024, Time: 3, Threads: 4}
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+var b64 = base64.RawStdEncoding
+
+func (a Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, a.Memory, a.Time, a.Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (a Argon2id) NeedsRehash(encoded string) bool {
+	params, _, _, err := parseArgon2id(encoded)
+	return err != nil || params != a
+}
+
+func parseArgon2id(encoded string) (Argon2id, []byte, []byte, error) {
+	var params Argon2id
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownScheme
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnknownScheme
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, ErrUnknownScheme
+	}
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrUnknownScheme
+	}
+	key, err := b64.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, ErrUnknownScheme
+	}
+	return params, salt, key, nil
+}
+
+func verifyArgon2id(password, encoded string) bool {
+	params, salt, key, err := parseArgon2id(encoded)
+	if err != nil || params.Time == 0 || params.Threads == 0 || len(key) == 0 {
+		return false
+	}
+	computed := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1
+}
+
+// Bcrypt is kept for deployments that need it. It ignores everything past 72 bytes of the password.
+type Bcrypt struct {
+	Cost int
+}
+
+func (b Bcrypt) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	return string(hash), err
+}
+
+func (b Bcrypt) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != b.Cost
+}
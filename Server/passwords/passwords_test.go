@@ -0,0 +1,48 @@
+package passwords
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	cheap := Argon2id{Memory: 64, Time: 1, Threads: 1}
+	hash, err := Hash(cheap, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, rehash, err := Verify(cheap, "correct horse", hash); !ok || rehash || err != nil {
+		t.Fatalf("the right password: ok %v, rehash %v, %v", ok, rehash, err)
+	}
+	if ok, _, _ := Verify(cheap, "wrong horse", hash); ok {
+		t.Fatal("the wrong password matched")
+	}
+	if _, rehash, _ := Verify(Argon2id{Memory: 128, Time: 1, Threads: 1}, "correct horse", hash); !rehash {
+		t.Fatal("a hash with other parameters wasn't marked for rehashing")
+	}
+}
+
+func TestHashingIsCapped(t *testing.T) {
+	SetConcurrency(1)
+	t.Cleanup(func() { SetConcurrency(4) })
+	cheap := Argon2id{Memory: 64, Time: 1, Threads: 1}
+	hash, err := Hash(cheap, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release, err := acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Verify(cheap, "correct horse", hash); !errors.Is(err, ErrBusy) {
+		t.Fatalf("checking a password with every slot taken: %v, want ErrBusy", err)
+	}
+	if _, err := Hash(cheap, "correct horse"); !errors.Is(err, ErrBusy) {
+		t.Fatalf("hashing a password with every slot taken: %v, want ErrBusy", err)
+	}
+	release()
+	if ok, _, err := Verify(cheap, "correct horse", hash); !ok || err != nil {
+		t.Fatalf("checking a password once the slot was free: %v, %v", ok, err)
+	}
+}
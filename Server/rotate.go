@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"simplehost-server/controllers"
+	"simplehost-server/models"
+	"simplehost-server/storage"
+)
+
+// rotateKeys rewraps the data key of every file and upload chunk with the current master
+// key: simplehost rotate-keys. With the key file, a new key is generated first and the
+// old ones are dropped once nothing needs them. With storage.encryption.keys, put the new
+// key first in the list, run this, then remove the old keys. Run it while the server is
+// stopped, since a running server keeps wrapping with the key it started with.
+func rotateKeys(blobs storage.Driver) error {
+	enc := cfg.Storage.Encryption
+	encrypted, ok := blobs.(*storage.Encrypted)
+	if !ok {
+		return errors.New("storage.encryption.enabled is off")
+	}
+	if enc.Keys == "" {
+		keys, err := storage.AddKeyFileKey(enc.KeyFile)
+		if err != nil {
+			return err
+		}
+		encrypted.Keys = storage.NewKeyRing(keys)
+	}
+	current := encrypted.Keys.Current()
+
+	fileKeys, err := models.AllStorageKeys()
+	if err != nil {
+		return err
+	}
+	rewrapped, failed := 0, 0
+	for _, key := range fileKeys {
+		changed, err := encrypted.Rewrap(context.Background(), key)
+		if err != nil {
+			slog.Error("Failed to rewrap data key", "key", key, "error", err)
+			failed++
+		} else if changed {
+			rewrapped++
+		}
+	}
+	slog.Info("Rewrapped data keys", "key_id", current.ID, "rewrapped", rewrapped, "files", len(fileKeys), "failed", failed)
+	// Chunks of unfinished uploads are encrypted too, and are lost with the old keys
+	chunksRewrapped, chunksFailed, err := controllers.RewrapChunks(context.Background())
+	if err != nil {
+		return err
+	}
+	slog.Info("Rewrapped data keys of upload chunks", "key_id", current.ID, "rewrapped", chunksRewrapped, "failed", chunksFailed)
+	failed += chunksFailed
+	if failed > 0 {
+		return fmt.Errorf("%d files or chunks could not be rewrapped, so the old keys are still needed", failed)
+	}
+	if enc.Keys != "" {
+		slog.Info("Every file now uses the first key; the others can be removed from storage.encryption.keys")
+		return nil
+	}
+	if err := storage.WriteKeyFile(enc.KeyFile, []storage.MasterKey{current}); err != nil {
+		return err
+	}
+	slog.Info("Removed retired encryption keys", "path", enc.KeyFile)
+	return nil
+}
@@ -5,5 +5,5 @@ import "embed"
 //go:embed templates/*
 var TemplatesFS embed.FS
 
-//go:embed templates/uploader.js
+//go:embed templates/uploader.js templates/passkey.js
 var StaticFS embed.FS
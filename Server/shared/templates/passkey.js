@@ -0,0 +1,109 @@
+// Passkey registration and login using the WebAuthn browser API.
+// The server sends and expects binary fields as base64url strings.
+
+function csrfToken() {
+    const meta = document.querySelector('meta[name="csrf-token"]');
+    return meta ? meta.content : '';
+}
+
+function basePath() {
+    const meta = document.querySelector('meta[name="base-path"]');
+    return meta ? meta.content : '';
+}
+
+function base64urlToBuffer(value) {
+    const base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+    const padded = base64 + '='.repeat((4 - base64.length % 4) % 4);
+    return Uint8Array.from(atob(padded), c => c.charCodeAt(0)).buffer;
+}
+
+function bufferToBase64url(buffer) {
+    const bytes = new Uint8Array(buffer);
+    let binary = '';
+    bytes.forEach(b => binary += String.fromCharCode(b));
+    return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+async function postJSON(url, body) {
+    const res = await fetch(basePath() + url, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken() },
+        body: body ? JSON.stringify(body) : null,
+        credentials: 'same-origin'
+    });
+    const data = await res.json().catch(() => ({}));
+    if (!res.ok) {
+        throw new Error(data.error || 'Request failed');
+    }
+    return data;
+}
+
+async function registerPasskey(name) {
+    const options = await postJSON('/account/passkeys/register/begin');
+    const publicKey = options.publicKey;
+    publicKey.challenge = base64urlToBuffer(publicKey.challenge);
+    publicKey.user.id = base64urlToBuffer(publicKey.user.id);
+    (publicKey.excludeCredentials || []).forEach(c => c.id = base64urlToBuffer(c.id));
+
+    const credential = await navigator.credentials.create({ publicKey });
+    await postJSON('/account/passkeys/register/finish?name=' + encodeURIComponent(name || ''), {
+        id: credential.id,
+        rawId: bufferToBase64url(credential.rawId),
+        type: credential.type,
+        response: {
+            clientDataJSON: bufferToBase64url(credential.response.clientDataJSON),
+            attestationObject: bufferToBase64url(credential.response.attestationObject),
+            transports: credential.response.getTransports ? credential.response.getTransports() : []
+        }
+    });
+}
+
+async function loginWithPasskey() {
+    const options = await postJSON('/login/passkey/begin');
+    const publicKey = options.publicKey;
+    publicKey.challenge = base64urlToBuffer(publicKey.challenge);
+    (publicKey.allowCredentials || []).forEach(c => c.id = base64urlToBuffer(c.id));
+
+    const assertion = await navigator.credentials.get({ publicKey });
+    const result = await postJSON('/login/passkey/finish', {
+        id: assertion.id,
+        rawId: bufferToBase64url(assertion.rawId),
+        type: assertion.type,
+        response: {
+            clientDataJSON: bufferToBase64url(assertion.response.clientDataJSON),
+            authenticatorData: bufferToBase64url(assertion.response.authenticatorData),
+            signature: bufferToBase64url(assertion.response.signature),
+            userHandle: assertion.response.userHandle ? bufferToBase64url(assertion.response.userHandle) : null
+        }
+    });
+    window.location.href = result.redirect || basePath() + '/simplehost';
+}
+
+function showPasskeyError(target, err) {
+    const el = document.getElementById(target);
+    if (el) {
+        el.textContent = err.name === 'NotAllowedError' ? 'Passkey request was cancelled.' : err.message;
+    }
+}
+
+document.addEventListener('DOMContentLoaded', () => {
+    const loginBtn = document.getElementById('passkeyLoginBtn');
+    if (loginBtn) {
+        if (!window.PublicKeyCredential) {
+            loginBtn.style.display = 'none';
+        }
+        loginBtn.addEventListener('click', () => {
+            loginWithPasskey().catch(err => showPasskeyError('passkeyError', err));
+        });
+    }
+
+    const addBtn = document.getElementById('passkeyAddBtn');
+    if (addBtn) {
+        addBtn.addEventListener('click', () => {
+            const name = document.getElementById('passkeyName').value;
+            registerPasskey(name)
+                .then(() => window.location.reload())
+                .catch(err => showPasskeyError('passkeyError', err));
+        });
+    }
+});
@@ -85,8 +85,23 @@ class FileUploader extends HTMLElement {
             this.uploadFiles(e.dataTransfer.files, status, progressBar);
         });
     }
+    // The server issues each upload's ID and only accepts its chunks from this user
+    async startUpload(status, progressBar) {
+        const res = await fetch(basePath() + '/api/upload/start', {
+            method: 'POST',
+            headers: { 'X-CSRF-Token': csrfToken(), 'Accept': 'application/json' },
+        }).catch(() => null);
+        if (!res || !res.ok) {
+            status.textContent = 'Upload failed.';
+            progressBar.style.display = 'none';
+            throw new Error('Could not start upload');
+        }
+        return (await res.json()).upload_id;
+    }
     async uploadFiles(fileList, status, progressBar) {
-        const CHUNK_SIZE = 5 * 1024 * 1024; // 5MB
+        // The server sets the chunk size from its storage.chunk_size setting
+        const chunkMeta = document.querySelector('meta[name="upload-chunk-size"]');
+        const CHUNK_SIZE = (chunkMeta && parseInt(chunkMeta.content, 10)) || 5 * 1024 * 1024; // 5MB
         const params = new URLSearchParams(window.location.search);
         const folderId = params.get('folderId') || 'root';
         let totalBytes = 0;
@@ -101,7 +116,7 @@ class FileUploader extends HTMLElement {
         // Track bulk conflict choice
         let conflictChoice = null; // 'overwrite', 'skip', 'overwriteAll', 'skipAll'
         for (const file of fileList) {
-            const uploadId = Math.random().toString(36).slice(2) + Date.now();
+            const uploadId = await this.startUpload(status, progressBar);
             const totalChunks = Math.ceil(file.size / CHUNK_SIZE);
             let skipFile = false;
             let overwrite = false;
@@ -120,7 +135,8 @@ class FileUploader extends HTMLElement {
                 if (overwrite || conflictChoice === 'overwriteAll') formData.append('overwrite', 'true');
                 await new Promise((resolve, reject) => {
                     const xhr = new XMLHttpRequest();
-                    xhr.open('POST', '/api/upload', true);
+                    xhr.open('POST', basePath() + '/api/upload', true);
+                    xhr.setRequestHeader('X-CSRF-Token', csrfToken());
                     xhr.onload = async function() {
                         if (xhr.status === 200) {
                             uploadedBytes += chunk.size;
@@ -132,7 +148,8 @@ class FileUploader extends HTMLElement {
                                     overwrite = true;
                                     formData.set('overwrite', 'true');
                                     const retryXhr = new XMLHttpRequest();
-                                    retryXhr.open('POST', '/api/upload', true);
+                                    retryXhr.open('POST', basePath() + '/api/upload', true);
+                                    retryXhr.setRequestHeader('X-CSRF-Token', csrfToken());
                                     retryXhr.onload = function() {
                                         if (retryXhr.status === 200) {
                                             uploadedBytes += chunk.size;
@@ -160,7 +177,8 @@ class FileUploader extends HTMLElement {
                                         overwrite = true;
                                         formData.set('overwrite', 'true');
                                         const retryXhr = new XMLHttpRequest();
-                                        retryXhr.open('POST', '/api/upload', true);
+                                        retryXhr.open('POST', basePath() + '/api/upload', true);
+                                        retryXhr.setRequestHeader('X-CSRF-Token', csrfToken());
                                         retryXhr.onload = function() {
                                             if (retryXhr.status === 200) {
                                                 uploadedBytes += chunk.size;
@@ -183,7 +201,8 @@ class FileUploader extends HTMLElement {
                                         overwrite = true;
                                         formData.set('overwrite', 'true');
                                         const retryXhr = new XMLHttpRequest();
-                                        retryXhr.open('POST', '/api/upload', true);
+                                        retryXhr.open('POST', basePath() + '/api/upload', true);
+                                        retryXhr.setRequestHeader('X-CSRF-Token', csrfToken());
                                         retryXhr.onload = function() {
                                             if (retryXhr.status === 200) {
                                                 uploadedBytes += chunk.size;
@@ -251,6 +270,16 @@ class FileUploader extends HTMLElement {
     }
 }
 customElements.define('file-uploader', FileUploader);
+// Token rendered into base.html, required on every state-changing request
+function csrfToken() {
+    const meta = document.querySelector('meta[name="csrf-token"]');
+    return meta ? meta.content : '';
+}
+// Prefix the app is served under, e.g. /files behind a reverse proxy
+function basePath() {
+    const meta = document.querySelector('meta[name="base-path"]');
+    return meta ? meta.content : '';
+}
 // Helper for custom dialog (can be replaced with a better UI)
 window.showFileConflictDialogBulk = async function(filename) {
     return new Promise((resolve) => {
@@ -0,0 +1,156 @@
+package sigv4
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Payload hashes of request bodies sent in aws-chunked encoding
+const (
+	StreamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	StreamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+// ErrChunkSignature is returned when a chunk of a streamed body doesn't match its signature
+var ErrChunkSignature = errors.New("sigv4: chunk signature does not match")
+
+// ChunkReader decodes an aws-chunked body. When it has a signing key, each chunk's
+// signature is checked, chained from the seed signature of the request itself. Data is
+// returned as it arrives, so a bad chunk is only reported once it has been read: callers
+// must not keep what they read unless they reach io.EOF.
+type ChunkReader struct {
+	r     *bufio.Reader
+	key   []byte
+	time  time.Time
+	scope string
+	prev  string
+
+	left int64
+	sig  string
+	hash hash.Hash
+	err  error
+}
+
+// NewChunkReader decodes a STREAMING-AWS4-HMAC-SHA256-PAYLOAD body signed with key
+func NewChunkReader(r io.Reader, key []byte, t time.Time, scope, seedSignature string) *ChunkReader {
+	return &ChunkReader{r: bufio.NewReader(r), key: key, time: t, scope: scope, prev: seedSignature, left: -1}
+}
+
+// NewUnsignedChunkReader decodes a STREAMING-UNSIGNED-PAYLOAD-TRAILER body. Trailing
+// checksums are skipped.
+func NewUnsignedChunkReader(r io.Reader) *ChunkReader {
+	return &ChunkReader{r: bufio.NewReader(r), left: -1}
+}
+
+func (c *ChunkReader) Read(p []byte) (int, error) {
+	for c.err == nil && c.left <= 0 {
+		if c.left == 0 {
+			c.err = c.endChunk()
+		}
+		if c.err == nil {
+			c.err = c.startChunk()
+		}
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if c.hash != nil {
+		c.hash.Write(p[:n])
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (c *ChunkReader) line() (string, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err == io.EOF {
+		return "", io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// startChunk reads a chunk header: hex size, then ;chunk-signature=... when signed
+func (c *ChunkReader) startChunk() error {
+	header, err := c.line()
+	if err != nil {
+		return err
+	}
+	size, ext, _ := strings.Cut(header, ";")
+	n, err := strconv.ParseInt(size, 16, 64)
+	if err != nil || n < 0 {
+		return errors.New("sigv4: malformed chunk header")
+	}
+	c.left = n
+	if c.key != nil {
+		sig, ok := strings.CutPrefix(ext, "chunk-signature=")
+		if !ok {
+			return ErrChunkSignature
+		}
+		c.sig, c.hash = sig, sha256.New()
+	}
+	if n == 0 {
+		// The last chunk is empty, and signed like the others
+		if err := c.verify(); err != nil {
+			return err
+		}
+		return c.trailer()
+	}
+	return nil
+}
+
+// endChunk checks the line break after a chunk's data and its signature
+func (c *ChunkReader) endChunk() error {
+	if line, err := c.line(); err != nil || line != "" {
+		return errors.New("sigv4: malformed chunk")
+	}
+	return c.verify()
+}
+
+func (c *ChunkReader) verify() error {
+	if c.key == nil {
+		return nil
+	}
+	stringToSign := Algorithm + "-PAYLOAD\n" + c.time.UTC().Format(TimeFormat) + "\n" + c.scope + "\n" +
+		c.prev + "\n" + EmptyPayloadHash + "\n" + hex.EncodeToString(c.hash.Sum(nil))
+	want := Signature(c.key, stringToSign)
+	if !hmac.Equal([]byte(want), []byte(c.sig)) {
+		return ErrChunkSignature
+	}
+	c.prev = c.sig
+	return nil
+}
+
+// trailer skips any trailing headers after the last chunk and ends the body
+func (c *ChunkReader) trailer() error {
+	for {
+		line, err := c.line()
+		if err == io.ErrUnexpectedEOF && c.key == nil {
+			// Unsigned bodies may stop right after the last chunk
+			return io.EOF
+		}
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return io.EOF
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Package sigv4 implements AWS Signature Version 4 request signing as used by S3
+package sigv4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	Algorithm = "AWS4-HMAC-SHA256"
+	// TimeFormat is the layout of the X-Amz-Date header
+	TimeFormat = "20060102T150405Z"
+	// UnsignedPayload is sent as the payload hash when the body isn't hashed up front
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+	// EmptyPayloadHash is the SHA-256 of an empty body
+	EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// Credentials is an access key pair
+type Credentials struct {
+	AccessKey string
+	SecretKey string
+}
+
+// HashPayload returns the hex SHA-256 of a request body
+func HashPayload(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// SignRequest sets the X-Amz-Date, X-Amz-Content-Sha256 and Authorization headers.
+// payloadHash is HashPayload of the body, EmptyPayloadHash or UnsignedPayload.
+func SignRequest(req *http.Request, creds Credentials, region, service, payloadHash string, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signed := []string{"host"}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" || lower == "content-type" || lower == "content-md5" {
+			signed = append(signed, lower)
+		}
+	}
+	sort.Strings(signed)
+
+	scope := Scope(now, region, service)
+	canonical := CanonicalRequest(req, signed, payloadHash)
+	key := SigningKey(creds.SecretKey, now.Format("20060102"), region, service)
+	signature := Signature(key, StringToSign(now, scope, canonical))
+	req.Header.Set("Authorization", Algorithm+" Credential="+creds.AccessKey+"/"+scope+
+		", SignedHeaders="+strings.Join(signed, ";")+", Signature="+signature)
+}
+
+// Scope is the credential scope: date/region/service/aws4_request
+func Scope(t time.Time, region, service string) string {
+	return t.UTC().Format("20060102") + "/" + region + "/" + service + "/aws4_request"
+}
+
+// CanonicalRequest builds the canonical form of req over the given lower-case header names
+func CanonicalRequest(req *http.Request, signedHeaders []string, payloadHash string) string {
+	var b strings.Builder
+	b.WriteString(req.Method)
+	b.WriteByte('\n')
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	b.WriteString(URIEncode(path, false))
+	b.WriteByte('\n')
+	b.WriteString(canonicalQuery(req.URL.Query()))
+	b.WriteByte('\n')
+	for _, name := range signedHeaders {
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(headerValue(req, name))
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	b.WriteString(strings.Join(signedHeaders, ";"))
+	b.WriteByte('\n')
+	b.WriteString(payloadHash)
+	return b.String()
+}
+
+func headerValue(req *http.Request, name string) string {
+	if name == "host" {
+		if req.Host != "" {
+			return req.Host
+		}
+		return req.URL.Host
+	}
+	values := req.Header.Values(name)
+	for i, v := range values {
+		values[i] = strings.Join(strings.Fields(v), " ")
+	}
+	return strings.Join(values, ",")
+}
+
+func canonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for key, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, URIEncode(key, true)+"="+URIEncode(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// StringToSign combines the request time, scope and canonical request
+func StringToSign(t time.Time, scope, canonicalRequest string) string {
+	return Algorithm + "\n" + t.UTC().Format(TimeFormat) + "\n" + scope + "\n" + HashPayload([]byte(canonicalRequest))
+}
+
+// SigningKey derives the key for one day, region and service from the secret key
+func SigningKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// Signature is the hex HMAC of the string to sign
+func Signature(signingKey []byte, stringToSign string) string {
+	return hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// URIEncode percent-encodes everything but unreserved characters, as SigV4 requires.
+// Slashes are kept when encoding a path.
+func URIEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,134 @@
+package sigv4
+
+import (
+	"crypto/hmac"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrMalformed is returned for credentials that can't be parsed
+var ErrMalformed = errors.New("sigv4: malformed credentials")
+
+// Authorization is what a signed request says about how it was signed
+type Authorization struct {
+	AccessKey string
+	// Date, Region and Service come from the credential scope
+	Date          string
+	Region        string
+	Service       string
+	SignedHeaders []string
+	Signature     string
+	// Presigned is set for credentials in the query string rather than a header
+	Presigned bool
+	// Expires is how long a presigned URL is valid for
+	Expires time.Duration
+}
+
+// Scope is the credential scope the request was signed with
+func (a *Authorization) Scope() string {
+	return a.Date + "/" + a.Region + "/" + a.Service + "/aws4_request"
+}
+
+// parseCredential splits AccessKey/date/region/service/aws4_request
+func (a *Authorization) parseCredential(credential string) error {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[0] == "" || parts[4] != "aws4_request" {
+		return ErrMalformed
+	}
+	a.AccessKey, a.Date, a.Region, a.Service = parts[0], parts[1], parts[2], parts[3]
+	return nil
+}
+
+// ParseAuthorization reads an Authorization header like the ones SignRequest writes
+func ParseAuthorization(header string) (*Authorization, error) {
+	rest, ok := strings.CutPrefix(header, Algorithm+" ")
+	if !ok {
+		return nil, ErrMalformed
+	}
+	a := &Authorization{}
+	for _, field := range strings.Split(rest, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch name {
+		case "Credential":
+			if err := a.parseCredential(value); err != nil {
+				return nil, err
+			}
+		case "SignedHeaders":
+			a.SignedHeaders = strings.Split(value, ";")
+		case "Signature":
+			a.Signature = value
+		}
+	}
+	if a.AccessKey == "" || len(a.SignedHeaders) == 0 || a.Signature == "" {
+		return nil, ErrMalformed
+	}
+	return a, nil
+}
+
+// ParseQuery reads the credentials of a presigned URL
+func ParseQuery(query url.Values) (*Authorization, error) {
+	if query.Get("X-Amz-Algorithm") != Algorithm {
+		return nil, ErrMalformed
+	}
+	a := &Authorization{Presigned: true, Signature: query.Get("X-Amz-Signature")}
+	if err := a.parseCredential(query.Get("X-Amz-Credential")); err != nil {
+		return nil, err
+	}
+	if h := query.Get("X-Amz-SignedHeaders"); h != "" {
+		a.SignedHeaders = strings.Split(h, ";")
+	}
+	seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || seconds < 0 {
+		return nil, ErrMalformed
+	}
+	a.Expires = time.Duration(seconds) * time.Second
+	if len(a.SignedHeaders) == 0 || a.Signature == "" {
+		return nil, ErrMalformed
+	}
+	return a, nil
+}
+
+// RequestTime returns when req says it was signed, from X-Amz-Date or else the Date header
+func RequestTime(req *http.Request) (time.Time, error) {
+	if v := req.URL.Query().Get("X-Amz-Date"); v != "" {
+		return time.Parse(TimeFormat, v)
+	}
+	if v := req.Header.Get("X-Amz-Date"); v != "" {
+		return time.Parse(TimeFormat, v)
+	}
+	if v := req.Header.Get("Date"); v != "" {
+		return http.ParseTime(v)
+	}
+	return time.Time{}, ErrMalformed
+}
+
+// Verify reports whether req was signed at t with secret. payloadHash is the value the
+// client signed for the body, usually its X-Amz-Content-Sha256 header.
+func (a *Authorization) Verify(req *http.Request, secret string, t time.Time, payloadHash string) bool {
+	if !slices.Contains(a.SignedHeaders, "host") || t.UTC().Format("20060102") != a.Date {
+		return false
+	}
+	signed := *req
+	if a.Presigned {
+		// The signature covers the rest of the query
+		u := *req.URL
+		query := u.Query()
+		query.Del("X-Amz-Signature")
+		u.RawQuery = query.Encode()
+		signed.URL = &u
+	}
+	if slices.Contains(a.SignedHeaders, "content-length") && req.Header.Get("Content-Length") == "" {
+		// The server takes Content-Length out of the headers for chunked bodies
+		signed.Header = req.Header.Clone()
+		signed.Header.Set("Content-Length", strconv.FormatInt(req.ContentLength, 10))
+	}
+	canonical := CanonicalRequest(&signed, a.SignedHeaders, payloadHash)
+	key := SigningKey(secret, a.Date, a.Region, a.Service)
+	want := Signature(key, StringToSign(t, a.Scope(), canonical))
+	return hmac.Equal([]byte(want), []byte(a.Signature))
+}
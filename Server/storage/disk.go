@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PartialSuffix marks files that are still being written. They're renamed into place once
+// complete, so an interrupted write never leaves a truncated file under its final name.
+const PartialSuffix = ".part"
+
+var errBadKey = errors.New("storage: invalid key")
+
+// Disk stores each object as a file under Root
+type Disk struct {
+	Root string
+}
+
+func (d *Disk) path(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.HasSuffix(key, PartialSuffix) {
+		return "", errBadKey
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." || strings.ContainsRune(part, '\\') {
+			return "", errBadKey
+		}
+	}
+	return filepath.Join(d.Root, filepath.FromSlash(key)), nil
+}
+
+func (d *Disk) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	// Each write gets its own partial file, so concurrent puts to the same key, such as a
+	// retried chunk, can't interleave their bytes
+	out, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*"+PartialSuffix)
+	if err != nil {
+		return err
+	}
+	tmp := out.Name()
+	n, err := io.Copy(out, contextReader{ctx, r})
+	if err == nil && n != size {
+		err = fmt.Errorf("storage: wrote %d bytes of %d", n, size)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (d *Disk) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (d *Disk) Stat(ctx context.Context, key string) (Info, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return Info{}, err
+	}
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Info{}, ErrNotExist
+	}
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (d *Disk) Delete(ctx context.Context, key string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// RemovePartial deletes files left by writes that were cut off, e.g. by a crash
+func (d *Disk) RemovePartial() {
+	filepath.WalkDir(d.Root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.HasSuffix(path, PartialSuffix) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			slog.Error("Failed to remove partial upload", "path", path, "error", err)
+			return nil
+		}
+		slog.Info("Removed partial upload", "path", path)
+		return nil
+	})
+}
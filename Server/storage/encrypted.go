@@ -0,0 +1,447 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// segmentSize is how much plaintext each AES-GCM seal covers. Ranged reads only need
+	// to fetch and open the segments they overlap.
+	segmentSize = 64 << 10
+	tagSize     = 16
+	// Each object's wrapped data key is kept in a small object next to it
+	envelopeSuffix = ".dek"
+)
+
+var (
+	errTampered = errors.New("storage: encrypted file is corrupt or was tampered with")
+	// errNoEnvelope is returned for an object without an envelope that isn't known to be
+	// from before encryption was turned on, e.g. one whose envelope was lost
+	errNoEnvelope = errors.New("storage: encrypted file has no envelope")
+)
+
+// envelope is the metadata stored next to an encrypted object
+type envelope struct {
+	Version int    `json:"version"`
+	KeyID   string `json:"key_id"`
+	// WrappedKey is the data key sealed with the master key, prefixed with the nonce
+	WrappedKey []byte `json:"wrapped_key"`
+	// Size is the length of the plaintext
+	Size        int64 `json:"size"`
+	SegmentSize int64 `json:"segment_size"`
+}
+
+// Encrypted encrypts objects before handing them to Inner. Each object gets its own
+// random data key, wrapped by the current master key and kept in an envelope next to
+// the object.
+type Encrypted struct {
+	Inner Driver
+	Keys  *KeyRing
+	// Plaintext reports whether an object without an envelope was stored before
+	// encryption was turned on. Other objects without one can't be read, since what
+	// they hold may be ciphertext. When nil, every object needs an envelope.
+	Plaintext func(ctx context.Context, key string) (bool, error)
+}
+
+func encryptedSize(size int64) int64 {
+	segments := max(1, (size+segmentSize-1)/segmentSize)
+	return size + segments*tagSize
+}
+
+// segmentNonce derives a nonce from the segment's position. Data keys are never reused,
+// so position alone keeps nonces unique, and flagging the last segment means a truncated
+// object fails to decrypt instead of reading as a shorter file.
+func segmentNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrap seals a data key with a master key, bound to the object's key so envelopes
+// can't be swapped between objects
+func wrap(master MasterKey, objectKey string, dataKey []byte) ([]byte, error) {
+	gcm, err := newGCM(master.Key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, dataKey, []byte(objectKey)), nil
+}
+
+func (e *Encrypted) unwrap(objectKey string, env *envelope) ([]byte, error) {
+	master, ok := e.Keys.byID(env.KeyID)
+	if !ok {
+		return nil, fmt.Errorf("storage: encryption key %q is not configured", env.KeyID)
+	}
+	gcm, err := newGCM(master.Key)
+	if err != nil {
+		return nil, err
+	}
+	if len(env.WrappedKey) < gcm.NonceSize() {
+		return nil, errTampered
+	}
+	nonce, sealed := env.WrappedKey[:gcm.NonceSize()], env.WrappedKey[gcm.NonceSize():]
+	dataKey, err := gcm.Open(nil, nonce, sealed, []byte(objectKey))
+	if err != nil {
+		return nil, errTampered
+	}
+	return dataKey, nil
+}
+
+func checkKey(key string) error {
+	if strings.HasSuffix(key, envelopeSuffix) {
+		return errBadKey
+	}
+	return nil
+}
+
+// envelope reads the object's envelope, returning ErrNotExist if it has none
+func (e *Encrypted) envelope(ctx context.Context, key string) (*envelope, error) {
+	r, err := e.Inner.Get(ctx, key+envelopeSuffix, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	env := &envelope{}
+	if err := json.NewDecoder(io.LimitReader(r, 64<<10)).Decode(env); err != nil {
+		return nil, fmt.Errorf("storage: reading envelope of %s: %w", key, err)
+	}
+	if env.Version != 1 || env.SegmentSize != segmentSize {
+		return nil, fmt.Errorf("storage: unsupported envelope for %s", key)
+	}
+	return env, nil
+}
+
+func (e *Encrypted) putEnvelope(ctx context.Context, key string, env *envelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return e.Inner.Put(ctx, key+envelopeSuffix, bytes.NewReader(data), int64(len(data)))
+}
+
+// rawEnvelope returns the object's envelope as stored, or nil if it has none
+func (e *Encrypted) rawEnvelope(ctx context.Context, key string) ([]byte, error) {
+	r, err := e.Inner.Get(ctx, key+envelopeSuffix, 0, -1)
+	if errors.Is(err, ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(io.LimitReader(r, 64<<10))
+}
+
+// restoreEnvelope puts back the envelope an object had before a failed Put, or removes
+// the new one if it had none
+func (e *Encrypted) restoreEnvelope(ctx context.Context, key string, previous []byte) error {
+	if previous == nil {
+		return e.Inner.Delete(ctx, key+envelopeSuffix)
+	}
+	return e.Inner.Put(ctx, key+envelopeSuffix, bytes.NewReader(previous), int64(len(previous)))
+}
+
+// checkPlaintext allows reading an object without an envelope as it is only if it was
+// stored before encryption was turned on
+func (e *Encrypted) checkPlaintext(ctx context.Context, key string) error {
+	if e.Plaintext == nil {
+		return errNoEnvelope
+	}
+	plaintext, err := e.Plaintext(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !plaintext {
+		return errNoEnvelope
+	}
+	return nil
+}
+
+func (e *Encrypted) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	master := e.Keys.Current()
+	wrapped, err := wrap(master, key, dataKey)
+	if err != nil {
+		return err
+	}
+
+	// The envelope goes first. Until the new contents replace the old ones, reading fails
+	// to decrypt instead of returning ciphertext as an unencrypted object.
+	previous, err := e.rawEnvelope(ctx, key)
+	if err != nil {
+		return err
+	}
+	err = e.putEnvelope(ctx, key, &envelope{
+		Version:     1,
+		KeyID:       master.ID,
+		WrappedKey:  wrapped,
+		Size:        size,
+		SegmentSize: segmentSize,
+	})
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	encrypted := make(chan error, 1)
+	go func() {
+		err := encryptSegments(gcm, r, pw, size)
+		pw.CloseWithError(err)
+		encrypted <- err
+	}()
+	err = e.Inner.Put(ctx, key, pr, encryptedSize(size))
+	// Unblocks the encrypting goroutine if Put stopped reading early
+	pr.CloseWithError(io.ErrClosedPipe)
+	encryptErr := <-encrypted
+	cleanup := context.WithoutCancel(ctx)
+	if err != nil {
+		// The driver kept the old contents, which go with the old envelope
+		e.restoreEnvelope(cleanup, key, previous)
+		return err
+	}
+	// A driver that stops after size bytes never sees an error the source reports with its
+	// last bytes, such as a failed checksum, so what it stored can't be kept
+	if encryptErr != nil {
+		e.Inner.Delete(cleanup, key)
+		e.Inner.Delete(cleanup, key+envelopeSuffix)
+		return encryptErr
+	}
+	return nil
+}
+
+// errRecorder keeps the first error other than io.EOF that r returns. io.ReadFull drops
+// an error that comes with the bytes that fill its buffer, and readers that check the
+// body as a whole report a mismatch in exactly that last read.
+type errRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errRecorder) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+func encryptSegments(gcm cipher.AEAD, r io.Reader, w io.Writer, size int64) error {
+	src := &errRecorder{r: r}
+	segments := max(1, (size+segmentSize-1)/segmentSize)
+	buf := make([]byte, segmentSize+tagSize)
+	for i := int64(0); i < segments; i++ {
+		n := min(segmentSize, size-i*segmentSize)
+		if _, err := io.ReadFull(src, buf[:n]); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if src.err != nil {
+			return src.err
+		}
+		sealed := gcm.Seal(buf[:0], segmentNonce(i, i == segments-1), buf[:n], nil)
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+	}
+	if n, _ := src.Read(buf[:1]); n > 0 {
+		return fmt.Errorf("storage: more than the expected %d bytes", size)
+	}
+	return src.err
+}
+
+func (e *Encrypted) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	env, err := e.envelope(ctx, key)
+	if errors.Is(err, ErrNotExist) {
+		if _, err := e.Inner.Stat(ctx, key); err != nil {
+			return nil, err
+		}
+		if err := e.checkPlaintext(ctx, key); err != nil {
+			return nil, err
+		}
+		return e.Inner.Get(ctx, key, offset, length)
+	}
+	if err != nil {
+		return nil, err
+	}
+	end := env.Size
+	if length >= 0 && offset+length < end {
+		end = offset + length
+	}
+	if offset >= end {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	dataKey, err := e.unwrap(key, env)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	first, last := offset/segmentSize, (end-1)/segmentSize
+	start := first * (segmentSize + tagSize)
+	stop := min((last+1)*(segmentSize+tagSize), encryptedSize(env.Size))
+	body, err := e.Inner.Get(ctx, key, start, stop-start)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		body:      body,
+		gcm:       gcm,
+		size:      env.Size,
+		index:     first,
+		skip:      offset - first*segmentSize,
+		remaining: end - offset,
+	}, nil
+}
+
+// decryptReader opens segments one at a time as they're read
+type decryptReader struct {
+	body      io.ReadCloser
+	gcm       cipher.AEAD
+	size      int64
+	index     int64
+	buf       []byte
+	plain     []byte
+	skip      int64
+	remaining int64
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if d.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if len(d.plain) == 0 {
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain[:min(int64(len(d.plain)), d.remaining)])
+	d.plain = d.plain[n:]
+	d.remaining -= int64(n)
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	segments := max(1, (d.size+segmentSize-1)/segmentSize)
+	n := min(segmentSize, d.size-d.index*segmentSize) + tagSize
+	if d.buf == nil {
+		d.buf = make([]byte, segmentSize+tagSize)
+	}
+	if _, err := io.ReadFull(d.body, d.buf[:n]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return errTampered
+		}
+		return err
+	}
+	plain, err := d.gcm.Open(d.buf[:0], segmentNonce(d.index, d.index == segments-1), d.buf[:n], nil)
+	if err != nil {
+		return errTampered
+	}
+	d.index++
+	d.plain = plain[d.skip:]
+	d.skip = 0
+	return nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.body.Close()
+}
+
+func (e *Encrypted) Stat(ctx context.Context, key string) (Info, error) {
+	if err := checkKey(key); err != nil {
+		return Info{}, err
+	}
+	info, err := e.Inner.Stat(ctx, key)
+	if err != nil {
+		return Info{}, err
+	}
+	env, err := e.envelope(ctx, key)
+	if errors.Is(err, ErrNotExist) {
+		if err := e.checkPlaintext(ctx, key); err != nil {
+			return Info{}, err
+		}
+		return info, nil
+	}
+	if err != nil {
+		return Info{}, err
+	}
+	info.Size = env.Size
+	return info, nil
+}
+
+func (e *Encrypted) Delete(ctx context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if err := e.Inner.Delete(ctx, key); err != nil {
+		return err
+	}
+	return e.Inner.Delete(ctx, key+envelopeSuffix)
+}
+
+// Rewrap rewraps the object's data key with the current master key, reporting whether
+// anything changed. The file contents are left alone.
+func (e *Encrypted) Rewrap(ctx context.Context, key string) (bool, error) {
+	env, err := e.envelope(ctx, key)
+	if errors.Is(err, ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	current := e.Keys.Current()
+	if env.KeyID == current.ID {
+		return false, nil
+	}
+	dataKey, err := e.unwrap(key, env)
+	if err != nil {
+		return false, err
+	}
+	if env.WrappedKey, err = wrap(current, key, dataKey); err != nil {
+		return false, err
+	}
+	env.KeyID = current.ID
+	return true, e.putEnvelope(ctx, key, env)
+}
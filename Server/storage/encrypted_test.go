@@ -0,0 +1,297 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func masterKey(id string, b byte) MasterKey {
+	return MasterKey{ID: id, Key: bytes.Repeat([]byte{b}, masterKeyLength)}
+}
+
+// newEncrypted returns an encrypting driver over a disk driver in a temporary folder
+func newEncrypted(t *testing.T) *Encrypted {
+	t.Helper()
+	return &Encrypted{Inner: &Disk{Root: t.TempDir()}, Keys: NewKeyRing([]MasterKey{masterKey("k1", 1)})}
+}
+
+// testData is n bytes that differ from segment to segment
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i*7 + i/segmentSize)
+	}
+	return data
+}
+
+func readAll(t *testing.T, d Driver, key string, offset, length int64) ([]byte, error) {
+	t.Helper()
+	r, err := d.Get(context.Background(), key, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func TestEncryptedRangedReads(t *testing.T) {
+	e := newEncrypted(t)
+	for _, size := range []int{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 3*segmentSize + 100} {
+		data := testData(size)
+		key := "obj"
+		if err := e.Put(context.Background(), key, bytes.NewReader(data), int64(size)); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		stored, err := os.ReadFile(filepath.Join(e.Inner.(*Disk).Root, key))
+		if err != nil || int64(len(stored)) != encryptedSize(int64(size)) {
+			t.Fatalf("size %d: stored %d bytes, want %d", size, len(stored), encryptedSize(int64(size)))
+		}
+		if size > 16 && bytes.Contains(stored, data[:16]) {
+			t.Fatalf("size %d: plaintext was stored", size)
+		}
+		if info, err := e.Stat(context.Background(), key); err != nil || info.Size != int64(size) {
+			t.Fatalf("size %d: Stat %+v, %v", size, info, err)
+		}
+
+		for _, r := range []struct{ offset, length int64 }{
+			{0, -1},
+			{0, 1},
+			{segmentSize - 10, 20},
+			{segmentSize, segmentSize},
+			{2*segmentSize - 1, 2},
+			{10, 2*segmentSize + 50},
+			{int64(size) - 1, -1},
+			{int64(size), 10},
+			{int64(size) + 5, -1},
+		} {
+			if r.offset < 0 {
+				continue
+			}
+			start, end := min(r.offset, int64(size)), int64(size)
+			if r.length >= 0 {
+				end = min(r.offset+r.length, int64(size))
+			}
+			want := data[start:max(start, end)]
+			got, err := readAll(t, e, key, r.offset, r.length)
+			if err != nil {
+				t.Fatalf("size %d, Get(%d, %d): %v", size, r.offset, r.length, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("size %d, Get(%d, %d): read %d bytes that don't match the %d expected", size, r.offset, r.length, len(got), len(want))
+			}
+		}
+	}
+}
+
+func TestEncryptedDetectsTampering(t *testing.T) {
+	size := 2*segmentSize + 100
+	for _, c := range []struct {
+		name   string
+		change func([]byte) []byte
+	}{
+		{"truncated mid-segment", func(b []byte) []byte { return b[:len(b)-50] }},
+		// Dropping the whole last segment leaves valid segments, but the new last one
+		// wasn't sealed as the last
+		{"truncated at a segment boundary", func(b []byte) []byte { return b[:2*(segmentSize+tagSize)] }},
+		{"flipped byte", func(b []byte) []byte { b[segmentSize+tagSize+3] ^= 1; return b }},
+		{"swapped segments", func(b []byte) []byte {
+			seg := segmentSize + tagSize
+			swapped := append([]byte{}, b[seg:2*seg]...)
+			swapped = append(swapped, b[:seg]...)
+			return append(swapped, b[2*seg:]...)
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			e := newEncrypted(t)
+			if err := e.Put(context.Background(), "obj", bytes.NewReader(testData(size)), int64(size)); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(e.Inner.(*Disk).Root, "obj")
+			stored, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, c.change(stored), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readAll(t, e, "obj", 0, -1); !errors.Is(err, errTampered) {
+				t.Fatalf("reading the whole file: %v, want errTampered", err)
+			}
+		})
+	}
+
+	// An envelope copied from another object doesn't unwrap
+	e := newEncrypted(t)
+	for _, key := range []string{"a", "b"} {
+		if err := e.Put(context.Background(), key, bytes.NewReader(testData(10)), 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := e.Inner.(*Disk).Root
+	envelope, _ := os.ReadFile(filepath.Join(root, "a"+envelopeSuffix))
+	os.WriteFile(filepath.Join(root, "b"+envelopeSuffix), envelope, 0o600)
+	if _, err := readAll(t, e, "b", 0, -1); !errors.Is(err, errTampered) {
+		t.Fatalf("reading with another object's envelope: %v, want errTampered", err)
+	}
+}
+
+// lastReadFails returns all of data and err from the same Read, the way readers that
+// check a body's checksum report a mismatch
+type lastReadFails struct {
+	data []byte
+	err  error
+}
+
+func (r *lastReadFails) Read(p []byte) (int, error) {
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	if len(r.data) == 0 {
+		return n, r.err
+	}
+	return n, nil
+}
+
+func TestEncryptedPutKeepsSourceErrors(t *testing.T) {
+	errChecksum := errors.New("checksum mismatch")
+	for _, size := range []int{10, segmentSize, segmentSize + 10} {
+		e := newEncrypted(t)
+		err := e.Put(context.Background(), "obj", &lastReadFails{testData(size), errChecksum}, int64(size))
+		if !errors.Is(err, errChecksum) {
+			t.Fatalf("size %d: Put returned %v, want the source's error", size, err)
+		}
+		if _, err := e.Stat(context.Background(), "obj"); !errors.Is(err, ErrNotExist) {
+			t.Fatalf("size %d: the object was stored anyway: %v", size, err)
+		}
+	}
+
+	e := newEncrypted(t)
+	if err := e.Put(context.Background(), "obj", bytes.NewReader(testData(20)), 10); err == nil {
+		t.Fatal("Put accepted more bytes than the size")
+	}
+	if err := e.Put(context.Background(), "obj", bytes.NewReader(testData(5)), 10); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Put with fewer bytes than the size: %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestEncryptedRewrap(t *testing.T) {
+	e := newEncrypted(t)
+	ctx := context.Background()
+	data := testData(segmentSize + 10)
+	if err := e.Put(ctx, "obj", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Inner.Put(ctx, "plain", bytes.NewReader([]byte("old file")), 8); err != nil {
+		t.Fatal(err)
+	}
+	e.Plaintext = func(ctx context.Context, key string) (bool, error) { return key == "plain", nil }
+
+	if changed, err := e.Rewrap(ctx, "obj"); changed || err != nil {
+		t.Fatalf("rewrapping with the key it already has: %v, %v", changed, err)
+	}
+
+	e.Keys = NewKeyRing([]MasterKey{masterKey("k2", 2), masterKey("k1", 1)})
+	if changed, err := e.Rewrap(ctx, "obj"); !changed || err != nil {
+		t.Fatalf("rewrapping after rotation: %v, %v", changed, err)
+	}
+	if changed, err := e.Rewrap(ctx, "plain"); changed || err != nil {
+		t.Fatalf("rewrapping an unencrypted file: %v, %v", changed, err)
+	}
+	if env, err := e.envelope(ctx, "obj"); err != nil || env.KeyID != "k2" {
+		t.Fatalf("envelope after rewrapping: %+v, %v", env, err)
+	}
+
+	// The old key can be dropped once everything is rewrapped
+	e.Keys = NewKeyRing([]MasterKey{masterKey("k2", 2)})
+	if got, err := readAll(t, e, "obj", 0, -1); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("reading with only the new key: %d bytes, %v", len(got), err)
+	}
+	if got, err := readAll(t, e, "plain", 0, -1); err != nil || string(got) != "old file" {
+		t.Fatalf("reading an unencrypted file: %q, %v", got, err)
+	}
+
+	e.Keys = NewKeyRing([]MasterKey{masterKey("k3", 3)})
+	if _, err := readAll(t, e, "obj", 0, -1); err == nil {
+		t.Fatal("read a file whose key isn't configured")
+	}
+}
+
+func TestEncryptedOnlyReadsKnownPlaintextWithoutEnvelope(t *testing.T) {
+	e := newEncrypted(t)
+	ctx := context.Background()
+	for _, key := range []string{"old", "lost"} {
+		if err := e.Inner.Put(ctx, key, bytes.NewReader([]byte("contents")), 8); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"old", "lost"} {
+		if _, err := readAll(t, e, key, 0, -1); !errors.Is(err, errNoEnvelope) {
+			t.Errorf("reading %s without Plaintext: %v, want errNoEnvelope", key, err)
+		}
+	}
+
+	e.Plaintext = func(ctx context.Context, key string) (bool, error) { return key == "old", nil }
+	if got, err := readAll(t, e, "old", 0, -1); err != nil || string(got) != "contents" {
+		t.Errorf("reading a file from before encryption: %q, %v", got, err)
+	}
+	if info, err := e.Stat(ctx, "old"); err != nil || info.Size != 8 {
+		t.Errorf("Stat of a file from before encryption: %+v, %v", info, err)
+	}
+	if _, err := readAll(t, e, "lost", 0, -1); !errors.Is(err, errNoEnvelope) {
+		t.Errorf("reading a file whose envelope is missing: %v, want errNoEnvelope", err)
+	}
+	if _, err := e.Stat(ctx, "lost"); !errors.Is(err, errNoEnvelope) {
+		t.Errorf("Stat of a file whose envelope is missing: %v, want errNoEnvelope", err)
+	}
+	if _, err := readAll(t, e, "missing", 0, -1); !errors.Is(err, ErrNotExist) {
+		t.Errorf("reading a missing file: %v, want ErrNotExist", err)
+	}
+}
+
+// failingPuts fails to store anything but envelopes
+type failingPuts struct {
+	Driver
+}
+
+var errPutFailed = errors.New("put failed")
+
+func (f failingPuts) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if strings.HasSuffix(key, envelopeSuffix) {
+		return f.Driver.Put(ctx, key, r, size)
+	}
+	io.Copy(io.Discard, r)
+	return errPutFailed
+}
+
+func TestEncryptedFailedPutKeepsTheOldContents(t *testing.T) {
+	e := newEncrypted(t)
+	ctx := context.Background()
+	if err := e.Put(ctx, "obj", bytes.NewReader([]byte("first")), 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Inner.Put(ctx, "old", bytes.NewReader([]byte("plain")), 5); err != nil {
+		t.Fatal(err)
+	}
+	e.Plaintext = func(ctx context.Context, key string) (bool, error) { return key == "old", nil }
+
+	failing := &Encrypted{Inner: failingPuts{e.Inner}, Keys: e.Keys, Plaintext: e.Plaintext}
+	for _, key := range []string{"obj", "old", "new"} {
+		if err := failing.Put(ctx, key, bytes.NewReader([]byte("second")), 6); !errors.Is(err, errPutFailed) {
+			t.Fatalf("replacing %s: %v, want errPutFailed", key, err)
+		}
+	}
+	if got, err := readAll(t, e, "obj", 0, -1); err != nil || string(got) != "first" {
+		t.Errorf("encrypted file after a failed replace: %q, %v", got, err)
+	}
+	if got, err := readAll(t, e, "old", 0, -1); err != nil || string(got) != "plain" {
+		t.Errorf("file from before encryption after a failed replace: %q, %v", got, err)
+	}
+	if _, err := e.Inner.Stat(ctx, "new"+envelopeSuffix); !errors.Is(err, ErrNotExist) {
+		t.Errorf("a failed put left an envelope behind: %v", err)
+	}
+}
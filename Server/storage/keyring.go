@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"simplehost-server/config"
+)
+
+// Master keys are AES-256 keys
+const masterKeyLength = 32
+
+// MasterKey wraps the data keys of encrypted files
+type MasterKey struct {
+	ID        string    `json:"id"`
+	Key       []byte    `json:"key"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// KeyRing holds the master key new data keys are wrapped with, followed by older keys
+// that can still unwrap
+type KeyRing struct {
+	keys []MasterKey
+}
+
+// NewKeyRing makes a key ring whose first key is current
+func NewKeyRing(keys []MasterKey) *KeyRing {
+	return &KeyRing{keys: keys}
+}
+
+// Current is the key that wraps new data keys
+func (k *KeyRing) Current() MasterKey {
+	return k.keys[0]
+}
+
+func (k *KeyRing) byID(id string) (MasterKey, bool) {
+	for _, key := range k.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return MasterKey{}, false
+}
+
+// LoadKeyRing loads the master keys from storage.encryption.keys, a comma separated list
+// of id:base64-key pairs where the first key is current, or else from the key file, which
+// is created with a random key on first run
+func LoadKeyRing(c config.Encryption) (*KeyRing, error) {
+	var keys []MasterKey
+	if c.Keys != "" {
+		for _, pair := range strings.Split(c.Keys, ",") {
+			id, encoded, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			key, err := base64.StdEncoding.DecodeString(encoded)
+			if !ok || id == "" || err != nil || len(key) != masterKeyLength {
+				return nil, fmt.Errorf("storage.encryption.keys must be id:key pairs with base64 encoded %d-byte keys", masterKeyLength)
+			}
+			keys = append(keys, MasterKey{ID: id, Key: key})
+		}
+	} else {
+		var err error
+		if keys, err = readKeyFile(c.KeyFile); err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			if keys, err = AddKeyFileKey(c.KeyFile); err != nil {
+				return nil, err
+			}
+		}
+	}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if seen[key.ID] {
+			return nil, fmt.Errorf("duplicate encryption key id %q", key.ID)
+		}
+		if len(key.Key) != masterKeyLength {
+			return nil, fmt.Errorf("encryption key %q is not %d bytes", key.ID, masterKeyLength)
+		}
+		seen[key.ID] = true
+	}
+	return NewKeyRing(keys), nil
+}
+
+// readKeyFile returns the keys in the file newest first, or none if it doesn't exist
+func readKeyFile(path string) ([]MasterKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []MasterKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+// AddKeyFileKey generates a new current key in the key file and returns every key in it
+func AddKeyFileKey(path string) ([]MasterKey, error) {
+	keys, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := MasterKey{Key: make([]byte, masterKeyLength), CreatedAt: time.Now().UTC()}
+	if _, err := rand.Read(key.Key); err != nil {
+		return nil, err
+	}
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	key.ID = base64.RawURLEncoding.EncodeToString(id)
+	keys = append([]MasterKey{key}, keys...)
+	if err := WriteKeyFile(path, keys); err != nil {
+		return nil, err
+	}
+	slog.Info("Generated encryption key", "id", key.ID, "path", path)
+	return keys, nil
+}
+
+// WriteKeyFile replaces the keys in the key file
+func WriteKeyFile(path string, keys []MasterKey) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
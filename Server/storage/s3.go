@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"simplehost-server/config"
+	"simplehost-server/sigv4"
+)
+
+// S3 limits a multipart upload to this many parts
+const maxParts = 10000
+
+// S3 stores objects in a bucket through the S3 REST API
+type S3 struct {
+	Endpoint  *url.URL
+	Region    string
+	Bucket    string
+	Prefix    string
+	PathStyle bool
+	PartSize  int64
+	Creds     sigv4.Credentials
+	Client    *http.Client
+}
+
+// NewS3 returns a driver for the bucket described by c
+func NewS3(c config.S3) (*S3, error) {
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + c.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("storage: invalid S3 endpoint %q", endpoint)
+	}
+	return &S3{
+		Endpoint:  u,
+		Region:    c.Region,
+		Bucket:    c.Bucket,
+		Prefix:    c.Prefix,
+		PathStyle: c.PathStyle,
+		PartSize:  c.PartSize,
+		Creds:     sigv4.Credentials{AccessKey: c.AccessKey, SecretKey: c.SecretKey},
+		Client:    &http.Client{},
+	}, nil
+}
+
+// S3Error is an error response from the server
+type S3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("storage: S3 returned %d", e.Status)
+	}
+	return fmt.Sprintf("storage: S3 returned %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (e *S3Error) Is(target error) bool {
+	return target == ErrNotExist && (e.Code == "NoSuchKey" || (e.Code == "" && e.Status == http.StatusNotFound))
+}
+
+func (s *S3) objectURL(key string, query url.Values) *url.URL {
+	u := *s.Endpoint
+	path := "/" + s.Prefix + key
+	if s.PathStyle {
+		path = "/" + s.Bucket + path
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = sigv4.URIEncode(u.Path, false)
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// do sends a signed request and turns error responses into *S3Error. size is the body
+// length, and the body is sent unsigned unless payloadHash is given.
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64, payloadHash string, header http.Header) (*http.Response, error) {
+	if body == nil || size == 0 {
+		body, payloadHash = http.NoBody, sigv4.EmptyPayloadHash
+	} else if payloadHash == "" {
+		payloadHash = sigv4.UnsignedPayload
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	sigv4.SignRequest(req, s.Creds, s.Region, "s3", payloadHash, time.Now())
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		s3err := &S3Error{Status: resp.StatusCode}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		xml.Unmarshal(data, s3err)
+		return nil, s3err
+	}
+	return resp, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if size <= s.PartSize {
+		resp, err := s.do(ctx, http.MethodPut, key, nil, contextReader{ctx, r}, size, "", nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	return s.putMultipart(ctx, key, r, size)
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// putMultipart uploads a large object in parts. The object only appears once the upload
+// is completed, and a failed upload is aborted so its parts don't linger in the bucket.
+func (s *S3) putMultipart(ctx context.Context, key string, r io.Reader, size int64) error {
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, 0, "", nil)
+	if err != nil {
+		return err
+	}
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if created.UploadID == "" {
+		return errors.New("storage: S3 did not return an upload ID")
+	}
+
+	partSize := max(s.PartSize, (size+maxParts-1)/maxParts)
+	var parts []completedPart
+	for offset, number := int64(0), 1; offset < size; offset, number = offset+partSize, number+1 {
+		length := min(partSize, size-offset)
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {created.UploadID}}
+		resp, err := s.do(ctx, http.MethodPut, key, query, contextReader{ctx, io.LimitReader(r, length)}, length, "", nil)
+		if err != nil {
+			s.abortMultipart(key, created.UploadID)
+			return err
+		}
+		resp.Body.Close()
+		parts = append(parts, completedPart{number, resp.Header.Get("ETag")})
+	}
+
+	body, _ := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	resp, err = s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {created.UploadID}},
+		bytes.NewReader(body), int64(len(body)), sigv4.HashPayload(body), nil)
+	if err != nil {
+		s.abortMultipart(key, created.UploadID)
+		return err
+	}
+	// Completion can fail after a 200 status, with the error in the body
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	s3err := &S3Error{Status: resp.StatusCode}
+	if xml.Unmarshal(data, s3err) == nil && s3err.Code != "" {
+		s.abortMultipart(key, created.UploadID)
+		return s3err
+	}
+	return nil
+}
+
+func (s *S3) abortMultipart(key, uploadID string) {
+	// The upload may have failed because ctx was cancelled, so abort with a fresh one
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if resp, err := s.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, 0, "", nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (s *S3) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	header := http.Header{}
+	if length > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil, 0, "", header)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (Info, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, 0, "", nil)
+	if err != nil {
+		return Info{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return Info{Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, 0, "", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,308 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"simplehost-server/config"
+	"simplehost-server/sigv4"
+)
+
+// fakeS3 is an in-memory bucket that checks every request's signature
+type fakeS3 struct {
+	*httptest.Server
+	t      *testing.T
+	bucket string
+	secret string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	aborted []string
+	// failPart makes uploading that part number fail
+	failPart int
+	// failComplete makes completion fail inside a 200 response, as S3 can
+	failComplete bool
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	f := &fakeS3{t: t, bucket: "files", secret: "secret-key", objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// driver returns an S3 driver for the fake. With virtual-hosted addressing the bucket is
+// part of the host name, so the client dials the fake whatever host it asks for.
+func (f *fakeS3) driver(pathStyle bool) *S3 {
+	endpoint, _ := url.Parse(f.URL)
+	addr := endpoint.Host
+	return &S3{
+		Endpoint:  endpoint,
+		Region:    "us-east-1",
+		Bucket:    f.bucket,
+		Prefix:    "data/",
+		PathStyle: pathStyle,
+		PartSize:  5,
+		Creds:     sigv4.Credentials{AccessKey: "access-key", SecretKey: f.secret},
+		Client: &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		}},
+	}
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	a, err := sigv4.ParseAuthorization(r.Header.Get("Authorization"))
+	signedAt, timeErr := sigv4.RequestTime(r)
+	if err != nil || timeErr != nil || a.Region != "us-east-1" || a.Service != "s3" ||
+		!a.Verify(r, f.secret, signedAt, r.Header.Get("X-Amz-Content-Sha256")) {
+		f.error(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	if hash := r.Header.Get("X-Amz-Content-Sha256"); hash != sigv4.UnsignedPayload && hash != sigv4.HashPayload(body) {
+		f.error(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch")
+		return
+	}
+
+	// Both addressing styles end up at bucket and key
+	path := r.URL.Path
+	if host, _, _ := net.SplitHostPort(r.Host); host == f.bucket+".127.0.0.1" {
+		path = "/" + f.bucket + path
+	}
+	key, ok := strings.CutPrefix(path, "/"+f.bucket+"/")
+	if !ok {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		id := fmt.Sprintf("upload-%d", len(f.uploads)+1)
+		f.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		if !ok || number < 1 {
+			f.error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		if number == f.failPart {
+			f.error(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		parts[number] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, number))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		if f.failComplete {
+			fmt.Fprint(w, "<Error><Code>InternalError</Code><Message>try again</Message></Error>")
+			return
+		}
+		var complete struct {
+			Parts []completedPart `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			f.error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var data []byte
+		for i, p := range complete.Parts {
+			if p.PartNumber != i+1 || p.ETag != fmt.Sprintf(`"etag-%d"`, p.PartNumber) || parts[p.PartNumber] == nil {
+				f.error(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			data = append(data, parts[p.PartNumber]...)
+		}
+		f.objects[key] = data
+		delete(f.uploads, query.Get("uploadId"))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		f.aborted = append(f.aborted, query.Get("uploadId"))
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Last-Modified", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Format(http.TimeFormat))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func TestS3RoundTrip(t *testing.T) {
+	for _, pathStyle := range []bool{true, false} {
+		t.Run(fmt.Sprintf("path style %v", pathStyle), func(t *testing.T) {
+			f := newFakeS3(t)
+			s := f.driver(pathStyle)
+			ctx := context.Background()
+			key := "ab/cd/file name+1.txt"
+
+			if err := s.Put(ctx, key, strings.NewReader("hey"), 3); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(f.objects["data/"+key]); got != "hey" {
+				t.Fatalf("stored %q under the prefixed key, want hey", got)
+			}
+			info, err := s.Stat(ctx, key)
+			if err != nil || info.Size != 3 || info.ModTime.Year() != 2024 {
+				t.Fatalf("Stat: %+v, %v", info, err)
+			}
+			body, err := s.Get(ctx, key, 0, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(body)
+			body.Close()
+			if string(data) != "hey" {
+				t.Fatalf("Get read %q", data)
+			}
+
+			if err := s.Delete(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Get(ctx, key, 0, -1); !errors.Is(err, ErrNotExist) {
+				t.Fatalf("Get after Delete: %v, want ErrNotExist", err)
+			}
+			if _, err := s.Stat(ctx, key); !errors.Is(err, ErrNotExist) {
+				t.Fatalf("Stat after Delete: %v, want ErrNotExist", err)
+			}
+		})
+	}
+}
+
+func TestS3RangedGet(t *testing.T) {
+	f := newFakeS3(t)
+	s := f.driver(true)
+	ctx := context.Background()
+	if err := s.Put(ctx, "k", strings.NewReader("0123456789"), 10); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, -1, "0123456789"},
+		{3, 4, "3456"},
+		{7, -1, "789"},
+		{5, 0, ""},
+	} {
+		body, err := s.Get(ctx, "k", c.offset, c.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(body)
+		body.Close()
+		if string(data) != c.want {
+			t.Errorf("Get(%d, %d) = %q, want %q", c.offset, c.length, data, c.want)
+		}
+	}
+
+	// ReadSeeker starts a new ranged read after each seek
+	rs := NewReadSeeker(ctx, s, "k", 10)
+	defer rs.Close()
+	rs.Seek(-2, io.SeekEnd)
+	if data, _ := io.ReadAll(rs); string(data) != "89" {
+		t.Fatalf("read %q after seeking to 8", data)
+	}
+}
+
+func TestS3Multipart(t *testing.T) {
+	f := newFakeS3(t)
+	s := f.driver(true)
+	ctx := context.Background()
+	content := "hello multipart world"
+
+	if err := s.Put(ctx, "big", strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(f.objects["data/big"]); got != content {
+		t.Fatalf("assembled %q, want %q", got, content)
+	}
+	if len(f.uploads) != 0 || len(f.aborted) != 0 {
+		t.Fatalf("uploads left %v, aborted %v", f.uploads, f.aborted)
+	}
+
+	f.failPart = 2
+	if err := s.Put(ctx, "broken", strings.NewReader(content), int64(len(content))); err == nil {
+		t.Fatal("Put succeeded although a part failed")
+	}
+	f.failPart = 0
+	f.failComplete = true
+	if err := s.Put(ctx, "incomplete", strings.NewReader(content), int64(len(content))); err == nil {
+		t.Fatal("Put succeeded although completion failed in the response body")
+	}
+	if _, ok := f.objects["data/broken"]; ok {
+		t.Fatal("an object appeared for a failed upload")
+	}
+	if len(f.aborted) != 2 || len(f.uploads) != 0 {
+		t.Fatalf("aborted %v with %d uploads left, want both failed uploads aborted", f.aborted, len(f.uploads))
+	}
+}
+
+func TestS3Errors(t *testing.T) {
+	f := newFakeS3(t)
+	s := f.driver(true)
+	s.Creds.SecretKey = "wrong"
+	err := s.Put(context.Background(), "k", strings.NewReader("x"), 1)
+	var s3err *S3Error
+	if !errors.As(err, &s3err) || s3err.Status != http.StatusForbidden || s3err.Code != "SignatureDoesNotMatch" {
+		t.Fatalf("a request signed with the wrong secret: %v", err)
+	}
+	if errors.Is(err, ErrNotExist) {
+		t.Fatal("an access error counts as a missing object")
+	}
+
+	if _, err := NewS3(configS3("ftp://example.com")); err == nil {
+		t.Fatal("NewS3 accepted an ftp endpoint")
+	}
+	s, err = NewS3(configS3(""))
+	if err != nil || s.Endpoint.String() != "https://s3.eu-west-1.amazonaws.com" {
+		t.Fatalf("default endpoint %v, %v", s.Endpoint, err)
+	}
+}
+
+func configS3(endpoint string) config.S3 {
+	return config.S3{Endpoint: endpoint, Region: "eu-west-1", Bucket: "files", AccessKey: "a", SecretKey: "s", PartSize: 5 << 20}
+}
@@ -0,0 +1,124 @@
+// Package storage keeps file contents behind a driver, on local disk or in S3-compatible
+// object storage. The database refers to contents by key only.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"simplehost-server/config"
+)
+
+// ErrNotExist is returned for keys with nothing stored under them
+var ErrNotExist = errors.New("storage: object does not exist")
+
+// Info describes a stored object
+type Info struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Driver stores file contents under keys made of slash-separated names
+type Driver interface {
+	// Put stores size bytes from r under key, replacing anything already there. The
+	// object only becomes visible once it has been written completely.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get reads length bytes from offset, or to the end when length is negative
+	Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	Stat(ctx context.Context, key string) (Info, error)
+	// Delete removes the object. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// FromConfig returns the driver named by the storage section, encrypting when enabled
+func FromConfig(c config.Storage) (Driver, error) {
+	var d Driver = &Disk{Root: c.UploadDir}
+	if c.Driver == "s3" {
+		s3, err := NewS3(c.S3)
+		if err != nil {
+			return nil, err
+		}
+		d = s3
+	}
+	if c.Encryption.Enabled {
+		keys, err := LoadKeyRing(c.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		d = &Encrypted{Inner: d, Keys: keys}
+	}
+	return d, nil
+}
+
+// ReadSeeker reads an object through a driver with seeking, which http.ServeContent
+// needs to answer Range requests. Each seek starts a new ranged read.
+type ReadSeeker struct {
+	ctx    context.Context
+	driver Driver
+	key    string
+	size   int64
+	pos    int64
+	body   io.ReadCloser
+}
+
+// NewReadSeeker reads the object stored under key, which is size bytes long
+func NewReadSeeker(ctx context.Context, d Driver, key string, size int64) *ReadSeeker {
+	return &ReadSeeker{ctx: ctx, driver: d, key: key, size: size}
+}
+
+func (rs *ReadSeeker) Read(p []byte) (int, error) {
+	if rs.pos >= rs.size {
+		return 0, io.EOF
+	}
+	if rs.body == nil {
+		body, err := rs.driver.Get(rs.ctx, rs.key, rs.pos, -1)
+		if err != nil {
+			return 0, err
+		}
+		rs.body = body
+	}
+	n, err := rs.body.Read(p)
+	rs.pos += int64(n)
+	return n, err
+}
+
+func (rs *ReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += rs.pos
+	case io.SeekEnd:
+		offset += rs.size
+	}
+	if offset < 0 {
+		return 0, errors.New("storage: negative seek position")
+	}
+	if offset != rs.pos {
+		rs.Close()
+		rs.pos = offset
+	}
+	return offset, nil
+}
+
+func (rs *ReadSeeker) Close() error {
+	if rs.body == nil {
+		return nil
+	}
+	err := rs.body.Close()
+	rs.body = nil
+	return err
+}
+
+// contextReader stops reading once ctx is done, so a shutdown can abort a long copy
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,70 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 seed from RFC 6238 appendix B, "12345678901234567890", in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeAtRFC6238Vectors(t *testing.T) {
+	// The RFC lists 8 digit codes; 6 digit codes are their last six digits
+	for _, tc := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		code, err := CodeAt(rfc6238Secret, Step(time.Unix(tc.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tc.code {
+			t.Errorf("CodeAt at %d = %s, want %s", tc.unix, code, tc.code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+	codeAt := func(s int64) string {
+		code, err := CodeAt(rfc6238Secret, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+	for _, tc := range []struct {
+		name string
+		code string
+		ok   bool
+	}{
+		{"current step", codeAt(step), true},
+		{"previous step", codeAt(step - 1), true},
+		{"next step", codeAt(step + 1), true},
+		{"two steps old", codeAt(step - 2), false},
+		{"two steps ahead", codeAt(step + 2), false},
+		{"spaces", codeAt(step)[:3] + " " + codeAt(step)[3:], true},
+		{"too short", codeAt(step)[:5], false},
+		{"empty", "", false},
+	} {
+		got, ok := Validate(rfc6238Secret, tc.code, now)
+		if ok != tc.ok {
+			t.Errorf("%s: Validate(%q) ok = %v, want %v", tc.name, tc.code, ok, tc.ok)
+		}
+		if ok && tc.name == "current step" && got != step {
+			t.Errorf("%s: matched step %d, want %d", tc.name, got, step)
+		}
+	}
+	// The secret is case-insensitive, as users may type it
+	if _, ok := Validate("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", codeAt(step), now); !ok {
+		t.Error("a lower case secret didn't validate")
+	}
+}
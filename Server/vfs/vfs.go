@@ -0,0 +1,399 @@
+// Package vfs presents the folders and files tables as a path-based file tree, as one user
+// sees it in the web UI. Private items of other users are hidden, and only owners may
+// replace, rename, move or delete an item. Network file protocols are built on it.
+package vfs
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"simplehost-server/models"
+	"simplehost-server/storage"
+)
+
+const rootID = "root"
+
+// Errors wrap the io/fs ones so protocol libraries map them to the right status
+var (
+	ErrNotExist   = fs.ErrNotExist
+	ErrExist      = fs.ErrExist
+	ErrPermission = fs.ErrPermission
+	ErrInvalid    = fs.ErrInvalid
+)
+
+// Node is a folder or file. It implements fs.FileInfo.
+type Node struct {
+	Folder *models.Folder
+	File   *models.File
+}
+
+func (n *Node) Name() string {
+	if n.File != nil {
+		return n.File.Name
+	}
+	if n.Folder.ID == rootID {
+		return "/"
+	}
+	return n.Folder.Name
+}
+
+func (n *Node) Size() int64 {
+	if n.File != nil {
+		return n.File.Size
+	}
+	return 0
+}
+
+// Mode marks items the user doesn't own as read-only. Anyone can add to the root folder.
+func (n *Node) Mode() fs.FileMode {
+	if n.File != nil {
+		if n.File.CanDelete {
+			return 0o644
+		}
+		return 0o444
+	}
+	if n.Folder.CanDelete || n.Folder.ID == rootID {
+		return fs.ModeDir | 0o755
+	}
+	return fs.ModeDir | 0o555
+}
+
+// ModTime is the upload time of files. Folders don't record one.
+func (n *Node) ModTime() time.Time {
+	if n.File != nil {
+		return n.File.UploadedDate
+	}
+	return time.Unix(0, 0)
+}
+
+func (n *Node) IsDir() bool { return n.File == nil }
+func (n *Node) Sys() any    { return nil }
+
+// ID is the folder or file ID
+func (n *Node) ID() string {
+	if n.File != nil {
+		return n.File.ID
+	}
+	return n.Folder.ID
+}
+
+// FS is the file tree as seen by one user
+type FS struct {
+	UserID string
+}
+
+// New returns the tree as userID sees it
+func New(userID string) *FS {
+	return &FS{UserID: userID}
+}
+
+// split cleans name and returns its parent directory and last element
+func split(name string) (string, string) {
+	name = path.Clean("/" + name)
+	return path.Dir(name), path.Base(name)
+}
+
+func (f *FS) root() (*Node, error) {
+	folder, err := models.GetFolderByID(rootID)
+	if err != nil {
+		return nil, err
+	}
+	if folder == nil {
+		return nil, ErrNotExist
+	}
+	return &Node{Folder: folder}, nil
+}
+
+// child finds the item called name in a folder. Names are only unique per owner, so the
+// user's own item wins over other users' items with the same name, and folders over files.
+func (f *FS) child(folderID, name string) (*Node, error) {
+	folders, files, err := models.GetFolderChildren(folderID, f.UserID)
+	if err != nil {
+		return nil, err
+	}
+	var found *Node
+	for i := range folders {
+		if folders[i].Name == name && (found == nil || folders[i].CanDelete) {
+			found = &Node{Folder: &folders[i]}
+			if folders[i].CanDelete {
+				return found, nil
+			}
+		}
+	}
+	if found != nil {
+		return found, nil
+	}
+	for i := range files {
+		if files[i].Name == name && (found == nil || files[i].CanDelete) {
+			found = &Node{File: &files[i]}
+			if files[i].CanDelete {
+				return found, nil
+			}
+		}
+	}
+	if found == nil {
+		return nil, ErrNotExist
+	}
+	return found, nil
+}
+
+// Stat looks up the item at a slash-separated path
+func (f *FS) Stat(ctx context.Context, name string) (*Node, error) {
+	node, err := f.root()
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		if !node.IsDir() {
+			return nil, ErrNotExist
+		}
+		if node, err = f.child(node.Folder.ID, part); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// folder looks up a path that must be a folder
+func (f *FS) folder(ctx context.Context, name string) (*Node, error) {
+	node, err := f.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !node.IsDir() {
+		return nil, ErrInvalid
+	}
+	return node, nil
+}
+
+// ReadDir lists a folder, folders first
+func (f *FS) ReadDir(ctx context.Context, name string) ([]*Node, error) {
+	dir, err := f.folder(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	folders, files, err := models.GetFolderChildren(dir.Folder.ID, f.UserID)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]*Node, 0, len(folders)+len(files))
+	for i := range folders {
+		nodes = append(nodes, &Node{Folder: &folders[i]})
+	}
+	for i := range files {
+		nodes = append(nodes, &Node{File: &files[i]})
+	}
+	return nodes, nil
+}
+
+// Mkdir creates a folder. Like the web UI, any visible folder can hold new folders.
+func (f *FS) Mkdir(ctx context.Context, name string) error {
+	dir, base := split(name)
+	parent, err := f.folder(ctx, dir)
+	if err != nil {
+		return err
+	}
+	if _, err := f.child(parent.Folder.ID, base); err == nil {
+		return ErrExist
+	} else if err != ErrNotExist {
+		return err
+	}
+	return models.InsertFolder(models.Folder{
+		ID:       uuid.NewString(),
+		Name:     base,
+		ParentID: sql.NullString{String: parent.Folder.ID, Valid: true},
+		OwnerID:  f.UserID,
+	})
+}
+
+// MkdirAll creates a folder along with any missing parents
+func (f *FS) MkdirAll(ctx context.Context, name string) error {
+	dir := "/"
+	for _, part := range strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		dir = path.Join(dir, part)
+		node, err := f.Stat(ctx, dir)
+		if err == ErrNotExist {
+			err = f.Mkdir(ctx, dir)
+		} else if err == nil && !node.IsDir() {
+			err = ErrInvalid
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Open looks up name and, for a file, returns a reader that supports seeking for ranged
+// reads. Folders have no reader.
+func (f *FS) Open(ctx context.Context, name string) (*Node, *storage.ReadSeeker, error) {
+	node, err := f.Stat(ctx, name)
+	if err != nil || node.IsDir() {
+		return node, nil, err
+	}
+	return node, storage.NewReadSeeker(ctx, models.Blobs, node.File.StorageKey, node.File.Size), nil
+}
+
+// CheckCreate reports whether Create could write name, so protocols can fail before
+// receiving the contents
+func (f *FS) CheckCreate(ctx context.Context, name string) error {
+	_, _, err := f.createTarget(ctx, name)
+	return err
+}
+
+// createTarget returns the folder a new file goes in and the file it replaces, if any
+func (f *FS) createTarget(ctx context.Context, name string) (*Node, *Node, error) {
+	dir, base := split(name)
+	if base == "/" {
+		return nil, nil, ErrInvalid
+	}
+	parent, err := f.folder(ctx, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	existing, err := f.child(parent.Folder.ID, base)
+	if err == ErrNotExist {
+		return parent, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if existing.IsDir() {
+		return nil, nil, ErrInvalid
+	}
+	if !existing.File.CanDelete {
+		return nil, nil, ErrPermission
+	}
+	return parent, existing, nil
+}
+
+// Create stores size bytes from r as the file at name, replacing the user's own file with
+// that name. Other users' files can't be replaced.
+func (f *FS) Create(ctx context.Context, name string, r io.Reader, size int64) (*Node, error) {
+	parent, existing, err := f.createTarget(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	_, base := split(name)
+	file := models.File{
+		ID:           uuid.NewString(),
+		Name:         base,
+		FolderID:     parent.Folder.ID,
+		Size:         size,
+		OwnerID:      f.UserID,
+		UploadedDate: time.Now(),
+		CanDelete:    true,
+	}
+	file.StorageKey = file.ID
+	if err := models.Blobs.Put(ctx, file.StorageKey, r, size); err != nil {
+		return nil, err
+	}
+	if err := models.InsertFile(file); err != nil {
+		models.Blobs.Delete(context.WithoutCancel(ctx), file.StorageKey)
+		return nil, err
+	}
+	if existing != nil {
+		if err := models.DeleteFileByID(existing.File.ID, f.UserID); err != nil {
+			return nil, err
+		}
+	}
+	return &Node{File: &file}, nil
+}
+
+// Remove deletes a file, or a folder with everything in it. Everything removed must
+// belong to the user.
+func (f *FS) Remove(ctx context.Context, name string) error {
+	node, err := f.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	if node.File != nil {
+		if !node.File.CanDelete {
+			return ErrPermission
+		}
+		return models.DeleteFileByID(node.File.ID, f.UserID)
+	}
+	if node.Folder.ID == rootID || !node.Folder.CanDelete {
+		return ErrPermission
+	}
+	files, folders, err := models.GetAllFilesInFolderRecursive(node.Folder.ID)
+	if err != nil {
+		return err
+	}
+	// Check everything first so a folder isn't left half deleted
+	for _, file := range files {
+		if file.OwnerID != f.UserID {
+			return ErrPermission
+		}
+	}
+	for _, folder := range folders {
+		if folder.OwnerID != f.UserID {
+			return ErrPermission
+		}
+	}
+	for _, file := range files {
+		if err := models.DeleteFileByID(file.ID, f.UserID); err != nil {
+			return err
+		}
+	}
+	for i := len(folders) - 1; i >= 0; i-- {
+		if err := models.DeleteFolderByID(folders[i].ID, f.UserID); err != nil {
+			return err
+		}
+	}
+	return models.DeleteFolderByID(node.Folder.ID, f.UserID)
+}
+
+// Rename moves an item the user owns. The destination must not exist.
+func (f *FS) Rename(ctx context.Context, oldName, newName string) error {
+	node, err := f.Stat(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if node.IsDir() && node.Folder.ID == rootID {
+		return ErrPermission
+	}
+	if (node.File != nil && !node.File.CanDelete) || (node.Folder != nil && !node.Folder.CanDelete) {
+		return ErrPermission
+	}
+	dir, base := split(newName)
+	if base == "/" {
+		return ErrInvalid
+	}
+	parent, err := f.folder(ctx, dir)
+	if err != nil {
+		return err
+	}
+	if _, err := f.child(parent.Folder.ID, base); err == nil {
+		return ErrExist
+	} else if err != ErrNotExist {
+		return err
+	}
+	if node.File != nil {
+		return models.MoveFile(node.File.ID, parent.Folder.ID, base)
+	}
+	// A folder can't move into itself or one of its subfolders
+	ancestors, err := models.GetFolderPath(parent.Folder.ID)
+	if err != nil {
+		return err
+	}
+	for _, ancestor := range ancestors {
+		if ancestor.ID == node.Folder.ID {
+			return ErrInvalid
+		}
+	}
+	return models.MoveFolder(node.Folder.ID, parent.Folder.ID, base)
+}